@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// cMaxAliasDepth - maximum length of alias -> alias -> canonical chains
+const cMaxAliasDepth = 16
+
+// gOrgAliases - lower case alias -> canonical organization name
+var gOrgAliases map[string]string
+
+// loadOrgAliases - loads ORG_ALIASES CSV file with alias,canonical rows (header is optional)
+// used for acquired or renamed companies, for example "Red Hat Inc" -> "Red Hat"
+func loadOrgAliases(dbg bool) (err error) {
+	gOrgAliases = make(map[string]string)
+	fileName := os.Getenv("ORG_ALIASES")
+	if fileName == "" {
+		return
+	}
+	var f *os.File
+	f, err = os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	var lines [][]string
+	lines, err = readCSV(f, fileName, os.Getenv("ENCODING"), dbg)
+	if err != nil {
+		return
+	}
+	for i, line := range lines {
+		if len(line) < 2 {
+			err = fmt.Errorf("%s:%d: expected alias,canonical got %v", fileName, i+1, line)
+			return
+		}
+		alias, canonical := strings.TrimSpace(line[0]), strings.TrimSpace(line[1])
+		if i == 0 && strings.ToLower(alias) == "alias" && strings.ToLower(canonical) == "canonical" {
+			continue
+		}
+		if alias == "" || canonical == "" {
+			err = fmt.Errorf("%s:%d: alias and canonical cannot be empty in %v", fileName, i+1, line)
+			return
+		}
+		key := strings.ToLower(alias)
+		prev, ok := gOrgAliases[key]
+		if ok && prev != canonical {
+			err = fmt.Errorf("%s:%d: alias '%s' maps to both '%s' and '%s'", fileName, i+1, alias, prev, canonical)
+			return
+		}
+		gOrgAliases[key] = canonical
+	}
+	for alias := range gOrgAliases {
+		_, err = resolveOrgAlias(alias)
+		if err != nil {
+			return
+		}
+	}
+	fmt.Printf("Loaded %d organization aliases from %s\n", len(gOrgAliases), fileName)
+	return
+}
+
+// resolveOrgAlias - returns canonical organization name, follows alias chains
+func resolveOrgAlias(orgName string) (canonical string, err error) {
+	canonical = orgName
+	for i := 0; i < cMaxAliasDepth; i++ {
+		next, ok := gOrgAliases[strings.ToLower(canonical)]
+		if !ok || next == canonical {
+			return
+		}
+		canonical = next
+	}
+	err = fmt.Errorf("organization alias '%s' is a cycle or its chain is longer than %d", orgName, cMaxAliasDepth)
+	return
+}
+
+// checkOrgAliases - reports aliases whose canonical organization doesn't exist in the DB
+func checkOrgAliases(db *sql.DB, dbg bool) {
+	canonicals := make(map[string][]string)
+	for alias := range gOrgAliases {
+		canonical, _ := resolveOrgAlias(alias)
+		canonicals[canonical] = append(canonicals[canonical], alias)
+	}
+	names := []string{}
+	for canonical := range canonicals {
+		names = append(names, canonical)
+	}
+	sort.Strings(names)
+	for _, canonical := range names {
+		_, err := orgNameToID(db, dbg, canonical)
+		if err != nil && !isNotFound(err) {
+			warnf(cWarnOther, "organization aliases: cannot check canonical organization '%s': %v\n", canonical, err)
+			continue
+		}
+		if err != nil {
+			aliases := canonicals[canonical]
+			sort.Strings(aliases)
+			warnf(cWarnNotFound, "organization aliases %v: canonical organization '%s' not found in SH DB\n", aliases, canonical)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// gAllowColumns - identity fields that imports may change, nil means all
+var gAllowColumns map[string]struct{}
+
+// setAllowColumns - ALLOW_COLUMNS, comma separated identity fields that can be updated: name, username, email
+// CSV values of other fields are ignored (DB values are kept), for example "name,email" when usernames are unreliable
+func setAllowColumns() (err error) {
+	gAllowColumns = nil
+	s := os.Getenv("ALLOW_COLUMNS")
+	if strings.TrimSpace(s) == "" {
+		return
+	}
+	gAllowColumns = make(map[string]struct{})
+	for _, column := range strings.Split(s, ",") {
+		column = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(column), "identity_")))
+		switch column {
+		case "":
+		case "name", "username", "email":
+			gAllowColumns[column] = struct{}{}
+		default:
+			err = fmt.Errorf("invalid ALLOW_COLUMNS item '%s', allowed: name, username, email", column)
+			return
+		}
+	}
+	return
+}
+
+// columnAllowed - identity field can be updated
+func columnAllowed(column string) bool {
+	if gAllowColumns == nil {
+		return true
+	}
+	_, ok := gAllowColumns[column]
+	return ok
+}
+
+// allowedValue - new value of the identity field, the DB value when the field cannot be updated
+func allowedValue(dbg bool, key, column, value, newValue string) string {
+	if value == newValue || columnAllowed(column) {
+		return newValue
+	}
+	if dbg {
+		fmt.Printf("%s %s '%s' -> '%s' ignored, not in ALLOW_COLUMNS\n", key, column, value, newValue)
+	}
+	return value
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// gAnonymize - mask PII in logs, summaries and audit notes (ANONYMIZE_LOGS)
+	gAnonymize bool
+	// gPII - registered PII values (names, usernames, emails) to mask
+	gPII = make(map[string]struct{})
+	// gPIIReplacer - replacer of registered values, rebuilt when a new value is registered
+	gPIIReplacer *strings.Replacer
+	// gPIIMtx - guards gPII and gPIIReplacer
+	gPIIMtx sync.Mutex
+	// gEmailRE - email addresses are masked even when they were not registered
+	gEmailRE = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	// gLogsDone - closed when the anonymizing log filters finished
+	gLogsDone []chan struct{}
+	// gLogWriters - pipe ends replacing stdout and stderr
+	gLogWriters []*os.File
+	// gLogTargets - original stdout and stderr
+	gLogTargets []*os.File
+)
+
+// piiToken - stable short hash of a value, equal values get equal tokens so log lines can still be correlated
+func piiToken(kind, value string) string {
+	h := sha256.Sum256([]byte(value))
+	return "<" + kind + ":" + hex.EncodeToString(h[:4]) + ">"
+}
+
+// isPIIColumn - CSV columns holding names, usernames and emails of people (not organization names)
+func isPIIColumn(column string) bool {
+	if strings.Contains(column, "org") {
+		return false
+	}
+	return strings.HasSuffix(column, "_name") || strings.HasSuffix(column, "_email") || strings.HasSuffix(column, "_username") ||
+		column == "name" || column == "email" || column == "username"
+}
+
+// registerPII - remembers PII values to mask, values shorter than 3 characters are ignored
+func registerPII(values ...string) {
+	if !gAnonymize {
+		return
+	}
+	gPIIMtx.Lock()
+	defer gPIIMtx.Unlock()
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if len(value) < 3 {
+			continue
+		}
+		if _, ok := gPII[value]; !ok {
+			gPII[value] = struct{}{}
+			gPIIReplacer = nil
+		}
+	}
+}
+
+// registerRowPII - registers PII columns of a CSV row
+func registerRowPII(row map[string]string) {
+	if !gAnonymize {
+		return
+	}
+	for column, value := range row {
+		if isPIIColumn(column) {
+			registerPII(value)
+		}
+	}
+}
+
+// anonymize - masks emails and registered PII values, identity ids and uuids are kept
+func anonymize(s string) string {
+	if !gAnonymize {
+		return s
+	}
+	s = gEmailRE.ReplaceAllStringFunc(s, func(email string) string {
+		return piiToken("email", strings.ToLower(email))
+	})
+	gPIIMtx.Lock()
+	if gPIIReplacer == nil && len(gPII) > 0 {
+		values := []string{}
+		for value := range gPII {
+			values = append(values, value)
+		}
+		// Longest first, so "John Smith" is masked before "John"
+		sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+		pairs := []string{}
+		for _, value := range values {
+			pairs = append(pairs, value, piiToken("pii", value))
+		}
+		gPIIReplacer = strings.NewReplacer(pairs...)
+	}
+	replacer := gPIIReplacer
+	gPIIMtx.Unlock()
+	if replacer != nil {
+		s = replacer.Replace(s)
+	}
+	return s
+}
+
+// filterLog - copies lines from r to w, anonymized
+func filterLog(r io.Reader, w io.Writer, done chan struct{}) {
+	defer close(done)
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			_, _ = io.WriteString(w, anonymize(line))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// setAnonymize - ANONYMIZE_LOGS, everything written to stdout and stderr goes through anonymize
+func setAnonymize() (err error) {
+	gAnonymize = os.Getenv("ANONYMIZE_LOGS") != ""
+	if !gAnonymize {
+		return
+	}
+	for _, target := range []**os.File{&os.Stdout, &os.Stderr} {
+		var r, w *os.File
+		r, w, err = os.Pipe()
+		if err != nil {
+			return
+		}
+		done := make(chan struct{})
+		go filterLog(r, *target, done)
+		gLogTargets = append(gLogTargets, *target)
+		gLogWriters = append(gLogWriters, w)
+		gLogsDone = append(gLogsDone, done)
+		*target = w
+	}
+	return
+}
+
+// flushLogs - writes out all pending anonymized output and restores stdout and stderr, called by shutdown
+func flushLogs() {
+	if len(gLogWriters) == 0 {
+		return
+	}
+	os.Stdout, os.Stderr = gLogTargets[0], gLogTargets[1]
+	for i, w := range gLogWriters {
+		_ = w.Close()
+		<-gLogsDone[i]
+	}
+	gLogWriters = nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// enrollmentState - all values of an enrollment row, used to compensate its deletion
+type enrollmentState struct {
+	ID             int    `json:"id"`
+	UUID           string `json:"uuid"`
+	OrganizationID int    `json:"organization_id"`
+	ProjectSlug    string `json:"project_slug"`
+	Start          string `json:"start"`
+	End            string `json:"end"`
+	LastModifiedBy string `json:"last_modified_by"`
+	LockedBy       string `json:"locked_by"`
+}
+
+var (
+	gAudit      bool
+	gAuditRunID string
+)
+
+// getEnrollmentState - returns current values of enrollment eid
+func getEnrollmentState(db *sql.DB, eid int) (state *enrollmentState, err error) {
+	var rows *stmtRows
+	rows, err = query(
+		db,
+		"select id, uuid, organization_id, coalesce(project_slug, ''), date_format(start, '%Y-%m-%d %H:%i:%s'), date_format(end, '%Y-%m-%d %H:%i:%s'), "+
+			auditColumn("enrollments", "last_modified_by")+", "+auditColumn("enrollments", "locked_by")+" from enrollments where id = ?",
+		eid,
+	)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		state = &enrollmentState{}
+		err = rows.Scan(&state.ID, &state.UUID, &state.OrganizationID, &state.ProjectSlug, &state.Start, &state.End, &state.LastModifiedBy, &state.LockedBy)
+		break
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	e := rows.Close()
+	if err == nil {
+		err = e
+	}
+	if err == nil && state == nil {
+		err = fmt.Errorf("enrollment %d not found", eid)
+	}
+	return
+}
+
+// sqlQuote - quotes string as a SQL literal
+func sqlQuote(s string) string {
+	return "'" + strings.Replace(strings.Replace(s, "\\", "\\\\", -1), "'", "''", -1) + "'"
+}
+
+// restoreSQL - statement that re-creates deleted enrollment
+func (s *enrollmentState) restoreSQL() string {
+	slug := "null"
+	if s.ProjectSlug != "" {
+		slug = sqlQuote(s.ProjectSlug)
+	}
+	columns, values := "", ""
+	if hasAuditColumn("enrollments", "last_modified_by") {
+		columns += ", last_modified_by"
+		values += ", " + sqlQuote(s.LastModifiedBy)
+	}
+	if hasAuditColumn("enrollments", "locked_by") {
+		columns += ", locked_by"
+		values += ", " + sqlQuote(s.LockedBy)
+	}
+	return adaptQuery(fmt.Sprintf(
+		"insert into enrollments(id, uuid, organization_id, project_slug, start, end%s) values(%d, %s, %d, %s, %s, %s%s);",
+		columns, s.ID, sqlQuote(s.UUID), s.OrganizationID, slug, sqlQuote(s.Start), sqlQuote(s.End), values,
+	))
+}
+
+// initAudit - enables audit trail in import_audit table
+// AUDIT - enables the audit trail, it is not written in dry mode
+// Deleted enrollments are stored with all their values, so they can be restored later
+func initAudit(db *sql.DB, dry bool, runID string) (err error) {
+	gAudit = !dry && os.Getenv("AUDIT") != ""
+	gAuditRunID = runID
+	if !gAudit {
+		return
+	}
+	_, err = execDB(
+		db,
+		"create table if not exists import_audit(id bigint not null auto_increment primary key, run_id varchar(32) not null, "+
+			"action varchar(16) not null, table_name varchar(64) not null, row_id bigint not null, uuid varchar(128), "+
+			"before_json text, after_json text, who varchar(255), created_at datetime not null) engine=InnoDB default charset=utf8mb4",
+	)
+	return
+}
+
+// auditEnrollmentDeletion - records deleted enrollment in the same transaction as the deletion
+func auditEnrollmentDeletion(tx *sql.Tx, eid int, before *enrollmentState, who string) (err error) {
+	if !gAudit {
+		return
+	}
+	var data []byte
+	data, err = json.Marshal(before)
+	if err != nil {
+		return
+	}
+	_, err = exec(
+		tx,
+		"",
+		"insert into import_audit(run_id, action, table_name, row_id, uuid, before_json, who, created_at) values(?, ?, ?, ?, ?, ?, ?, now())",
+		gAuditRunID, "delete", "enrollments", eid, before.UUID, string(data), anonymize(who),
+	)
+	return
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	cBenchPrefix      = "bench-"
+	cBenchSource      = "bench"
+	cBenchDASlug      = "bench/project"
+	cBenchSFSlug      = "bench-project"
+	cBenchInsertBatch = 500
+)
+
+var (
+	gBenchOrgs = []string{"Bench Org A", "Bench Org B"}
+	// gBenchUnset - settings with side effects outside the benchmark schema or that would skip synthetic rows
+	gBenchUnset = []string{
+		"SLACK_WEBHOOK", "TEAMS_WEBHOOK", "WEBHOOK_URL", "SMTP_HOST", "AFFILIATION_CACHE_URL", "RESULTS",
+		"STALE_CHECK", "UUID_CHECK", "LEDGER", "ST", "STAGING_DSN", "INFER_ORG_FROM_DOMAIN", "FANOUT",
+	}
+)
+
+// benchResult - throughput of a single benchmark run
+type benchResult struct {
+	threads  int
+	rows     int
+	duration time.Duration
+	err      error
+}
+
+func (r benchResult) rowsPerSec() float64 {
+	if r.duration <= 0 {
+		return 0
+	}
+	return float64(r.rows) / r.duration.Seconds()
+}
+
+// benchThreads - BENCH_THREADS list, default powers of two up to the number of CPUs
+func benchThreads() (threads []int, err error) {
+	s := os.Getenv("BENCH_THREADS")
+	if s == "" {
+		for n := 1; n < runtime.NumCPU(); n *= 2 {
+			threads = append(threads, n)
+		}
+		threads = append(threads, runtime.NumCPU())
+		return
+	}
+	for _, item := range strings.Split(s, ",") {
+		var n int
+		n, err = strconv.Atoi(strings.TrimSpace(item))
+		if err != nil || n < 1 {
+			err = fmt.Errorf("invalid BENCH_THREADS=%s, expected comma separated positive numbers", s)
+			return
+		}
+		if n > runtime.NumCPU() {
+			fmt.Printf("WARNING: %d threads capped to %d CPUs\n", n, runtime.NumCPU())
+			n = runtime.NumCPU()
+		}
+		threads = append(threads, n)
+	}
+	return
+}
+
+// benchInsert - multi-row insert of synthetic rows, values are (?,...) groups of len(columns)
+func benchInsert(db *sql.DB, table string, columns []string, rows [][]interface{}) (err error) {
+	group := "(" + strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",") + ")"
+	for from := 0; from < len(rows); from += cBenchInsertBatch {
+		to := from + cBenchInsertBatch
+		if to > len(rows) {
+			to = len(rows)
+		}
+		args := []interface{}{}
+		for _, row := range rows[from:to] {
+			args = append(args, row...)
+		}
+		_, err = execDB(
+			db,
+			"insert into "+table+"("+strings.Join(columns, ", ")+") values "+strings.TrimSuffix(strings.Repeat(group+",", to-from), ","),
+			args...,
+		)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// benchCleanup - removes synthetic identities, their enrollments, profiles and unique identities
+func benchCleanup(db *sql.DB) (err error) {
+	for _, table := range []string{"enrollments", "identities", "profiles", "uidentities"} {
+		_, err = execDB(db, "delete from "+table+" where uuid like ?", cBenchPrefix+"%")
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// benchGenerate - creates n synthetic identities enrolled in the first benchmark organization
+func benchGenerate(db *sql.DB, n int) (err error) {
+	err = benchCleanup(db)
+	if err != nil {
+		return
+	}
+	for _, org := range gBenchOrgs {
+		_, err = execDB(db, "insert into organizations(name) select ? from dual where not exists (select 1 from organizations where name = ?)", org, org)
+		if err != nil {
+			return
+		}
+	}
+	_, err = execDB(
+		db,
+		"insert into slug_mapping(da_name, sf_name) select ?, ? from dual where not exists (select 1 from slug_mapping where sf_name = ?)",
+		cBenchDASlug, cBenchSFSlug, cBenchSFSlug,
+	)
+	if err != nil {
+		return
+	}
+	var orgID int
+	err = db.QueryRow("select id from organizations where name = ?", gBenchOrgs[0]).Scan(&orgID)
+	if err != nil {
+		return
+	}
+	var uidentities, profiles, identities, enrollments [][]interface{}
+	for i := 0; i < n; i++ {
+		uuid := fmt.Sprintf("%s%08d", cBenchPrefix, i)
+		name, email := fmt.Sprintf("Bench User %d", i), fmt.Sprintf("bench%d@example.com", i)
+		uidentities = append(uidentities, []interface{}{uuid})
+		profiles = append(profiles, []interface{}{uuid, name, email})
+		identities = append(identities, []interface{}{uuid, uuid, name, email, fmt.Sprintf("bench%d", i), cBenchSource})
+		enrollments = append(enrollments, []interface{}{uuid, orgID, cBenchDASlug, "1900-01-01", "2100-01-01"})
+	}
+	err = benchInsert(db, "uidentities", []string{"uuid"}, uidentities)
+	if err != nil {
+		return
+	}
+	err = benchInsert(db, "profiles", []string{"uuid", "name", "email"}, profiles)
+	if err != nil {
+		return
+	}
+	err = benchInsert(db, "identities", []string{"id", "uuid", "name", "email", "username", "source"}, identities)
+	if err != nil {
+		return
+	}
+	return benchInsert(db, "enrollments", []string{"uuid", "organization_id", "project_slug", "start", "end"}, enrollments)
+}
+
+// benchWriteCSV - writes CSV file with header
+func benchWriteCSV(fileName string, hdr []string, lines [][]string) (err error) {
+	var f *os.File
+	f, err = os.Create(fileName)
+	if err != nil {
+		return
+	}
+	w := csv.NewWriter(f)
+	_ = w.Write(hdr)
+	_ = w.WriteAll(lines)
+	err = w.Error()
+	e := f.Close()
+	if err == nil {
+		err = e
+	}
+	return
+}
+
+// benchFiles - identities and affiliations CSVs for run r: every identity gets a new name and its enrollment
+// moves between benchmark organizations, so each run changes all rows
+func benchFiles(dir string, n, r int) (identitiesFile, affiliationsFile string, err error) {
+	var identities, affiliations [][]string
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("%s%08d", cBenchPrefix, i)
+		identities = append(identities, []string{id, fmt.Sprintf("Bench User %d run %d", i, r), fmt.Sprintf("bench%d", i), fmt.Sprintf("bench%d@example.com", i), cBenchSource})
+		affiliations = append(affiliations, []string{id, gBenchOrgs[r%2], "", "", gBenchOrgs[(r+1)%2], "", "", cBenchSFSlug})
+	}
+	ts := fmt.Sprintf("2000010100%02d", r%60)
+	identitiesFile = filepath.Join(dir, "user_identities_"+ts+".csv")
+	affiliationsFile = filepath.Join(dir, "user_affiliations_"+ts+".csv")
+	err = benchWriteCSV(identitiesFile, []string{"identity_id", "identity_name", "identity_username", "identity_email", "identity_source"}, identities)
+	if err != nil {
+		return
+	}
+	err = benchWriteCSV(affiliationsFile, []string{"identity_id", "from_org_name", "from_start_date", "from_end_date", "to_org_name", "to_start_date", "to_end_date", "project_slug"}, affiliations)
+	return
+}
+
+// benchmark - "benchmark" subcommand, measures import throughput on synthetic data
+// BENCH_DSN - test schema with SortingHat tables, synthetic rows (uuids starting with "bench-") are created there,
+// it is required so the benchmark can never run against the production database
+// BENCH_ROWS - number of synthetic identities (and enrollments), default 1000
+// BENCH_THREADS - comma separated thread counts to compare, default 1, 2, 4, ... up to the number of CPUs
+// BENCH_KEEP - keep synthetic rows after the benchmark
+func benchmark(dbg bool) (err error) {
+	dsn := os.Getenv("BENCH_DSN")
+	if dsn == "" {
+		err = fmt.Errorf("BENCH_DSN must be set to a test schema, synthetic rows are written there")
+		return
+	}
+	n := 1000
+	if s := os.Getenv("BENCH_ROWS"); s != "" {
+		n, err = strconv.Atoi(s)
+		if err != nil || n < 1 {
+			err = fmt.Errorf("invalid BENCH_ROWS=%s", s)
+			return
+		}
+	}
+	var threads []int
+	threads, err = benchThreads()
+	if err != nil {
+		return
+	}
+	for _, env := range gBenchUnset {
+		_ = os.Unsetenv(env)
+	}
+	shdb := &shDatabase{name: dsnName(dsn), dsn: dsn, charset: dsnCharset(dsn)}
+	shdb.db, err = openMySQL(dsn)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = shdb.db.Close()
+	}()
+	shdb.use(false)
+	fmt.Printf("Generating %d synthetic identities and enrollments in %s\n", n, shdb.name)
+	err = benchGenerate(shdb.db, n)
+	if err != nil {
+		return
+	}
+	if os.Getenv("BENCH_KEEP") == "" {
+		defer func() {
+			e := benchCleanup(shdb.db)
+			if e != nil {
+				fmt.Printf("WARNING: cannot remove synthetic rows: %v\n", e)
+			}
+		}()
+	}
+	var dir string
+	dir, err = ioutil.TempDir("", "bench-")
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	results := []benchResult{}
+	for r, thrN := range threads {
+		var identitiesFile, affiliationsFile string
+		identitiesFile, affiliationsFile, err = benchFiles(dir, n, r)
+		if err != nil {
+			return
+		}
+		_ = os.Setenv("NCPUS", strconv.Itoa(thrN))
+		dtStart := time.Now()
+		summary, e := importCSVfiles(shdb.db, dbg, false, inputFiles{identities: []string{identitiesFile}, affiliations: []string{affiliationsFile}}, runOptions{})
+		result := benchResult{threads: thrN, rows: 2 * n, duration: time.Since(dtStart), err: e}
+		if e == nil && summary.FailedRows > 0 {
+			result.err = fmt.Errorf("%d rows failed", summary.FailedRows)
+		}
+		results = append(results, result)
+	}
+	fmt.Printf("\n%-8s %-8s %-14s %s\n", "threads", "rows", "duration", "rows/s")
+	best := -1
+	for i, result := range results {
+		if result.err != nil {
+			fmt.Printf("%-8d %-8d %-14v failed: %v\n", result.threads, result.rows, result.duration.Round(time.Millisecond), result.err)
+			continue
+		}
+		fmt.Printf("%-8d %-8d %-14v %.1f\n", result.threads, result.rows, result.duration.Round(time.Millisecond), result.rowsPerSec())
+		if best < 0 || result.rowsPerSec() > results[best].rowsPerSec() {
+			best = i
+		}
+	}
+	if best < 0 {
+		err = fmt.Errorf("all benchmark runs failed")
+		return
+	}
+	// the fewest threads within 10% of the best throughput put the least load on the database
+	ok := []benchResult{}
+	for _, result := range results {
+		if result.err == nil && result.rowsPerSec() >= 0.9*results[best].rowsPerSec() {
+			ok = append(ok, result)
+		}
+	}
+	sort.Slice(ok, func(i, j int) bool { return ok[i].threads < ok[j].threads })
+	fmt.Printf("\nRecommendation: NCPUS=%d (%.1f rows/s, best %.1f rows/s with %d threads)\n", ok[0].threads, ok[0].rowsPerSec(), results[best].rowsPerSec(), results[best].threads)
+	return
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// botPattern - single bots list entry
+type botPattern struct {
+	kind  string
+	value string
+	re    *regexp.Regexp
+}
+
+var gBots []botPattern
+
+// loadBots - loads BOTS_FILE, one entry per line, empty lines and lines starting with # are ignored
+// id:<identity_id>, username:<username>, email:<email>, name:<name> - exact (case-insensitive) match
+// re:<regexp> - regular expression matched against username, name and email
+// other lines are usernames
+func loadBots() (err error) {
+	gBots = nil
+	fileName := os.Getenv("BOTS_FILE")
+	if fileName == "" {
+		return
+	}
+	var f *os.File
+	f, err = os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		bot := botPattern{kind: "username", value: line}
+		if i := strings.Index(line, ":"); i > 0 {
+			switch kind := strings.ToLower(line[:i]); kind {
+			case "id", "username", "email", "name", "re":
+				bot.kind, bot.value = kind, strings.TrimSpace(line[i+1:])
+			}
+		}
+		if bot.kind == "re" {
+			bot.re, err = regexp.Compile(bot.value)
+			if err != nil {
+				err = fmt.Errorf("%s:%d: %v", fileName, n, err)
+				return
+			}
+		}
+		gBots = append(gBots, bot)
+	}
+	err = scanner.Err()
+	if err == nil {
+		fmt.Printf("Loaded %d bots list entries from %s\n", len(gBots), fileName)
+	}
+	return
+}
+
+// matchBot - true when identity matches any bots list entry
+func matchBot(id, name, username, email string) bool {
+	for _, bot := range gBots {
+		switch bot.kind {
+		case "id":
+			if id == bot.value {
+				return true
+			}
+		case "username":
+			if username != "" && strings.EqualFold(username, bot.value) {
+				return true
+			}
+		case "email":
+			if email != "" && strings.EqualFold(email, bot.value) {
+				return true
+			}
+		case "name":
+			if name != "" && strings.EqualFold(name, bot.value) {
+				return true
+			}
+		case "re":
+			for _, value := range []string{username, name, email} {
+				if value != "" && bot.re.MatchString(value) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// cDefaultBulkMax - people a single bulk row can expand to unless BULK_MAX is set
+	cDefaultBulkMax = 500
+)
+
+var (
+	// gAllowBulk - ALLOW_BULK confirms bulk rows are meant to be applied
+	gAllowBulk bool
+	// gBulkMax - BULK_MAX, a bulk row expanding to more people fails
+	gBulkMax = cDefaultBulkMax
+)
+
+// setBulk - affiliations rows without identity_id but with bulk_email_domain (everyone having an identity with
+// @domain email) and/or bulk_org_name (everyone enrolled in the organization) are applied to every matching person,
+// ALLOW_BULK must be set to apply them (dry runs only preview), BULK_MAX caps people per row (default 500)
+func setBulk() (err error) {
+	gAllowBulk = os.Getenv("ALLOW_BULK") != ""
+	gBulkMax = cDefaultBulkMax
+	if s := os.Getenv("BULK_MAX"); s != "" {
+		gBulkMax, err = strconv.Atoi(s)
+		if err != nil || gBulkMax <= 0 {
+			err = fmt.Errorf("invalid BULK_MAX=%s, expected a positive integer", s)
+		}
+	}
+	return
+}
+
+// isBulkRow - affiliations row selects people by a filter instead of identity_id
+func isBulkRow(row map[string]string) bool {
+	return strings.TrimSpace(row["identity_id"]) == "" && (strings.TrimSpace(row["bulk_email_domain"]) != "" || strings.TrimSpace(row["bulk_org_name"]) != "")
+}
+
+// bulkIdentities - uuid and an identity_id of every person matching the row's bulk filters (all of them)
+func bulkIdentities(db *sql.DB, row map[string]string) (uuids, ids []string, err error) {
+	domain := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(row["bulk_email_domain"]), "@"))
+	orgName := strings.TrimSpace(row["bulk_org_name"])
+	q := "select i.uuid, min(i.id) from identities i"
+	args := []interface{}{}
+	conds := []string{}
+	if domain != "" {
+		conds = append(conds, "lower(trim(i.email)) like ?")
+		args = append(args, "%@"+strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(domain))
+	}
+	if orgName != "" {
+		conds = append(conds, "i.uuid in (select e.uuid from enrollments e, organizations o where e.organization_id = o.id and o.name = ?)")
+		args = append(args, orgName)
+	}
+	q += " where " + strings.Join(conds, " and ") + " group by i.uuid order by i.uuid"
+	var rows *stmtRows
+	rows, err = query(db, q, args...)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		uuid, id := "", ""
+		err = rows.Scan(&uuid, &id)
+		if err != nil {
+			break
+		}
+		uuids = append(uuids, uuid)
+		ids = append(ids, id)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	e := rows.Close()
+	if err == nil {
+		err = e
+	}
+	return
+}
+
+// bulkEnrollment - expands bulk rows into a row per matching person applied by next, people are processed even if
+// some of them fail, the first non-skip error is returned (as fan-out does), other rows go to next unchanged
+func bulkEnrollment(next rowProcessor) rowProcessor {
+	return func(db *sql.DB, dbg, dry bool, row map[string]string) (err error) {
+		if !isBulkRow(row) {
+			return next(db, dbg, dry, row)
+		}
+		filter := fmt.Sprintf("bulk_email_domain=%q bulk_org_name=%q", strings.TrimSpace(row["bulk_email_domain"]), strings.TrimSpace(row["bulk_org_name"]))
+		if !dry && !gAllowBulk {
+			err = fmt.Errorf("bulk row (%s) requires ALLOW_BULK, preview it with DRY first (row %v)", filter, row)
+			return
+		}
+		var uuids, ids []string
+		uuids, ids, err = bulkIdentities(replica(db), row)
+		if err != nil {
+			err = fmt.Errorf("bulk row (%s) lookup: %v in %v", filter, err, row)
+			return
+		}
+		if len(ids) == 0 {
+			err = skipf(cWarnNotFound, "bulk row (%s) matches nobody (row %v)\n", filter, row)
+			return
+		}
+		if len(ids) > gBulkMax {
+			err = fmt.Errorf("bulk row (%s) matches %d people, more than BULK_MAX=%d (row %v)", filter, len(ids), gBulkMax, row)
+			return
+		}
+		fmt.Printf("bulk row (%s) expands to %d people\n", filter, len(ids))
+		for i, id := range ids {
+			if terminating() {
+				if err == nil {
+					err = errTerminated
+				}
+				return
+			}
+			personRow := make(map[string]string, len(row))
+			for k, v := range row {
+				personRow[k] = v
+			}
+			personRow["identity_id"] = id
+			if dbg {
+				fmt.Printf("bulk row (%s) person %d/%d identity_id %s/%s\n", filter, i+1, len(ids), id, uuids[i])
+			}
+			e := next(db, dbg, dry, personRow)
+			if e != nil && (err == nil || isSkipped(err) && !isSkipped(e)) {
+				err = e
+			}
+		}
+		return
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// gAffectedProjects - DA project slugs of changed enrollments
+	gAffectedProjects map[string]struct{}
+	// gAffectedUUIDs - uuids of changed identities, their projects are looked up after the import
+	gAffectedUUIDs map[string]struct{}
+	// gChangedUUIDs - uuids of all changed identities, profiles and enrollments
+	gChangedUUIDs map[string]struct{}
+)
+
+// resetAffected - clears projects and uuids affected by the current run
+func resetAffected() {
+	gAffectedProjects = make(map[string]struct{})
+	gAffectedUUIDs = make(map[string]struct{})
+	gChangedUUIDs = make(map[string]struct{})
+}
+
+// recordAffected - remembers committed change for cache invalidation, empty projectSlug means all projects of uuid
+func recordAffected(uuid, projectSlug string) {
+	if gMtx != nil {
+		gMtx.Lock()
+	}
+	if projectSlug != "" {
+		gAffectedProjects[projectSlug] = struct{}{}
+	} else if uuid != "" {
+		gAffectedUUIDs[uuid] = struct{}{}
+	}
+	if uuid != "" {
+		gChangedUUIDs[uuid] = struct{}{}
+	}
+	if gMtx != nil {
+		gMtx.Unlock()
+	}
+}
+
+// affectedProjects - changed enrollments' projects and all projects changed identities are enrolled in
+func affectedProjects(db *sql.DB) (projects, uuids []string, err error) {
+	set := make(map[string]struct{})
+	for project := range gAffectedProjects {
+		set[project] = struct{}{}
+	}
+	for uuid := range gAffectedUUIDs {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	for from := 0; from < len(uuids); from += cReconcileBatch {
+		to := from + cReconcileBatch
+		if to > len(uuids) {
+			to = len(uuids)
+		}
+		args := []interface{}{}
+		for _, uuid := range uuids[from:to] {
+			args = append(args, uuid)
+		}
+		var rows *stmtRows
+		rows, err = query(db, "select distinct project_slug from enrollments where project_slug is not null and uuid in ("+strings.TrimSuffix(strings.Repeat("?,", to-from), ",")+")", args...)
+		if err != nil {
+			return
+		}
+		project := ""
+		for rows.Next() {
+			err = rows.Scan(&project)
+			if err != nil {
+				_ = rows.Close()
+				return
+			}
+			set[project] = struct{}{}
+		}
+		err = rows.Err()
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+	}
+	for project := range set {
+		projects = append(projects, project)
+	}
+	sort.Strings(projects)
+	return
+}
+
+// callAPI - calls JSON API endpoint, non-empty token is sent as bearer token
+func callAPI(method, endpoint, token string, payload interface{}) (err error) {
+	var data []byte
+	if payload != nil {
+		data, err = json.Marshal(payload)
+		if err != nil {
+			return
+		}
+	}
+	var req *http.Request
+	req, err = http.NewRequest(method, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	var resp *http.Response
+	resp, err = client.Do(req)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("%s %s returned %d: %s", method, endpoint, resp.StatusCode, string(body))
+	}
+	return
+}
+
+// invalidateCaches - asks the affiliation API to drop caches of projects affected by the run
+// AFFILIATION_CACHE_URL - endpoint, when it contains {project} it is called once per affected project (slug URL-escaped),
+// otherwise it is called once with {"projects": [...], "uuids": [...]} JSON
+// AFFILIATION_CACHE_METHOD - HTTP method (default POST)
+// Failures are only reported, changes are already committed
+func invalidateCaches(db *sql.DB, dbg bool) {
+	endpoint := os.Getenv("AFFILIATION_CACHE_URL")
+	if endpoint == "" || (len(gAffectedProjects) == 0 && len(gAffectedUUIDs) == 0) {
+		return
+	}
+	method := os.Getenv("AFFILIATION_CACHE_METHOD")
+	if method == "" {
+		method = http.MethodPost
+	}
+	projects, uuids, err := affectedProjects(db)
+	if err != nil {
+		warnf(cWarnOther, "cannot get affected projects, caches not invalidated: %v\n", err)
+		return
+	}
+	if !strings.Contains(endpoint, "{project}") {
+		err = callAPI(method, endpoint, os.Getenv("AFFILIATION_API_TOKEN"), map[string][]string{"projects": projects, "uuids": uuids})
+		if err != nil {
+			warnf(cWarnOther, "cache invalidation failed: %v\n", err)
+			return
+		}
+		fmt.Printf("Invalidated affiliation caches of %d projects\n", len(projects))
+		return
+	}
+	invalidated := 0
+	for _, project := range projects {
+		err = callAPI(method, strings.Replace(endpoint, "{project}", url.PathEscape(project), -1), os.Getenv("AFFILIATION_API_TOKEN"), nil)
+		if err != nil {
+			warnf(cWarnOther, "cache invalidation of %s failed: %v\n", project, err)
+			continue
+		}
+		if dbg {
+			fmt.Printf("Invalidated affiliation cache of %s\n", project)
+		}
+		invalidated++
+	}
+	fmt.Printf("Invalidated affiliation caches of %d/%d projects\n", invalidated, len(projects))
+}
+
+// writeAffectedUUIDs - AFFECTED_UUIDS=path, writes uuids changed by the run for downstream re-enrichment jobs
+// path ending with .json gets {"run_id", "database", "uuids"} object, otherwise one uuid per line
+// {run_id} in the path is replaced with the run ID, file is written for failed runs too (rows applied before the failure)
+func writeAffectedUUIDs(summary *importSummary) (err error) {
+	path := os.Getenv("AFFECTED_UUIDS")
+	if path == "" || summary.Dry || summary.Shadow {
+		return
+	}
+	path = strings.Replace(path, "{run_id}", summary.RunID, -1)
+	uuids := []string{}
+	for uuid := range gChangedUUIDs {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	var data []byte
+	if strings.HasSuffix(strings.ToLower(path), ".json") {
+		data, err = json.MarshalIndent(
+			struct {
+				RunID    string   `json:"run_id"`
+				Database string   `json:"database,omitempty"`
+				UUIDs    []string `json:"uuids"`
+			}{RunID: summary.RunID, Database: summary.Database, UUIDs: uuids},
+			"",
+			"  ",
+		)
+		if err != nil {
+			return
+		}
+		data = append(data, '\n')
+	} else {
+		for _, uuid := range uuids {
+			data = append(data, []byte(uuid+"\n")...)
+		}
+	}
+	err = writeOutput(path, data)
+	if err == nil {
+		fmt.Printf("%d affected uuids written to %s\n", len(uuids), path)
+	}
+	return
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// gRequiredColumns - tables and columns the import reads or writes
+	gRequiredColumns = map[string][]string{
+		"identities":    {"id", "uuid", "name", "email", "username", "source", "last_modified", "last_modified_by", "locked_by"},
+		"uidentities":   {"uuid", "last_modified", "last_modified_by", "locked_by"},
+		"profiles":      {"uuid", "name", "email", "is_bot", "country_code", "gender", "gender_acc", "last_modified", "last_modified_by", "locked_by"},
+		"enrollments":   {"id", "uuid", "organization_id", "project_slug", "start", "end", "last_modified", "last_modified_by", "locked_by"},
+		"organizations": {"id", "name"},
+		"slug_mapping":  {"da_name", "sf_name"},
+	}
+	// gRequiredPrivileges - privileges the import needs per table
+	gRequiredPrivileges = map[string][]string{
+		"identities":    {"SELECT", "UPDATE"},
+		"uidentities":   {"SELECT", "UPDATE"},
+		"profiles":      {"SELECT", "UPDATE"},
+		"enrollments":   {"SELECT", "INSERT", "UPDATE", "DELETE"},
+		"organizations": {"SELECT"},
+		"slug_mapping":  {"SELECT"},
+	}
+	// gVanilla - check upstream SortingHat schema (FLAVOR=vanilla)
+	gVanilla bool
+	// GRANT SELECT, UPDATE ON `shdb`.* TO `user`@`%`
+	gGrantRE = regexp.MustCompile("^GRANT (.+?) ON (\\S+) TO ")
+)
+
+// checkResult - collects readiness report lines
+type checkResult struct {
+	failed int
+}
+
+func (c *checkResult) report(ok bool, f string, a ...interface{}) {
+	status := "OK  "
+	if !ok {
+		status = "FAIL"
+		c.failed++
+	}
+	fmt.Printf("  [%s] %s\n", status, fmt.Sprintf(f, a...))
+}
+
+// tableColumns - table -> column -> data type in the current database
+func tableColumns(db *sql.DB) (columns map[string]map[string]string, err error) {
+	columns = make(map[string]map[string]string)
+	var rows *stmtRows
+	rows, err = query(db, "select table_name, column_name, data_type from information_schema.columns where table_schema = database()")
+	if err != nil {
+		return
+	}
+	table, column, dataType := "", "", ""
+	for rows.Next() {
+		err = rows.Scan(&table, &column, &dataType)
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		table, column = strings.ToLower(table), strings.ToLower(column)
+		if _, ok := columns[table]; !ok {
+			columns[table] = make(map[string]string)
+		}
+		columns[table][column] = strings.ToLower(dataType)
+	}
+	err = rows.Err()
+	if err != nil {
+		_ = rows.Close()
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+// grantedPrivileges - parses SHOW GRANTS of the current user, returns object (*.*, db.*, db.table) -> privileges
+func grantedPrivileges(db *sql.DB) (grants map[string]map[string]struct{}, err error) {
+	grants = make(map[string]map[string]struct{})
+	var rows *stmtRows
+	rows, err = query(db, "show grants")
+	if err != nil {
+		return
+	}
+	grant := ""
+	for rows.Next() {
+		err = rows.Scan(&grant)
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		m := gGrantRE.FindStringSubmatch(grant)
+		if m == nil {
+			continue
+		}
+		object := strings.ToLower(strings.Replace(m[2], "`", "", -1))
+		if _, ok := grants[object]; !ok {
+			grants[object] = make(map[string]struct{})
+		}
+		for _, privilege := range strings.Split(m[1], ",") {
+			privilege = strings.ToUpper(strings.TrimSpace(privilege))
+			// column level grants: UPDATE (name, email)
+			privilege = strings.TrimSpace(strings.SplitN(privilege, "(", 2)[0])
+			grants[object][privilege] = struct{}{}
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		_ = rows.Close()
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+// hasPrivilege - if privilege is granted on the table of dbName globally, on the database or on the table
+func hasPrivilege(grants map[string]map[string]struct{}, dbName, table, privilege string) bool {
+	for _, object := range []string{"*.*", strings.ToLower(dbName) + ".*", strings.ToLower(dbName + "." + table)} {
+		privileges := grants[object]
+		if _, ok := privileges["ALL PRIVILEGES"]; ok {
+			return true
+		}
+		if _, ok := privileges["ALL"]; ok {
+			return true
+		}
+		if _, ok := privileges[privilege]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDatabase - connectivity, schema and privileges of a single database
+func checkDatabase(c *checkResult, name string, db *sql.DB, readOnly bool) {
+	fmt.Printf("%s:\n", name)
+	err := db.Ping()
+	c.report(err == nil, "connectivity %v", errText(err))
+	if err != nil {
+		return
+	}
+	dbName, version := "", ""
+	_, err = queryFirst(db, []interface{}{&dbName, &version}, "select coalesce(database(), ''), version()")
+	c.report(err == nil && dbName != "", "database '%s', server %s %v", dbName, version, errText(err))
+	if err != nil {
+		return
+	}
+	var columns map[string]map[string]string
+	columns, err = tableColumns(db)
+	c.report(err == nil, "schema readable %v", errText(err))
+	if err != nil {
+		return
+	}
+	tables := []string{}
+	for table := range gRequiredColumns {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		existing, ok := columns[schemaTable(table)]
+		if !ok {
+			c.report(false, "table %s is missing", schemaTable(table))
+			continue
+		}
+		missing := []string{}
+		for _, column := range gRequiredColumns[table] {
+			if gVanilla && isLFColumn(column) {
+				continue
+			}
+			if _, ok := existing[schemaColumn(table, column)]; !ok {
+				missing = append(missing, schemaColumn(table, column))
+			}
+		}
+		c.report(len(missing) == 0, "table %s columns %s", schemaTable(table), missingText(missing))
+	}
+	var grants map[string]map[string]struct{}
+	grants, err = grantedPrivileges(db)
+	c.report(err == nil, "grants readable %v", errText(err))
+	if err != nil {
+		return
+	}
+	for _, table := range tables {
+		privileges := gRequiredPrivileges[table]
+		if readOnly {
+			privileges = []string{"SELECT"}
+		}
+		missing := []string{}
+		for _, privilege := range privileges {
+			if !hasPrivilege(grants, dbName, schemaTable(table), privilege) {
+				missing = append(missing, privilege)
+			}
+		}
+		c.report(len(missing) == 0, "privileges %s on %s %s", strings.Join(privileges, ", "), schemaTable(table), missingText(missing))
+	}
+}
+
+func errText(err error) string {
+	if err != nil {
+		return "(" + err.Error() + ")"
+	}
+	return ""
+}
+
+func missingText(missing []string) string {
+	if len(missing) > 0 {
+		return "(missing: " + strings.Join(missing, ", ") + ")"
+	}
+	return ""
+}
+
+// checkDatabases - "check" subcommand, prints readiness report of all configured databases
+// (SH_*, SH_DSN_2..., read replica from SH_RO_DSN, staging from STAGING_DSN)
+func checkDatabases(dbs []*shDatabase, staging string) (err error) {
+	gVanilla, err = vanillaFlavor()
+	if err != nil {
+		return
+	}
+	c := &checkResult{}
+	for _, shdb := range dbs {
+		shdb.use(false)
+		checkDatabase(c, shdb.name, shdb.db, false)
+		if shdb.ro != nil {
+			checkDatabase(c, shdb.name+" read replica", shdb.ro, true)
+		}
+	}
+	if staging != "" {
+		var db *sql.DB
+		db, err = openMySQL(staging)
+		if err != nil {
+			return
+		}
+		checkDatabase(c, dsnName(staging)+" staging", db, false)
+		_ = db.Close()
+	}
+	if c.failed > 0 {
+		err = fmt.Errorf("%d checks failed, not ready to import", c.failed)
+		return
+	}
+	fmt.Printf("Ready to import\n")
+	return
+}
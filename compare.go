@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	cCompareIdentical   = "identical"
+	cCompareDiffers     = "differs"
+	cCompareMissing     = "missing"
+	cCompareNotCompared = "not compared"
+)
+
+// compareIdentity - DB values of an identity compared with an identities row
+type compareIdentity struct {
+	uuid     string
+	name     string
+	username string
+	email    string
+	source   string
+}
+
+// compareIdentities - identities of ids, queried in batches
+func compareIdentities(db *sql.DB, ids []string) (identities map[string]compareIdentity, err error) {
+	identities = make(map[string]compareIdentity)
+	for from := 0; from < len(ids); from += cReconcileBatch {
+		to := from + cReconcileBatch
+		if to > len(ids) {
+			to = len(ids)
+		}
+		batch := ids[from:to]
+		args := []interface{}{}
+		for _, id := range batch {
+			args = append(args, id)
+		}
+		var rows *stmtRows
+		rows, err = query(
+			db,
+			"select id, uuid, trim(coalesce(name, '')), trim(coalesce(username, '')), trim(coalesce(email, '')), trim(source) from identities where id in ("+
+				strings.TrimSuffix(strings.Repeat("?,", len(batch)), ",")+")",
+			args...,
+		)
+		if err != nil {
+			return
+		}
+		for rows.Next() {
+			id, i := "", compareIdentity{}
+			err = rows.Scan(&id, &i.uuid, &i.name, &i.username, &i.email, &i.source)
+			if err != nil {
+				_ = rows.Close()
+				return
+			}
+			identities[id] = i
+		}
+		err = rows.Err()
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// uuidExists - unique identity exists
+func uuidExists(db *sql.DB, uuid string) (bool, error) {
+	var found string
+	return queryFirst(db, []interface{}{&found}, "select uuid from uidentities where uuid = ?", uuid)
+}
+
+// compareValue - export value equals the DB one, the way imports compare them (NORMALIZE, IGNORE_CASE_*)
+func compareValue(dbValue, value string, ignoreCase bool) bool {
+	dbValue, value = normalizeValue(dbValue), normalizeValue(value)
+	return dbValue == value || (ignoreCase && strings.EqualFold(dbValue, value))
+}
+
+// compareRow - status and differences of an identities row against the database
+func compareRow(db *sql.DB, row map[string]string, identities map[string]compareIdentity) (status, details string, err error) {
+	switch strings.ToLower(strings.TrimSpace(row["action"])) {
+	case "merge", "suggest":
+		from, into := strings.TrimSpace(row["uuid"]), strings.TrimSpace(row["merge_into_uuid"])
+		var fromFound, intoFound bool
+		fromFound, err = uuidExists(db, from)
+		if err == nil {
+			intoFound, err = uuidExists(db, into)
+		}
+		switch {
+		case err != nil:
+		case !intoFound:
+			status, details = cCompareMissing, "merge_into_uuid "+into+" not found"
+		case fromFound:
+			status, details = cCompareDiffers, "uuid "+from+" is not merged into "+into
+		default:
+			status, details = cCompareIdentical, "uuid "+from+" merged into "+into
+		}
+		return
+	}
+	id := strings.TrimSpace(row["identity_id"])
+	if id == "" {
+		status, details = cCompareNotCompared, "no identity_id"
+		return
+	}
+	i, ok := identities[id]
+	if !ok {
+		status, details = cCompareMissing, "identity_id "+id+" not found"
+		return
+	}
+	diffs := ""
+	if !compareValue(i.name, row["identity_name"], false) {
+		diffs += fieldChange("name", i.name, strings.TrimSpace(row["identity_name"]))
+	}
+	if !compareValue(i.username, row["identity_username"], gIgnoreCaseUsername) {
+		diffs += fieldChange("username", i.username, strings.TrimSpace(row["identity_username"]))
+	}
+	if !compareValue(i.email, row["identity_email"], gIgnoreCaseEmail) {
+		diffs += fieldChange("email", i.email, strings.TrimSpace(row["identity_email"]))
+	}
+	if source := strings.TrimSpace(row["identity_source"]); source != "" && source != i.source {
+		diffs += fieldChange("source", i.source, source)
+	}
+	if diffs == "" {
+		status = cCompareIdentical
+		return
+	}
+	status, details = cCompareDiffers, "identity_id "+id+"/"+i.uuid+" "+strings.TrimSpace(diffs)
+	return
+}
+
+// compareExport - "compare" subcommand, read only: reports which rows of identities files are identical to the
+// database (the export was applied or nothing changed since), which differ (with DB -> export values) and which
+// reference identities that don't exist, values are compared as imports compare them (NORMALIZE, IGNORE_CASE_*)
+// COMPARE_OUT - CSV report with source_line, identity_id, status and details (local path, s3:// or http(s)://)
+func compareExport(db *sql.DB, dbg bool, args []string) (err error) {
+	if len(args) == 0 {
+		err = fmt.Errorf("compare requires identities files or patterns")
+		return
+	}
+	var files inputFiles
+	files, err = classifyInputFiles(args)
+	if err != nil {
+		return
+	}
+	if len(files.identities) == 0 {
+		err = fmt.Errorf("compare requires identities files, got %v", args)
+		return
+	}
+	if len(files.affiliations) > 0 || len(files.organizations) > 0 || len(files.profiles) > 0 {
+		fmt.Printf("WARNING: compare only reports identities files, other files are ignored\n")
+	}
+	gIgnoreCaseEmail = os.Getenv("IGNORE_CASE_EMAIL") != ""
+	gIgnoreCaseUsername = os.Getenv("IGNORE_CASE_USERNAME") != ""
+	err = setNormalize(os.Getenv("NORMALIZE"))
+	if err != nil {
+		return
+	}
+	var inputs []csvInput
+	inputs, err = readCSVFiles(files.identities, dbg)
+	if err != nil {
+		return
+	}
+	var identities map[string]compareIdentity
+	identities, err = compareIdentities(db, inputIDs(inputs))
+	if err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write([]string{"file", "source_line", "identity_id", "status", "details"})
+	for _, input := range inputs {
+		if len(input.lines) < 2 {
+			continue
+		}
+		counts := make(map[string]int)
+		for n, line := range input.lines[1:] {
+			row := csvRow(input.lines[0], line)
+			var status, details string
+			status, details, err = compareRow(db, row, identities)
+			if err != nil {
+				err = fmt.Errorf("%s:%d: %v", input.name, n+1, err)
+				return
+			}
+			counts[status]++
+			if status == cCompareDiffers || status == cCompareMissing || dbg {
+				fmt.Printf("%s:%d %s: %s\n", input.name, n+1, status, details)
+			}
+			_ = w.Write([]string{input.name, strconv.Itoa(n + 1), strings.TrimSpace(row["identity_id"]), status, details})
+		}
+		fmt.Printf(
+			"%s: %d rows, %d identical, %d differ, %d missing, %d not compared\n",
+			input.name, len(input.lines)-1, counts[cCompareIdentical], counts[cCompareDiffers], counts[cCompareMissing], counts[cCompareNotCompared],
+		)
+	}
+	w.Flush()
+	err = w.Error()
+	if err != nil {
+		return
+	}
+	if path := os.Getenv("COMPARE_OUT"); path != "" {
+		err = writeOutput(path, buf.Bytes())
+		if err == nil {
+			fmt.Printf("Comparison written to %s\n", path)
+		}
+	}
+	return
+}
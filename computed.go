@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	// gComputed - computed columns per file kind (organizations, identities, profiles, affiliations), in order
+	gComputed map[string][]computedColumn
+	// gComputedKinds - sections of COLUMNS_FILE, "all" applies to every file
+	gComputedKinds = []string{"all", "organizations", "identities", "profiles", "affiliations"}
+	// gValueFuncs - functions of column expressions: minimal and maximal number of arguments (-1 - any)
+	gValueFuncs = map[string][2]int{
+		"concat":    {1, -1},
+		"concat_ws": {2, -1},
+		"coalesce":  {1, -1},
+		"trim":      {1, 1},
+		"lower":     {1, 1},
+		"upper":     {1, 1},
+		"replace":   {3, 3},
+		"split":     {3, 3},
+	}
+)
+
+// computedColumn - column set from an expression over the row's columns
+type computedColumn struct {
+	name string
+	text string
+	expr valueExpr
+}
+
+// valueExpr - parsed column expression: a 'literal' or number, a column reference or a function call
+type valueExpr struct {
+	literal *string
+	column  string
+	fn      string
+	args    []valueExpr
+}
+
+// exprParser - recursive descent parser of a column expression
+type exprParser struct {
+	s   string
+	pos int
+}
+
+// setComputedColumns - COLUMNS_FILE is a YAML file with computed columns per file kind (all, organizations,
+// identities, profiles, affiliations), each an ordered map of column: expression, for example
+// identities: {identity_name: "concat_ws(' ', first_name, last_name)"}, expressions are 'literals', integers, column
+// names (`quoted` when they aren't identifiers, computed columns can use the ones computed before them) and functions:
+// concat, concat_ws, coalesce (first non-empty), trim, lower, upper, replace(value, old, new),
+// split(value, separator, index) (0-based, negative from the end)
+func setComputedColumns() (err error) {
+	gComputed = nil
+	fileName := os.Getenv("COLUMNS_FILE")
+	if fileName == "" {
+		return
+	}
+	var data []byte
+	data, err = ioutil.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+	sections := make(map[string]yaml.MapSlice)
+	err = yaml.Unmarshal(data, &sections)
+	if err != nil {
+		err = fmt.Errorf("cannot parse COLUMNS_FILE %s: %v", fileName, err)
+		return
+	}
+	gComputed = make(map[string][]computedColumn)
+	for kind, columns := range sections {
+		known := false
+		for _, k := range gComputedKinds {
+			known = known || k == kind
+		}
+		if !known {
+			err = fmt.Errorf("COLUMNS_FILE %s: unknown section '%s', allowed: %s", fileName, kind, strings.Join(gComputedKinds, ", "))
+			return
+		}
+		for _, item := range columns {
+			name, text := strings.TrimSpace(fmt.Sprintf("%v", item.Key)), fmt.Sprintf("%v", item.Value)
+			var expr valueExpr
+			expr, err = parseValueExpr(text)
+			if err != nil {
+				err = fmt.Errorf("COLUMNS_FILE %s: %s.%s: %v", fileName, kind, name, err)
+				return
+			}
+			gComputed[kind] = append(gComputed[kind], computedColumn{name: name, text: text, expr: expr})
+		}
+	}
+	return
+}
+
+// parseValueExpr - parses the whole expression
+func parseValueExpr(s string) (expr valueExpr, err error) {
+	p := &exprParser{s: s}
+	expr, err = p.expr()
+	if err != nil {
+		return
+	}
+	p.skipSpaces()
+	if p.pos < len(p.s) {
+		err = fmt.Errorf("unexpected '%s' at %d in %s", p.s[p.pos:], p.pos+1, s)
+	}
+	return
+}
+
+// skipSpaces - skips whitespace
+func (p *exprParser) skipSpaces() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// quoted - text up to the closing quote, a doubled quote stands for the quote itself
+func (p *exprParser) quoted(q byte) (s string, err error) {
+	var b strings.Builder
+	for p.pos++; p.pos < len(p.s); p.pos++ {
+		if p.s[p.pos] != q {
+			b.WriteByte(p.s[p.pos])
+			continue
+		}
+		if p.pos+1 < len(p.s) && p.s[p.pos+1] == q {
+			b.WriteByte(q)
+			p.pos++
+			continue
+		}
+		p.pos++
+		s = b.String()
+		return
+	}
+	err = fmt.Errorf("unterminated %c in %s", q, p.s)
+	return
+}
+
+// expr - literal, column or function call
+func (p *exprParser) expr() (expr valueExpr, err error) {
+	p.skipSpaces()
+	if p.pos >= len(p.s) {
+		err = fmt.Errorf("expression expected at the end of %s", p.s)
+		return
+	}
+	switch c := p.s[p.pos]; {
+	case c == '\'' || c == '"':
+		var s string
+		s, err = p.quoted(c)
+		expr.literal = &s
+		return
+	case c == '`':
+		expr.column, err = p.quoted(c)
+		return
+	}
+	start := p.pos
+	if c := p.s[p.pos]; c == '-' || c >= '0' && c <= '9' {
+		// number literal
+		for p.pos++; p.pos < len(p.s) && p.s[p.pos] >= '0' && p.s[p.pos] <= '9'; p.pos++ {
+		}
+		number := p.s[start:p.pos]
+		if _, e := strconv.Atoi(number); e != nil {
+			err = fmt.Errorf("invalid number '%s' at %d in %s", number, start+1, p.s)
+			return
+		}
+		expr.literal = &number
+		return
+	}
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			break
+		}
+		p.pos++
+	}
+	name := p.s[start:p.pos]
+	if name == "" {
+		err = fmt.Errorf("unexpected '%s' at %d in %s", p.s[p.pos:], p.pos+1, p.s)
+		return
+	}
+	p.skipSpaces()
+	if p.pos >= len(p.s) || p.s[p.pos] != '(' {
+		expr.column = name
+		return
+	}
+	expr.fn = strings.ToLower(name)
+	arity, ok := gValueFuncs[expr.fn]
+	if !ok {
+		err = fmt.Errorf("unknown function %s in %s", name, p.s)
+		return
+	}
+	p.pos++
+	for {
+		p.skipSpaces()
+		if p.pos < len(p.s) && p.s[p.pos] == ')' && len(expr.args) == 0 {
+			p.pos++
+			break
+		}
+		var arg valueExpr
+		arg, err = p.expr()
+		if err != nil {
+			return
+		}
+		expr.args = append(expr.args, arg)
+		p.skipSpaces()
+		if p.pos < len(p.s) && p.s[p.pos] == ',' {
+			p.pos++
+			continue
+		}
+		if p.pos < len(p.s) && p.s[p.pos] == ')' {
+			p.pos++
+			break
+		}
+		err = fmt.Errorf("',' or ')' expected at %d in %s", p.pos+1, p.s)
+		return
+	}
+	if len(expr.args) < arity[0] || (arity[1] >= 0 && len(expr.args) > arity[1]) {
+		err = fmt.Errorf("%s: wrong number of arguments %d in %s", expr.fn, len(expr.args), p.s)
+	}
+	return
+}
+
+// columns - columns referenced by the expression
+func (e valueExpr) columns() (columns []string) {
+	if e.column != "" {
+		columns = append(columns, e.column)
+	}
+	for _, arg := range e.args {
+		columns = append(columns, arg.columns()...)
+	}
+	return
+}
+
+// eval - value of the expression for the row
+func (e valueExpr) eval(row map[string]string) (value string, err error) {
+	if e.literal != nil {
+		return *e.literal, nil
+	}
+	if e.fn == "" {
+		return row[e.column], nil
+	}
+	args := make([]string, len(e.args))
+	for i, arg := range e.args {
+		args[i], err = arg.eval(row)
+		if err != nil {
+			return
+		}
+	}
+	switch e.fn {
+	case "concat":
+		value = strings.Join(args, "")
+	case "concat_ws":
+		values := []string{}
+		for _, arg := range args[1:] {
+			if strings.TrimSpace(arg) != "" {
+				values = append(values, strings.TrimSpace(arg))
+			}
+		}
+		value = strings.Join(values, args[0])
+	case "coalesce":
+		for _, arg := range args {
+			if strings.TrimSpace(arg) != "" {
+				value = arg
+				break
+			}
+		}
+	case "trim":
+		value = strings.TrimSpace(args[0])
+	case "lower":
+		value = strings.ToLower(args[0])
+	case "upper":
+		value = strings.ToUpper(args[0])
+	case "replace":
+		value = strings.Replace(args[0], args[1], args[2], -1)
+	case "split":
+		var n int
+		n, err = strconv.Atoi(strings.TrimSpace(args[2]))
+		if err != nil {
+			err = fmt.Errorf("split: invalid index '%s'", args[2])
+			return
+		}
+		parts := strings.Split(args[0], args[1])
+		if n < 0 {
+			n += len(parts)
+		}
+		if n >= 0 && n < len(parts) {
+			value = strings.TrimSpace(parts[n])
+		}
+	}
+	return
+}
+
+// applyComputedColumns - sets computed columns of the kind in all data rows of inputs, columns missing in a file are
+// appended to its header, an expression of the kind referencing a column the file doesn't have is an error (those of
+// "all" files are skipped)
+func applyComputedColumns(kind string, inputs []csvInput) (err error) {
+	all := len(gComputed["all"])
+	if all+len(gComputed[kind]) == 0 {
+		return
+	}
+	for i := range inputs {
+		input := &inputs[i]
+		if len(input.lines) == 0 {
+			continue
+		}
+		hdr := append([]string{}, input.lines[0]...)
+		columns, indices := []computedColumn{}, []int{}
+		for c, column := range append(append([]computedColumn{}, gComputed["all"]...), gComputed[kind]...) {
+			missing := ""
+			for _, ref := range column.expr.columns() {
+				if columnIndex(hdr, ref) < 0 {
+					missing = ref
+					break
+				}
+			}
+			if missing != "" && c < all {
+				// columns of all files are only computed in files having the columns they use
+				continue
+			}
+			if missing != "" {
+				err = fmt.Errorf("%s: computed column %s = %s references column %s missing in the header %v", input.name, column.name, column.text, missing, input.lines[0])
+				return
+			}
+			idx := columnIndex(hdr, column.name)
+			if idx < 0 {
+				idx = len(hdr)
+				hdr = append(hdr, column.name)
+			}
+			columns = append(columns, column)
+			indices = append(indices, idx)
+		}
+		if len(columns) == 0 {
+			continue
+		}
+		input.lines[0] = hdr
+		for n, line := range input.lines[1:] {
+			row := csvRow(hdr, line)
+			for len(line) < len(hdr) {
+				line = append(line, "")
+			}
+			for c, column := range columns {
+				var value string
+				value, err = column.expr.eval(row)
+				if err != nil {
+					err = fmt.Errorf("%s:%d: computed column %s: %v", input.name, n+1, column.name, err)
+					return
+				}
+				line[indices[c]] = value
+				row[column.name] = value
+			}
+			input.lines[n+1] = line
+		}
+		fmt.Printf("%s: %d computed columns set in %d rows\n", input.name, len(columns), len(input.lines)-1)
+	}
+	return
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseValueExpr(t *testing.T) {
+	row := map[string]string{
+		"first":      "Jane",
+		"middle":     " ",
+		"last":       "Doe",
+		"nick":       "JD",
+		"email":      "jane.doe@example.com",
+		"first name": "Janet",
+	}
+	var testCases = []struct {
+		expr     string
+		expected string
+	}{
+		{expr: "first", expected: "Jane"},
+		{expr: "'literal'", expected: "literal"},
+		{expr: `"double"`, expected: "double"},
+		{expr: "'it''s'", expected: "it's"},
+		{expr: `"say ""hi"""`, expected: `say "hi"`},
+		{expr: "'a, b) c'", expected: "a, b) c"},
+		{expr: "`first name`", expected: "Janet"},
+		{expr: "`a``b`", expected: ""},
+		{expr: "42", expected: "42"},
+		{expr: "-1", expected: "-1"},
+		{expr: "missing", expected: ""},
+		{expr: "concat(first, ' ', last)", expected: "Jane Doe"},
+		{expr: "  concat ( first , last )  ", expected: "JaneDoe"},
+		{expr: "CONCAT(first, last)", expected: "JaneDoe"},
+		{expr: "concat_ws(' ', first, middle, last)", expected: "Jane Doe"},
+		{expr: "coalesce(middle, nick, first)", expected: "JD"},
+		{expr: "coalesce(middle, missing)", expected: ""},
+		{expr: "upper(trim(concat(' ', first, ' ')))", expected: "JANE"},
+		{expr: "lower(concat(upper(first), last))", expected: "janedoe"},
+		{expr: "trim(concat(middle, first))", expected: "Jane"},
+		{expr: "replace(email, '@', ' at ')", expected: "jane.doe at example.com"},
+		{expr: "split(email, '@', -1)", expected: "example.com"},
+		{expr: "split(email, '@', 0)", expected: "jane.doe"},
+		{expr: "split(email, '@', 5)", expected: ""},
+		{expr: "split(split(email, '@', 0), '.', 1)", expected: "doe"},
+	}
+	for index, test := range testCases {
+		expr, err := parseValueExpr(test.expr)
+		if err != nil {
+			t.Errorf("test number %d, parsing %s failed: %v", index+1, test.expr, err)
+			continue
+		}
+		got, err := expr.eval(row)
+		if err != nil {
+			t.Errorf("test number %d, evaluating %s failed: %v", index+1, test.expr, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("test number %d, expected '%s', got '%s' for %s", index+1, test.expected, got, test.expr)
+		}
+	}
+}
+
+func TestParseValueExprErrors(t *testing.T) {
+	var testCases = []string{
+		"",
+		"'unterminated",
+		`"unterminated`,
+		"`unterminated",
+		"concat(first",
+		"concat(first,)",
+		"concat(first last)",
+		"concat()",
+		"trim(first, last)",
+		"replace(first, 'a')",
+		"unknown(first)",
+		"first last",
+		"-",
+		"1a",
+		"'a' 'b'",
+		"@first",
+	}
+	for index, test := range testCases {
+		_, err := parseValueExpr(test)
+		if err == nil {
+			t.Errorf("test number %d, expected an error for '%s'", index+1, test)
+		}
+	}
+}
+
+func TestValueExprEvalErrors(t *testing.T) {
+	expr, err := parseValueExpr("split(email, '@', index)")
+	if err != nil {
+		t.Fatalf("parsing failed: %v", err)
+	}
+	_, err = expr.eval(map[string]string{"email": "a@b", "index": "x"})
+	if err == nil {
+		t.Errorf("expected an error for an invalid split index")
+	}
+}
+
+func TestValueExprColumns(t *testing.T) {
+	expr, err := parseValueExpr("concat_ws(' ', first, coalesce(`middle name`, 'x'), upper(last))")
+	if err != nil {
+		t.Fatalf("parsing failed: %v", err)
+	}
+	expected := []string{"first", "middle name", "last"}
+	if got := expr.columns(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestApplyComputedColumns(t *testing.T) {
+	saved := gComputed
+	defer func() {
+		gComputed = saved
+	}()
+	column := func(name, text string) computedColumn {
+		expr, err := parseValueExpr(text)
+		if err != nil {
+			t.Fatalf("parsing %s failed: %v", text, err)
+		}
+		return computedColumn{name: name, text: text, expr: expr}
+	}
+	// "all" columns are computed first, then the kind's ones in order, each can use the ones before it
+	gComputed = map[string][]computedColumn{
+		"all": {column("full_name", "concat_ws(' ', first, last)"), column("unused", "missing_column")},
+		"identities": {
+			column("identity_name", "upper(full_name)"),
+			column("first", "lower(first)"),
+			column("login", "concat(first, '.', lower(last))"),
+		},
+	}
+	inputs := []csvInput{{
+		name: "user_identities_202601010000.csv",
+		lines: [][]string{
+			{"first", "last"},
+			{"Jane", "Doe"},
+			{"John"},
+		},
+	}}
+	err := applyComputedColumns("identities", inputs)
+	if err != nil {
+		t.Fatalf("applying computed columns failed: %v", err)
+	}
+	expected := [][]string{
+		{"first", "last", "full_name", "identity_name", "login"},
+		{"jane", "Doe", "Jane Doe", "JANE DOE", "jane.doe"},
+		{"john", "", "John", "JOHN", "john."},
+	}
+	if !reflect.DeepEqual(inputs[0].lines, expected) {
+		t.Errorf("expected %v, got %v", expected, inputs[0].lines)
+	}
+	gComputed["identities"] = append(gComputed["identities"], column("x", "missing_column"))
+	err = applyComputedColumns("identities", []csvInput{{name: "f.csv", lines: [][]string{{"first", "last"}}}})
+	if err == nil {
+		t.Errorf("expected an error for a column of the kind referencing a missing column")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	cConflictOverwrite     = "overwrite"
+	cConflictSkip          = "skip"
+	cConflictMergeNonEmpty = "merge-nonempty"
+	cConflictReportOnly    = "report-only"
+)
+
+var (
+	// gConflict - strategy for rows modified in the DB after the export
+	gConflict string
+	// gConflictColumns - per-column strategies overriding gConflict
+	gConflictColumns map[string]string
+)
+
+func validConflictStrategy(s string) bool {
+	switch s {
+	case cConflictOverwrite, cConflictSkip, cConflictMergeNonEmpty, cConflictReportOnly:
+		return true
+	}
+	return false
+}
+
+// setConflict - configures conflict resolution, conflicts are rows modified in the DB after the export (see STALE_CHECK)
+// CONFLICT - overwrite, skip, merge-nonempty (only fill blank DB values) or report-only, enables STALE_CHECK when it is not set
+// CONFLICT_COLUMNS - per-column strategies, for example "identity_name:merge-nonempty,identity_email:skip"
+// columns: identity_name, identity_username, identity_email, profile, enrollment
+// Without CONFLICT, STALE_CHECK=skip means skip and STALE_CHECK=warn means overwrite
+func setConflict() (err error) {
+	gConflict = strings.TrimSpace(os.Getenv("CONFLICT"))
+	gConflictColumns = make(map[string]string)
+	if gConflict != "" && !validConflictStrategy(gConflict) {
+		err = fmt.Errorf("invalid CONFLICT=%s, allowed: %s, %s, %s, %s", gConflict, cConflictOverwrite, cConflictSkip, cConflictMergeNonEmpty, cConflictReportOnly)
+		return
+	}
+	for _, item := range strings.Split(os.Getenv("CONFLICT_COLUMNS"), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		ary := strings.SplitN(item, ":", 2)
+		if len(ary) != 2 || !validConflictStrategy(strings.TrimSpace(ary[1])) {
+			err = fmt.Errorf("invalid CONFLICT_COLUMNS item '%s', expected column:strategy", item)
+			return
+		}
+		gConflictColumns[strings.TrimSpace(ary[0])] = strings.TrimSpace(ary[1])
+	}
+	if gStaleMode == "" && (gConflict != "" || len(gConflictColumns) > 0) {
+		gStaleMode = cStaleSkip
+	}
+	return
+}
+
+// conflictStrategy - strategy for a column
+func conflictStrategy(column string) string {
+	if strategy, ok := gConflictColumns[column]; ok {
+		return strategy
+	}
+	if gConflict != "" {
+		return gConflict
+	}
+	if gStaleMode == cStaleWarn {
+		return cConflictOverwrite
+	}
+	return cConflictSkip
+}
+
+// resolveConflict - returns value to write for a column of a row modified after the export
+// the second value is true when the column change is dropped because of skip strategy
+func resolveConflict(column, dbValue, newValue string) (string, bool) {
+	if dbValue == newValue {
+		return newValue, false
+	}
+	switch conflictStrategy(column) {
+	case cConflictOverwrite:
+		return newValue, false
+	case cConflictMergeNonEmpty:
+		if dbValue == "" {
+			return newValue, false
+		}
+		return dbValue, false
+	case cConflictReportOnly:
+		return dbValue, false
+	}
+	return dbValue, true
+}
+
+// conflictRow - reports conflict, returns skip error when changes were dropped by skip strategy and nothing else remains
+func conflictRow(changed, skipped bool, f string, a ...interface{}) error {
+	if skipped && !changed {
+		return skipf(cWarnOther, f, a...)
+	}
+	warnf(cWarnOther, f, a...)
+	return nil
+}
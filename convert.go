@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// gConvertIdentitiesHdr - columns of identities rows converted from merge commands
+	gConvertIdentitiesHdr = []string{"action", "identity_id", "uuid", "merge_into_uuid", "user_name", "user_email", "user_sfid"}
+	// gConvertAffiliationsHdr - columns of affiliations rows converted from enroll and withdraw commands
+	gConvertAffiliationsHdr = []string{
+		"action", "identity_id", "project_slug", "from_org_name", "from_start_date", "from_end_date",
+		"to_org_name", "to_start_date", "to_end_date", "user_name", "user_email", "user_sfid",
+	}
+	// gConvertProfilesHdr - columns of profiles rows converted from profile commands
+	gConvertProfilesHdr = []string{"uuid", "profile_name", "profile_email", "profile_country", "profile_is_bot", "profile_gender", "user_name", "user_email", "user_sfid"}
+	// gConvertOrganizationsHdr - columns of organizations rows converted from orgs commands
+	gConvertOrganizationsHdr = []string{"action", "org_name", "domain", "is_top_domain", "user_name", "user_email", "user_sfid"}
+	// gSortingHatGlobalOpts - sortinghat options given before the command, they take a value
+	gSortingHatGlobalOpts = map[string]struct{}{"-u": {}, "--user": {}, "-p": {}, "--password": {}, "--host": {}, "--port": {}, "-d": {}, "--database": {}}
+)
+
+// sortingHatCommand - one sortinghat invocation of a script
+type sortingHatCommand struct {
+	file string
+	line int
+	text string
+	args []string
+}
+
+// converted - rows converted from sortinghat commands, per import file kind
+type converted struct {
+	identities    [][]string
+	affiliations  [][]string
+	profiles      [][]string
+	organizations [][]string
+	unconverted   []string
+}
+
+// shellWords - splits a command line as a POSIX shell would (quotes and backslash escapes, no expansions)
+func shellWords(s string) (words []string, err error) {
+	var (
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			default:
+				word.WriteRune(r)
+			}
+		case r == '\\':
+			escaped, inWord = true, true
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		err = fmt.Errorf("unterminated quote or escape")
+		return
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return
+}
+
+// readSortingHatScript - sortinghat invocations of a script, other lines (comments, blank, other programs) are
+// ignored, backslash continued lines are joined
+func readSortingHatScript(path string) (commands []sortingHatCommand, ignored int, err error) {
+	var f *os.File
+	f, err = os.Open(path)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	n, start, text := 0, 0, ""
+	for scanner.Scan() {
+		n++
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if text == "" {
+			start = n
+		}
+		if strings.HasSuffix(line, "\\") {
+			text += strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		text += line
+		cmd := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(text), "$ "))
+		text = ""
+		if cmd == "" || strings.HasPrefix(cmd, "#") {
+			continue
+		}
+		args, e := shellWords(cmd)
+		if e != nil || len(args) == 0 || filepath.Base(args[0]) != "sortinghat" {
+			ignored++
+			continue
+		}
+		commands = append(commands, sortingHatCommand{file: path, line: start, text: cmd, args: args[1:]})
+	}
+	err = scanner.Err()
+	return
+}
+
+// parseSortingHatArgs - command name, its positional arguments and options (--flag -> "", --opt value)
+func parseSortingHatArgs(args []string, flags map[string]struct{}) (command string, positional []string, opts map[string]string, err error) {
+	opts = make(map[string]string)
+	i := 0
+	for ; i < len(args) && strings.HasPrefix(args[i], "-"); i++ {
+		opt := args[i]
+		if strings.Contains(opt, "=") {
+			continue
+		}
+		if _, ok := gSortingHatGlobalOpts[opt]; ok {
+			i++
+		}
+	}
+	if i >= len(args) {
+		err = fmt.Errorf("no sortinghat command")
+		return
+	}
+	command = args[i]
+	for i++; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			positional = append(positional, arg)
+			continue
+		}
+		if kv := strings.SplitN(arg, "=", 2); len(kv) == 2 {
+			opts[kv[0]] = kv[1]
+			continue
+		}
+		if _, ok := flags[arg]; ok || i+1 >= len(args) {
+			opts[arg] = ""
+			continue
+		}
+		opts[arg] = args[i+1]
+		i++
+	}
+	return
+}
+
+// convertCommand - appends import rows equivalent to the sortinghat command, error when it cannot be converted
+func (c *converted) convertCommand(db *sql.DB, cmd sortingHatCommand, who []string) (err error) {
+	flags := map[string]struct{}{"--bot": {}, "--no-bot": {}, "--merge": {}, "--top-domain": {}, "--overwrite": {}, "-a": {}, "--add": {}, "-d": {}, "--delete": {}}
+	command, positional, opts, err := parseSortingHatArgs(cmd.args, flags)
+	if err != nil {
+		return
+	}
+	switch command {
+	case "merge":
+		if len(positional) != 2 {
+			err = fmt.Errorf("merge expects FROM_UUID TO_UUID")
+			return
+		}
+		c.identities = append(c.identities, append([]string{"merge", "", positional[0], positional[1]}, who...))
+	case "profile":
+		if len(positional) != 1 {
+			err = fmt.Errorf("profile expects UUID")
+			return
+		}
+		isBot := ""
+		if _, ok := opts["--bot"]; ok {
+			isBot = "1"
+		}
+		if _, ok := opts["--no-bot"]; ok {
+			isBot = "0"
+		}
+		c.profiles = append(c.profiles, append([]string{positional[0], opts["--name"], opts["--email"], opts["--country"], isBot, opts["--gender"]}, who...))
+	case "enroll":
+		if len(positional) != 2 {
+			err = fmt.Errorf("enroll expects UUID ORGANIZATION")
+			return
+		}
+		var id string
+		id, err = enrollmentIdentity(db, positional[0])
+		if err != nil {
+			return
+		}
+		c.affiliations = append(c.affiliations, append([]string{"", id, "", "", "", "", positional[1], opts["--from"], opts["--to"]}, who...))
+	case "withdraw":
+		if len(positional) != 2 {
+			err = fmt.Errorf("withdraw expects UUID ORGANIZATION")
+			return
+		}
+		var id string
+		id, err = enrollmentIdentity(db, positional[0])
+		if err != nil {
+			return
+		}
+		var enrollments []showEnrollment
+		enrollments, err = withdrawnEnrollments(db, positional[0], positional[1], opts["--from"], opts["--to"])
+		if err != nil {
+			return
+		}
+		if len(enrollments) == 0 {
+			err = fmt.Errorf("uuid %s has no enrollments in %s to withdraw", positional[0], positional[1])
+			return
+		}
+		for _, e := range enrollments {
+			c.affiliations = append(c.affiliations, append([]string{"", id, e.ProjectSlug, e.Organization, e.Start, e.End, "", "", ""}, who...))
+		}
+	case "orgs":
+		_, add := opts["-a"]
+		if _, ok := opts["--add"]; ok {
+			add = true
+		}
+		if !add || len(positional) < 1 || len(positional) > 2 {
+			err = fmt.Errorf("only orgs -a ORGANIZATION [DOMAIN] is supported")
+			return
+		}
+		if len(positional) == 1 {
+			c.organizations = append(c.organizations, append([]string{"create", positional[0], "", ""}, who...))
+			return
+		}
+		top := ""
+		if _, ok := opts["--top-domain"]; ok {
+			top = "1"
+		}
+		c.organizations = append(c.organizations, append([]string{"add_domain", positional[0], positional[1], top}, who...))
+	default:
+		err = fmt.Errorf("command %s has no import equivalent", command)
+	}
+	return
+}
+
+// enrollmentIdentity - identity keying affiliations rows of the uuid: the one with the uuid's id or the first one
+func enrollmentIdentity(db *sql.DB, uuid string) (id string, err error) {
+	var identities []personIdentity
+	identities, err = personIdentities(db, uuid)
+	if err != nil {
+		err = fmt.Errorf("uuid %s identities: %v", uuid, err)
+		return
+	}
+	for _, identity := range identities {
+		if id == "" || identity.id == uuid {
+			id = identity.id
+		}
+	}
+	if id == "" {
+		err = fmt.Errorf("uuid %s has no identities", uuid)
+	}
+	return
+}
+
+// withdrawnEnrollments - enrollments of the uuid in the organization within from - to (default all), as withdraw
+// removes them
+func withdrawnEnrollments(db *sql.DB, uuid, orgName, from, to string) (enrollments []showEnrollment, err error) {
+	var tFrom, tTo time.Time
+	tFrom, err = parseEnrollmentDate(from, gMinDate)
+	if err == nil {
+		tTo, err = parseEnrollmentDate(to, gMaxDate)
+	}
+	if err != nil {
+		return
+	}
+	var rows *stmtRows
+	rows, err = query(
+		db,
+		"select e.id, o.name, e.organization_id, coalesce(e.project_slug, ''), date_format(e.start, '%Y-%m-%d'), date_format(e.end, '%Y-%m-%d') "+
+			"from enrollments e, organizations o where e.organization_id = o.id and e.uuid = ? and o.name = ? "+
+			"and e.start >= str_to_date(?, ?) and e.end <= str_to_date(?, ?) order by e.project_slug, e.start, e.id",
+		uuid, orgName, toYMDDate(tFrom), cDateTimeFormat, toYMDDate(tTo), cDateTimeFormat,
+	)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		e := showEnrollment{}
+		err = rows.Scan(&e.ID, &e.Organization, &e.OrganizationID, &e.ProjectSlug, &e.Start, &e.End)
+		if err != nil {
+			break
+		}
+		enrollments = append(enrollments, e)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	e := rows.Close()
+	if err == nil {
+		err = e
+	}
+	return
+}
+
+// convertSortingHat - "convert" subcommand, read only: translates sortinghat CLI scripts (merge, profile, enroll,
+// withdraw and orgs -a invocations) to user_organizations_, user_identities_, user_profiles_ and
+// user_affiliations_<timestamp>.csv so a backlog is replayed through the audited import, commands without an import
+// equivalent are written to sortinghat_unconverted_<timestamp>.sh
+// CONVERT_DIR - output directory, s3:// prefix or http(s):// URL (default current directory)
+// CONVERT_USER_EMAIL, CONVERT_USER_SFID - who the rows are attributed to, user_name is the script file and line
+func convertSortingHat(db *sql.DB, dbg bool, args []string) (err error) {
+	if len(args) == 0 {
+		err = fmt.Errorf("convert requires sortinghat command scripts")
+		return
+	}
+	c := &converted{
+		identities:    [][]string{gConvertIdentitiesHdr},
+		affiliations:  [][]string{gConvertAffiliationsHdr},
+		profiles:      [][]string{gConvertProfilesHdr},
+		organizations: [][]string{gConvertOrganizationsHdr},
+	}
+	total := 0
+	for _, path := range args {
+		var (
+			commands []sortingHatCommand
+			ignored  int
+		)
+		commands, ignored, err = readSortingHatScript(path)
+		if err != nil {
+			return
+		}
+		if ignored > 0 {
+			fmt.Printf("WARNING: %s: %d lines are not sortinghat invocations and are ignored\n", path, ignored)
+		}
+		for _, cmd := range commands {
+			total++
+			who := []string{"sortinghat " + cmd.file + ":" + strconv.Itoa(cmd.line), os.Getenv("CONVERT_USER_EMAIL"), os.Getenv("CONVERT_USER_SFID")}
+			e := c.convertCommand(db, cmd, who)
+			if e != nil {
+				fmt.Printf("WARNING: %s:%d not converted: %v\n", cmd.file, cmd.line, e)
+				c.unconverted = append(c.unconverted, fmt.Sprintf("# %s:%d: %v\n%s", cmd.file, cmd.line, e, cmd.text))
+				continue
+			}
+			if dbg {
+				fmt.Printf("%s:%d converted: %s\n", cmd.file, cmd.line, cmd.text)
+			}
+		}
+	}
+	dir := os.Getenv("CONVERT_DIR")
+	if dir == "" {
+		dir = "."
+	}
+	ts := time.Now().Format("200601021504")
+	for _, file := range []struct {
+		prefix string
+		rows   [][]string
+	}{
+		{"user_organizations_", c.organizations},
+		{"user_identities_", c.identities},
+		{"user_profiles_", c.profiles},
+		{"user_affiliations_", c.affiliations},
+	} {
+		if len(file.rows) < 2 {
+			continue
+		}
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		err = w.WriteAll(file.rows)
+		if err != nil {
+			return
+		}
+		path := joinPath(dir, file.prefix+ts+".csv")
+		err = writeOutput(path, buf.Bytes())
+		if err != nil {
+			return
+		}
+		fmt.Printf("%d rows written to %s\n", len(file.rows)-1, path)
+	}
+	if len(c.unconverted) > 0 {
+		path := joinPath(dir, "sortinghat_unconverted_"+ts+".sh")
+		err = writeOutput(path, []byte(strings.Join(c.unconverted, "\n")+"\n"))
+		if err != nil {
+			return
+		}
+		fmt.Printf("%d commands not converted written to %s\n", len(c.unconverted), path)
+	}
+	fmt.Printf("Converted %d/%d sortinghat commands\n", total-len(c.unconverted), total)
+	return
+}
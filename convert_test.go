@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestShellWords(t *testing.T) {
+	var testCases = []struct {
+		line     string
+		expected []string
+	}{
+		{line: "", expected: nil},
+		{line: "   ", expected: nil},
+		{line: "sortinghat enroll", expected: []string{"sortinghat", "enroll"}},
+		{line: " a \t b  c ", expected: []string{"a", "b", "c"}},
+		{line: "--name 'Jane Doe'", expected: []string{"--name", "Jane Doe"}},
+		{line: `--name "Jane Doe"`, expected: []string{"--name", "Jane Doe"}},
+		{line: `--name=Jane\ Doe`, expected: []string{"--name=Jane Doe"}},
+		{line: `'it'\''s'`, expected: []string{"it's"}},
+		{line: `"say \"hi\""`, expected: []string{`say "hi"`}},
+		{line: `'no \escapes "here"'`, expected: []string{`no \escapes "here"`}},
+		{line: `"back\\slash"`, expected: []string{`back\slash`}},
+		{line: `pre'quoted'post`, expected: []string{"prequotedpost"}},
+		{line: `'' ""`, expected: []string{"", ""}},
+		{line: `--from 2020-01-01 --to ''`, expected: []string{"--from", "2020-01-01", "--to", ""}},
+	}
+	for index, test := range testCases {
+		got, err := shellWords(test.line)
+		if err != nil {
+			t.Errorf("test number %d, splitting %s failed: %v", index+1, test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("test number %d, expected %q, got %q for %s", index+1, test.expected, got, test.line)
+		}
+	}
+}
+
+func TestShellWordsErrors(t *testing.T) {
+	var testCases = []string{
+		"'unterminated",
+		`"unterminated`,
+		`trailing\`,
+		`"escaped quote\"`,
+	}
+	for index, test := range testCases {
+		_, err := shellWords(test)
+		if err == nil {
+			t.Errorf("test number %d, expected an error for %s", index+1, test)
+		}
+	}
+}
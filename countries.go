@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	gCountriesMtx = &sync.Mutex{}
+	gCountries    map[string]string
+	gCountryMiss  map[string]struct{}
+	gAllowedCodes map[string]struct{}
+)
+
+// resetCountries - countries table is loaded again by the next lookup
+// ALLOWED_COUNTRY_CODES - optional comma separated list of ISO codes that can be set
+func resetCountries() {
+	gCountriesMtx.Lock()
+	gCountries = nil
+	gCountryMiss = make(map[string]struct{})
+	gAllowedCodes = nil
+	for _, code := range strings.Split(os.Getenv("ALLOWED_COUNTRY_CODES"), ",") {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if code == "" {
+			continue
+		}
+		if gAllowedCodes == nil {
+			gAllowedCodes = make(map[string]struct{})
+		}
+		gAllowedCodes[code] = struct{}{}
+	}
+	gCountriesMtx.Unlock()
+}
+
+// loadCountries - maps lower case code, alpha3 and name from countries table to the ISO code
+func loadCountries(db *sql.DB) (err error) {
+	var rows *stmtRows
+	rows, err = query(replica(db), "select code, coalesce(alpha3, ''), name from countries")
+	if err != nil {
+		return
+	}
+	countries := make(map[string]string)
+	for rows.Next() {
+		code, alpha3, name := "", "", ""
+		err = rows.Scan(&code, &alpha3, &name)
+		if err != nil {
+			break
+		}
+		for _, key := range []string{code, alpha3, name} {
+			key = strings.ToLower(strings.TrimSpace(key))
+			if key != "" {
+				countries[key] = code
+			}
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	e := rows.Close()
+	if err == nil {
+		err = e
+	}
+	if err == nil {
+		gCountries = countries
+	}
+	return
+}
+
+// countryCode - maps country name, ISO code or alpha3 code to ISO code
+// unmapped or not allowed values are reported once and return empty code
+func countryCode(db *sql.DB, country string) (code string, err error) {
+	gCountriesMtx.Lock()
+	defer gCountriesMtx.Unlock()
+	if gCountries == nil {
+		err = loadCountries(db)
+		if err != nil {
+			return
+		}
+	}
+	key := strings.ToLower(strings.TrimSpace(country))
+	code = gCountries[key]
+	reason, category := "unknown country", cWarnNotFound
+	if code != "" && gAllowedCodes != nil {
+		if _, ok := gAllowedCodes[code]; !ok {
+			reason, category = "country code "+code+" is not allowed", cWarnValidation
+			code = ""
+		}
+	}
+	if code == "" {
+		if _, rep := gCountryMiss[key]; !rep {
+			gCountryMiss[key] = struct{}{}
+			warnf(category, "%s: '%s', country not updated\n", reason, country)
+		}
+	}
+	return
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// cDefaultNameSimilarity - minimal similarity of names suggested as the same person
+	cDefaultNameSimilarity = 0.85
+	// cEmailMatchScore - score of a merge suggested because of the same email
+	cEmailMatchScore = 0.95
+	// cNameCandidatesLimit - identities with a similar name checked per name
+	cNameCandidatesLimit = 200
+)
+
+// mergeSuggestion - uuid likely to be the same person as a uuid referenced in the input files
+type mergeSuggestion struct {
+	from    string
+	into    string
+	score   float64
+	reasons []string
+}
+
+// levenshtein - edit distance of two strings in runes
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// similarity - 1 for equal strings, 0 for completely different ones
+func similarity(a, b string) float64 {
+	n := len([]rune(a))
+	if m := len([]rune(b)); m > n {
+		n = m
+	}
+	if n == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(a, b))/float64(n)
+}
+
+// nameKey - name compared regardless of case, accents, "Last, First" form and word order
+func nameKey(name string) string {
+	return nameWords(strings.ToLower(transliterate(commaName(strings.TrimSpace(name)))))
+}
+
+// referencedUUIDs - uuids of individuals referenced by identities, profiles and affiliations rows
+func referencedUUIDs(db *sql.DB, inputs []csvInput) (uuids []string, err error) {
+	seen := make(map[string]struct{})
+	for _, input := range inputs {
+		if len(input.lines) < 2 {
+			continue
+		}
+		hdr := input.lines[0]
+		for _, line := range input.lines[1:] {
+			row := make(map[string]string)
+			for c, col := range line {
+				if c < len(hdr) {
+					row[hdr[c]] = col
+				}
+			}
+			uuid := strings.TrimSpace(row["uuid"])
+			if id := strings.TrimSpace(row["identity_id"]); uuid == "" && id != "" {
+				_, err = queryFirst(replica(db), []interface{}{&uuid}, "select uuid from identities where id = ?", rekeyedID(id))
+				if err != nil {
+					return
+				}
+			}
+			if _, ok := seen[uuid]; ok || uuid == "" {
+				continue
+			}
+			seen[uuid] = struct{}{}
+			uuids = append(uuids, uuid)
+		}
+	}
+	sort.Strings(uuids)
+	return
+}
+
+// suggestMerges - uuids with an identity of the same email (any source) or a similar name
+func suggestMerges(db *sql.DB, dbg bool, uuid string, minSimilarity float64, names bool) (suggestions map[string]*mergeSuggestion, err error) {
+	suggestions = make(map[string]*mergeSuggestion)
+	add := func(other string, score float64, reason string) {
+		s, ok := suggestions[other]
+		if !ok {
+			s = &mergeSuggestion{from: other, into: uuid}
+			suggestions[other] = s
+		}
+		if score > s.score {
+			s.score = score
+		}
+		for _, r := range s.reasons {
+			if r == reason {
+				return
+			}
+		}
+		s.reasons = append(s.reasons, reason)
+	}
+	var identities []personIdentity
+	identities, err = personIdentities(replica(db), uuid)
+	if err != nil {
+		return
+	}
+	emails, keys := make(map[string]struct{}), make(map[string]string)
+	for _, identity := range identities {
+		if email := strings.ToLower(identity.email); strings.Contains(email, "@") && !strings.Contains(email, "noreply") {
+			emails[email] = struct{}{}
+		}
+		if key := nameKey(identity.name); strings.Contains(key, " ") {
+			keys[key] = identity.name
+		}
+	}
+	for email := range emails {
+		var rows *stmtRows
+		rows, err = query(replica(db), "select distinct uuid, trim(source) from identities where lower(email) = ? and uuid <> ?", email, uuid)
+		if err != nil {
+			return
+		}
+		for rows.Next() {
+			var other, source string
+			err = rows.Scan(&other, &source)
+			if err != nil {
+				_ = rows.Close()
+				return
+			}
+			add(other, cEmailMatchScore, fmt.Sprintf("same email %s (%s)", email, source))
+		}
+		err = rows.Err()
+		e := rows.Close()
+		if err == nil {
+			err = e
+		}
+		if err != nil {
+			return
+		}
+	}
+	if !names {
+		return
+	}
+	for key, name := range keys {
+		// candidates share the longest word of the name
+		longest := ""
+		for _, word := range strings.Fields(strings.ToLower(name)) {
+			if len([]rune(word)) > len([]rune(longest)) {
+				longest = word
+			}
+		}
+		if len([]rune(longest)) < 3 {
+			continue
+		}
+		var rows *stmtRows
+		rows, err = query(
+			replica(db),
+			"select uuid, trim(name) from identities where lower(name) like ? and uuid <> ? limit "+strconv.Itoa(cNameCandidatesLimit),
+			"%"+strings.Replace(strings.Replace(longest, "%", "\\%", -1), "_", "\\_", -1)+"%", uuid,
+		)
+		if err != nil {
+			return
+		}
+		for rows.Next() {
+			var other, otherName string
+			err = rows.Scan(&other, &otherName)
+			if err != nil {
+				_ = rows.Close()
+				return
+			}
+			score := similarity(key, nameKey(otherName))
+			if dbg {
+				fmt.Printf("uuid %s name %q vs %s %q: %.2f\n", uuid, name, other, otherName, score)
+			}
+			if score >= minSimilarity {
+				add(other, score*0.9, fmt.Sprintf("similar name %q ~ %q", name, otherName))
+			}
+		}
+		err = rows.Err()
+		e := rows.Close()
+		if err == nil {
+			err = e
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// personSummary - distinct names and emails of the uuid's identities
+func personSummary(db *sql.DB, uuid string) (names, emails string, err error) {
+	var identities []personIdentity
+	identities, err = personIdentities(replica(db), uuid)
+	if err != nil {
+		return
+	}
+	nameSet, emailSet := make(map[string]struct{}), make(map[string]struct{})
+	for _, identity := range identities {
+		if identity.name != "" {
+			nameSet[identity.name] = struct{}{}
+		}
+		if identity.email != "" {
+			emailSet[identity.email] = struct{}{}
+		}
+	}
+	join := func(set map[string]struct{}) string {
+		values := []string{}
+		for v := range set {
+			values = append(values, v)
+		}
+		sort.Strings(values)
+		return strings.Join(values, "; ")
+	}
+	names, emails = join(nameSet), join(emailSet)
+	return
+}
+
+// analyzeDuplicates - "analyze" subcommand, read only: finds likely duplicates of individuals referenced by the
+// input files (same email in any source, similar names) and writes user_identities_suggested_merges_<timestamp>.csv
+// for human review, rows changed from action "suggest" to "merge" are then imported as merges
+// ANALYZE_DIR - output directory, s3:// prefix or http(s):// URL (default current directory)
+// ANALYZE_NAME_SIMILARITY - minimal similarity of names, 0-1 (default 0.85), ANALYZE_NO_NAMES - only compare emails
+func analyzeDuplicates(db *sql.DB, dbg bool, args []string) (err error) {
+	if len(args) == 0 {
+		err = fmt.Errorf("analyze requires input files, patterns or a directory")
+		return
+	}
+	if info, e := os.Stat(args[0]); len(args) == 1 && e == nil && info.IsDir() {
+		args = []string{args[0] + "/user_*.csv"}
+	}
+	minSimilarity := cDefaultNameSimilarity
+	if s := os.Getenv("ANALYZE_NAME_SIMILARITY"); s != "" {
+		minSimilarity, err = strconv.ParseFloat(s, 64)
+		if err != nil || minSimilarity < 0 || minSimilarity > 1 {
+			err = fmt.Errorf("invalid ANALYZE_NAME_SIMILARITY=%s, expected 0-1", s)
+			return
+		}
+	}
+	var files inputFiles
+	files, err = classifyInputFiles(args)
+	if err != nil {
+		return
+	}
+	var inputs []csvInput
+	inputs, err = readCSVFiles(append(append(append([]string{}, files.identities...), files.profiles...), files.affiliations...), dbg)
+	if err != nil {
+		return
+	}
+	var uuids []string
+	uuids, err = referencedUUIDs(db, inputs)
+	if err != nil {
+		return
+	}
+	fmt.Printf("Analyzing %d individuals referenced by %d files\n", len(uuids), len(inputs))
+	all := []*mergeSuggestion{}
+	seen := make(map[string]struct{})
+	for _, uuid := range uuids {
+		var suggestions map[string]*mergeSuggestion
+		suggestions, err = suggestMerges(db, dbg, uuid, minSimilarity, os.Getenv("ANALYZE_NO_NAMES") == "")
+		if err != nil {
+			err = fmt.Errorf("uuid %s: %v", uuid, err)
+			return
+		}
+		for _, s := range suggestions {
+			// both referenced: suggest the pair once
+			pair := s.from + "," + s.into
+			if s.from > s.into {
+				pair = s.into + "," + s.from
+			}
+			if _, ok := seen[pair]; ok {
+				continue
+			}
+			seen[pair] = struct{}{}
+			sort.Strings(s.reasons)
+			all = append(all, s)
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].score != all[j].score {
+			return all[i].score > all[j].score
+		}
+		return all[i].from+all[i].into < all[j].from+all[j].into
+	})
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write([]string{"action", "uuid", "merge_into_uuid", "score", "reason", "names", "emails", "merge_into_names", "merge_into_emails", "user_name", "user_email", "user_sfid"})
+	for _, s := range all {
+		var fromNames, fromEmails, intoNames, intoEmails string
+		fromNames, fromEmails, err = personSummary(db, s.from)
+		if err == nil {
+			intoNames, intoEmails, err = personSummary(db, s.into)
+		}
+		if err != nil {
+			return
+		}
+		_ = w.Write([]string{"suggest", s.from, s.into, strconv.FormatFloat(s.score, 'f', 2, 64), strings.Join(s.reasons, "; "), fromNames, fromEmails, intoNames, intoEmails, "", "", ""})
+	}
+	w.Flush()
+	err = w.Error()
+	if err != nil {
+		return
+	}
+	dir := os.Getenv("ANALYZE_DIR")
+	if dir == "" {
+		dir = "."
+	}
+	path := joinPath(dir, "user_identities_suggested_merges_"+time.Now().Format("200601021504")+".csv")
+	err = writeOutput(path, buf.Bytes())
+	if err == nil {
+		fmt.Printf("%d suggested merges written to %s, set action to \"merge\" in approved rows and import the file\n", len(all), path)
+	}
+	return
+}
+
+// mergeUUID - identities row with action "merge" moves all identities and enrollments of uuid to merge_into_uuid,
+// then removes uuid's profile and unique identity (as SortingHat merge), duplicate enrollments are removed,
+// rows with action "suggest" (not reviewed suggestions) are skipped
+func mergeUUID(db *sql.DB, dbg, dry bool, row map[string]string) (err error) {
+	from, into := strings.TrimSpace(row["uuid"]), strings.TrimSpace(row["merge_into_uuid"])
+	if from == "" || into == "" {
+		err = fmt.Errorf("merge requires uuid and merge_into_uuid in %v", row)
+		return
+	}
+	if from == into {
+		err = skippedf("uuid %s cannot be merged into itself (row %v)", from, row)
+		return
+	}
+	for _, uuid := range []string{from, into} {
+		if reason := protectedIdentity("", uuid); reason != "" {
+			err = protectedf(reason, row)
+			return
+		}
+	}
+	var found bool
+	found, err = queryFirst(db, []interface{}{new(string)}, "select uuid from uidentities where uuid = ?", into)
+	if err != nil {
+		err = fmt.Errorf("uuid %s lookup: %v in %v", into, err, row)
+		return
+	}
+	if !found {
+		err = notFoundf("cannot find unique identity %s to merge into (row %v)", into, row)
+		return
+	}
+	found, err = queryFirst(db, []interface{}{new(string)}, "select uuid from uidentities where uuid = ?", from)
+	if err != nil {
+		err = fmt.Errorf("uuid %s lookup: %v in %v", from, err, row)
+		return
+	}
+	if !found {
+		err = skippedf("unique identity %s doesn't exist, already merged? (row %v)", from, row)
+		return
+	}
+	who := "email:" + strings.TrimSpace(row["user_email"]) + ",sfid:" + strings.TrimSpace(row["user_sfid"])
+	msg := fmt.Sprintf("merge uuid %s into %s by %s", from, into, who)
+	if dry {
+		fmt.Printf("%s\n", msg)
+		addChange(msg)
+		recordPlanned(from)
+		recordPlanned(into)
+		return
+	}
+	var tx *sql.Tx
+	var cancelTx context.CancelFunc
+	tx, cancelTx, err = beginTx(db)
+	if err != nil {
+		err = fmt.Errorf("error starting transaction %v for row %v", err, row)
+		return
+	}
+	defer cancelTx()
+	defer func() {
+		if tx != nil {
+			fmt.Printf("rollback %s\n", msg)
+			_ = tx.Rollback()
+		}
+	}()
+	shadow := newShadow(tx, into)
+	err = shadow.capture("uidentities", "uuid", from)
+	if err == nil {
+		err = shadow.capture("profiles", "uuid", from)
+	}
+	if err == nil {
+		err = shadow.capture("profiles", "uuid", into)
+	}
+	if err != nil {
+		err = fmt.Errorf("error capturing shadow state %v for row %v", err, row)
+		return
+	}
+	var res sql.Result
+	res, err = exec(tx, "", "update identities set uuid = ?, "+auditSet("identities")+" where uuid = ?", append(append([]interface{}{into}, auditArgs("identities", who)...), from)...)
+	if err != nil {
+		err = fmt.Errorf("error moving identities %v for row %v", err, row)
+		return
+	}
+	movedI, _ := res.RowsAffected()
+	// enrollments the target already has stay behind and are removed
+	res, err = exec(tx, "", "update ignore enrollments set uuid = ?, "+auditSet("enrollments")+" where uuid = ?", append(append([]interface{}{into}, auditArgs("enrollments", who)...), from)...)
+	if err != nil {
+		err = fmt.Errorf("error moving enrollments %v for row %v", err, row)
+		return
+	}
+	movedE, _ := res.RowsAffected()
+	var rows *sql.Rows
+	ctx, cancel := stmtContext()
+	defer cancel()
+	rows, err = tx.QueryContext(ctx, adaptQuery("select id from enrollments where uuid = ?"), from)
+	if err != nil {
+		err = fmt.Errorf("error reading duplicate enrollments %v for row %v", err, row)
+		return
+	}
+	duplicates := []int{}
+	for rows.Next() {
+		var eid int
+		err = rows.Scan(&eid)
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		duplicates = append(duplicates, eid)
+	}
+	err = rows.Err()
+	e := rows.Close()
+	if err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+	for _, eid := range duplicates {
+		var before *enrollmentState
+		before, err = getEnrollmentState(db, eid)
+		if err == nil {
+			_, err = exec(tx, "", "delete from enrollments where id = ?", eid)
+		}
+		if err == nil {
+			err = auditEnrollmentDeletion(tx, eid, before, who)
+		}
+		if err != nil {
+			err = fmt.Errorf("error removing duplicate enrollment %d %v for row %v", eid, err, row)
+			return
+		}
+	}
+	for _, q := range []string{"delete from profiles where uuid = ?", "delete from uidentities where uuid = ?"} {
+		_, err = exec(tx, "", q, from)
+		if err != nil {
+			err = fmt.Errorf("error removing merged uuid %v for (%s) for row %v", err, q, row)
+			return
+		}
+	}
+	for _, table := range []string{"uidentities", "profiles"} {
+		_, err = exec(tx, "", "update "+table+" set "+auditSet(table)+" where uuid = ?", append(auditArgs(table, who), into)...)
+		if err != nil {
+			err = fmt.Errorf("error updating %s %v for row %v", table, err, row)
+			return
+		}
+	}
+	err = shadow.commit(tx, msg)
+	if err != nil {
+		err = fmt.Errorf("error committing transaction %v for row %v", err, row)
+		return
+	}
+	tx = nil
+	fmt.Printf("%s: %d identities, %d enrollments moved, %d duplicate enrollments removed\n", msg, movedI, movedE, len(duplicates))
+	addChange(msg)
+	recordAffected(into, "")
+	recordAffected(from, "")
+	recordMerge(into)
+	if gMtx != nil {
+		gMtx.Lock()
+	}
+	gUpdatedUIdentities[into] = struct{}{}
+	gUpdatedProfiles[into] = struct{}{}
+	if gMtx != nil {
+		gMtx.Unlock()
+	}
+	return
+}
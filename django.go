@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	// gDjango - target database uses the Django-managed schema of SortingHat 0.8+ (SCHEMA=django)
+	gDjango bool
+	// gDjangoTables - legacy table name -> Django schema table name
+	gDjangoTables = map[string]string{"uidentities": "individuals"}
+	// gDjangoColumns - legacy table name -> legacy column name -> Django schema column name
+	// identities are keyed by uuid and belong to individuals (mk), organizations are groups
+	gDjangoColumns = map[string]map[string]string{
+		"identities":  {"id": "uuid", "uuid": "individual_id"},
+		"uidentities": {"uuid": "mk"},
+		"profiles":    {"uuid": "individual_id", "country_code": "country_id"},
+		"enrollments": {"uuid": "individual_id", "organization_id": "group_id"},
+	}
+	// gSQLLiteralRE - string literals, left unchanged
+	gSQLLiteralRE = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'`)
+	// gSQLTableRE - table (with optional alias) after from, update, into, join or a comma
+	gSQLTableRE = regexp.MustCompile(`(?i)(?:\b(?:from|update|into|join)|,)\s+(\w+)(?:\s+(?:as\s+)?(\w+))?`)
+	// gSQLIdentRE - optionally qualified identifier
+	gSQLIdentRE = regexp.MustCompile(`\b(?:(\w+)\.)?([A-Za-z_]\w*)\b`)
+	// gSQLKeywords - words that can follow a table name and are not its alias
+	gSQLKeywords = map[string]struct{}{
+		"set": {}, "where": {}, "values": {}, "order": {}, "group": {}, "limit": {}, "for": {}, "on": {},
+		"join": {}, "left": {}, "inner": {}, "select": {}, "having": {}, "union": {},
+	}
+)
+
+// setSchema - SCHEMA: "legacy" (default) - SortingHat up to 0.7 (uidentities, uuid), "django" - SortingHat 0.8+
+func setSchema() (err error) {
+	switch os.Getenv("SCHEMA") {
+	case "", "legacy":
+		gDjango = false
+	case "django":
+		gDjango = true
+	default:
+		err = fmt.Errorf("invalid SCHEMA=%s, allowed: legacy, django", os.Getenv("SCHEMA"))
+	}
+	return
+}
+
+// schemaTable - name of the legacy table in the target schema
+func schemaTable(table string) string {
+	if gDjango {
+		if t, ok := gDjangoTables[table]; ok {
+			return t
+		}
+	}
+	return table
+}
+
+// schemaColumn - name of the legacy table's column in the target schema
+func schemaColumn(table, column string) string {
+	if gDjango {
+		if c, ok := gDjangoColumns[table][column]; ok {
+			return c
+		}
+	}
+	return column
+}
+
+// adaptQuery - rewrites statement written for the legacy schema to the target schema
+// unqualified columns belong to the first table of the statement, qualified ones to the table of their alias
+func adaptQuery(q string) string {
+	if !gDjango {
+		return q
+	}
+	primary := ""
+	aliases := make(map[string]string)
+	for _, m := range gSQLTableRE.FindAllStringSubmatch(gSQLLiteralRE.ReplaceAllString(q, "''"), -1) {
+		table := strings.ToLower(m[1])
+		if _, ok := gDjangoColumns[table]; !ok {
+			if _, ok := gDjangoTables[table]; !ok {
+				continue
+			}
+		}
+		if primary == "" {
+			primary = table
+		}
+		aliases[table] = table
+		if alias := strings.ToLower(m[2]); alias != "" {
+			if _, keyword := gSQLKeywords[alias]; !keyword {
+				aliases[alias] = table
+			}
+		}
+	}
+	if primary == "" {
+		return q
+	}
+	adapt := func(s string) string {
+		return gSQLIdentRE.ReplaceAllStringFunc(s, func(ident string) string {
+			m := gSQLIdentRE.FindStringSubmatch(ident)
+			if m[1] != "" {
+				table, ok := aliases[strings.ToLower(m[1])]
+				if !ok {
+					return ident
+				}
+				qualifier := m[1]
+				if qualifier == table {
+					qualifier = schemaTable(table)
+				}
+				return qualifier + "." + schemaColumn(table, m[2])
+			}
+			if t, ok := gDjangoTables[strings.ToLower(m[2])]; ok {
+				return t
+			}
+			return schemaColumn(primary, m[2])
+		})
+	}
+	out := ""
+	last := 0
+	for _, loc := range gSQLLiteralRE.FindAllStringIndex(q, -1) {
+		out += adapt(q[last:loc[0]]) + q[loc[0]:loc[1]]
+		last = loc[1]
+	}
+	return out + adapt(q[last:])
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	// cFailoverNet - DSN network of a comma separated host list: user:pass@failover(h1:3306,h2:3306)/db
+	cFailoverNet = "failover"
+	// cDefaultFailoverTimeout - connect timeout per host of the list
+	cDefaultFailoverTimeout = 5 * time.Second
+	// cFailoverBackoff - a host that failed is tried after the other hosts for this long
+	cFailoverBackoff = 30 * time.Second
+)
+
+var (
+	// gFailoverDown - host:port -> time of its last failed connect
+	gFailoverDown = make(map[string]time.Time)
+	// gFailoverMtx - guards gFailoverDown
+	gFailoverMtx sync.Mutex
+)
+
+// hostAddr - host:port of a host given as name, IPv4, IPv6 (bracketed or not) with optional port,
+// bracket IPv6 addresses to give their port: [::1]:3307
+func hostAddr(host, port string) string {
+	host = strings.TrimSpace(host)
+	if h, p, err := net.SplitHostPort(host); err == nil && p != "" {
+		return net.JoinHostPort(h, p)
+	}
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), port)
+}
+
+// connectAddr - DSN network and address of the prefix's PROTO, HOST, SOCKET and PORT: SOCKET or a HOST starting with
+// "/" is a unix socket path, a comma separated HOST list is tried in order (network "failover")
+func connectAddr(prefix string) (proto, addr string) {
+	proto = os.Getenv(prefix + "PROTO")
+	socket := os.Getenv(prefix + "SOCKET")
+	host := os.Getenv(prefix + "HOST")
+	if socket == "" && (proto == "unix" || strings.HasPrefix(host, "/")) {
+		socket = host
+	}
+	if socket != "" {
+		proto, addr = "unix", socket
+		return
+	}
+	if proto == "" {
+		proto = "tcp"
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	port := os.Getenv(prefix + "PORT")
+	if port == "" {
+		port = "3306"
+	}
+	hosts := []string{}
+	for _, h := range strings.Split(host, ",") {
+		if strings.TrimSpace(h) != "" {
+			hosts = append(hosts, hostAddr(h, port))
+		}
+	}
+	if len(hosts) > 1 {
+		proto = cFailoverNet
+	}
+	addr = strings.Join(hosts, ",")
+	return
+}
+
+// registerFailover - registers the "failover" DSN network, also usable in SH_DSN, SH_DSN_2, SH_RO_DSN:
+// every new connection tries hosts in order, hosts that failed within cFailoverBackoff are tried last,
+// SH_FAILOVER_TIMEOUT (default 5s) is the connect timeout per host
+func registerFailover() (err error) {
+	timeout := cDefaultFailoverTimeout
+	if s := os.Getenv("SH_FAILOVER_TIMEOUT"); s != "" {
+		timeout, err = time.ParseDuration(s)
+		if err != nil || timeout <= 0 {
+			err = fmt.Errorf("invalid SH_FAILOVER_TIMEOUT=%s, expected a positive duration like 5s", s)
+			return
+		}
+	}
+	mysql.RegisterDialContext(cFailoverNet, func(ctx context.Context, addr string) (net.Conn, error) {
+		return dialFailover(ctx, timeout, addr)
+	})
+	return
+}
+
+// dialFailover - connects to the first reachable host of the comma separated list (through its SSH tunnel with SH_SSH_HOST)
+func dialFailover(ctx context.Context, timeout time.Duration, addrs string) (conn net.Conn, err error) {
+	now := time.Now()
+	up, down := []string{}, []string{}
+	gFailoverMtx.Lock()
+	for _, addr := range strings.Split(addrs, ",") {
+		if dt, ok := gFailoverDown[addr]; ok && now.Sub(dt) < cFailoverBackoff {
+			down = append(down, addr)
+			continue
+		}
+		up = append(up, addr)
+	}
+	gFailoverMtx.Unlock()
+	errs := []string{}
+	for i, addr := range append(up, down...) {
+		if gSSHHost != "" {
+			conn, err = dialTunnel(ctx, timeout, addr)
+		} else {
+			d := net.Dialer{Timeout: timeout}
+			conn, err = d.DialContext(ctx, "tcp", addr)
+		}
+		gFailoverMtx.Lock()
+		if err != nil {
+			gFailoverDown[addr] = time.Now()
+		} else {
+			delete(gFailoverDown, addr)
+		}
+		gFailoverMtx.Unlock()
+		if err == nil {
+			if i > 0 {
+				fmt.Printf("WARNING: connected to %s after failing over (%s)\n", addr, strings.Join(errs, "; "))
+			}
+			return
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", addr, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	err = fmt.Errorf("no reachable host: %s", strings.Join(errs, "; "))
+	return
+}
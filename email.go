@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	cDefaultEmailSubject = "Individual dashboard {{.Mode}} {{.Status}}: {{.IdentitiesFile}}, {{.AffiliationsFile}}"
+	cDefaultEmailBody    = `Individual dashboard {{.Mode}} {{.Status}}.
+
+Files: {{.IdentitiesFile}}, {{.AffiliationsFile}}
+Started: {{.Start.Format "2006-01-02 15:04:05 MST"}}, took {{.Duration}}
+Rows: {{.IdentityRows}} identities, {{.EnrollmentRows}} enrollments
+Updated: {{.UpdatedIdentities}} identities, {{.UpdatedEnrollments}} enrollments, {{.UpdatedUIdentities}} uidentities, {{.UpdatedProfiles}} profiles
+Changes: {{.ChangesCount}}, warnings: {{.Warnings}}, collisions: {{.Collisions}}, failed rows: {{.FailedRows}}
+{{if .Error}}
+Error: {{.Error}}
+{{end}}
+Full lists of changes and warnings are attached.
+`
+)
+
+// renderTemplate - executes text template with the run summary
+func renderTemplate(name, tmpl string, summary *importSummary) (string, error) {
+	t, err := template.New(name).Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = t.Execute(&buf, summary)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// buildEmail - builds multipart MIME message with the report and attachments
+func buildEmail(from string, to []string, subject, body string, attachments map[string][]string) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	hdr := fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%s\r\n\r\n",
+		from, strings.Join(to, ", "), subject, time.Now().Format(time.RFC1123Z), mw.Boundary(),
+	)
+	buf.WriteString(hdr)
+	pw, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return nil, err
+	}
+	_, err = pw.Write([]byte(body))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"changes.txt", "warnings.txt"} {
+		lines := attachments[name]
+		if len(lines) == 0 {
+			continue
+		}
+		pw, err = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"text/plain; charset=utf-8"},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {fmt.Sprintf("attachment; filename=\"%s\"", name)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString([]byte(strings.Join(lines, "\n") + "\n"))
+		for len(encoded) > 76 {
+			_, _ = pw.Write([]byte(encoded[:76] + "\r\n"))
+			encoded = encoded[76:]
+		}
+		_, err = pw.Write([]byte(encoded + "\r\n"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = mw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// emailRun - emails run summary with changes and warnings attached
+// SMTP_HOST - SMTP server, email is only sent when set
+// SMTP_PORT - SMTP port, default 587
+// SMTP_USER, SMTP_PASS - optional PLAIN auth credentials
+// SMTP_FROM - sender address, default SMTP_USER
+// SMTP_TO - comma separated list of recipients
+// SMTP_SUBJECT - subject template, default cDefaultEmailSubject
+// SMTP_TEMPLATE - file with body template, default cDefaultEmailBody
+// Templates are Go text/template executed with importSummary
+func emailRun(dbg bool, summary *importSummary) (err error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	user := os.Getenv("SMTP_USER")
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = user
+	}
+	to := []string{}
+	for _, addr := range strings.Split(os.Getenv("SMTP_TO"), ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			to = append(to, addr)
+		}
+	}
+	if from == "" || len(to) == 0 {
+		err = fmt.Errorf("SMTP_FROM (or SMTP_USER) and SMTP_TO must be set when SMTP_HOST is set")
+		return
+	}
+	subjectTmpl := os.Getenv("SMTP_SUBJECT")
+	if subjectTmpl == "" {
+		subjectTmpl = cDefaultEmailSubject
+	}
+	bodyTmpl := cDefaultEmailBody
+	if os.Getenv("SMTP_TEMPLATE") != "" {
+		var data []byte
+		data, err = ioutil.ReadFile(os.Getenv("SMTP_TEMPLATE"))
+		if err != nil {
+			return
+		}
+		bodyTmpl = string(data)
+	}
+	var subject, body string
+	subject, err = renderTemplate("subject", subjectTmpl, summary)
+	if err != nil {
+		return
+	}
+	body, err = renderTemplate("body", bodyTmpl, summary)
+	if err != nil {
+		return
+	}
+	var changes, warnings []string
+	changes, err = summary.allChanges()
+	if err != nil {
+		return
+	}
+	warnings, err = summary.allWarnings()
+	if err != nil {
+		return
+	}
+	var msg []byte
+	msg, err = buildEmail(from, to, strings.TrimSpace(subject), body, map[string][]string{"changes.txt": changes, "warnings.txt": warnings})
+	if err != nil {
+		return
+	}
+	var auth smtp.Auth
+	if user != "" {
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASS"), host)
+	}
+	err = smtp.SendMail(host+":"+port, auth, from, to, msg)
+	if err == nil && dbg {
+		fmt.Printf("summary emailed to %v\n", to)
+	}
+	return
+}
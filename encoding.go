@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+var (
+	gCharsetRE   = regexp.MustCompile(`[?&]charset=([^&,]+)`)
+	gConnCharset = "utf8"
+	// gDecoders - supported non UTF-8 input encodings, UTF-16 ones use BOM when present
+	// Windows-1252 bytes without a character (0x81, 0x8D, 0x8F, 0x90, 0x9D) decode to U+FFFD
+	gDecoders = map[string]encoding.Encoding{
+		"utf-16":       unicode.UTF16(unicode.LittleEndian, unicode.UseBOM),
+		"utf-16le":     unicode.UTF16(unicode.LittleEndian, unicode.UseBOM),
+		"utf-16be":     unicode.UTF16(unicode.BigEndian, unicode.UseBOM),
+		"windows-1252": charmap.Windows1252,
+		"cp1252":       charmap.Windows1252,
+		"latin1":       charmap.Windows1252,
+		"iso-8859-1":   charmap.ISO8859_1,
+	}
+)
+
+// detectEncoding - detects encoding using BOM, UTF-8 validity and NUL bytes distribution
+func detectEncoding(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return "utf-8"
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return "utf-16le"
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return "utf-16be"
+	}
+	// UTF-16 without BOM: ASCII heavy CSV has every other byte NUL
+	n := len(data)
+	if n > 4096 {
+		n = 4096
+	}
+	even, odd := 0, 0
+	for i := 0; i < n; i++ {
+		if data[i] == 0 {
+			if i%2 == 0 {
+				even++
+			} else {
+				odd++
+			}
+		}
+	}
+	if odd > n/4 && even == 0 {
+		return "utf-16le"
+	}
+	if even > n/4 && odd == 0 {
+		return "utf-16be"
+	}
+	if utf8.Valid(data) {
+		return "utf-8"
+	}
+	return "windows-1252"
+}
+
+// decodeToUTF8 - transcodes data in a given encoding to UTF-8
+func decodeToUTF8(data []byte, enc string) (string, error) {
+	if enc == "utf-8" || enc == "utf8" {
+		data = bytes.TrimPrefix(data, []byte{0xEF, 0xBB, 0xBF})
+		if !utf8.Valid(data) {
+			return "", fmt.Errorf("data is not valid UTF-8, set ENCODING=windows-1252 (or other) to transcode it")
+		}
+		return string(data), nil
+	}
+	decoder, ok := gDecoders[enc]
+	if !ok {
+		return "", fmt.Errorf("unsupported encoding '%s', supported: auto, utf-8, utf-16, utf-16le, utf-16be, windows-1252, iso-8859-1", enc)
+	}
+	if strings.HasPrefix(enc, "utf-16") && len(data)%2 != 0 {
+		return "", fmt.Errorf("odd number of bytes in UTF-16 data")
+	}
+	decoded, err := decoder.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+// rawRecord - original text of a CSV record (can span multiple physical lines) and its first line number
+type rawRecord struct {
+	line int
+	text string
+}
+
+// rawRecords - splits CSV text into records exactly as encoding/csv does (newlines in quoted values don't end
+// the record, empty lines are skipped), text must be a valid CSV
+func rawRecords(text string) (records []rawRecord) {
+	quoted := false
+	start, startLine, line := 0, 1, 1
+	add := func(end int) {
+		record := strings.TrimSuffix(text[start:end], "\r")
+		if record != "" {
+			records = append(records, rawRecord{line: startLine, text: record})
+		}
+	}
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '"':
+			quoted = !quoted
+		case '\n':
+			line++
+			if quoted {
+				continue
+			}
+			add(i)
+			start, startLine = i+1, line
+		}
+	}
+	add(len(text))
+	return
+}
+
+// readCSV - reads whole CSV transcoding it to UTF-8
+// ENCODING - input encoding: auto (default), utf-8, utf-16, utf-16le, utf-16be, windows-1252 (latin1), iso-8859-1
+func readCSV(r io.Reader, name, encoding string, dbg bool) (lines [][]string, err error) {
+	lines, _, err = readCSVRaw(r, name, encoding, dbg)
+	return
+}
+
+// readCSVRaw - like readCSV, also returns the raw text of each record (nil when it cannot be matched to parsed lines)
+func readCSVRaw(r io.Reader, name, encoding string, dbg bool) (lines [][]string, raw []rawRecord, err error) {
+	var data []byte
+	data, err = ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	if encoding == "" || encoding == "auto" {
+		encoding = detectEncoding(data)
+		if dbg || encoding != "utf-8" {
+			fmt.Printf("%s: detected %s encoding\n", name, encoding)
+		}
+	}
+	var text string
+	text, err = decodeToUTF8(data, encoding)
+	if err != nil {
+		err = fmt.Errorf("%s: %v", name, err)
+		return
+	}
+	lines, err = csv.NewReader(strings.NewReader(text)).ReadAll()
+	if err != nil {
+		return
+	}
+	raw = rawRecords(text)
+	if len(raw) != len(lines) {
+		if dbg {
+			fmt.Printf("%s: cannot match %d raw records with %d parsed lines\n", name, len(raw), len(lines))
+		}
+		raw = nil
+	}
+	return
+}
+
+// dsnCharset - returns the first connection charset from DSN params, MySQL driver defaults to utf8
+func dsnCharset(dsn string) string {
+	m := gCharsetRE.FindStringSubmatch(dsn)
+	if m == nil {
+		return "utf8"
+	}
+	return strings.ToLower(m[1])
+}
+
+// validateCharset - checks that the value survives the connection charset
+// utf8 (utf8mb3) cannot store characters outside of BMP (like emoji), latin1 can only store Windows-1252 characters
+func validateCharset(field, value string) error {
+	for _, r := range value {
+		ok := true
+		switch gConnCharset {
+		case "utf8", "utf8mb3":
+			ok = r <= 0xFFFF
+		case "latin1":
+			_, ok = charmap.Windows1252.EncodeRune(r)
+		}
+		if !ok {
+			return fmt.Errorf("%s '%s' contains character %U that cannot be stored using %s connection charset", field, value, r, gConnCharset)
+		}
+	}
+	return nil
+}
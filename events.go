@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// cEventsDefaultBatch - change events published together
+	cEventsDefaultBatch = 100
+	// cNATSDefaultPort - NATS client port
+	cNATSDefaultPort = "4222"
+)
+
+var (
+	// gEvents - change events publisher, nil when not configured or in dry and shadow runs
+	gEvents *eventsPublisher
+)
+
+// changeEvent - single committed row change published to the changelog topic
+type changeEvent struct {
+	Type     string            `json:"type"`
+	UUID     string            `json:"uuid"`
+	Table    string            `json:"table"`
+	Key      string            `json:"key"`
+	Action   string            `json:"action"`
+	Before   map[string]string `json:"before,omitempty"`
+	After    map[string]string `json:"after,omitempty"`
+	Change   string            `json:"change"`
+	RunID    string            `json:"run_id,omitempty"`
+	Database string            `json:"database,omitempty"`
+	Time     time.Time         `json:"time"`
+}
+
+// eventsSink - destination of change events
+type eventsSink interface {
+	publish([]changeEvent) error
+	String() string
+}
+
+// eventsPublisher - buffers change events and publishes them in batches
+type eventsPublisher struct {
+	sink   eventsSink
+	batch  int
+	mtx    sync.Mutex
+	events []changeEvent
+	sent   int
+}
+
+// kafkaSink - Kafka topic written via Kafka REST Proxy (v2 API), uuid is the record key
+type kafkaSink struct {
+	url   string
+	topic string
+}
+
+// natsSink - NATS subject, each batch is published on a new connection and confirmed with PING/PONG
+type natsSink struct {
+	addr    string
+	user    string
+	pass    string
+	subject string
+}
+
+// setEvents - EVENTS_KAFKA_REST_URL + EVENTS_TOPIC (Kafka REST Proxy) or EVENTS_NATS_URL + EVENTS_SUBJECT
+// publish an event for every committed row change with its before/after values
+// EVENTS_BATCH (default 100) events are published together, remaining ones when the run ends
+// no events are published in dry and shadow runs
+func setEvents(dry bool) (err error) {
+	gEvents = nil
+	kafkaURL, natsURL := os.Getenv("EVENTS_KAFKA_REST_URL"), os.Getenv("EVENTS_NATS_URL")
+	if kafkaURL == "" && natsURL == "" {
+		return
+	}
+	var sink eventsSink
+	switch {
+	case kafkaURL != "" && natsURL != "":
+		err = fmt.Errorf("EVENTS_KAFKA_REST_URL and EVENTS_NATS_URL cannot be used together")
+	case kafkaURL != "":
+		topic := os.Getenv("EVENTS_TOPIC")
+		if topic == "" {
+			err = fmt.Errorf("EVENTS_KAFKA_REST_URL requires EVENTS_TOPIC")
+			break
+		}
+		sink = &kafkaSink{url: strings.TrimSuffix(kafkaURL, "/"), topic: topic}
+	default:
+		subject := os.Getenv("EVENTS_SUBJECT")
+		if subject == "" {
+			err = fmt.Errorf("EVENTS_NATS_URL requires EVENTS_SUBJECT")
+			break
+		}
+		sink, err = newNATSSink(natsURL, subject)
+	}
+	if err != nil {
+		return
+	}
+	batch := cEventsDefaultBatch
+	if s := os.Getenv("EVENTS_BATCH"); s != "" {
+		batch, err = strconv.Atoi(s)
+		if err != nil || batch < 1 {
+			err = fmt.Errorf("invalid EVENTS_BATCH=%s", s)
+			return
+		}
+	}
+	if dry || gShadow {
+		fmt.Printf("Change events to %s are not published in dry and shadow runs\n", sink)
+		return
+	}
+	gEvents = &eventsPublisher{sink: sink, batch: batch}
+	fmt.Printf("Publishing change events to %s\n", sink)
+	return
+}
+
+// eventType - identity.updated, enrollment.added, profile.deleted, ...
+func eventType(table, action string) string {
+	name := strings.TrimSuffix(table, "s")
+	if strings.HasSuffix(table, "ies") {
+		name = strings.TrimSuffix(table, "ies") + "y"
+	}
+	switch action {
+	case "insert":
+		return name + ".added"
+	case "delete":
+		return name + ".deleted"
+	}
+	return name + ".updated"
+}
+
+// publishChanges - queues events of a committed transaction of uuid, publishes a full batch
+func publishChanges(uuid, msg string, diffs []shadowDiff) {
+	p := gEvents
+	if p == nil || len(diffs) == 0 {
+		return
+	}
+	var runID, database string
+	gSummaryMtx.Lock()
+	if gSummary != nil {
+		runID, database = gSummary.RunID, gSummary.Database
+	}
+	gSummaryMtx.Unlock()
+	now := time.Now().UTC()
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, diff := range diffs {
+		p.events = append(p.events, changeEvent{
+			Type:     eventType(diff.Table, diff.Action),
+			UUID:     uuid,
+			Table:    diff.Table,
+			Key:      diff.Key,
+			Action:   diff.Action,
+			Before:   diff.Before,
+			After:    diff.After,
+			Change:   strings.TrimSpace(msg),
+			RunID:    runID,
+			Database: database,
+			Time:     now,
+		})
+	}
+	if len(p.events) >= p.batch {
+		p.flush()
+	}
+}
+
+// flush - publishes queued events, failures are warnings because the changes are already committed
+// must be called with mtx locked
+func (p *eventsPublisher) flush() {
+	if len(p.events) == 0 {
+		return
+	}
+	events := p.events
+	p.events = nil
+	err := p.sink.publish(events)
+	if err != nil {
+		warnf(cWarnOther, "cannot publish %d change events to %s: %v\n", len(events), p.sink, err)
+		return
+	}
+	p.sent += len(events)
+}
+
+// flushEvents - publishes events still queued when the run ends, returns the number of events published by the run
+func flushEvents() int {
+	p := gEvents
+	if p == nil {
+		return 0
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.flush()
+	sent := p.sent
+	p.sent = 0
+	return sent
+}
+
+// String - sink description
+func (k *kafkaSink) String() string {
+	return "Kafka topic " + k.topic
+}
+
+// publish - produces events to the topic, uuid is the key so changes of a uuid stay ordered within a partition
+func (k *kafkaSink) publish(events []changeEvent) (err error) {
+	type record struct {
+		Key   string      `json:"key"`
+		Value changeEvent `json:"value"`
+	}
+	records := struct {
+		Records []record `json:"records"`
+	}{}
+	for _, event := range events {
+		records.Records = append(records.Records, record{Key: event.UUID, Value: event})
+	}
+	var payload []byte
+	payload, err = json.Marshal(records)
+	if err != nil {
+		return
+	}
+	uri := k.url + "/topics/" + url.PathEscape(k.topic)
+	var req *http.Request
+	req, err = http.NewRequest(http.MethodPost, uri, bytes.NewReader(payload))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", cKafkaJSONRecords)
+	req.Header.Set("Accept", cKafkaContentType)
+	client := &http.Client{Timeout: 30 * time.Second}
+	var resp *http.Response
+	resp, err = client.Do(req)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("Kafka REST POST %s returned %d: %s", uri, resp.StatusCode, string(data))
+		return
+	}
+	// Partial failures are reported per record
+	var result struct {
+		Offsets []struct {
+			Error string `json:"error"`
+		} `json:"offsets"`
+	}
+	if json.Unmarshal(data, &result) == nil {
+		for _, offset := range result.Offsets {
+			if offset.Error != "" {
+				err = fmt.Errorf("Kafka REST POST %s: %s", uri, offset.Error)
+				return
+			}
+		}
+	}
+	return
+}
+
+// newNATSSink - nats://[user:pass@]host[:port]
+func newNATSSink(natsURL, subject string) (sink *natsSink, err error) {
+	var u *url.URL
+	u, err = url.Parse(natsURL)
+	if err != nil || u.Scheme != "nats" || u.Hostname() == "" {
+		err = fmt.Errorf("invalid EVENTS_NATS_URL=%s, expected nats://[user:pass@]host[:port]", natsURL)
+		return
+	}
+	port := u.Port()
+	if port == "" {
+		port = cNATSDefaultPort
+	}
+	sink = &natsSink{addr: net.JoinHostPort(u.Hostname(), port), subject: subject}
+	if u.User != nil {
+		sink.user = u.User.Username()
+		sink.pass, _ = u.User.Password()
+	}
+	return
+}
+
+// String - sink description
+func (n *natsSink) String() string {
+	return "NATS subject " + n.subject + " on " + n.addr
+}
+
+// publish - CONNECT, PUB every event, then PING and wait for PONG so the server processed all of them
+func (n *natsSink) publish(events []changeEvent) (err error) {
+	var conn net.Conn
+	conn, err = net.DialTimeout("tcp", n.addr, 10*time.Second)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+	r := bufio.NewReader(conn)
+	var line string
+	line, err = r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		err = fmt.Errorf("unexpected NATS greeting: %s", strings.TrimSpace(line))
+		return
+	}
+	connect := map[string]interface{}{"verbose": false, "pedantic": false, "name": "import-individual-dashboard"}
+	if n.user != "" {
+		connect["user"], connect["pass"] = n.user, n.pass
+	}
+	var data []byte
+	data, err = json.Marshal(connect)
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(conn)
+	_, _ = fmt.Fprintf(w, "CONNECT %s\r\n", data)
+	for _, event := range events {
+		data, err = json.Marshal(event)
+		if err != nil {
+			return
+		}
+		_, _ = fmt.Fprintf(w, "PUB %s %d\r\n%s\r\n", n.subject, len(data), data)
+	}
+	_, _ = fmt.Fprintf(w, "PING\r\n")
+	err = w.Flush()
+	if err != nil {
+		return
+	}
+	for {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return
+		case strings.HasPrefix(line, "-ERR"):
+			err = fmt.Errorf("NATS: %s", line)
+			return
+		case line == "PING":
+			_, _ = fmt.Fprintf(conn, "PONG\r\n")
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// gExtractIdentitiesHdr - columns of the extracted identities file
+	gExtractIdentitiesHdr = []string{"action", "identity_id", "uuid", "identity_name", "identity_username", "identity_email", "identity_source", "user_name", "user_email", "user_sfid"}
+	// gExtractAffiliationsHdr - columns of the extracted affiliations file, to_* start as a copy of from_*
+	gExtractAffiliationsHdr = []string{
+		"action", "identity_id", "project_slug", "from_org_name", "from_start_date", "from_end_date",
+		"to_org_name", "to_start_date", "to_end_date", "user_name", "user_email", "user_sfid",
+	}
+	// gExtractProfilesHdr - columns of the extracted profiles file, gender and timezone are left blank (unchanged)
+	gExtractProfilesHdr = []string{
+		"uuid", "profile_name", "profile_email", "profile_country", "profile_timezone", "profile_is_bot", "profile_gender",
+		"user_name", "user_email", "user_sfid",
+	}
+)
+
+// extractArgs - people given as arguments or listed in files given as arguments (one per line, # comments)
+func extractArgs(args []string) (people []string, err error) {
+	for _, arg := range args {
+		info, e := os.Stat(arg)
+		if e != nil || info.IsDir() {
+			people = append(people, strings.TrimSpace(arg))
+			continue
+		}
+		var f *os.File
+		f, err = os.Open(arg)
+		if err != nil {
+			return
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				people = append(people, line)
+			}
+		}
+		err = scanner.Err()
+		_ = f.Close()
+		if err != nil {
+			err = fmt.Errorf("%s: %v", arg, err)
+			return
+		}
+	}
+	return
+}
+
+// extractCorrections - "extract" subcommand, read only: writes user_identities_, user_affiliations_ and
+// user_profiles_<timestamp>.csv in the import schema pre-filled with the current values of people given by uuid,
+// email or identity_id (or files listing them), admins edit only the values to change (to_* columns of
+// affiliations) and fill user_* columns, unchanged rows are no-ops when the files are imported back
+// EXTRACT_DIR - output directory, s3:// prefix or http(s):// URL (default current directory)
+func extractCorrections(db *sql.DB, dbg bool, args []string) (err error) {
+	var people []string
+	people, err = extractArgs(args)
+	if err != nil {
+		return
+	}
+	if len(people) == 0 {
+		err = fmt.Errorf("extract requires uuids, emails or identity_ids, or files listing them")
+		return
+	}
+	identities, affiliations, profiles := [][]string{gExtractIdentitiesHdr}, [][]string{gExtractAffiliationsHdr}, [][]string{gExtractProfilesHdr}
+	seen := make(map[string]struct{})
+	for _, person := range people {
+		var uuids []string
+		uuids, err = resolvePerson(db, person)
+		if err != nil {
+			return
+		}
+		if len(uuids) == 0 {
+			fmt.Printf("WARNING: no person found for %s\n", person)
+			continue
+		}
+		for _, uuid := range uuids {
+			if _, ok := seen[uuid]; ok {
+				continue
+			}
+			seen[uuid] = struct{}{}
+			var view *personView
+			view, err = loadPersonView(db, dbg, uuid, 0)
+			if err != nil {
+				return
+			}
+			// enrollments belong to the uuid, any of its identities keys them, the one with uuid's id is preferred
+			enrollmentID := ""
+			for _, i := range view.Identities {
+				identities = append(identities, []string{"", i.ID, uuid, i.Name, i.Username, i.Email, i.Source, "", "", ""})
+				if enrollmentID == "" || i.ID == uuid {
+					enrollmentID = i.ID
+				}
+			}
+			if enrollmentID == "" && len(view.Enrollments) > 0 {
+				fmt.Printf("WARNING: uuid %s has no identities, its %d enrollments are not extracted\n", uuid, len(view.Enrollments))
+			}
+			for _, e := range view.Enrollments {
+				if enrollmentID == "" {
+					break
+				}
+				affiliations = append(affiliations, []string{"", enrollmentID, e.ProjectSlug, e.Organization, e.Start, e.End, e.Organization, e.Start, e.End, "", "", ""})
+			}
+			if p := view.Profile; p != nil {
+				isBot := "0"
+				if p.IsBot {
+					isBot = "1"
+				}
+				profiles = append(profiles, []string{uuid, p.Name, p.Email, p.CountryCode, "", isBot, "", "", "", ""})
+			}
+		}
+	}
+	dir := os.Getenv("EXTRACT_DIR")
+	if dir == "" {
+		dir = "."
+	}
+	ts := time.Now().Format("200601021504")
+	for _, file := range []struct {
+		prefix string
+		rows   [][]string
+	}{
+		{"user_identities_", identities},
+		{"user_affiliations_", affiliations},
+		{"user_profiles_", profiles},
+	} {
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		err = w.WriteAll(file.rows)
+		if err != nil {
+			return
+		}
+		path := joinPath(dir, file.prefix+ts+".csv")
+		err = writeOutput(path, buf.Bytes())
+		if err != nil {
+			return
+		}
+		fmt.Printf("%d rows written to %s\n", len(file.rows)-1, path)
+	}
+	fmt.Printf("Extracted %d people, edit the values to change, fill user_name, user_email and user_sfid and import the files\n", len(seen))
+	return
+}
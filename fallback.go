@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// gIDFallback - identity columns used to find the identity when identity_id is missing or unknown
+var gIDFallback []string
+
+// setIDFallback - ID_FALLBACK, "email" and/or "username" in the order they are tried, for example "email,username"
+func setIDFallback() (err error) {
+	gIDFallback = nil
+	for _, key := range strings.Split(os.Getenv("ID_FALLBACK"), ",") {
+		key = strings.TrimSpace(key)
+		switch key {
+		case "":
+		case "email", "username":
+			gIDFallback = append(gIDFallback, key)
+		default:
+			err = fmt.Errorf("invalid ID_FALLBACK item '%s', allowed: email, username", key)
+			return
+		}
+	}
+	return
+}
+
+// fallbackValue - value of identity column key from the row: identity_<key>, for email also user_email
+// (enrollment requests are usually made by the person themselves)
+func fallbackValue(row map[string]string, key string, enrollment bool) string {
+	value := strings.TrimSpace(row["identity_"+key])
+	if value == "" && key == "email" && enrollment {
+		value = strings.TrimSpace(row["user_email"])
+	}
+	return value
+}
+
+// fallbackIdentityID - finds identity by (source, email) or (source, username) when identity_id is missing or unknown
+// source is identity_source (any source when it is empty for enrollments), emails are compared case insensitively
+// identities rows need exactly one matching identity, enrollments rows one matching unique identity
+func fallbackIdentityID(db *sql.DB, dbg bool, row map[string]string, enrollment bool) (id string, err error) {
+	if len(gIDFallback) == 0 {
+		return
+	}
+	source := strings.TrimSpace(row["identity_source"])
+	if source == "" && !enrollment {
+		return
+	}
+	for _, key := range gIDFallback {
+		value := fallbackValue(row, key, enrollment)
+		if value == "" {
+			continue
+		}
+		q := "select id, uuid from identities where " + key + " = ?"
+		if key == "email" {
+			q = "select id, uuid from identities where lower(email) = lower(?)"
+		}
+		args := []interface{}{value}
+		if source != "" {
+			q += " and source = ?"
+			args = append(args, source)
+		}
+		var rows *stmtRows
+		rows, err = query(replica(db), q, args...)
+		if err != nil {
+			return
+		}
+		ids, uuids := []string{}, make(map[string]struct{})
+		for rows.Next() {
+			var i, u string
+			err = rows.Scan(&i, &u)
+			if err != nil {
+				_ = rows.Close()
+				return
+			}
+			ids = append(ids, i)
+			uuids[u] = struct{}{}
+		}
+		err = rows.Err()
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		sort.Strings(ids)
+		if len(ids) > 1 && (!enrollment || len(uuids) > 1) {
+			err = skipf(cWarnValidation, "ambiguous identity: %d identities (%d unique identities) have %s %s source '%s': %s (row %v)\n", len(ids), len(uuids), key, value, source, strings.Join(ids, ", "), row)
+			return
+		}
+		id = ids[0]
+		fmt.Printf("identity_id %s found by %s %s source '%s'\n", id, key, value, source)
+		return
+	}
+	return
+}
+
+// withFallbackID - when the row's identity_id is missing or unknown and ID_FALLBACK finds the identity,
+// returns copy of the row with that identity_id, nil otherwise
+func withFallbackID(db *sql.DB, dbg bool, row map[string]string, enrollment bool) (newRow map[string]string, err error) {
+	var id string
+	id, err = fallbackIdentityID(db, dbg, row, enrollment)
+	if err != nil || id == "" || id == row["identity_id"] {
+		return
+	}
+	newRow = make(map[string]string)
+	for k, v := range row {
+		newRow[k] = v
+	}
+	newRow["identity_id"] = id
+	return
+}
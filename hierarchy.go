@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// cDASlugKey - row key with already resolved DA project slug, set by the fan-out for child projects
+const cDASlugKey = "_da_project_slug"
+
+var (
+	gFanOut       bool
+	gChildrenFile map[string][]string
+	gChildrenMap  map[string][]string
+)
+
+// setFanOut - configures project hierarchy fan-out
+// FANOUT - enrollments for a foundation (parent) slug are also applied to all its child projects
+// FANOUT_FILE - optional YAML file mapping parent DA slug to the list of child DA slugs
+// Without FANOUT_FILE children are all slug_mapping DA slugs starting with "parent/"
+func setFanOut() (err error) {
+	gFanOut = os.Getenv("FANOUT") != ""
+	gChildrenFile = nil
+	gChildrenMap = make(map[string][]string)
+	if !gFanOut || os.Getenv("FANOUT_FILE") == "" {
+		return
+	}
+	var data []byte
+	data, err = ioutil.ReadFile(os.Getenv("FANOUT_FILE"))
+	if err != nil {
+		return
+	}
+	err = yaml.Unmarshal(data, &gChildrenFile)
+	if err != nil {
+		err = fmt.Errorf("cannot parse FANOUT_FILE %s: %v", os.Getenv("FANOUT_FILE"), err)
+	}
+	return
+}
+
+// childProjects - returns child DA slugs of the given DA slug (empty when it is not a parent)
+func childProjects(db *sql.DB, dbg bool, daSlug string) (children []string, err error) {
+	if gChildrenFile != nil {
+		children = gChildrenFile[daSlug]
+		return
+	}
+	var found bool
+	if gMtx != nil {
+		gMtx.Lock()
+	}
+	children, found = gChildrenMap[daSlug]
+	if gMtx != nil {
+		gMtx.Unlock()
+	}
+	if found {
+		return
+	}
+	var rows *stmtRows
+	rows, err = query(replica(db), "select distinct da_name from slug_mapping where da_name like ?", strings.Replace(daSlug, "%", "\\%", -1)+"/%")
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		child := ""
+		err = rows.Scan(&child)
+		if err != nil {
+			break
+		}
+		children = append(children, child)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	e := rows.Close()
+	if err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+	sort.Strings(children)
+	if gMtx != nil {
+		gMtx.Lock()
+	}
+	gChildrenMap[daSlug] = children
+	if gMtx != nil {
+		gMtx.Unlock()
+	}
+	if dbg {
+		fmt.Printf("project %s children: %v\n", daSlug, children)
+	}
+	return
+}
+
+// fanOutEnrollment - applies enrollment row to its project and all child projects
+// Children are processed even if some of them fail, the first non-skip error is returned
+func fanOutEnrollment(db *sql.DB, dbg, dry bool, row map[string]string) (err error) {
+	sfdcSlug := strings.TrimSpace(row["project_slug"])
+	if sfdcSlug == "" {
+		return updateEnrollment(db, dbg, dry, row)
+	}
+	daSlug, e := sfdcSlugToDASlug(db, dbg, sfdcSlug)
+	if e != nil && !isNotFound(e) {
+		return e
+	}
+	if e != nil {
+		// updateEnrollment reports missing slugs
+		return updateEnrollment(db, dbg, dry, row)
+	}
+	var children []string
+	children, err = childProjects(db, dbg, daSlug)
+	if err != nil {
+		return
+	}
+	err = updateEnrollment(db, dbg, dry, row)
+	for _, child := range children {
+		childRow := make(map[string]string, len(row)+1)
+		for k, v := range row {
+			childRow[k] = v
+		}
+		childRow[cDASlugKey] = child
+		e = updateEnrollment(db, dbg, dry, childRow)
+		if e != nil && (err == nil || isSkipped(err) && !isSkipped(e)) {
+			err = e
+		}
+	}
+	return
+}
+
+// enrollmentProcessor - updateEnrollment, with fan-out to child projects when FANOUT is set, bulk rows are
+// expanded to every matching person first
+func enrollmentProcessor() rowProcessor {
+	if gFanOut {
+		return bulkEnrollment(fanOutEnrollment)
+	}
+	return bulkEnrollment(updateEnrollment)
+}
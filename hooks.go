@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"strings"
+)
+
+var (
+	// gHooks - hook event -> shell command, from HOOK_PRE_RUN, HOOK_POST_RUN, HOOK_PRE_ROW, HOOK_POST_ROW
+	gHooks map[string]string
+	// gHookRunID - run ID passed to row hooks
+	gHookRunID string
+)
+
+// hookEvent - JSON hook commands receive on stdin
+type hookEvent struct {
+	Event              string            `json:"event"`
+	RunID              string            `json:"run_id"`
+	Database           string            `json:"database,omitempty"`
+	Dry                bool              `json:"dry"`
+	Kind               string            `json:"kind,omitempty"`
+	Row                map[string]string `json:"row,omitempty"`
+	Error              string            `json:"error,omitempty"`
+	Skipped            bool              `json:"skipped,omitempty"`
+	IdentitiesFiles    []string          `json:"identities_files,omitempty"`
+	AffiliationsFiles  []string          `json:"affiliations_files,omitempty"`
+	OrganizationsFiles []string          `json:"organizations_files,omitempty"`
+	ProfilesFiles      []string          `json:"profiles_files,omitempty"`
+	Summary            *importSummary    `json:"summary,omitempty"`
+}
+
+// setHooks - reads hook commands, they are run with sh -c
+func setHooks() {
+	gHooks = make(map[string]string)
+	for event, env := range map[string]string{"pre-run": "HOOK_PRE_RUN", "post-run": "HOOK_POST_RUN", "pre-row": "HOOK_PRE_ROW", "post-row": "HOOK_POST_ROW"} {
+		if command := os.Getenv(env); command != "" {
+			gHooks[event] = command
+		}
+	}
+}
+
+// runHook - runs hook command of the event with JSON event on stdin, returns its stdout
+// non-zero exit status is an error including the command's stderr
+func runHook(dbg bool, event hookEvent) (out []byte, err error) {
+	command, ok := gHooks[event.Event]
+	if !ok {
+		return
+	}
+	var data []byte
+	data, err = json.Marshal(event)
+	if err != nil {
+		return
+	}
+	if dbg {
+		fmt.Printf("%s hook: %s\n", event.Event, command)
+	}
+	var stderr bytes.Buffer
+	cmd := osexec.Command("sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = &stderr
+	out, err = cmd.Output()
+	if err != nil {
+		err = fmt.Errorf("%s hook '%s': %v: %s", event.Event, command, err, strings.TrimSpace(stderr.String()))
+	}
+	return
+}
+
+// preRunHook - HOOK_PRE_RUN, failing hook aborts the run before any row is processed
+func preRunHook(dbg bool, summary *importSummary, inputs inputFiles) (err error) {
+	gHookRunID = summary.RunID
+	_, err = runHook(dbg, hookEvent{
+		Event:              "pre-run",
+		RunID:              summary.RunID,
+		Database:           summary.Database,
+		Dry:                summary.Dry,
+		IdentitiesFiles:    inputs.identities,
+		AffiliationsFiles:  inputs.affiliations,
+		OrganizationsFiles: inputs.organizations,
+		ProfilesFiles:      inputs.profiles,
+	})
+	return
+}
+
+// postRunHook - HOOK_POST_RUN, receives the run summary, failures are only reported
+func postRunHook(dbg bool, summary *importSummary) {
+	_, err := runHook(dbg, hookEvent{Event: "post-run", RunID: summary.RunID, Database: summary.Database, Dry: summary.Dry, Summary: summary})
+	if err != nil {
+		fmt.Printf("WARNING: %v\n", err)
+	}
+}
+
+// hookRow - wraps row processor with HOOK_PRE_ROW and HOOK_POST_ROW
+// pre-row hook failing skips the row, a JSON object printed by it replaces the row (custom enrichment)
+// post-row hook receives the row with its error (if any), failures are reported as warnings
+func hookRow(kind string, fn rowProcessor) rowProcessor {
+	_, pre := gHooks["pre-row"]
+	_, post := gHooks["post-row"]
+	if !pre && !post {
+		return fn
+	}
+	return func(db *sql.DB, dbg, dry bool, row map[string]string) (err error) {
+		out, e := runHook(dbg, hookEvent{Event: "pre-row", RunID: gHookRunID, Database: gDatabase, Dry: dry, Kind: kind, Row: row})
+		if e != nil {
+			err = skipf(cWarnValidation, "row rejected: %v (row %v)\n", e, row)
+			return
+		}
+		if len(bytes.TrimSpace(out)) > 0 {
+			newRow := make(map[string]string)
+			e = json.Unmarshal(out, &newRow)
+			if e != nil {
+				err = fmt.Errorf("pre-row hook returned invalid row: %v: %s", e, string(out))
+				return
+			}
+			if dbg {
+				fmt.Printf("pre-row hook changed row %v -> %v\n", row, newRow)
+			}
+			row = newRow
+		}
+		err = fn(db, dbg, dry, row)
+		if gQuiet {
+			return
+		}
+		event := hookEvent{Event: "post-row", RunID: gHookRunID, Database: gDatabase, Dry: dry, Kind: kind, Row: row, Skipped: isSkipped(err)}
+		if err != nil {
+			event.Error = err.Error()
+		}
+		_, e = runHook(dbg, event)
+		if e != nil {
+			warnf(cWarnOther, "%v\n", e)
+		}
+		return
+	}
+}
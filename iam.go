@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	osexec "os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	// cIAMTokenTTL - RDS IAM tokens are valid for 15 minutes, they are regenerated earlier
+	cIAMTokenTTL = 10 * time.Minute
+	// cIAMTLSConfig - name of the TLS config registered from RDS_IAM_CA
+	cIAMTLSConfig = "rds-iam"
+)
+
+var (
+	// gRDSIAM - RDS_IAM: database passwords are RDS IAM auth tokens generated at connect time
+	gRDSIAM bool
+	// gIAMTLS - TLS config name used for IAM connections without tls= in the DSN
+	gIAMTLS string
+	// gIAMTokens - user@host:port -> token, gIAMMtx guards it
+	gIAMTokens = make(map[string]iamToken)
+	gIAMMtx    sync.Mutex
+)
+
+// iamToken - generated RDS IAM auth token
+type iamToken struct {
+	token   string
+	created time.Time
+}
+
+// iamConnector - connects with a fresh IAM token (cached for cIAMTokenTTL) every time the pool opens a connection
+type iamConnector struct {
+	cfg  *mysql.Config
+	addr string
+	dbg  bool
+}
+
+// setRDSIAM - RDS_IAM=1 replaces static passwords by RDS IAM auth tokens (AWS CLI rds generate-db-auth-token, with
+// the usual AWS credentials chain), RDS_REGION (default AWS_REGION), RDS_IAM_CA - CA bundle of RDS certificates
+// (default system roots), the token is sent in clear text so TLS is always used
+func setRDSIAM() (err error) {
+	gRDSIAM = os.Getenv("RDS_IAM") != ""
+	if !gRDSIAM {
+		return
+	}
+	gIAMTLS = "true"
+	ca := os.Getenv("RDS_IAM_CA")
+	if ca == "" {
+		return
+	}
+	var data []byte
+	data, err = ioutil.ReadFile(ca)
+	if err != nil {
+		err = fmt.Errorf("RDS_IAM_CA: %v", err)
+		return
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		err = fmt.Errorf("RDS_IAM_CA: no PEM certificates in %s", ca)
+		return
+	}
+	err = mysql.RegisterTLSConfig(cIAMTLSConfig, &tls.Config{RootCAs: pool})
+	if err != nil {
+		err = fmt.Errorf("RDS_IAM_CA: %v", err)
+		return
+	}
+	gIAMTLS = cIAMTLSConfig
+	return
+}
+
+// openMySQL - opens a database of the DSN, with RDS_IAM connections authenticate with IAM tokens, with SH_SSH_HOST
+// they go through SSH tunnels
+func openMySQL(dsn string) (*sql.DB, error) {
+	if !gRDSIAM && gSSHHost == "" {
+		return sql.Open("mysql", dsn)
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	// the token is signed for the database address, not the tunnel's one
+	addr := cfg.Addr
+	if gRDSIAM {
+		if cfg.Net != "tcp" {
+			return nil, fmt.Errorf("RDS_IAM requires a single tcp host, got %s(%s)", cfg.Net, cfg.Addr)
+		}
+		if cfg.TLSConfig == "" || cfg.TLSConfig == "false" {
+			cfg.TLSConfig = gIAMTLS
+			// the DSN is re-parsed to resolve the TLS config name
+			cfg, err = mysql.ParseDSN(cfg.FormatDSN())
+			if err != nil {
+				return nil, err
+			}
+		}
+		cfg.AllowCleartextPasswords = true
+	}
+	if gSSHHost != "" {
+		err = tunnelConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if gRDSIAM {
+		return sql.OpenDB(&iamConnector{cfg: cfg, addr: addr, dbg: os.Getenv("DEBUG") != ""}), nil
+	}
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(connector), nil
+}
+
+// Connect - driver.Connector: sets the current IAM token as password and connects
+func (c *iamConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	token, err := iamAuthToken(c.cfg.User, c.addr, c.dbg)
+	if err != nil {
+		return nil, err
+	}
+	cfg := c.cfg.Clone()
+	cfg.Passwd = token
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(ctx)
+}
+
+// Driver - driver.Connector
+func (c *iamConnector) Driver() driver.Driver {
+	return mysql.MySQLDriver{}
+}
+
+// iamAuthToken - cached or newly generated RDS IAM auth token of the user on host:port
+func iamAuthToken(user, addr string, dbg bool) (token string, err error) {
+	key := user + "@" + addr
+	gIAMMtx.Lock()
+	defer gIAMMtx.Unlock()
+	if t, ok := gIAMTokens[key]; ok && time.Since(t.created) < cIAMTokenTTL {
+		token = t.token
+		return
+	}
+	var host, port string
+	host, port, err = net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	args := []string{"rds", "generate-db-auth-token", "--hostname", host, "--port", port, "--username", user}
+	region := os.Getenv("RDS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region != "" {
+		args = append(args, "--region", region)
+	}
+	if dbg {
+		fmt.Printf("aws %s\n", strings.Join(args, " "))
+	}
+	var stderr bytes.Buffer
+	cmd := osexec.Command("aws", args...)
+	cmd.Stderr = &stderr
+	var out []byte
+	out, err = cmd.Output()
+	if err != nil {
+		err = fmt.Errorf("aws %s: %v: %s", strings.Join(args, " "), err, stderr.String())
+		return
+	}
+	token = strings.TrimSpace(string(out))
+	if token == "" {
+		err = fmt.Errorf("aws %s: empty token", strings.Join(args, " "))
+		return
+	}
+	gIAMTokens[key] = iamToken{token: token, created: time.Now()}
+	return
+}
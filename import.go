@@ -1,13 +1,14 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/csv"
 	"fmt"
 	"os"
 	"reflect"
 	"runtime"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,26 +21,50 @@ const (
 	cDateTimeFormat = "%Y-%m-%dT%H:%i:%s.%fZ"
 )
 
+var (
+	// gMinDate, gMaxDate - SortingHat open range sentinels
+	gMinDate = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+	gMaxDate = time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+	// gInputTZ - timezone of CSV timestamps without zone
+	gInputTZ = time.UTC
+)
+
 var (
 	gDebugSQL           bool
+	gPanicOnDBError     bool
+	gNoTouchUIdentities bool
+	gNoTouchProfiles    bool
+	gAllowBlanking      bool
 	gMtx                *sync.Mutex
 	gUpdatedIdentities  map[string]struct{}
 	gUpdatedEnrollments map[string]struct{}
 	gUpdatedUIdentities map[string]struct{}
 	gUpdatedProfiles    map[string]struct{}
-	gIDMtx              map[string]*sync.Mutex
-	gUUIDMtx            map[string]*sync.Mutex
 	gOrgMap             map[string]int
 	gSlugMap            map[string]string
 	gOrgMiss            map[string]struct{}
 	gSlugMiss           map[string]struct{}
+	gIgnoreCaseEmail    bool
+	gIgnoreCaseUsername bool
+	gQuiet              bool
+	gOutcomes           bool
 )
 
+// shutdown - releases what the process holds outside of it when it exits: stops the execution trace (TRACE_FILE),
+// kills SSH tunnels and flushes log files, safe to call more than once, only called on process exit
+func shutdown() {
+	stopTrace()
+	closeTunnels()
+	flushLogs()
+}
+
 func fatalOnError(err error) {
 	if err != nil {
 		tm := time.Now()
 		fmt.Printf("Error(time=%+v):\nError: '%s'\nStacktrace:\n%s\n", tm, err.Error(), string(debug.Stack()))
 		fmt.Fprintf(os.Stderr, "Error(time=%+v):\nError: '%s'\nStacktrace:\n", tm, err.Error())
+		// no shutdown here, serve and schedule recover the panic and go on with their tunnels and logs, main's
+		// deferred shutdown runs when the panic ends the process
 		panic("stacktrace")
 	}
 }
@@ -67,16 +92,59 @@ func queryOut(query string, args ...interface{}) {
 	}
 }
 
-func query(db *sql.DB, query string, args ...interface{}) (*sql.Rows, error) {
-	rows, err := db.Query(query, args...)
+func query(db *sql.DB, query string, args ...interface{}) (*stmtRows, error) {
+	dtStart := time.Now()
+	query = adaptQuery(query)
+	ctx, cancel := stmtContext()
+	rows, err := db.QueryContext(ctx, query, args...)
+	recordLatency(query, time.Since(dtStart), args...)
 	if err != nil || gDebugSQL {
 		queryOut(query, args...)
 	}
-	return rows, err
+	if err != nil && gPanicOnDBError {
+		fatalOnError(err)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &stmtRows{Rows: rows, cancel: cancel}, nil
+}
+
+// queryFirst - runs query and scans its first row into dest, found is false when there are no rows
+func queryFirst(db *sql.DB, dest []interface{}, q string, args ...interface{}) (found bool, err error) {
+	var rows *stmtRows
+	rows, err = query(db, q, args...)
+	if err != nil {
+		return
+	}
+	if rows.Next() {
+		err = rows.Scan(dest...)
+		found = err == nil
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	e := rows.Close()
+	if err == nil {
+		err = e
+	}
+	if err != nil && gPanicOnDBError {
+		fatalOnError(err)
+	}
+	return
 }
 
 func exec(db *sql.Tx, skip, query string, args ...interface{}) (sql.Result, error) {
-	res, err := db.Exec(query, args...)
+	if err := readOnlyGuard(query); err != nil {
+		return nil, err
+	}
+	dtStart := time.Now()
+	query = adaptQuery(query)
+	ctx, cancel := stmtContext()
+	defer cancel()
+	res, err := db.ExecContext(ctx, query, args...)
+	recordLatency(query, time.Since(dtStart), args...)
 	if err != nil || gDebugSQL {
 		if skip == "" || !strings.Contains(err.Error(), skip) || gDebugSQL {
 			queryOut(query, args...)
@@ -85,15 +153,33 @@ func exec(db *sql.Tx, skip, query string, args ...interface{}) (sql.Result, erro
 	return res, err
 }
 
-func getThreadsNum() int {
+func execDB(db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
+	if err := readOnlyGuard(query); err != nil {
+		return nil, err
+	}
+	dtStart := time.Now()
+	query = adaptQuery(query)
+	ctx, cancel := stmtContext()
+	defer cancel()
+	res, err := db.ExecContext(ctx, query, args...)
+	recordLatency(query, time.Since(dtStart), args...)
+	if err != nil || gDebugSQL {
+		queryOut(query, args...)
+	}
+	return res, err
+}
+
+func getThreadsNum() (int, error) {
 	st := os.Getenv("ST") != ""
 	if st {
-		return 1
+		return 1, nil
 	}
 	nCPUs := 0
 	if os.Getenv("NCPUS") != "" {
 		n, err := strconv.Atoi(os.Getenv("NCPUS"))
-		fatalOnError(err)
+		if err != nil {
+			return 0, fmt.Errorf("invalid NCPUS=%s: %v", os.Getenv("NCPUS"), err)
+		}
 		if n > 0 {
 			nCPUs = n
 		}
@@ -104,123 +190,247 @@ func getThreadsNum() int {
 			nCPUs = n
 		}
 		runtime.GOMAXPROCS(nCPUs)
-		return nCPUs
+		return nCPUs, nil
 	}
 	nCPUs = runtime.NumCPU()
 	runtime.GOMAXPROCS(nCPUs)
-	return nCPUs
+	return nCPUs, nil
 }
 
-func updateIdentity(ch chan error, db *sql.DB, dbg, dry bool, row map[string]string) (err error) {
+func updateIdentity(db *sql.DB, dbg, dry bool, row map[string]string) (err error) {
 	// action identity_id identity_name identity_username identity_email identity_source user_sfid user_email
-	if ch != nil {
-		defer func() {
-			ch <- err
-		}()
-	}
 	if dbg {
 		fmt.Printf("%v\n", row)
 	}
+	switch strings.ToLower(strings.TrimSpace(row["action"])) {
+	case "merge":
+		return mergeUUID(db, dbg, dry, row)
+	case "suggest":
+		err = skippedf("merge suggestion of uuid %s into %s was not approved (row %v)", row["uuid"], row["merge_into_uuid"], row)
+		return
+	}
 	id, _ := row["identity_id"]
+	if id == "" && strings.TrimSpace(row["uuid"]) != "" {
+		// row keyed by the person's uuid
+		return updatePerson(db, dbg, dry, row)
+	}
 	if id == "" {
+		var newRow map[string]string
+		newRow, err = withFallbackID(db, dbg, row, false)
+		if err != nil || newRow != nil {
+			if err == nil {
+				err = updateIdentity(db, dbg, dry, newRow)
+			}
+			return
+		}
 		err = fmt.Errorf("identity_id cannot be empty in %v", row)
 		return
 	}
-	rows, err := query(db, "select uuid, trim(coalesce(name, '')), trim(coalesce(username, '')), trim(coalesce(email, '')), trim(source) from identities where id = ?", id)
-	fatalOnError(err)
-	uuid, name, username, email, source, found := "", "", "", "", "", false
-	for rows.Next() {
-		fatalOnError(rows.Scan(&uuid, &name, &username, &email, &source))
-		found = true
-		break
-	}
-	fatalOnError(rows.Err())
-	fatalOnError(rows.Close())
+	uuid, name, username, email, source, version := "", "", "", "", "", ""
+	nameNull, usernameNull, emailNull := false, false, false
+	found, err := queryFirst(
+		versionDB(db),
+		[]interface{}{&uuid, &name, &username, &email, &source, &version, &nameNull, &usernameNull, &emailNull},
+		"select uuid, trim(coalesce(name, '')), trim(coalesce(username, '')), trim(coalesce(email, '')), trim(source), "+cVersionColumn+", "+
+			"name is null, username is null, email is null from identities where id = ?",
+		id,
+	)
+	if err != nil {
+		err = fmt.Errorf("identity_id %s lookup: %v in %v", id, err, row)
+		return
+	}
+	registerPII(name, username, email)
 	if !found {
-		fmt.Printf("WARNING: cannot find identity with id=%s (row %v)\n", id, row)
+		var newRow map[string]string
+		newRow, err = withFallbackID(db, dbg, row, false)
+		if err != nil || newRow != nil {
+			if err == nil {
+				err = updateIdentity(db, dbg, dry, newRow)
+			}
+			return
+		}
+		err = skipf(cWarnNotFound, "cannot find identity with id=%s (row %v)\n", id, row)
 		return
 	}
 	if dbg {
 		fmt.Printf("Found: (%s,%s,%s,%s,%s) for id %s\n", uuid, name, username, email, source, id)
 	}
+	if !sourceAllowed(source) {
+		err = skippedf("identity_id %s/%s source %s is filtered out (row %v)", id, uuid, source, row)
+		if dbg {
+			fmt.Printf("%v\n", err)
+		}
+		return
+	}
+	if reason := protectedIdentity(id, uuid); reason != "" {
+		err = protectedf(reason, row)
+		return
+	}
 	newName, _ := row["identity_name"]
 	newUsername, _ := row["identity_username"]
 	newEmail, _ := row["identity_email"]
 	newSource, _ := row["identity_source"]
-	newName = strings.TrimSpace(newName)
-	newUsername = strings.TrimSpace(newUsername)
-	newEmail = strings.TrimSpace(newEmail)
+	newName = normalizeValue(newName)
+	newUsername = normalizeValue(newUsername)
+	newEmail = normalizeValue(newEmail)
+	// Values that only differ from the DB ones by normalization are not changed
+	if normalizeValue(name) == newName {
+		newName = name
+	}
+	sameName, err := equivalentName(db, uuid, normalizeValue(name), newName)
+	if err != nil {
+		err = fmt.Errorf("identity_id %s/%s name comparison: %v in %v", id, uuid, err, row)
+		return
+	}
+	if sameName && newName != name {
+		if dbg {
+			fmt.Printf("identity_id %s/%s name '%s' only differs from '%s' by formatting\n", id, uuid, newName, name)
+		}
+		newName = name
+	}
+	if normalizeValue(username) == newUsername || (gIgnoreCaseUsername && strings.EqualFold(normalizeValue(username), newUsername)) {
+		newUsername = username
+	}
+	if normalizeValue(email) == newEmail || (gIgnoreCaseEmail && strings.EqualFold(normalizeValue(email), newEmail)) {
+		newEmail = email
+	}
+	key := "identity_id " + id + "/" + uuid
+	newName = allowedValue(dbg, key, "name", name, newName)
+	newUsername = allowedValue(dbg, key, "username", username, newUsername)
+	newEmail = allowedValue(dbg, key, "email", email, newEmail)
 	if source != newSource {
 		err = fmt.Errorf("identity_id %s/%s updating source is not supported, attempted %s -> %s in %v", id, uuid, source, newSource, row)
 		return
 	}
-	if name == newName && username == newUsername && email == newEmail {
+	var (
+		profileQuery string
+		profileArgs  []interface{}
+		profileMsg   string
+	)
+	profileQuery, profileArgs, profileMsg, err = profileChanges(db, dbg, id, uuid, newName, newUsername, newEmail, row)
+	if err != nil {
+		err = fmt.Errorf("identity_id %s/%s %v in %v", id, uuid, err, row)
+		return
+	}
+	identityChanged := name != newName || username != newUsername || email != newEmail
+	if !identityChanged && profileQuery == "" {
 		if dbg {
 			fmt.Printf("identity_id %s/%s (%s,%s,%s) nothing changed in %v\n", id, uuid, name, username, email, row)
 		}
 		return
 	}
-	// Concurrecncy check
-	if gMtx != nil {
-		// Lock working on identity ID
-		gMtx.Lock()
-		mtx, found := gIDMtx[id]
-		gMtx.Unlock()
-		if !found {
-			mtx = &sync.Mutex{}
-			gMtx.Lock()
-			gIDMtx[id] = mtx
-			gMtx.Unlock()
-		} else if dbg {
-			fmt.Printf("Duplicate id %s found in %v\n", id, row)
+	stale, err := modifiedAfterExport(db, "identities", "id", id)
+	if err != nil {
+		err = fmt.Errorf("identity_id %s/%s stale-export check: %v in %v", id, uuid, err, row)
+		return
+	}
+	if stale {
+		var skippedName, skippedUsername, skippedEmail bool
+		resolved := []string{}
+		newName, skippedName = resolveConflict("identity_name", name, newName)
+		newUsername, skippedUsername = resolveConflict("identity_username", username, newUsername)
+		newEmail, skippedEmail = resolveConflict("identity_email", email, newEmail)
+		skipped := skippedName || skippedUsername || skippedEmail
+		if profileQuery != "" {
+			switch conflictStrategy("profile") {
+			case cConflictOverwrite:
+			case cConflictSkip:
+				skipped = true
+				fallthrough
+			default:
+				resolved = append(resolved, "dropped profile changes: "+strings.TrimSpace(profileMsg))
+				profileQuery, profileArgs, profileMsg = "", nil, ""
+			}
 		}
-		mtx.Lock()
-		defer mtx.Unlock()
-		// Lock working on uidentity/profile UUID
-		gMtx.Lock()
-		umtx, found := gUUIDMtx[uuid]
-		gMtx.Unlock()
-		if !found {
-			umtx = &sync.Mutex{}
-			gMtx.Lock()
-			gUUIDMtx[uuid] = umtx
-			gMtx.Unlock()
-		} else if dbg {
-			fmt.Printf("Duplicate uuid %s found in %v\n", uuid, row)
+		identityChanged = name != newName || username != newUsername || email != newEmail
+		err = conflictRow(
+			identityChanged || profileQuery != "",
+			skipped,
+			"identity_id %s/%s was modified after the export, resolved to (%s,%s,%s) %s (row %v)\n",
+			id, uuid, newName, newUsername, newEmail, strings.Join(resolved, " "), row,
+		)
+		if err != nil || (!identityChanged && profileQuery == "") {
+			return
+		}
+	}
+	// An identity without name, username and email is useless
+	if identityChanged && newName == "" && newUsername == "" && newEmail == "" {
+		if !gAllowBlanking {
+			addBlanked(fmt.Sprintf("identity_id %s/%s refused", id, uuid))
+			err = skipf(cWarnOther, "identity_id %s/%s would blank out name, username and email (%s,%s,%s), set ALLOW_BLANKING to apply (row %v)\n", id, uuid, name, username, email, row)
+			return
+		}
+		addBlanked(fmt.Sprintf("identity_id %s/%s allowed", id, uuid))
+		warnf(cWarnOther, "identity_id %s/%s blanks out name, username and email (%s,%s,%s)\n", id, uuid, name, username, email)
+	}
+	// Identity id should stay SHA1 of its values
+	newID := ""
+	if identityChanged && gUUIDCheck != "" {
+		newID = identityHash(source, storedValue(email, newEmail, emailNull), storedValue(name, newName, nameNull), storedValue(username, newUsername, usernameNull))
+		if newID == id {
+			newID = ""
+		} else if gUUIDCheck == cUUIDReport || id == uuid {
+			if id == uuid {
+				warnf(cWarnOther, "identity_id %s/%s new values hash to %s, but it is the unique identity's uuid so it is not rekeyed\n", id, uuid, newID)
+			} else {
+				warnf(cWarnOther, "identity_id %s/%s new values hash to %s\n", id, uuid, newID)
+			}
+			newID = ""
+		}
+	}
+	for field, value := range map[string]string{"identity_name": newName, "identity_username": newUsername, "identity_email": newEmail} {
+		err = validateCharset(field, value)
+		if err != nil {
+			err = fmt.Errorf("identity_id %s/%s %v in %v", id, uuid, err, row)
+			return
 		}
-		umtx.Lock()
-		defer umtx.Unlock()
 	}
 	args := []interface{}{}
 	query := "update identities set "
 	msg := "identity_id " + id + "/" + uuid + " "
 	if newName != name {
 		query += "name = ?, "
-		args = append(args, newName)
-		msg += "name " + name + " -> " + newName + " "
+		args = append(args, nullIfEmpty(newName))
+		msg += fieldChange("name", name, newName)
 	}
 	if newUsername != username {
 		query += "username = ?, "
-		args = append(args, newUsername)
-		msg += "username " + username + " -> " + newUsername + " "
+		args = append(args, nullIfEmpty(newUsername))
+		msg += fieldChange("username", username, newUsername)
 	}
 	if newEmail != email {
 		query += "email = ?, "
-		args = append(args, newEmail)
-		msg += "email " + email + " -> " + newEmail + " "
+		args = append(args, nullIfEmpty(newEmail))
+		msg += fieldChange("email", email, newEmail)
+	}
+	query += auditSet("identities") + " where id = ?"
+	if newID != "" {
+		msg += fieldChange("id", id, newID)
 	}
-	query += "last_modified = now(), last_modified_by = ?, locked_by = ? where id = ?"
+	msg += profileMsg
 	userSFID, _ := row["user_sfid"]
 	userEmail, _ := row["user_email"]
 	userSFID = strings.TrimSpace(userSFID)
 	userEmail = strings.TrimSpace(userEmail)
 	who := "email:" + userEmail + ",sfid:" + userSFID
 	msg += " by " + who
-	args = append(args, who, "individual", id)
+	args = append(args, auditArgs("identities", who)...)
+	args = append(args, id)
+	versionQuery, versionArgs := versionCheck(version)
+	query += versionQuery
+	args = append(args, versionArgs...)
+	profileQuery = "update profiles set " + profileQuery + auditSet("profiles") + " where uuid = ?"
+	profileArgs = append(profileArgs, auditArgs("profiles", who)...)
+	profileArgs = append(profileArgs, uuid)
 	if dry {
 		fmt.Printf("%s\n", msg)
+		addChange(msg)
+		recordPlanned(uuid)
 		if dbg {
-			fmt.Printf("(%s,%v)\n", query, args)
+			if identityChanged {
+				fmt.Printf("(%s,%v)\n", query, args)
+			}
+			fmt.Printf("(%s,%v)\n", profileQuery, profileArgs)
 		}
 		return
 	}
@@ -232,11 +442,13 @@ func updateIdentity(ch chan error, db *sql.DB, dbg, dry bool, row map[string]str
 		tx        *sql.Tx
 		res       sql.Result
 	)
-	tx, err = db.Begin()
+	var cancelTx context.CancelFunc
+	tx, cancelTx, err = beginTx(db)
 	if err != nil {
 		err = fmt.Errorf("error starting transaction %v for row %v", err, row)
 		return
 	}
+	defer cancelTx()
 	collision := false
 	defer func() {
 		if tx != nil {
@@ -246,67 +458,127 @@ func updateIdentity(ch chan error, db *sql.DB, dbg, dry bool, row map[string]str
 			_ = tx.Rollback()
 		}
 	}()
-	// Update identities
-	skip := "Error 1062"
-	res, err = exec(tx, skip, query, args...)
+	err = lockIdentity(tx, id, name, username, email)
 	if err != nil {
-		if strings.Contains(err.Error(), skip) {
-			err = nil
-			collision = true
-			if dbg {
-				fmt.Printf("%s: collision\n", msg)
-			}
-			return
-		}
-		err = fmt.Errorf("error updating identities %v for (%s,%v) for row %v", err, query, args, row)
+		err = fmt.Errorf("%v in %v", err, row)
 		return
 	}
-	affectedI, err = res.RowsAffected()
-	if err != nil {
-		err = fmt.Errorf("error getting affected rows count %v for (%s,%v) for row %v", err, query, args, row)
-		return
+	// Shadow runs report row states before and after the transaction
+	shadow := newShadow(tx, uuid)
+	err = shadow.capture("identities", "id", id)
+	if err == nil {
+		err = shadow.capture("uidentities", "uuid", uuid)
 	}
-	if affectedI <= 0 || dbg {
-		fmt.Printf("%s: affected %d identities rows\n", msg, affectedI)
+	if err == nil {
+		err = shadow.capture("profiles", "uuid", uuid)
 	}
-	// Update uidentities
-	res, err = exec(tx, "", "update uidentities set last_modified = now(), last_modified_by = ?, locked_by = ? where uuid = ?", who, "individual", uuid)
 	if err != nil {
-		err = fmt.Errorf("error updating uidentities %v for uuid %s for row %v", err, uuid, row)
+		err = fmt.Errorf("error capturing shadow state %v for row %v", err, row)
 		return
 	}
-	affectedU, err = res.RowsAffected()
-	if err != nil {
-		err = fmt.Errorf("error getting affected rows count %v for uuid %s for row %v", err, uuid, row)
-		return
+	// Update identities
+	if identityChanged {
+		skip := "Error 1062"
+		res, err = exec(tx, skip, query, args...)
+		if err != nil {
+			if strings.Contains(err.Error(), skip) {
+				err = collisionf("%s: collision", msg)
+				collision = true
+				addCollision()
+				if dbg {
+					fmt.Printf("%s: collision\n", msg)
+				}
+				return
+			}
+			err = fmt.Errorf("error updating identities %v for (%s,%v) for row %v", err, query, args, row)
+			return
+		}
+		affectedI, err = res.RowsAffected()
+		if err != nil {
+			err = fmt.Errorf("error getting affected rows count %v for (%s,%v) for row %v", err, query, args, row)
+			return
+		}
+		if affectedI <= 0 || dbg {
+			fmt.Printf("%s: affected %d identities rows\n", msg, affectedI)
+		}
+		if newID != "" {
+			_, err = exec(tx, skip, "update identities set id = ? where id = ?", newID, id)
+			if err != nil {
+				if strings.Contains(err.Error(), skip) {
+					err = collisionf("%s: collision, identity %s already exists", msg, newID)
+					collision = true
+					addCollision()
+					return
+				}
+				err = fmt.Errorf("error rekeying identity %s -> %s %v for row %v", id, newID, err, row)
+				return
+			}
+			shadow.rekey("identities", newID)
+		}
 	}
-	if affectedU <= 0 || dbg {
-		fmt.Printf("%s: affected %d uidentities rows\n", msg, affectedU)
+	// Update uidentities (NO_TOUCH_UIDENTITIES skips it, TOUCH_BATCH defers it)
+	touchU := !gNoTouchUIdentities && gTouchBatch == 0
+	if touchU {
+		res, err = exec(tx, "", "update uidentities set "+auditSet("uidentities")+" where uuid = ?", append(auditArgs("uidentities", who), uuid)...)
+		if err != nil {
+			err = fmt.Errorf("error updating uidentities %v for uuid %s for row %v", err, uuid, row)
+			return
+		}
+		affectedU, err = res.RowsAffected()
+		if err != nil {
+			err = fmt.Errorf("error getting affected rows count %v for uuid %s for row %v", err, uuid, row)
+			return
+		}
+		if affectedU <= 0 || dbg {
+			fmt.Printf("%s: affected %d uidentities rows\n", msg, affectedU)
+		}
 	}
-	// Update profiles
-	res, err = exec(tx, "", "update profiles set last_modified = now(), last_modified_by = ?, locked_by = ? where uuid = ?", who, "individual", uuid)
-	if err != nil {
-		err = fmt.Errorf("error updating profiles %v for uuid %s for row %v", err, uuid, row)
-		return
+	// Update profiles (NO_TOUCH_PROFILES skips it unless profile fields changed, TOUCH_BATCH defers it)
+	touchP := profileMsg != "" || (!gNoTouchProfiles && gTouchBatch == 0)
+	if touchP {
+		res, err = exec(tx, "", profileQuery, profileArgs...)
+		if err != nil {
+			err = fmt.Errorf("error updating profiles %v for uuid %s for row %v", err, uuid, row)
+			return
+		}
+		affectedP, err = res.RowsAffected()
+		if err != nil {
+			err = fmt.Errorf("error getting affected rows count %v for uuid %s for row %v", err, uuid, row)
+			return
+		}
+		if affectedP <= 0 || dbg {
+			fmt.Printf("%s: affected %d profiles rows\n", msg, affectedU)
+		}
 	}
-	affectedP, err = res.RowsAffected()
-	if err != nil {
-		err = fmt.Errorf("error getting affected rows count %v for uuid %s for row %v", err, uuid, row)
+	if identityChanged && affectedI <= 0 && gOptimistic {
+		err = concurrentf("%s: identity was modified by another writer since it was read", msg)
 		return
 	}
-	if affectedP <= 0 || dbg {
-		fmt.Printf("%s: affected %d profiles rows\n", msg, affectedU)
-	}
-	if affectedI <= 0 || affectedU <= 0 || affectedP <= 0 {
-		fmt.Printf("WARNING: %s: didn't affect identities or uidentities or profiles: (%d,%d,%d)\n", msg, affectedI, affectedU, affectedP)
+	if (identityChanged && affectedI <= 0) || (touchU && affectedU <= 0) || (touchP && affectedP <= 0) {
+		err = skipf(cWarnPartial, "%s: didn't affect identities or uidentities or profiles: (%d,%d,%d)\n", msg, affectedI, affectedU, affectedP)
 		return
 	}
-	err = tx.Commit()
+	err = shadow.commit(tx, msg)
 	if err != nil {
 		err = fmt.Errorf("error committing transaction %v for row %v", err, row)
 		return
 	}
 	tx = nil
+	addChange(msg)
+	if newID != "" {
+		recordRekey(id, newID)
+		id = newID
+	}
+	recordIdentityForVerify(id, newName, newUsername, newEmail)
+	recordAffected(uuid, "")
+	if gTouchBatch > 0 {
+		if !gNoTouchUIdentities {
+			recordTouch("uidentities", uuid, who)
+		}
+		if !touchP && !gNoTouchProfiles {
+			recordTouch("profiles", uuid, who)
+		}
+	}
 	if gMtx != nil {
 		gMtx.Lock()
 		if affectedI > 0 {
@@ -325,6 +597,16 @@ func updateIdentity(ch chan error, db *sql.DB, dbg, dry bool, row map[string]str
 
 func orgNameToID(db *sql.DB, dbg bool, orgName string) (orgID int, err error) {
 	var found bool
+	if len(gOrgAliases) > 0 {
+		alias := orgName
+		orgName, err = resolveOrgAlias(alias)
+		if err != nil {
+			return
+		}
+		if dbg && orgName != alias {
+			fmt.Printf("org alias %s -> %s\n", alias, orgName)
+		}
+	}
 	if gMtx != nil {
 		gMtx.Lock()
 	}
@@ -338,17 +620,13 @@ func orgNameToID(db *sql.DB, dbg bool, orgName string) (orgID int, err error) {
 		}
 		return
 	}
-	rows, e := query(db, "select id from organizations where name = ?", orgName)
-	fatalOnError(e)
-	for rows.Next() {
-		fatalOnError(rows.Scan(&orgID))
-		found = true
-		break
+	found, err = queryFirst(replica(db), []interface{}{&orgID}, "select id from organizations where name = ?", orgName)
+	if err != nil {
+		err = fmt.Errorf("error looking up organization %s: %v", orgName, err)
+		return
 	}
-	fatalOnError(rows.Err())
-	fatalOnError(rows.Close())
 	if !found {
-		err = fmt.Errorf("cannot find organization_id for %s", orgName)
+		err = notFoundf("cannot find organization_id for %s", orgName)
 		return
 	}
 	if gMtx != nil {
@@ -379,17 +657,13 @@ func sfdcSlugToDASlug(db *sql.DB, dbg bool, sfdcSlug string) (daSlug string, err
 		}
 		return
 	}
-	rows, e := query(db, "select da_name from slug_mapping where sf_name = ?", sfdcSlug)
-	fatalOnError(e)
-	for rows.Next() {
-		fatalOnError(rows.Scan(&daSlug))
-		found = true
-		break
+	found, err = queryFirst(replica(db), []interface{}{&daSlug}, "select da_name from slug_mapping where sf_name = ?", sfdcSlug)
+	if err != nil {
+		err = fmt.Errorf("error looking up DA slug for SFDC slug %s: %v", sfdcSlug, err)
+		return
 	}
-	fatalOnError(rows.Err())
-	fatalOnError(rows.Close())
 	if !found {
-		err = fmt.Errorf("cannot find DA slug for SFDC slug %s", sfdcSlug)
+		err = notFoundf("cannot find DA slug for SFDC slug %s", sfdcSlug)
 		return
 	}
 	if gMtx != nil {
@@ -405,14 +679,61 @@ func sfdcSlugToDASlug(db *sql.DB, dbg bool, sfdcSlug string) (daSlug string, err
 	return
 }
 
+// setInputTZ - sets timezone of CSV dates that have time but no zone, default UTC
+func setInputTZ(tz string) (err error) {
+	gInputTZ = time.UTC
+	if tz == "" {
+		return
+	}
+	gInputTZ, err = time.LoadLocation(tz)
+	if err != nil {
+		err = fmt.Errorf("invalid INPUT_TZ '%s': %v", tz, err)
+	}
+	return
+}
+
+// timeParseAny - parses date or timestamp, the result keeps the zone of the value so its calendar date is the written one
+// Timestamps with zone are in their own zone, timestamps without zone are in INPUT_TZ
+// Date only values are calendar dates, they are never shifted
 func timeParseAny(dtStr string) (time.Time, error) {
-	formats := []string{
-		"2006-01-02T15:04:05Z",
+	zoned := []string{
+		time.RFC3339Nano,
+		"2006-01-02T15:04:05Z0700",
+		"2006-01-02 15:04:05Z07:00",
+		"2006-01-02 15:04:05 -0700",
+		"2006-01-02 15:04:05 MST",
+	}
+	for _, format := range zoned {
+		t, e := time.Parse(format, dtStr)
+		if e == nil {
+			return t, nil
+		}
+	}
+	local := []string{
+		"2006-01-02T15:04:05",
+		"2006-01-02T15:04",
 		"2006-01-02 15:04:05",
 		"2006-01-02 15:04",
 		"2006-01-02 15",
+	}
+	for _, format := range local {
+		t, e := time.ParseInLocation(format, dtStr, gInputTZ)
+		if e == nil {
+			return t, nil
+		}
+	}
+	formats := []string{
 		"2006-01-02",
+		"2006/01/02",
+		"2006.01.02",
+		"Jan 2, 2006",
+		"January 2, 2006",
+		"2 Jan 2006",
+		"2 January 2006",
 		"2006-01",
+		"2006/01",
+		"Jan 2006",
+		"January 2006",
 		"2006",
 	}
 	for _, format := range formats {
@@ -425,43 +746,89 @@ func timeParseAny(dtStr string) (time.Time, error) {
 	return time.Now(), err
 }
 
+// openDate - blank and "present"-like values mean open range (1900-01-01 start or 2100-01-01 end in SortingHat)
+func openDate(dtStr string) bool {
+	switch strings.ToLower(strings.TrimSpace(dtStr)) {
+	case "", "present", "current", "now", "ongoing", "-", "n/a", "null", "none":
+		return true
+	}
+	return false
+}
+
+// parseEnrollmentDate - parses enrollment date, open values are mapped to the given sentinel
+// dates outside of the sentinels range are rejected
+func parseEnrollmentDate(dtStr string, sentinel time.Time) (dt time.Time, err error) {
+	if openDate(dtStr) {
+		dt = sentinel
+		return
+	}
+	dt, err = timeParseAny(strings.TrimSpace(dtStr))
+	if err != nil {
+		return
+	}
+	if dt.Before(gMinDate) || dt.After(gMaxDate) {
+		err = fmt.Errorf("date '%s' is outside of the %s - %s range", dtStr, toYMDDate(gMinDate), toYMDDate(gMaxDate))
+	}
+	return
+}
+
+// toYMDDate - calendar date of dt in its own zone
 func toYMDDate(dt time.Time) string {
 	return fmt.Sprintf("%04d-%02d-%02d", dt.Year(), dt.Month(), dt.Day())
 }
 
-func updateEnrollment(ch chan error, db *sql.DB, dbg, dry bool, row map[string]string) (err error) {
+func updateEnrollment(db *sql.DB, dbg, dry bool, row map[string]string) (err error) {
 	// action identity_id user_sfid user_name user_email project_slug project_id project_name
 	// to_org_name to_start_date to_end_date from_org_name from_start_date from_end_date
-	if ch != nil {
-		defer func() {
-			ch <- err
-		}()
-	}
 	if dbg {
 		fmt.Printf("%v\n", row)
 	}
 	id, _ := row["identity_id"]
 	if id == "" {
+		var newRow map[string]string
+		newRow, err = withFallbackID(db, dbg, row, true)
+		if err != nil || newRow != nil {
+			if err == nil {
+				err = updateEnrollment(db, dbg, dry, newRow)
+			}
+			return
+		}
 		err = fmt.Errorf("identity_id cannot be empty in %v", row)
 		return
 	}
-	rows, err := query(db, "select uuid from identities where id = ?", id)
-	fatalOnError(err)
-	uuid, found := "", false
-	for rows.Next() {
-		fatalOnError(rows.Scan(&uuid))
-		found = true
-		break
-	}
-	fatalOnError(rows.Err())
-	fatalOnError(rows.Close())
+	id = rekeyedID(id)
+	uuid, source := "", ""
+	found, err := queryFirst(replica(db), []interface{}{&uuid, &source}, "select uuid, trim(source) from identities where id = ?", id)
+	if err != nil {
+		err = fmt.Errorf("identity_id %s lookup: %v in %v", id, err, row)
+		return
+	}
 	if !found {
-		fmt.Printf("WARNING: cannot find identity with id=%s (row %v)\n", id, row)
+		var newRow map[string]string
+		newRow, err = withFallbackID(db, dbg, row, true)
+		if err != nil || newRow != nil {
+			if err == nil {
+				err = updateEnrollment(db, dbg, dry, newRow)
+			}
+			return
+		}
+		err = skipf(cWarnNotFound, "cannot find identity with id=%s (row %v)\n", id, row)
 		return
 	}
 	if dbg {
 		fmt.Printf("Found: uuid %s for id %s\n", uuid, id)
 	}
+	if !sourceAllowed(source) {
+		err = skippedf("identity_id %s/%s source %s is filtered out (row %v)", id, uuid, source, row)
+		if dbg {
+			fmt.Printf("%v\n", err)
+		}
+		return
+	}
+	if reason := protectedIdentity(id, uuid); reason != "" {
+		err = protectedf(reason, row)
+		return
+	}
 	orgName, _ := row["from_org_name"]
 	orgName = strings.TrimSpace(orgName)
 	var (
@@ -471,59 +838,107 @@ func updateEnrollment(ch chan error, db *sql.DB, dbg, dry bool, row map[string]s
 		tNewEndDate   time.Time
 	)
 	startDate, _ := row["from_start_date"]
-	startDate = strings.TrimSpace(startDate)
-	if startDate != "" {
-		tStartDate, err = timeParseAny(startDate)
-		if err != nil {
-			err = fmt.Errorf("identity_id %s/%s cannot parse date %s %v", id, uuid, startDate, row)
-			return
-		}
-	} else {
-		tStartDate = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+	tStartDate, err = parseEnrollmentDate(startDate, gMinDate)
+	if err != nil {
+		err = fmt.Errorf("identity_id %s/%s from_start_date: %v in %v", id, uuid, err, row)
+		return
 	}
 	startDate = toYMDDate(tStartDate)
 	endDate, _ := row["from_end_date"]
-	endDate = strings.TrimSpace(endDate)
-	if endDate != "" {
-		tEndDate, err = timeParseAny(endDate)
-		if err != nil {
-			err = fmt.Errorf("identity_id %s/%s cannot parse date %s %v", id, uuid, endDate, row)
-			return
-		}
-	} else {
-		tEndDate = time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+	tEndDate, err = parseEnrollmentDate(endDate, gMaxDate)
+	if err != nil {
+		err = fmt.Errorf("identity_id %s/%s from_end_date: %v in %v", id, uuid, err, row)
+		return
 	}
 	endDate = toYMDDate(tEndDate)
 	newOrgName, _ := row["to_org_name"]
 	newOrgName = strings.TrimSpace(newOrgName)
-	if newOrgName == "" {
-		err = fmt.Errorf("identity_id %s/%s to_org_name cannot be empty in %v", id, uuid, row)
+	independent := isIndependentRow(row, newOrgName)
+	if independent {
+		newOrgName = gIndependentOrg
+	}
+	if newOrgName != "" && !independent {
+		mapped, skip := placeholderOrg(newOrgName)
+		if skip {
+			err = skipf(cWarnOther, "identity_id %s/%s to_org_name '%s' is a placeholder, not an organization, PLACEHOLDER_ORGS_POLICY=skip (row %v)\n", id, uuid, newOrgName, row)
+			return
+		}
+		if mapped != newOrgName {
+			if dbg {
+				fmt.Printf("identity_id %s/%s placeholder to_org_name '%s' mapped to '%s'\n", id, uuid, newOrgName, mapped)
+			}
+			newOrgName = mapped
+			independent = isIndependentRow(row, newOrgName)
+		}
+	}
+	for _, name := range []string{orgName, newOrgName} {
+		if reason := protectedOrg(name); reason != "" {
+			err = protectedf(reason, row)
+			return
+		}
+	}
+	// Delete mode - all to_* columns are empty, from_* columns identify the enrollment to delete
+	toStartDate, _ := row["to_start_date"]
+	toEndDate, _ := row["to_end_date"]
+	toStartDate = strings.TrimSpace(toStartDate)
+	toEndDate = strings.TrimSpace(toEndDate)
+	deletion := newOrgName == "" && toStartDate == "" && toEndDate == ""
+	// End date mode - only from_org_name and to_end_date are given (to_org_name is empty or the same organization)
+	// the open-ended enrollment (ending 2100-01-01) in that organization gets the new end date, its start date is kept
+	fromStartDate, _ := row["from_start_date"]
+	fromEndDate, _ := row["from_end_date"]
+	endOnly := orgName != "" && openDate(fromStartDate) && openDate(fromEndDate) &&
+		toStartDate == "" && toEndDate != "" && (newOrgName == "" || newOrgName == orgName)
+	if endOnly {
+		newOrgName = orgName
+	}
+	if deletion && orgName == "" {
+		err = fmt.Errorf("identity_id %s/%s from_org_name cannot be empty when deleting an enrollment in %v", id, uuid, row)
 		return
 	}
-	newStartDate, _ := row["to_start_date"]
-	newStartDate = strings.TrimSpace(newStartDate)
-	if newStartDate != "" {
-		tNewStartDate, err = timeParseAny(newStartDate)
+	if newOrgName == "" && !deletion && gInferOrg {
+		domain := ""
+		newOrgName, domain, err = inferOrgName(db, dbg, id, row)
 		if err != nil {
-			err = fmt.Errorf("identity_id %s/%s cannot parse date %s %v", id, uuid, newStartDate, row)
+			err = fmt.Errorf("identity_id %s/%s cannot infer organization: %v in %v", id, uuid, err, row)
 			return
 		}
-	} else {
-		tNewStartDate = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+		if newOrgName != "" {
+			fmt.Printf("identity_id %s/%s organization '%s' inferred from email domain %s\n", id, uuid, newOrgName, domain)
+		}
+	}
+	if newOrgName == "" && !deletion {
+		err = fmt.Errorf("identity_id %s/%s to_org_name cannot be empty (unless all to_* columns are empty to delete an enrollment) in %v", id, uuid, row)
+		return
+	}
+	newStartDate, _ := row["to_start_date"]
+	tNewStartDate, err = parseEnrollmentDate(newStartDate, gMinDate)
+	if err != nil {
+		err = fmt.Errorf("identity_id %s/%s to_start_date: %v in %v", id, uuid, err, row)
+		return
 	}
 	newStartDate = toYMDDate(tNewStartDate)
 	newEndDate, _ := row["to_end_date"]
-	newEndDate = strings.TrimSpace(newEndDate)
-	if newEndDate != "" {
-		tNewEndDate, err = timeParseAny(newEndDate)
+	tNewEndDate, err = parseEnrollmentDate(newEndDate, gMaxDate)
+	if err != nil {
+		err = fmt.Errorf("identity_id %s/%s to_end_date: %v in %v", id, uuid, err, row)
+		return
+	}
+	newEndDate = toYMDDate(tNewEndDate)
+	if tStartDate.After(tEndDate) {
+		err = fmt.Errorf("identity_id %s/%s from_start_date %s is after from_end_date %s in %v", id, uuid, startDate, endDate, row)
+		return
+	}
+	if !deletion && tNewStartDate.After(tNewEndDate) {
+		err = fmt.Errorf("identity_id %s/%s to_start_date %s is after to_end_date %s in %v", id, uuid, newStartDate, newEndDate, row)
+		return
+	}
+	if !deletion {
+		err = checkDateSanity(id, uuid, tNewStartDate, tNewEndDate, openDate(row["to_start_date"]), openDate(row["to_end_date"]), row)
 		if err != nil {
-			err = fmt.Errorf("identity_id %s/%s cannot parse date %s %v", id, uuid, newEndDate, row)
 			return
 		}
-	} else {
-		tNewEndDate = time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
 	}
-	newEndDate = toYMDDate(tNewEndDate)
 	var (
 		orgID       int
 		newOrgID    int
@@ -531,8 +946,15 @@ func updateEnrollment(ch chan error, db *sql.DB, dbg, dry bool, row map[string]s
 	)
 	sfdcProjectSlug, _ := row["project_slug"]
 	sfdcProjectSlug = strings.TrimSpace(sfdcProjectSlug)
-	if sfdcProjectSlug != "" {
+	if daSlug, ok := row[cDASlugKey]; ok {
+		// child project of the fan-out
+		projectSlug = daSlug
+	} else if sfdcProjectSlug != "" {
 		projectSlug, err = sfdcSlugToDASlug(db, dbg, sfdcProjectSlug)
+		if err != nil && !isNotFound(err) {
+			err = fmt.Errorf("identity_id %s/%s %v in row %v", id, uuid, err, row)
+			return
+		}
 		if err != nil {
 			// err = fmt.Errorf("identity_id %s/%s error %v in row %v", id, uuid, err, row)
 			if dbg {
@@ -549,13 +971,29 @@ func updateEnrollment(ch chan error, db *sql.DB, dbg, dry bool, row map[string]s
 			if gMtx != nil {
 				gMtx.Unlock()
 			}
-			err = nil
+			err = skippedf("%v", err)
 			return
 		}
 	}
-	if orgName != "" {
-		orgID, err = orgNameToID(db, dbg, orgName)
-		if err != nil {
+	if !projectAllowed(sfdcProjectSlug, projectSlug) {
+		err = skippedf("identity_id %s/%s project %s/%s is filtered out (row %v)", id, uuid, sfdcProjectSlug, projectSlug, row)
+		if dbg {
+			fmt.Printf("%v\n", err)
+		}
+		return
+	}
+	if independent && gIndependentMode == "delete" {
+		// INDEPENDENT_MODE=delete - no enrollment means unaffiliated, from_* columns are not used
+		err = markUnaffiliated(db, dbg, dry, id, uuid, projectSlug, newStartDate, newEndDate, row)
+		return
+	}
+	if orgName != "" {
+		orgID, err = orgNameToID(db, dbg, orgName)
+		if err != nil && !isNotFound(err) {
+			err = fmt.Errorf("identity_id %s/%s %v in row %v", id, uuid, err, row)
+			return
+		}
+		if err != nil {
 			// err = fmt.Errorf("identity_id %s/%s error %v in row %v", id, uuid, err, row)
 			if dbg {
 				fmt.Printf("WARNING: identity_id %s/%s error %v in row %v\n", id, uuid, err, row)
@@ -571,39 +1009,51 @@ func updateEnrollment(ch chan error, db *sql.DB, dbg, dry bool, row map[string]s
 			if gMtx != nil {
 				gMtx.Unlock()
 			}
-			err = nil
+			err = skippedf("%v", err)
 			return
 		}
 	}
-	newOrgID, err = orgNameToID(db, dbg, newOrgName)
-	if err != nil {
-		// err = fmt.Errorf("identity_id %s/%s error %v in row %v", id, uuid, err, row)
-		if dbg {
-			fmt.Printf("WARNING: identity_id %s/%s error %v in row %v\n", id, uuid, err, row)
-		}
-		if gMtx != nil {
-			gMtx.Lock()
+	if !deletion {
+		newOrgID, err = orgNameToID(db, dbg, newOrgName)
+		if err != nil && !isNotFound(err) {
+			err = fmt.Errorf("identity_id %s/%s %v in row %v", id, uuid, err, row)
+			return
 		}
-		_, rep := gOrgMiss[newOrgName]
-		if !rep {
-			gOrgMiss[newOrgName] = struct{}{}
-			fmt.Printf("Organization not found in SH DB: %s\n", newOrgName)
+		if err != nil {
+			// err = fmt.Errorf("identity_id %s/%s error %v in row %v", id, uuid, err, row)
+			if dbg {
+				fmt.Printf("WARNING: identity_id %s/%s error %v in row %v\n", id, uuid, err, row)
+			}
+			if gMtx != nil {
+				gMtx.Lock()
+			}
+			_, rep := gOrgMiss[newOrgName]
+			if !rep {
+				gOrgMiss[newOrgName] = struct{}{}
+				fmt.Printf("Organization not found in SH DB: %s\n", newOrgName)
+			}
+			if gMtx != nil {
+				gMtx.Unlock()
+			}
+			err = skippedf("%v", err)
+			return
 		}
-		if gMtx != nil {
-			gMtx.Unlock()
+		if newOrgName != orgName {
+			err = checkAffiliationSanity(db, dbg, id, uuid, newOrgName, tNewEndDate, row)
+			if err != nil {
+				return
+			}
 		}
-		err = nil
-		return
 	}
 	// action identity_id user_sfid user_name user_email project_slug project_id project_name
 	// to_org_name to_start_date to_end_date from_org_name from_start_date from_end_date
 	// fmt.Printf("(%s,%s,%s,%s) (%v,%v,%v,%v)\n", startDate, endDate, newStartDate, newEndDate, tStartDate, tEndDate, tNewStartDate, tNewEndDate)
-	eid := 0
+	eid, version := 0, ""
 	if orgName != "" {
 		// Update mode - we have
 		args := []interface{}{uuid, projectSlug, orgID}
-		q := "select id from enrollments where uuid = ? and trim(coalesce(project_slug, '')) = ? and organization_id = ?"
-		if startDate != "" {
+		q := "select id, date_format(start, '%Y-%m-%d'), " + cVersionColumn + " from enrollments where uuid = ? and trim(coalesce(project_slug, '')) = ? and organization_id = ?"
+		if startDate != "" && !endOnly {
 			q += " and start = str_to_date(?, ?)"
 			args = append(args, startDate, cDateTimeFormat)
 		}
@@ -612,114 +1062,161 @@ func updateEnrollment(ch chan error, db *sql.DB, dbg, dry bool, row map[string]s
 			args = append(args, endDate, cDateTimeFormat)
 		}
 		found := 0
+		dbStartDate := ""
+		var rows *stmtRows
 		rows, err = query(db, q, args...)
-		fatalOnError(err)
+		if err != nil {
+			err = fmt.Errorf("identity_id %s/%s enrollment lookup: %v in %v", id, uuid, err, row)
+			return
+		}
 		for rows.Next() {
-			fatalOnError(rows.Scan(&eid))
+			err = rows.Scan(&eid, &dbStartDate, &version)
+			if err != nil {
+				break
+			}
 			found++
 			if found > 1 {
 				break
 			}
 		}
-		fatalOnError(rows.Err())
-		fatalOnError(rows.Close())
+		if err == nil {
+			err = rows.Err()
+		}
+		e := rows.Close()
+		if err == nil {
+			err = e
+		}
+		if err != nil {
+			err = fmt.Errorf("identity_id %s/%s enrollment lookup: %v in %v", id, uuid, err, row)
+			return
+		}
 		if found == 0 {
-			fmt.Printf("WARNING: cannot find identity with uuid=%s project_slug=%s organization=%s/%d start=%s end=%s (row %v)\n", uuid, projectSlug, orgName, orgID, startDate, endDate, row)
+			err = skipf(cWarnNotFound, "cannot find identity with uuid=%s project_slug=%s organization=%s/%d start=%s end=%s (row %v)\n", uuid, projectSlug, orgName, orgID, startDate, endDate, row)
 			return
 		}
 		if found > 1 {
-			fmt.Printf("WARNING: found more than one identities with uuid=%s project_slug=%s organization=%s/%d start=%s end=%s (row %v)\n", uuid, projectSlug, orgName, orgID, startDate, endDate, row)
+			err = skipf(cWarnValidation, "found more than one identities with uuid=%s project_slug=%s organization=%s/%d start=%s end=%s (row %v)\n", uuid, projectSlug, orgName, orgID, startDate, endDate, row)
 			return
 		}
+		if endOnly {
+			startDate = dbStartDate
+			newStartDate = dbStartDate
+			if newEndDate < newStartDate {
+				err = fmt.Errorf("identity_id %s/%s new end date %s is before enrollment %d start date %s in %v", id, uuid, newEndDate, eid, newStartDate, row)
+				return
+			}
+		}
 		if dbg {
 			fmt.Printf("Found: (%d) for uuid=%s project_slug=%s organization=%s/%d start=%s end=%s\n", eid, uuid, projectSlug, orgName, orgID, startDate, endDate)
 		}
 	} else if dbg {
 		fmt.Printf("identity %s/%s insert mode for row %v\n", id, uuid, row)
 	}
-	if orgID == newOrgID && startDate == newStartDate && endDate == newEndDate {
+	if !deletion && orgID == newOrgID && startDate == newStartDate && endDate == newEndDate {
 		if dbg {
 			fmt.Printf("enrollment %d for identity_id %s/%s nothing changed in %v\n", eid, id, uuid, row)
 		}
 		return
 	}
-	// Concurrecncy check
-	if gMtx != nil {
-		// Lock working on identity ID
-		gMtx.Lock()
-		mtx, found := gIDMtx[id]
-		gMtx.Unlock()
-		if !found {
-			mtx = &sync.Mutex{}
-			gMtx.Lock()
-			gIDMtx[id] = mtx
-			gMtx.Unlock()
-		} else if dbg {
-			fmt.Printf("Duplicate id %s found in %v\n", id, row)
+	if eid > 0 {
+		stale := false
+		stale, err = modifiedAfterExport(db, "enrollments", "id", eid)
+		if err != nil {
+			err = fmt.Errorf("enrollment %d stale-export check: %v in %v", eid, err, row)
+			return
 		}
-		mtx.Lock()
-		defer mtx.Unlock()
-		// Lock working on uidentity/profile UUID
-		gMtx.Lock()
-		umtx, found := gUUIDMtx[uuid]
-		gMtx.Unlock()
-		if !found {
-			umtx = &sync.Mutex{}
-			gMtx.Lock()
-			gUUIDMtx[uuid] = umtx
-			gMtx.Unlock()
-		} else if dbg {
-			fmt.Printf("Duplicate uuid %s found in %v\n", uuid, row)
+		if stale {
+			// enrollment values are never blank, so merge-nonempty keeps the DB enrollment like report-only
+			strategy := conflictStrategy("enrollment")
+			err = conflictRow(
+				strategy == cConflictOverwrite,
+				strategy == cConflictSkip,
+				"enrollment %d identity_id %s/%s was modified after the export, conflict strategy %s (row %v)\n",
+				eid, id, uuid, strategy, row,
+			)
+			if err != nil || strategy != cConflictOverwrite {
+				return
+			}
 		}
-		umtx.Lock()
-		defer umtx.Unlock()
 	}
 	args := []interface{}{}
-	query, msg, who := "", "", ""
-	if eid > 0 {
+	userSFID, _ := row["user_sfid"]
+	userName, _ := row["user_name"]
+	userEmail, _ := row["user_email"]
+	userSFID = strings.TrimSpace(userSFID)
+	userName = strings.TrimSpace(userName)
+	userEmail = strings.TrimSpace(userEmail)
+	who := "email:" + userEmail + ",name:" + userName + ",sfid:" + userSFID
+	query, msg := "", ""
+	var before *enrollmentState
+	// ENROLLMENT_HISTORY=keep - the existing enrollment is kept as history instead of being moved to the new range
+	history := !deletion && eid > 0 && gKeepEnrollmentHistory && newStartDate > startDate
+	historyQuery, historyArgs := "", []interface{}{}
+	if deletion {
+		// Keep deleted values, so the deletion can be compensated
+		before, err = getEnrollmentState(db, eid)
+		if err != nil {
+			err = fmt.Errorf("error getting enrollment %d state %v for row %v", eid, err, row)
+			return
+		}
+		query = "delete from enrollments where id = ?"
+		args = append(args, eid)
+		versionQuery, versionArgs := versionCheck(version)
+		query += versionQuery
+		args = append(args, versionArgs...)
+		msg = fmt.Sprintf("delete enrollment %d identity_id %s/%s %s/%d %s %s %s by %s, restore with: %s", eid, id, uuid, orgName, orgID, projectSlug, startDate, endDate, who, before.restoreSQL())
+	} else if eid > 0 && !history {
 		query = "update enrollments set "
 		msg = fmt.Sprintf("enrollment %d identity_id %s/%s ", eid, id, uuid)
 		if newOrgID != orgID {
 			query += "organization_id = ?, "
-			args = append(args, newOrgName)
-			msg += fmt.Sprintf("org %s/%d -> %s/%d ", orgName, orgID, newOrgName, newOrgID)
+			args = append(args, newOrgID)
+			msg += fieldChange("org", fmt.Sprintf("%s/%d", orgName, orgID), fmt.Sprintf("%s/%d", newOrgName, newOrgID))
 		}
 		if newStartDate != startDate {
 			query += "start = str_to_date(?, ?), "
 			args = append(args, newStartDate, cDateTimeFormat)
-			msg += "start " + startDate + " -> " + newStartDate + " "
+			msg += fieldChange("start", startDate, newStartDate)
 		}
 		if newEndDate != endDate {
 			query += "end = str_to_date(?, ?), "
 			args = append(args, newEndDate, cDateTimeFormat)
-			msg += "end " + endDate + " -> " + newEndDate + " "
-		}
-		query += "last_modified = now(), last_modified_by = ?, locked_by = ? where id = ?"
-		userSFID, _ := row["user_sfid"]
-		userName, _ := row["user_name"]
-		userEmail, _ := row["user_email"]
-		userSFID = strings.TrimSpace(userSFID)
-		userName = strings.TrimSpace(userName)
-		userEmail = strings.TrimSpace(userEmail)
-		who = "email:" + userEmail + ",name:" + userName + ",sfid:" + userSFID
+			msg += fieldChange("end", endDate, newEndDate)
+		}
+		query += auditSet("enrollments") + " where id = ?"
 		msg += " by " + who
-		args = append(args, who, "individual", id)
+		args = append(args, auditArgs("enrollments", who)...)
+		args = append(args, eid)
+		versionQuery, versionArgs := versionCheck(version)
+		query += versionQuery
+		args = append(args, versionArgs...)
 	} else {
-		userSFID, _ := row["user_sfid"]
-		userName, _ := row["user_name"]
-		userEmail, _ := row["user_email"]
-		userSFID = strings.TrimSpace(userSFID)
-		userName = strings.TrimSpace(userName)
-		userEmail = strings.TrimSpace(userEmail)
-		who = "email:" + userEmail + ",name:" + userName + ",sfid:" + userSFID
-		query = "insert into enrollments(uuid, organization_id, project_slug, start, end, last_modified_by, locked_by) "
-		query += "values(?, ?, ?, str_to_date(?, ?), str_to_date(?, ?), ?, ?)"
-		args = append(args, uuid, newOrgID, projectSlug, newStartDate, cDateTimeFormat, newEndDate, cDateTimeFormat, who, "individual")
-		msg = fmt.Sprintf("new enrollment identity_id %s/%s %s/%d %s %s %s by %s", id, uuid, newOrgName, newOrgID, projectSlug, newStartDate, newEndDate, who)
+		if history && newStartDate < endDate {
+			// the existing enrollment ends when the new one starts, earlier ended ones are left unchanged
+			historyQuery = "update enrollments set end = str_to_date(?, ?), " + auditSet("enrollments") + " where id = ?"
+			historyArgs = append(historyArgs, newStartDate, cDateTimeFormat)
+			historyArgs = append(historyArgs, auditArgs("enrollments", who)...)
+			historyArgs = append(historyArgs, eid)
+			versionQuery, versionArgs := versionCheck(version)
+			historyQuery += versionQuery
+			historyArgs = append(historyArgs, versionArgs...)
+			msg = fmt.Sprintf("enrollment %d identity_id %s/%s %s/%d %skept as history, ", eid, id, uuid, orgName, orgID, fieldChange("end", endDate, newStartDate))
+		}
+		columns, values := auditInsert("enrollments")
+		query = "insert into enrollments(uuid, organization_id, project_slug, start, end" + columns + ") "
+		query += "values(?, ?, ?, str_to_date(?, ?), str_to_date(?, ?)" + values + ")"
+		args = append(args, uuid, newOrgID, projectSlug, newStartDate, cDateTimeFormat, newEndDate, cDateTimeFormat)
+		args = append(args, auditArgs("enrollments", who)...)
+		msg += fmt.Sprintf("new enrollment identity_id %s/%s %s/%d %s %s %s by %s", id, uuid, newOrgName, newOrgID, projectSlug, newStartDate, newEndDate, who)
 	}
 	if dry {
 		fmt.Printf("%s\n", msg)
+		addChange(msg)
+		recordPlanned(uuid)
 		if dbg {
+			if historyQuery != "" {
+				fmt.Printf("(%s,%v)\n", historyQuery, historyArgs)
+			}
 			fmt.Printf("(%s,%v)\n", query, args)
 		}
 		return
@@ -732,11 +1229,13 @@ func updateEnrollment(ch chan error, db *sql.DB, dbg, dry bool, row map[string]s
 		tx        *sql.Tx
 		res       sql.Result
 	)
-	tx, err = db.Begin()
+	var cancelTx context.CancelFunc
+	tx, cancelTx, err = beginTx(db)
 	if err != nil {
 		err = fmt.Errorf("error starting transaction %v for row %v", err, row)
 		return
 	}
+	defer cancelTx()
 	collision := false
 	defer func() {
 		if tx != nil {
@@ -746,19 +1245,67 @@ func updateEnrollment(ch chan error, db *sql.DB, dbg, dry bool, row map[string]s
 			_ = tx.Rollback()
 		}
 	}()
+	err = lockEnrollment(tx, eid, uuid, orgID, startDate, endDate)
+	if err != nil {
+		err = fmt.Errorf("identity_id %s/%s %v in %v", id, uuid, err, row)
+		return
+	}
+	var shadowKey interface{}
+	if eid > 0 {
+		shadowKey = eid
+	}
+	// Shadow runs report row states before and after the transaction
+	shadow := newShadow(tx, uuid)
+	err = shadow.capture("enrollments", "id", shadowKey)
+	if err == nil && history {
+		err = shadow.capture("enrollments", "id", nil)
+	}
+	if err == nil {
+		err = shadow.capture("uidentities", "uuid", uuid)
+	}
+	if err == nil {
+		err = shadow.capture("profiles", "uuid", uuid)
+	}
+	if err != nil {
+		err = fmt.Errorf("error capturing shadow state %v for row %v", err, row)
+		return
+	}
+	// End the existing enrollment kept as history
+	if historyQuery != "" {
+		res, err = exec(tx, "", historyQuery, historyArgs...)
+		if err != nil {
+			err = fmt.Errorf("error ending enrollment %d %v for (%s,%v) for row %v", eid, err, historyQuery, historyArgs, row)
+			return
+		}
+		var affected int64
+		affected, err = res.RowsAffected()
+		if err != nil {
+			err = fmt.Errorf("error getting affected rows count %v for (%s,%v) for row %v", err, historyQuery, historyArgs, row)
+			return
+		}
+		if affected <= 0 {
+			if gOptimistic {
+				err = concurrentf("%s: enrollment was modified by another writer since it was read", msg)
+				return
+			}
+			err = skipf(cWarnPartial, "%s: didn't affect enrollment %d kept as history\n", msg, eid)
+			return
+		}
+	}
 	// Update/Insert enrollments
 	skip := "Error 1062"
 	res, err = exec(tx, skip, query, args...)
 	if err != nil {
 		if strings.Contains(err.Error(), skip) {
-			err = nil
+			err = collisionf("%s: collision", msg)
 			collision = true
+			addCollision()
 			if dbg {
 				fmt.Printf("%s: collision\n", msg)
 			}
 			return
 		}
-		err = fmt.Errorf("error updating/adding enrollments %v for (%s,%v) for row %v", err, query, args, row)
+		err = fmt.Errorf("error updating/adding/deleting enrollments %v for (%s,%v) for row %v", err, query, args, row)
 		return
 	}
 	affectedE, err = res.RowsAffected()
@@ -766,47 +1313,91 @@ func updateEnrollment(ch chan error, db *sql.DB, dbg, dry bool, row map[string]s
 		err = fmt.Errorf("error getting affected rows count %v for (%s,%v) for row %v", err, query, args, row)
 		return
 	}
-	if affectedE <= 0 || dbg {
-		fmt.Printf("%s: affected %d enrollments rows\n", msg, affectedE)
+	if deletion {
+		err = auditEnrollmentDeletion(tx, eid, before, who)
+		if err != nil {
+			err = fmt.Errorf("error recording deletion of enrollment %d in the audit trail %v for row %v", eid, err, row)
+			return
+		}
 	}
-	// Update uidentities
-	res, err = exec(tx, "", "update uidentities set last_modified = now(), last_modified_by = ?, locked_by = ? where uuid = ?", who, "individual", uuid)
-	if err != nil {
-		err = fmt.Errorf("error updating uidentities %v for uuid %s for row %v", err, uuid, row)
-		return
+	verifyEID := int64(eid)
+	if eid == 0 || history {
+		verifyEID, err = res.LastInsertId()
+		if err != nil {
+			err = fmt.Errorf("error getting inserted id %v for (%s,%v) for row %v", err, query, args, row)
+			return
+		}
+		shadow.rekey("enrollments", verifyEID)
 	}
-	affectedU, err = res.RowsAffected()
-	if err != nil {
-		err = fmt.Errorf("error getting affected rows count %v for uuid %s for row %v", err, uuid, row)
-		return
+	if affectedE <= 0 || dbg {
+		fmt.Printf("%s: affected %d enrollments rows\n", msg, affectedE)
 	}
-	if affectedU <= 0 || dbg {
-		fmt.Printf("%s: affected %d uidentities rows\n", msg, affectedU)
+	// Update uidentities (NO_TOUCH_UIDENTITIES skips it, TOUCH_BATCH defers it)
+	touchU := !gNoTouchUIdentities && gTouchBatch == 0
+	if touchU {
+		res, err = exec(tx, "", "update uidentities set "+auditSet("uidentities")+" where uuid = ?", append(auditArgs("uidentities", who), uuid)...)
+		if err != nil {
+			err = fmt.Errorf("error updating uidentities %v for uuid %s for row %v", err, uuid, row)
+			return
+		}
+		affectedU, err = res.RowsAffected()
+		if err != nil {
+			err = fmt.Errorf("error getting affected rows count %v for uuid %s for row %v", err, uuid, row)
+			return
+		}
+		if affectedU <= 0 || dbg {
+			fmt.Printf("%s: affected %d uidentities rows\n", msg, affectedU)
+		}
 	}
-	// Update profiles
-	res, err = exec(tx, "", "update profiles set last_modified = now(), last_modified_by = ?, locked_by = ? where uuid = ?", who, "individual", uuid)
-	if err != nil {
-		err = fmt.Errorf("error updating profiles %v for uuid %s for row %v", err, uuid, row)
-		return
+	// Update profiles (NO_TOUCH_PROFILES skips it, TOUCH_BATCH defers it)
+	touchP := !gNoTouchProfiles && gTouchBatch == 0
+	if touchP {
+		res, err = exec(tx, "", "update profiles set "+auditSet("profiles")+" where uuid = ?", append(auditArgs("profiles", who), uuid)...)
+		if err != nil {
+			err = fmt.Errorf("error updating profiles %v for uuid %s for row %v", err, uuid, row)
+			return
+		}
+		affectedP, err = res.RowsAffected()
+		if err != nil {
+			err = fmt.Errorf("error getting affected rows count %v for uuid %s for row %v", err, uuid, row)
+			return
+		}
+		if affectedP <= 0 || dbg {
+			fmt.Printf("%s: affected %d profiles rows\n", msg, affectedU)
+		}
 	}
-	affectedP, err = res.RowsAffected()
-	if err != nil {
-		err = fmt.Errorf("error getting affected rows count %v for uuid %s for row %v", err, uuid, row)
+	if affectedE <= 0 && eid > 0 && gOptimistic {
+		err = concurrentf("%s: enrollment was modified by another writer since it was read", msg)
 		return
 	}
-	if affectedP <= 0 || dbg {
-		fmt.Printf("%s: affected %d profiles rows\n", msg, affectedU)
-	}
-	if affectedE <= 0 || affectedU <= 0 || affectedP <= 0 {
-		fmt.Printf("WARNING: %s: didn't affect enrollments or uidentities or profiles: (%d,%d,%d)\n", msg, affectedE, affectedU, affectedP)
+	if affectedE <= 0 || (touchU && affectedU <= 0) || (touchP && affectedP <= 0) {
+		err = skipf(cWarnPartial, "%s: didn't affect enrollments or uidentities or profiles: (%d,%d,%d)\n", msg, affectedE, affectedU, affectedP)
 		return
 	}
-	err = tx.Commit()
+	err = shadow.commit(tx, msg)
 	if err != nil {
 		err = fmt.Errorf("error committing transaction %v for row %v", err, row)
 		return
 	}
 	tx = nil
+	addChange(msg)
+	if deletion {
+		recordEnrollmentDeletionForVerify(verifyEID)
+	} else {
+		recordEnrollmentForVerify(verifyEID, uuid, newOrgID, projectSlug, newStartDate, newEndDate)
+	}
+	recordAffected(uuid, projectSlug)
+	if !deletion {
+		recordMerge(uuid)
+	}
+	if gTouchBatch > 0 {
+		if !gNoTouchUIdentities {
+			recordTouch("uidentities", uuid, who)
+		}
+		if !gNoTouchProfiles {
+			recordTouch("profiles", uuid, who)
+		}
+	}
 	if gMtx != nil {
 		gMtx.Lock()
 		if affectedE > 0 {
@@ -823,7 +1414,262 @@ func updateEnrollment(ch chan error, db *sql.DB, dbg, dry bool, row map[string]s
 	return
 }
 
-func importCSVfiles(db *sql.DB, fileNames []string) (err error) {
+// rowProcessor - processes a single CSV row, for example updateIdentity or updateEnrollment
+type rowProcessor func(db *sql.DB, dbg, dry bool, row map[string]string) error
+
+// rowResult - result of processing a single CSV row, n is the data row number (header is row 0)
+type rowResult struct {
+	n   int
+	err error
+}
+
+// processRows - processes CSV lines (first line is a header) using thrN threads
+// Errors are handled according to the error policy, returns sorted numbers of rows that failed or were skipped
+// and of rows not processed because of a termination signal (then the error is errTerminated)
+func processRows(db *sql.DB, dbg, dry bool, thrN int, kind string, lines [][]string, policy *errorPolicy, results *rowResults, fn rowProcessor) (failed, remaining []int, err error) {
+	if len(lines) == 0 {
+		return
+	}
+	hdr := []string{}
+	for _, col := range lines[0] {
+		hdr = append(hdr, col)
+	}
+	if dbg {
+		fmt.Printf("%s header: %s\n", kind, hdr)
+	}
+	failedRows := []int{}
+	defer func() {
+		sort.Ints(failedRows)
+		failed = failedRows
+		sort.Ints(remaining)
+		if err == nil && len(remaining) > 0 {
+			err = errTerminated
+		}
+	}()
+	handle := func(res rowResult) error {
+		if res.err == errDeferred {
+			return nil
+		}
+		results.record(res.n, res.err)
+		if res.err == nil {
+			return nil
+		}
+		if res.err == errTerminated {
+			remaining = append(remaining, res.n)
+			return nil
+		}
+		if isSkipped(res.err) {
+			failedRows = append(failedRows, res.n)
+			return nil
+		}
+		if res.err == errRunTimeout || policy.mode == cOnErrorAbort {
+			return res.err
+		}
+		failedRows = append(failedRows, res.n)
+		warnf(errorCategory(res.err), "%s row %d failed: %v\n", kind, res.n, res.err)
+		// interleaved enrollments and identities share the policy
+		policy.mtx.Lock()
+		defer policy.mtx.Unlock()
+		policy.failed++
+		if policy.mode == cOnErrorThreshold && policy.failed > policy.threshold {
+			return fmt.Errorf("%d rows failed, threshold %d exceeded, last error: %v", policy.failed, policy.threshold, res.err)
+		}
+		return nil
+	}
+	getRow := func(line []string) map[string]string {
+		row := map[string]string{}
+		for c, col := range line {
+			row[hdr[c]] = col
+		}
+		registerRowPII(row)
+		return row
+	}
+	shards, keys, err := shardRows(db, lines, thrN)
+	if err != nil {
+		return
+	}
+	// every row holds the lock of its uuid, rows of the same uuid never run concurrently, even across imports
+	apply := func(n int) error {
+		if e := runExpired(); e != nil {
+			return e
+		}
+		unlock := gUUIDLocks.lock(keys[n])
+		defer unlock()
+		return fn(db, dbg, dry, getRow(lines[n]))
+	}
+	if thrN > 1 {
+		// Buffered, so rows still in flight can finish when we return early
+		ch := make(chan rowResult, len(lines))
+		stop := make(chan struct{})
+		defer close(stop)
+		queues := make([]chan int, thrN)
+		for t := range queues {
+			queues[t] = make(chan int, len(lines))
+			go func(queue chan int) {
+				for n := range queue {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					ch <- rowResult{n: n, err: apply(n)}
+				}
+			}(queues[t])
+		}
+		defer func() {
+			for _, queue := range queues {
+				close(queue)
+			}
+		}()
+		pending := 0
+		drain := func() error {
+			for ; pending > 0; pending-- {
+				e := handle(<-ch)
+				if e != nil {
+					return e
+				}
+			}
+			return nil
+		}
+		for i := 1; i < len(lines); i++ {
+			if shards[i] != cSerialShard {
+				queues[shards[i]] <- i
+				pending++
+				continue
+			}
+			// Rows that can touch any uuid wait for all previous rows and run alone
+			err = drain()
+			if err != nil {
+				return
+			}
+			err = handle(rowResult{n: i, err: apply(i)})
+			if err != nil {
+				return
+			}
+		}
+		err = drain()
+		return
+	}
+	for i := 1; i < len(lines); i++ {
+		err = handle(rowResult{n: i, err: apply(i)})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// csvInput - parsed CSV file, raw - original text of lines (nil when unknown)
+type csvInput struct {
+	name  string
+	lines [][]string
+	raw   []rawRecord
+}
+
+// readCSVFiles - reads and parses CSV files
+func readCSVFiles(fileNames []string, dbg bool) (inputs []csvInput, err error) {
+	for _, fileName := range fileNames {
+		var f *os.File
+		f, err = os.Open(fileName)
+		if err != nil {
+			return
+		}
+		input := csvInput{name: fileName}
+		input.lines, input.raw, err = readCSVRaw(f, fileName, os.Getenv("ENCODING"), dbg)
+		_ = f.Close()
+		if err != nil {
+			return
+		}
+		inputs = append(inputs, input)
+	}
+	return
+}
+
+// loadedInputs - input files read, checked against MANIFEST, with COLUMNS_FILE columns computed and rows selected
+// (START_ROW, END_ROW, LIMIT, SAMPLE, IDS_FILE), files - hashes of the files
+type loadedInputs struct {
+	organizations []csvInput
+	identities    []csvInput
+	profiles      []csvInput
+	affiliations  []csvInput
+	files         []runFile
+}
+
+// loadInputs - reads input files, checks them against the manifest, computes columns and selects rows to process
+func loadInputs(dbg bool, inputs inputFiles, files []runFile) (loaded *loadedInputs, err error) {
+	loaded = &loadedInputs{files: files}
+	kinds := []*[]csvInput{&loaded.organizations, &loaded.identities, &loaded.profiles, &loaded.affiliations}
+	all := []csvInput{}
+	for i, fileNames := range [][]string{inputs.organizations, inputs.identities, inputs.profiles, inputs.affiliations} {
+		*kinds[i], err = readCSVFiles(fileNames, dbg)
+		if err != nil {
+			return
+		}
+		all = append(all, *kinds[i]...)
+	}
+
+	// Truncated or tampered files are never applied
+	err = verifyManifest(files, all)
+	if err != nil {
+		return
+	}
+
+	// Columns computed from other columns (COLUMNS_FILE)
+	for i, kind := range kinds {
+		err = applyComputedColumns(gComputedKinds[i+1], *kind)
+		if err != nil {
+			return
+		}
+	}
+
+	// Trial or partial rerun on a subset of rows
+	for _, kind := range kinds {
+		for i := range *kind {
+			input := &(*kind)[i]
+			input.lines, input.raw = selectLines(input.name, input.lines, input.raw)
+		}
+	}
+	return
+}
+
+// dataRows - number of data rows (without headers) in all inputs
+func dataRows(inputs []csvInput) (n int) {
+	for _, input := range inputs {
+		if len(input.lines) > 0 {
+			n += len(input.lines) - 1
+		}
+	}
+	return
+}
+
+// runOptions - settings of a single import run that are not taken from the environment
+type runOptions struct {
+	// quiet - the run has no side effects outside of the database rows it changes: no import_runs record, run and
+	// post-row hooks, notifications, change events, ledger entries, SUMMARY_OUT and AFFECTED_UUIDS files (staging
+	// phase, dry-runs checking all databases first), pre-row hooks still run because they can change the rows
+	quiet bool
+	// verify - verification pass even without VERIFY
+	verify bool
+	// plan - every change must be one of the plan's changes (production phase after staging)
+	plan *importPlan
+	// session - the run is a part of a session the caller reports as one run: no import_runs record, run hooks,
+	// notifications, SUMMARY_OUT and AFFECTED_UUIDS files (review applying one person)
+	session bool
+	// inputs - already loaded inputs, the files are not read, verified or selected again (review applying one person)
+	inputs *loadedInputs
+	// shadow - shadow run even without SHADOW, diffs are not written to SHADOW_OUT (review preview)
+	shadow bool
+	// outcomes - keep per-row outcomes of every input file in the summary even without RESULTS (SFDC pull)
+	outcomes bool
+}
+
+// importCSVfiles - imports organizations files, then identities, profiles and affiliations files (each in given order)
+func importCSVfiles(db *sql.DB, dbg, dry bool, inputs inputFiles, opts runOptions) (summary *importSummary, err error) {
+	defer trackRun()()
+	if terminating() {
+		err = errTerminated
+		return
+	}
 	gUpdatedEnrollments = make(map[string]struct{})
 	gUpdatedIdentities = make(map[string]struct{})
 	gUpdatedUIdentities = make(map[string]struct{})
@@ -831,178 +1677,534 @@ func importCSVfiles(db *sql.DB, fileNames []string) (err error) {
 	gOrgMap = make(map[string]int)
 	gSlugMap = make(map[string]string)
 	gOrgMiss = make(map[string]struct{})
+	gUpdatedOrganizations = make(map[string]struct{})
 	gSlugMiss = make(map[string]struct{})
+	resetAffected()
+	resetLatencies()
 	gDebugSQL = os.Getenv("DEBUG_SQL") != ""
-	dbg := os.Getenv("DEBUG") != ""
-	dry := os.Getenv("DRY") != ""
-	identitiesFile := fileNames[0]
-	affiliationsFile := fileNames[1]
-	fmt.Printf("Importing: %s, %s files\n", identitiesFile, affiliationsFile)
-	var fileIdentities *os.File
-	fileIdentities, err = os.Open(identitiesFile)
+	gPanicOnDBError = os.Getenv("PANIC_ON_DB_ERROR") != ""
+	gNoTouchUIdentities = os.Getenv("NO_TOUCH_UIDENTITIES") != ""
+	gNoTouchProfiles = os.Getenv("NO_TOUCH_PROFILES") != ""
+	gAllowBlanking = os.Getenv("ALLOW_BLANKING") != ""
+	gQuiet = opts.quiet
+	gOutcomes = opts.outcomes
+	err = setShadow(opts.shadow)
 	if err != nil {
 		return
 	}
-	defer func() {
-		_ = fileIdentities.Close()
-	}()
-	var fileAffiliations *os.File
-	fileAffiliations, err = os.Open(affiliationsFile)
+	err = setEvents(dry || opts.quiet)
+	if err != nil {
+		return
+	}
+	err = setPlan(dry, opts.plan)
+	if err != nil {
+		return
+	}
+	resetVerify(!dry && !gShadow && (os.Getenv("VERIFY") != "" || opts.verify))
+	gIgnoreCaseEmail = os.Getenv("IGNORE_CASE_EMAIL") != ""
+	gIgnoreCaseUsername = os.Getenv("IGNORE_CASE_USERNAME") != ""
+	err = setNormalize(os.Getenv("NORMALIZE"))
+	if err != nil {
+		return
+	}
+	err = setNameCompare()
+	if err != nil {
+		return
+	}
+	err = setProtections()
+	if err != nil {
+		return
+	}
+	err = setOrgSanity()
+	if err != nil {
+		return
+	}
+	err = setDateSanity()
 	if err != nil {
 		return
 	}
+	err = setPlaceholderOrgs()
+	if err != nil {
+		return
+	}
+	err = setIndependent()
+	if err != nil {
+		return
+	}
+	err = setAllowColumns()
+	if err != nil {
+		return
+	}
+	err = setInputTZ(os.Getenv("INPUT_TZ"))
+	if err != nil {
+		return
+	}
+	err = setSlowQuery()
+	if err != nil {
+		return
+	}
+	err = setTouchBatch()
+	if err != nil {
+		return
+	}
+	err = setIsolation()
+	if err != nil {
+		return
+	}
+	err = setOptimistic()
+	if err != nil {
+		return
+	}
+	err = setIDFallback()
+	if err != nil {
+		return
+	}
+	err = setTimeouts()
+	if err != nil {
+		return
+	}
+	setSourceFilter()
+	setProjectFilter()
+	err = setSample()
+	if err != nil {
+		return
+	}
+	err = setBulk()
+	if err != nil {
+		return
+	}
+	err = setComputedColumns()
+	if err != nil {
+		return
+	}
+	err = setFanOut()
+	if err != nil {
+		return
+	}
+	setInferOrg()
+	resetCountries()
+	err = setStaleMode()
+	if err != nil {
+		return
+	}
+	err = setConflict()
+	if err != nil {
+		return
+	}
+	err = setUUIDCheck()
+	if err != nil {
+		return
+	}
+	setInterleave()
+	err = setMaxMemory()
+	if err != nil {
+		return
+	}
+	setProfileUpdates()
+	setHooks()
+	setMergeEnrollments()
+	err = setEnrollmentHistory()
+	if err != nil {
+		return
+	}
+	err = loadBots()
+	if err != nil {
+		return
+	}
+	err = loadOrgAliases(dbg)
+	if err != nil {
+		return
+	}
+	identitiesFiles, affiliationsFiles, organizationsFiles, profilesFiles := inputs.identities, inputs.affiliations, inputs.organizations, inputs.profiles
+	if len(organizationsFiles) > 0 {
+		fmt.Printf("Importing: %s organizations files\n", strings.Join(organizationsFiles, ", "))
+	}
+	if len(profilesFiles) > 0 {
+		fmt.Printf("Importing: %s profiles files\n", strings.Join(profilesFiles, ", "))
+	}
+	fmt.Printf("Importing: %s, %s files\n", strings.Join(identitiesFiles, ", "), strings.Join(affiliationsFiles, ", "))
+	var identities, affiliations, organizations, profiles []csvInput
+	summary = &importSummary{IdentitiesFile: strings.Join(identitiesFiles, ", "), AffiliationsFile: strings.Join(affiliationsFiles, ", "), Dry: dry, Shadow: gShadow && !dry, Start: time.Now()}
+	summary.OrganizationsFile = strings.Join(organizationsFiles, ", ")
+	summary.ProfilesFile = strings.Join(profilesFiles, ", ")
+	summary.RunID = newRunID(summary.Start)
+	summary.Database = gDatabase
+	summary.Profile = gProfile
+	gSummaryMtx.Lock()
+	gSummary = summary
+	gSummaryMtx.Unlock()
 	defer func() {
-		_ = fileAffiliations.Close()
+		r := recover()
+		if r != nil && err == nil {
+			err = fmt.Errorf("import aborted: %v", r)
+		}
+		published := flushEvents()
+		if gMtx != nil {
+			gMtx.Lock()
+		}
+		gSummaryMtx.Lock()
+		summary.PublishedEvents = published
+		summary.IdentityRows = dataRows(identities)
+		summary.EnrollmentRows = dataRows(affiliations)
+		summary.UpdatedIdentities = len(gUpdatedIdentities)
+		summary.UpdatedEnrollments = len(gUpdatedEnrollments)
+		summary.UpdatedUIdentities = len(gUpdatedUIdentities)
+		summary.UpdatedProfiles = len(gUpdatedProfiles)
+		summary.UpdatedOrganizations = len(gUpdatedOrganizations)
+		summary.OrganizationRows = dataRows(organizations)
+		summary.ProfileRows = dataRows(profiles)
+		summary.Latencies = latencyReport()
+		summary.finish(err)
+		gSummary = nil
+		gSummaryMtx.Unlock()
+		if gMtx != nil {
+			gMtx.Unlock()
+		}
+		if dbg || gSlowQuery > 0 {
+			for _, l := range summary.Latencies {
+				fmt.Printf("%s: %d statements, p50 %s, p95 %s, p99 %s, max %s\n", l.Statement, l.Count, l.P50, l.P95, l.P99, l.Max)
+			}
+		}
+		finishRunRecord(db, summary)
+		if !opts.quiet && !opts.session {
+			e := writeSummary(summary)
+			if e != nil {
+				fmt.Printf("WARNING: cannot write summary: %v\n", e)
+			}
+			e = writeAffectedUUIDs(summary)
+			if e != nil {
+				fmt.Printf("WARNING: cannot write affected uuids: %v\n", e)
+			}
+			postRunHook(dbg, summary)
+			notifyRun(dbg, summary)
+		}
+		if r != nil {
+			panic(r)
+		}
 	}()
-	thrN := getThreadsNum()
-	if thrN > 1 {
+	var policy *errorPolicy
+	policy, err = parseErrorPolicy(os.Getenv("ON_ERROR"))
+	if err != nil {
+		return
+	}
+	err = checkProfileInputs(inputs.all())
+	if err != nil {
+		return
+	}
+	err = checkSchema(db)
+	if err != nil {
+		return
+	}
+	if opts.inputs != nil {
+		summary.Files = opts.inputs.files
+	} else {
+		err = verifySignatures(dbg, inputs.all())
+		if err != nil {
+			return
+		}
+		summary.Files, err = inputFileHashes(inputs.all())
+		if err != nil {
+			return
+		}
+	}
+	err = checkPlan(db, summary)
+	if err != nil {
+		return
+	}
+	if !opts.session {
+		err = startRunRecord(db, summary)
+		if err != nil {
+			return
+		}
+	}
+	if !opts.quiet && !opts.session {
+		err = preRunHook(dbg, summary, inputs)
+		if err != nil {
+			return
+		}
+	}
+	var thrN int
+	thrN, err = getThreadsNum()
+	if err != nil {
+		return
+	}
+	if thrN > 1 || gInterleave {
 		gMtx = &sync.Mutex{}
-		gIDMtx = make(map[string]*sync.Mutex)
-		gUUIDMtx = make(map[string]*sync.Mutex)
 	}
-	// Identities CSV data
-	var identitiesLines [][]string
-	identitiesLines, err = csv.NewReader(fileIdentities).ReadAll()
+	loaded := opts.inputs
+	if loaded == nil {
+		loaded, err = loadInputs(dbg, inputs, summary.Files)
+		if err != nil {
+			return
+		}
+	}
+	organizations, identities, profiles, affiliations = loaded.organizations, loaded.identities, loaded.profiles, loaded.affiliations
+
+	// Report organization aliases that cannot be resolved
+	checkOrgAliases(db, dbg)
+
+	// Cross-check both files and the DB before any writes
+	_, err = reconcileFiles(db, dbg, identities, affiliations)
 	if err != nil {
 		return
 	}
 
-	// Enrollments/Affiliations CSV data
-	var enrollmentsLines [][]string
-	enrollmentsLines, err = csv.NewReader(fileAffiliations).ReadAll()
+	// Idempotency ledger
+	var (
+		ledger    *importLedger
+		fn        rowProcessor
+		failed    []int
+		remaining []int
+	)
+	ledger, err = newLedger(db, dry, summary.RunID)
 	if err != nil {
 		return
 	}
 
-	// Identities
-	hdr := []string{}
-	ch := make(chan error)
-	if thrN > 1 {
-		nThreads := 0
-		for i, line := range identitiesLines {
-			if i == 0 {
-				for _, col := range line {
-					hdr = append(hdr, col)
-				}
-				if dbg {
-					fmt.Printf("Identities header: %s\n", hdr)
-				}
-				continue
+	// Audit trail
+	err = initAudit(db, dry || gShadow, summary.RunID)
+	if err != nil {
+		return
+	}
+
+	// Operator's pre-import SQL
+	err = runSQLFile(db, dbg, dry || gShadow, "PRE_IMPORT_SQL", summary)
+	if err != nil {
+		return
+	}
+
+	// Organizations, single threaded because rows can depend on previous ones (create then add domain)
+	for i, input := range organizations {
+		fn, err = ledger.prepare("organizations", input.lines, hookRow("organizations", updateOrganization))
+		if err != nil {
+			return
+		}
+		results := newRowResults(dry)
+		failed, remaining, err = processRows(db, dbg, dry, 1, "Organizations", input.lines, policy, results, fn)
+		e := writeFailedRows(input.name, summary.RunID, len(organizations) > 1, input, failed)
+		if err == nil {
+			err = e
+		}
+		e = writeResults(input.name, summary.RunID, len(organizations) > 1, input, results)
+		if err == nil {
+			err = e
+		}
+		summary.keepOutcomes(input, results)
+		if err == errTerminated {
+			e = writeRemaining(input, remaining, summary.RunID, len(organizations) > 1)
+			if e == nil {
+				e = writeUnstarted(organizations[i+1:], summary.RunID, len(organizations) > 1)
 			}
-			row := map[string]string{}
-			for c, col := range line {
-				row[hdr[c]] = col
+			if e == nil {
+				e = writeUnstarted(identities, summary.RunID, len(identities) > 1)
 			}
-			go func() {
-				_ = updateIdentity(ch, db, dbg, dry, row)
-			}()
-			nThreads++
-			if nThreads == thrN {
-				err = <-ch
-				nThreads--
-				if err != nil {
-					return
-				}
+			if e == nil {
+				e = writeUnstarted(profiles, summary.RunID, len(profiles) > 1)
 			}
-		}
-		for nThreads > 0 {
-			err = <-ch
-			nThreads--
-			if err != nil {
-				return
+			if e == nil {
+				e = writeUnstarted(affiliations, summary.RunID, len(affiliations) > 1)
+			}
+			if e != nil {
+				err = fmt.Errorf("%v, cannot write remaining rows: %v", err, e)
 			}
 		}
-	} else {
-		for i, line := range identitiesLines {
-			if i == 0 {
-				for _, col := range line {
-					hdr = append(hdr, col)
-				}
-				if dbg {
-					fmt.Printf("Identities header: %s\n", hdr)
-				}
-				continue
+		if err != nil {
+			return
+		}
+	}
+	if len(organizations) > 0 {
+		fmt.Printf("Updated %d organizations\n", len(gUpdatedOrganizations))
+	}
+
+	// Enrollments not depending on identities rows, concurrently with identities (INTERLEAVE)
+	var interleave *interleaved
+	interleave, err = newInterleaved(db, identities, affiliations)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = interleave.wait()
+	}()
+	interleave.start(db, dbg, dry, thrN, policy, ledger, affiliations)
+
+	// Identities
+	for i, input := range identities {
+		setExportTime(input.name)
+		err = checkStaleFile(db, input.name, input.lines, false)
+		if err != nil {
+			return
+		}
+		fn, err = ledger.prepare("identities", input.lines, hookRow("identities", retryConcurrent(updateIdentity)))
+		if err != nil {
+			return
+		}
+		results := newRowResults(dry)
+		failed, remaining, err = processRows(db, dbg, dry, thrN, "Identities", input.lines, policy, results, fn)
+		e := flushTouches(db, dbg)
+		if err == nil {
+			err = e
+		}
+		e = writeFailedRows(input.name, summary.RunID, len(identities) > 1, input, failed)
+		if err == nil {
+			err = e
+		}
+		e = writeResults(input.name, summary.RunID, len(identities) > 1, input, results)
+		if err == nil {
+			err = e
+		}
+		summary.keepOutcomes(input, results)
+		if err == errTerminated {
+			e = writeRemaining(input, remaining, summary.RunID, len(identities) > 1)
+			if e == nil {
+				e = writeUnstarted(identities[i+1:], summary.RunID, len(identities) > 1)
 			}
-			row := map[string]string{}
-			for c, col := range line {
-				row[hdr[c]] = col
+			if e == nil {
+				e = writeUnstarted(profiles, summary.RunID, len(profiles) > 1)
 			}
-			err = updateIdentity(nil, db, dbg, dry, row)
-			if err != nil {
-				return
+			if e == nil {
+				e = interleave.writeUnfinished(affiliations, 0, summary.RunID)
+			}
+			if e != nil {
+				err = fmt.Errorf("%v, cannot write remaining rows: %v", err, e)
 			}
 		}
+		if err != nil {
+			return
+		}
 	}
 	fmt.Printf("Updated %d identities, %d uidentities, %d profiles\n", len(gUpdatedIdentities), len(gUpdatedUIdentities), len(gUpdatedProfiles))
 
-	// Enrollments/Affiliations
-	if thrN > 1 {
-		gIDMtx = make(map[string]*sync.Mutex)
-		gUUIDMtx = make(map[string]*sync.Mutex)
-	}
-	hdr = []string{}
-	ch = make(chan error)
-	if thrN > 1 {
-		nThreads := 0
-		for i, line := range enrollmentsLines {
-			if i == 0 {
-				for _, col := range line {
-					hdr = append(hdr, col)
-				}
-				if dbg {
-					fmt.Printf("Enrollments header: %s\n", hdr)
-				}
-				continue
+	// Profiles, independent of identities
+	for i, input := range profiles {
+		fn, err = ledger.prepare("profiles", input.lines, hookRow("profiles", retryConcurrent(updateProfile)))
+		if err != nil {
+			return
+		}
+		results := newRowResults(dry)
+		failed, remaining, err = processRows(db, dbg, dry, thrN, "Profiles", input.lines, policy, results, fn)
+		e := flushTouches(db, dbg)
+		if err == nil {
+			err = e
+		}
+		e = writeFailedRows(input.name, summary.RunID, len(profiles) > 1, input, failed)
+		if err == nil {
+			err = e
+		}
+		e = writeResults(input.name, summary.RunID, len(profiles) > 1, input, results)
+		if err == nil {
+			err = e
+		}
+		summary.keepOutcomes(input, results)
+		if err == errTerminated {
+			e = writeRemaining(input, remaining, summary.RunID, len(profiles) > 1)
+			if e == nil {
+				e = writeUnstarted(profiles[i+1:], summary.RunID, len(profiles) > 1)
 			}
-			row := map[string]string{}
-			for c, col := range line {
-				row[hdr[c]] = col
+			if e == nil {
+				e = interleave.writeUnfinished(affiliations, 0, summary.RunID)
 			}
-			go func() {
-				_ = updateEnrollment(ch, db, dbg, dry, row)
-			}()
-			nThreads++
-			if nThreads == thrN {
-				err = <-ch
-				nThreads--
-				if err != nil {
-					return
-				}
+			if e != nil {
+				err = fmt.Errorf("%v, cannot write remaining rows: %v", err, e)
 			}
 		}
-		for nThreads > 0 {
-			err = <-ch
-			nThreads--
-			if err != nil {
-				return
-			}
+		if err != nil {
+			return
 		}
-	} else {
-		for i, line := range enrollmentsLines {
-			if i == 0 {
-				for _, col := range line {
-					hdr = append(hdr, col)
-				}
-				if dbg {
-					fmt.Printf("Enrollments header: %s\n", hdr)
-				}
-				continue
-			}
-			row := map[string]string{}
-			for c, col := range line {
-				row[hdr[c]] = col
+	}
+	if len(profiles) > 0 {
+		fmt.Printf("Updated %d profiles, %d uidentities\n", len(gUpdatedProfiles), len(gUpdatedUIdentities))
+	}
+
+	// Enrollments/Affiliations, with INTERLEAVE only rows depending on identities rows are left
+	err = interleave.wait()
+	if err != nil {
+		e := interleave.writeUnfinished(affiliations, 0, summary.RunID)
+		if e != nil {
+			err = fmt.Errorf("%v, cannot write remaining rows: %v", err, e)
+		}
+		return
+	}
+	for i, input := range affiliations {
+		setExportTime(input.name)
+		err = checkStaleFile(db, input.name, input.lines, true)
+		if err != nil {
+			return
+		}
+		fn, err = ledger.prepare("enrollments", input.lines, hookRow("affiliations", retryConcurrent(enrollmentProcessor())))
+		if err != nil {
+			return
+		}
+		results := newRowResults(dry)
+		if interleave != nil {
+			fn = interleave.phase(true, fn)
+			results = interleave.results[i]
+		}
+		failed, remaining, err = processRows(db, dbg, dry, thrN, "Enrollments", input.lines, policy, results, fn)
+		if interleave != nil {
+			failed, remaining = interleave.finish(i, failed, remaining)
+		}
+		e := flushTouches(db, dbg)
+		if err == nil {
+			err = e
+		}
+		e = writeFailedRows(input.name, summary.RunID, len(affiliations) > 1, input, failed)
+		if err == nil {
+			err = e
+		}
+		e = writeResults(input.name, summary.RunID, len(affiliations) > 1, input, results)
+		if err == nil {
+			err = e
+		}
+		summary.keepOutcomes(input, results)
+		if err == errTerminated {
+			e = writeRemaining(input, remaining, summary.RunID, len(affiliations) > 1)
+			if e == nil {
+				e = interleave.writeUnfinished(affiliations, i+1, summary.RunID)
 			}
-			err = updateEnrollment(nil, db, dbg, dry, row)
-			if err != nil {
-				return
+			if e != nil {
+				err = fmt.Errorf("%v, cannot write remaining rows: %v", err, e)
 			}
 		}
+		if err != nil {
+			return
+		}
 	}
 	fmt.Printf("Updated %d enrollments, %d uidentities, %d profiles\n", len(gUpdatedEnrollments), len(gUpdatedUIdentities), len(gUpdatedProfiles))
+
+	// Post-import verification
+	err = verifyImport(db, dbg)
+	if err != nil {
+		return
+	}
+
+	// Enrollments consolidation
+	err = mergeEnrollments(db, dbg, dry)
+	if err != nil {
+		return
+	}
+
+	// Reviewed plan
+	err = finishPlan(db, summary)
+	if err != nil {
+		return
+	}
+
+	// Operator's post-import SQL
+	err = runSQLFile(db, dbg, dry || gShadow, "POST_IMPORT_SQL", summary)
+	if err != nil || dry || gShadow {
+		return
+	}
+
+	// Dashboards caches
+	invalidateCaches(db, dbg)
+
+	// Targeted re-enrichment
+	triggerReenrichment(db, dbg, summary)
 	return
 }
 
-// getConnectString - get MariaDB SH (Sorting Hat) database DSN
+// getConnectString - get MariaDB SH (Sorting Hat) database DSN, HOST can be a unix socket path, an IPv6 address or
+// a comma separated list of hosts tried in order (see connectAddr)
 // Either provide full DSN via SH_DSN='shuser:shpassword@tcp(shhost:shport)/shdb?charset=utf8&parseTime=true'
 // Or use some SH_ variables, only SH_PASS is required
 // Defaults are: "shuser:required_pwd@tcp(localhost:3306)/shdb?charset=utf8
@@ -1016,18 +2218,7 @@ func getConnectString(prefix string) string {
 		if user == "" {
 			user = os.Getenv(prefix + "USER")
 		}
-		proto := os.Getenv(prefix + "PROTO")
-		if proto == "" {
-			proto = "tcp"
-		}
-		host := os.Getenv(prefix + "HOST")
-		if host == "" {
-			host = "localhost"
-		}
-		port := os.Getenv(prefix + "PORT")
-		if port == "" {
-			port = "3306"
-		}
+		proto, addr := connectAddr(prefix)
 		db := os.Getenv(prefix + "DB")
 		if db == "" {
 			fatalf("please specify database via %sDB=...", prefix)
@@ -1040,12 +2231,11 @@ func getConnectString(prefix string) string {
 			params = ""
 		}
 		dsn = fmt.Sprintf(
-			"%s:%s@%s(%s:%s)/%s%s",
+			"%s:%s@%s(%s)/%s%s",
 			user,
 			pass,
 			proto,
-			host,
-			port,
+			addr,
 			db,
 			params,
 		)
@@ -1054,19 +2244,95 @@ func getConnectString(prefix string) string {
 }
 
 func main() {
+	fatalOnError(setProfile())
+	fatalOnError(setAnonymize())
+	defer shutdown()
+	fatalOnError(setProfiling())
+	fatalOnError(setSchema())
+	fatalOnError(setEnforceReadOnly())
+	handleSignals()
+	fatalOnError(registerFailover())
+	fatalOnError(setRDSIAM())
+	fatalOnError(setSSHTunnel())
+	if len(os.Args) > 1 && os.Args[1] == "benchmark" {
+		fatalOnError(benchmark(os.Getenv("DEBUG") != ""))
+		return
+	}
 	// Connect to MariaDB
-	if len(os.Args) < 3 {
+	watchDir := os.Getenv("WATCH_DIR")
+	serveAddr := os.Getenv("SERVE_ADDR")
+	sfdc := os.Getenv("SFDC_PULL") != ""
+	queue := os.Getenv("QUEUE_URL") != "" || os.Getenv("KAFKA_REST_URL") != ""
+	if len(os.Args) < 2 && watchDir == "" && serveAddr == "" && !sfdc && !queue {
 		fmt.Printf("Arguments required: user_identities_YYYYMMDDHHMI.csv user_affiliations_YYYYMMDDHHMI.csv\n")
+		fmt.Printf("Or any number of such files or glob patterns: 'user_identities_*.csv' 'user_affiliations_*.csv'\n")
+		fmt.Printf("Or a directory to import all user_identities_YYYYMMDDHHMI.csv user_affiliations_YYYYMMDDHHMI.csv pairs from, oldest first\n")
+		fmt.Printf("Or set WATCH_DIR=/path/to/dir|s3://bucket/prefix to watch for new files\n")
+		fmt.Printf("Or set SERVE_ADDR=:8080 to serve HTTP API\n")
+		fmt.Printf("Or set SFDC_PULL=1 to import pending requests from Salesforce\n")
+		fmt.Printf("Or set QUEUE_URL=https://sqs... or KAFKA_REST_URL=http://... to consume change requests from a queue\n")
+		fmt.Printf("Or run: benchmark (with BENCH_DSN set to a test schema) to measure import throughput\n")
+		fmt.Printf("Or run: check to validate database connectivity, schema and privileges\n")
+		fmt.Printf("Or run: analyze files... to suggest merges of duplicate individuals referenced by the files\n")
+		fmt.Printf("Or run: show email|uuid|identity_id... to print everything about a person (SHOW_JSON=1 for JSON)\n")
+		fmt.Printf("Or run: review files... to review and apply identities and affiliations rows person by person\n")
+		fmt.Printf("Or run: compare user_identities_*.csv to report which rows differ from the database (read only)\n")
+		fmt.Printf("Or run: extract uuid|email|identity_id|file... to write correction CSVs pre-filled with database values\n")
+		fmt.Printf("Or run: convert script.sh... to translate sortinghat command scripts into import CSVs\n")
+		fmt.Printf("Add SCHEDULE='0 3 * * *' to any of the file arguments to import them on a cron schedule\n")
 		return
 	}
 	dtStart := time.Now()
-	var db *sql.DB
-	dsn := getConnectString("SH_")
-	db, err := sql.Open("mysql", dsn)
+	dbs, err := openDatabases()
 	fatalOnError(err)
-	defer func() { fatalOnError(db.Close()) }()
-	err = importCSVfiles(db, os.Args[1:len(os.Args)])
+	defer closeDatabases(dbs)
+	db := dbs[0].db
+	gConnCharset = dbs[0].charset
+	startHealth(dbs)
+	if len(os.Args) == 2 && os.Args[1] == "check" {
+		err = checkDatabases(dbs, os.Getenv("STAGING_DSN"))
+	} else if len(os.Args) > 1 && os.Args[1] == "analyze" {
+		err = analyzeDuplicates(replica(db), os.Getenv("DEBUG") != "", os.Args[2:])
+	} else if len(os.Args) > 1 && os.Args[1] == "show" {
+		err = showPeople(replica(db), os.Getenv("DEBUG") != "", os.Args[2:])
+	} else if len(os.Args) > 1 && os.Args[1] == "compare" {
+		err = compareExport(replica(db), os.Getenv("DEBUG") != "", os.Args[2:])
+	} else if len(os.Args) > 1 && os.Args[1] == "extract" {
+		err = extractCorrections(replica(db), os.Getenv("DEBUG") != "", os.Args[2:])
+	} else if len(os.Args) > 1 && os.Args[1] == "convert" {
+		err = convertSortingHat(replica(db), os.Getenv("DEBUG") != "", os.Args[2:])
+	} else if len(os.Args) > 1 && os.Args[1] == "review" {
+		err = reviewChanges(db, os.Getenv("DEBUG") != "", os.Getenv("DRY") != "", os.Args[2:])
+	} else if serveAddr != "" {
+		err = serveHTTP(dbs, serveAddr)
+	} else if watchDir != "" {
+		err = watchDirectory(dbs, watchDir)
+	} else if sfdc {
+		err = sfdcPull(dbs, os.Getenv("DEBUG") != "", os.Getenv("DRY") != "")
+	} else if queue {
+		err = consumeQueue(dbs, os.Getenv("DEBUG") != "", os.Getenv("DRY") != "")
+	} else if schedule := os.Getenv("SCHEDULE"); schedule != "" {
+		err = runSchedule(dbs, os.Getenv("DEBUG") != "", os.Getenv("DRY") != "", schedule, os.Args[1:])
+	} else {
+		err = importArgs(dbs, os.Getenv("DEBUG") != "", os.Getenv("DRY") != "", os.Args[1:])
+	}
+	if terminating() {
+		closeDatabases(dbs)
+		exitTerminated()
+	}
+	if err != nil {
+		// fatalOnError panics, the process exits with 2
+		writeTerminationStatus("failed", 2, err)
+	}
 	fatalOnError(err)
 	dtEnd := time.Now()
 	fmt.Printf("Time(%s): %v\n", os.Args[0], dtEnd.Sub(dtStart))
+	code := warningExitCode()
+	writeTerminationStatus("succeeded", code, nil)
+	if code != 0 {
+		fmt.Printf("Exiting with code %d: %s\n", code, warningCategoriesText(gProcessWarnings))
+		closeDatabases(dbs)
+		shutdown()
+		os.Exit(code)
+	}
 }
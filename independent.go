@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	// gIndependentMode - INDEPENDENT_MODE: "record" (default) or "delete"
+	gIndependentMode string
+)
+
+// independentEnrollment - enrollment overlapping a range in which the individual is independent
+type independentEnrollment struct {
+	id    int
+	orgID int
+	start string
+	end   string
+}
+
+// setIndependent - INDEPENDENT_MODE decides how an individual is marked independent for a date range, by an
+// affiliations row with action=independent or to_org_name=INDEPENDENT_ORG:
+// "record" (default) - the canonical INDEPENDENT_ORG enrollment is inserted (or updated) as for any organization
+// "delete" - no enrollment means unaffiliated, enrollments overlapping the range are deleted or trimmed
+func setIndependent() (err error) {
+	gIndependentMode = strings.ToLower(strings.TrimSpace(os.Getenv("INDEPENDENT_MODE")))
+	switch gIndependentMode {
+	case "":
+		gIndependentMode = "record"
+	case "record", "delete":
+	default:
+		err = fmt.Errorf("invalid INDEPENDENT_MODE=%s, allowed: record, delete", gIndependentMode)
+	}
+	return
+}
+
+// isIndependentRow - the affiliations row marks the individual independent
+func isIndependentRow(row map[string]string, newOrgName string) bool {
+	return strings.EqualFold(strings.TrimSpace(row["action"]), "independent") || (newOrgName != "" && strings.EqualFold(newOrgName, gIndependentOrg))
+}
+
+// markUnaffiliated - INDEPENDENT_MODE=delete, enrollments of the uuid and project overlapping start - end are
+// deleted when inside the range, trimmed when partially overlapping and split when covering the whole range
+func markUnaffiliated(db *sql.DB, dbg, dry bool, id, uuid, projectSlug, start, end string, row map[string]string) (err error) {
+	var rows *stmtRows
+	rows, err = query(
+		db,
+		"select id, organization_id, date_format(start, '%Y-%m-%d'), date_format(end, '%Y-%m-%d') from enrollments "+
+			"where uuid = ? and trim(coalesce(project_slug, '')) = ? and start < str_to_date(?, ?) and end > str_to_date(?, ?) order by start, id",
+		uuid, projectSlug, end, cDateTimeFormat, start, cDateTimeFormat,
+	)
+	if err != nil {
+		err = fmt.Errorf("identity_id %s/%s enrollments lookup: %v in %v", id, uuid, err, row)
+		return
+	}
+	conflicts := []independentEnrollment{}
+	for rows.Next() {
+		e := independentEnrollment{}
+		err = rows.Scan(&e.id, &e.orgID, &e.start, &e.end)
+		if err != nil {
+			break
+		}
+		conflicts = append(conflicts, e)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	e := rows.Close()
+	if err == nil {
+		err = e
+	}
+	if err != nil {
+		err = fmt.Errorf("identity_id %s/%s enrollments lookup: %v in %v", id, uuid, err, row)
+		return
+	}
+	if len(conflicts) == 0 {
+		if dbg {
+			fmt.Printf("identity_id %s/%s has no enrollments in %s - %s, already independent in %v\n", id, uuid, start, end, row)
+		}
+		return
+	}
+	who := "email:" + strings.TrimSpace(row["user_email"]) + ",name:" + strings.TrimSpace(row["user_name"]) + ",sfid:" + strings.TrimSpace(row["user_sfid"])
+	type statement struct {
+		query string
+		args  []interface{}
+		eid   int
+	}
+	statements := []statement{}
+	parts := []string{}
+	for _, c := range conflicts {
+		trimStart, trimEnd := c.start < start, c.end > end
+		switch {
+		case !trimStart && !trimEnd:
+			statements = append(statements, statement{query: "delete from enrollments where id = ?", args: []interface{}{c.id}, eid: c.id})
+			parts = append(parts, fmt.Sprintf("delete enrollment %d org %d %s %s", c.id, c.orgID, c.start, c.end))
+			continue
+		case trimEnd && !trimStart:
+			statements = append(statements, statement{
+				query: "update enrollments set start = str_to_date(?, ?), " + auditSet("enrollments") + " where id = ?",
+				args:  append(append([]interface{}{end, cDateTimeFormat}, auditArgs("enrollments", who)...), c.id),
+			})
+			parts = append(parts, fmt.Sprintf("enrollment %d org %d %s", c.id, c.orgID, strings.TrimSpace(fieldChange("start", c.start, end))))
+			continue
+		}
+		statements = append(statements, statement{
+			query: "update enrollments set end = str_to_date(?, ?), " + auditSet("enrollments") + " where id = ?",
+			args:  append(append([]interface{}{start, cDateTimeFormat}, auditArgs("enrollments", who)...), c.id),
+		})
+		parts = append(parts, fmt.Sprintf("enrollment %d org %d %s", c.id, c.orgID, strings.TrimSpace(fieldChange("end", c.end, start))))
+		if trimEnd {
+			// the enrollment covers the whole range, its part after the range is kept as a new enrollment
+			columns, values := auditInsert("enrollments")
+			statements = append(statements, statement{
+				query: "insert into enrollments(uuid, organization_id, project_slug, start, end" + columns + ") values(?, ?, ?, str_to_date(?, ?), str_to_date(?, ?)" + values + ")",
+				args:  append([]interface{}{uuid, c.orgID, projectSlug, end, cDateTimeFormat, c.end, cDateTimeFormat}, auditArgs("enrollments", who)...),
+			})
+			parts = append(parts, fmt.Sprintf("new enrollment org %d %s %s", c.orgID, end, c.end))
+		}
+	}
+	msg := fmt.Sprintf("independent identity_id %s/%s %s %s %s: %s by %s", id, uuid, projectSlug, start, end, strings.Join(parts, ", "), who)
+	if dry {
+		fmt.Printf("%s\n", msg)
+		addChange(msg)
+		recordPlanned(uuid)
+		return
+	}
+	var tx *sql.Tx
+	var cancelTx context.CancelFunc
+	tx, cancelTx, err = beginTx(db)
+	if err != nil {
+		err = fmt.Errorf("error starting transaction %v for row %v", err, row)
+		return
+	}
+	defer cancelTx()
+	defer func() {
+		if tx != nil {
+			fmt.Printf("rollback %s\n", msg)
+			_ = tx.Rollback()
+		}
+	}()
+	shadow := newShadow(tx, uuid)
+	for _, c := range conflicts {
+		err = shadow.capture("enrollments", "id", c.id)
+		if err != nil {
+			err = fmt.Errorf("error capturing shadow state %v for row %v", err, row)
+			return
+		}
+	}
+	deleted := []int{}
+	for _, s := range statements {
+		var before *enrollmentState
+		if s.eid > 0 {
+			before, err = getEnrollmentState(db, s.eid)
+			if err != nil {
+				err = fmt.Errorf("error getting enrollment %d state %v for row %v", s.eid, err, row)
+				return
+			}
+		}
+		var res sql.Result
+		res, err = exec(tx, "Error 1062", s.query, s.args...)
+		if err != nil {
+			if strings.Contains(err.Error(), "Error 1062") {
+				err = collisionf("%s: collision", msg)
+				addCollision()
+				return
+			}
+			err = fmt.Errorf("error updating enrollments %v for (%s,%v) for row %v", err, s.query, s.args, row)
+			return
+		}
+		affected, _ := res.RowsAffected()
+		if affected <= 0 {
+			err = skipf(cWarnPartial, "%s: (%s,%v) didn't affect enrollments\n", msg, s.query, s.args)
+			return
+		}
+		if s.eid > 0 {
+			err = auditEnrollmentDeletion(tx, s.eid, before, who)
+			if err != nil {
+				err = fmt.Errorf("error recording deletion of enrollment %d in the audit trail %v for row %v", s.eid, err, row)
+				return
+			}
+			deleted = append(deleted, s.eid)
+		}
+	}
+	for _, table := range []string{"uidentities", "profiles"} {
+		if (table == "uidentities" && gNoTouchUIdentities) || (table == "profiles" && gNoTouchProfiles) {
+			continue
+		}
+		_, err = exec(tx, "", "update "+table+" set "+auditSet(table)+" where uuid = ?", append(auditArgs(table, who), uuid)...)
+		if err != nil {
+			err = fmt.Errorf("error updating %s %v for row %v", table, err, row)
+			return
+		}
+	}
+	err = shadow.commit(tx, msg)
+	if err != nil {
+		err = fmt.Errorf("error committing transaction %v for row %v", err, row)
+		return
+	}
+	tx = nil
+	addChange(msg)
+	for _, eid := range deleted {
+		recordEnrollmentDeletionForVerify(int64(eid))
+	}
+	recordAffected(uuid, projectSlug)
+	if gMtx != nil {
+		gMtx.Lock()
+	}
+	gUpdatedEnrollments[id] = struct{}{}
+	if gMtx != nil {
+		gMtx.Unlock()
+	}
+	return
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	gInferOrg     bool
+	gDomainOrgMap map[string]string
+)
+
+// setInferOrg - INFER_ORG_FROM_DOMAIN enables organization inference from identity email domain
+func setInferOrg() {
+	gInferOrg = os.Getenv("INFER_ORG_FROM_DOMAIN") != ""
+	gDomainOrgMap = make(map[string]string)
+}
+
+// domainToOrgName - finds organization for email domain in domains_organizations
+// exact domain match wins, parent domains only match when marked is_top_domain
+// returns empty name when the domain is unknown
+func domainToOrgName(db *sql.DB, dbg bool, domain string) (orgName string, err error) {
+	var found bool
+	if gMtx != nil {
+		gMtx.Lock()
+	}
+	orgName, found = gDomainOrgMap[domain]
+	if gMtx != nil {
+		gMtx.Unlock()
+	}
+	if found {
+		return
+	}
+	candidate := domain
+	for top := false; candidate != ""; top = true {
+		q := "select o.name from domains_organizations d, organizations o where d.organization_id = o.id and d.domain = ?"
+		if top {
+			q += " and d.is_top_domain = 1"
+		}
+		var rows *stmtRows
+		rows, err = query(replica(db), q, candidate)
+		if err != nil {
+			return
+		}
+		for rows.Next() {
+			err = rows.Scan(&orgName)
+			break
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		e := rows.Close()
+		if err == nil {
+			err = e
+		}
+		if err != nil || orgName != "" {
+			break
+		}
+		i := strings.Index(candidate, ".")
+		if i < 0 {
+			break
+		}
+		candidate = candidate[i+1:]
+		if !strings.Contains(candidate, ".") {
+			// never match bare TLDs
+			break
+		}
+	}
+	if err != nil {
+		return
+	}
+	if gMtx != nil {
+		gMtx.Lock()
+	}
+	gDomainOrgMap[domain] = orgName
+	if gMtx != nil {
+		gMtx.Unlock()
+	}
+	if dbg {
+		fmt.Printf("domain %s -> organization '%s'\n", domain, orgName)
+	}
+	return
+}
+
+// inferOrgName - infers organization of identity from its email domain (CSV user_email or identity's email in DB)
+func inferOrgName(db *sql.DB, dbg bool, id string, row map[string]string) (orgName, domain string, err error) {
+	email := strings.TrimSpace(row["user_email"])
+	if email == "" {
+		var rows *stmtRows
+		rows, err = query(replica(db), "select coalesce(email, '') from identities where id = ?", id)
+		if err != nil {
+			return
+		}
+		for rows.Next() {
+			err = rows.Scan(&email)
+			break
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		e := rows.Close()
+		if err == nil {
+			err = e
+		}
+		if err != nil {
+			return
+		}
+	}
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return
+	}
+	domain = strings.ToLower(strings.TrimSpace(email[i+1:]))
+	if domain == "" {
+		return
+	}
+	orgName, err = domainToOrgName(db, dbg, domain)
+	return
+}
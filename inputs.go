@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	gFileTimestampRE = regexp.MustCompile(`_(\d{12})\.csv$`)
+)
+
+// inputFiles - input files of a single run by kind, each kind is imported in the given order
+type inputFiles struct {
+	identities    []string
+	affiliations  []string
+	organizations []string
+	profiles      []string
+}
+
+// all - all input files in import order: organizations, identities, profiles and affiliations ones
+func (f inputFiles) all() []string {
+	return append(append(append(append([]string{}, f.organizations...), f.identities...), f.profiles...), f.affiliations...)
+}
+
+// fileTimestamp - YYYYMMDDHHMI from user_identities_YYYYMMDDHHMI.csv or "" when there is none
+func fileTimestamp(fileName string) string {
+	m := gFileTimestampRE.FindStringSubmatch(filepath.Base(fileName))
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// sortByTimestamp - sorts files by timestamp in their names, files without timestamp keep their order at the start
+func sortByTimestamp(fileNames []string) {
+	sort.SliceStable(fileNames, func(i, j int) bool {
+		return fileTimestamp(fileNames[i]) < fileTimestamp(fileNames[j])
+	})
+}
+
+// classifyInputFiles - expands glob patterns and splits files into identities, affiliations, organizations and profiles ones
+// files are classified by user_identities_ / user_affiliations_ / user_organizations_ / user_profiles_ name prefix
+// and sorted by timestamp
+// legacy: exactly two files of which at least one has no such prefix are identities and affiliations file
+// (in that order, or the other kind than the prefixed one)
+func classifyInputFiles(args []string) (inputs inputFiles, err error) {
+	files := []string{}
+	for _, arg := range args {
+		if strings.ContainsAny(arg, "*?[") {
+			var matches []string
+			matches, err = filepath.Glob(arg)
+			if err != nil {
+				err = fmt.Errorf("invalid pattern '%s': %v", arg, err)
+				return
+			}
+			if len(matches) == 0 {
+				fmt.Printf("WARNING: pattern '%s' doesn't match any files\n", arg)
+			}
+			for _, match := range matches {
+				// failed and remaining rows files from previous runs must be passed explicitly, results files are never inputs
+				base := filepath.Base(match)
+				if strings.Contains(base, "_failed_") || strings.Contains(base, "_remaining_") || strings.Contains(base, "_results_") {
+					fmt.Printf("Skipping failed rows, remaining rows or results file %s matched by '%s'\n", match, arg)
+					continue
+				}
+				files = append(files, match)
+			}
+			continue
+		}
+		files = append(files, arg)
+	}
+	var identities, affiliations, organizations, profiles []string
+	others := []string{}
+	seen := make(map[string]struct{})
+	for _, file := range files {
+		if _, ok := seen[file]; ok {
+			continue
+		}
+		seen[file] = struct{}{}
+		base := filepath.Base(file)
+		switch {
+		case strings.HasPrefix(base, "user_identities_"):
+			identities = append(identities, file)
+		case strings.HasPrefix(base, "user_affiliations_"):
+			affiliations = append(affiliations, file)
+		case strings.HasPrefix(base, "user_organizations_"):
+			organizations = append(organizations, file)
+		case strings.HasPrefix(base, "user_profiles_"):
+			profiles = append(profiles, file)
+		default:
+			others = append(others, file)
+		}
+	}
+	if len(others) > 0 {
+		if len(seen) == 2 && len(organizations) == 0 && len(profiles) == 0 {
+			switch {
+			case len(others) == 2:
+				inputs = inputFiles{identities: others[:1], affiliations: others[1:]}
+			case len(identities) == 1:
+				inputs = inputFiles{identities: identities, affiliations: others}
+			default:
+				inputs = inputFiles{identities: others, affiliations: affiliations}
+			}
+			return
+		}
+		err = fmt.Errorf("cannot tell the kind of %v, expected user_identities_*.csv, user_affiliations_*.csv, user_organizations_*.csv or user_profiles_*.csv", others)
+		return
+	}
+	if len(identities) == 0 && len(affiliations) == 0 && len(organizations) == 0 && len(profiles) == 0 {
+		err = fmt.Errorf("no input files")
+		return
+	}
+	sortByTimestamp(identities)
+	sortByTimestamp(affiliations)
+	sortByTimestamp(organizations)
+	sortByTimestamp(profiles)
+	inputs = inputFiles{identities: identities, affiliations: affiliations, organizations: organizations, profiles: profiles}
+	return
+}
+
+// importArgs - imports command line arguments: a directory with file pairs, or files and glob patterns
+func importArgs(dbs []*shDatabase, dbg, dry bool, args []string) (err error) {
+	if info, e := os.Stat(args[0]); len(args) == 1 && e == nil && info.IsDir() {
+		return importDirectory(dbs, dbg, dry, args[0])
+	}
+	var inputs inputFiles
+	inputs, err = classifyInputFiles(args)
+	if err != nil {
+		return
+	}
+	_, err = importFiles(dbs, dbg, dry, inputs, runOptions{})
+	return
+}
+
+// importDirectory - pairs user_identities_YYYYMMDDHHMI.csv with user_affiliations_YYYYMMDDHHMI.csv found in dir
+// and imports pairs oldest first, each pair is a separate run, stops on the first failed pair
+// user_organizations_YYYYMMDDHHMI.csv and user_profiles_YYYYMMDDHHMI.csv with the same timestamp are imported with its pair
+func importDirectory(dbs []*shDatabase, dbg, dry bool, dir string) (err error) {
+	var sizes map[string]int64
+	sizes, err = listWatchedFiles(dbg, dir)
+	if err != nil {
+		return
+	}
+	names := []string{}
+	for name := range sizes {
+		names = append(names, name)
+	}
+	pairs, unpaired := findFilePairs(names)
+	for _, name := range unpaired {
+		fmt.Printf("WARNING: %s has no matching file with the same timestamp, skipping\n", filepath.Join(dir, name))
+	}
+	if len(pairs) == 0 {
+		err = fmt.Errorf("no user_identities_YYYYMMDDHHMI.csv, user_affiliations_YYYYMMDDHHMI.csv pairs found in %s", dir)
+		return
+	}
+	fmt.Printf("Found %d pairs in %s\n", len(pairs), dir)
+	for _, pair := range pairs {
+		inputs := inputFiles{identities: []string{filepath.Join(dir, pair.identities)}, affiliations: []string{filepath.Join(dir, pair.affiliations)}}
+		orgs, profiles := "user_organizations_"+pair.ts+".csv", "user_profiles_"+pair.ts+".csv"
+		if _, ok := sizes[orgs]; ok {
+			inputs.organizations = []string{filepath.Join(dir, orgs)}
+		}
+		if _, ok := sizes[profiles]; ok {
+			inputs.profiles = []string{filepath.Join(dir, profiles)}
+		}
+		_, err = importFiles(dbs, dbg, dry, inputs, runOptions{})
+		if err != nil {
+			err = fmt.Errorf("importing %s pair: %v", pair.ts, err)
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// gInterleave - INTERLEAVE: enrollments of people not touched by identities rows are imported concurrently
+	// with identities
+	gInterleave bool
+	// errDeferred - row belongs to the other phase of an interleaved import, it is neither counted nor recorded
+	errDeferred = fmt.Errorf("row deferred to the other interleaved phase")
+)
+
+// interleaved - enrollments phase running concurrently with identities files, rows depending on identities rows
+// are deferred to the regular enrollments phase that runs once identities (and profiles) are settled
+type interleaved struct {
+	// keys - identity_ids and uuids touched by identities rows, all - some identities rows can't be keyed
+	keys map[string]struct{}
+	all  bool
+	// uuids - identity_id -> uuid of affiliations rows
+	uuids     map[string]string
+	wg        sync.WaitGroup
+	err       error
+	started   []bool
+	results   []*rowResults
+	failed    [][]int
+	remaining [][]int
+	deferred  [][]int
+}
+
+// setInterleave - INTERLEAVE enables the dependency aware schedule, it is disabled with STALE_CHECK (the export
+// time is per file) and does nothing unless both identities and affiliations files are imported
+func setInterleave() {
+	gInterleave = os.Getenv("INTERLEAVE") != ""
+	if gInterleave && gStaleMode != "" {
+		fmt.Printf("WARNING: INTERLEAVE is disabled with STALE_CHECK, files are imported one after another\n")
+		gInterleave = false
+	}
+}
+
+// interleaveKeys - keys of a data row: identity_id, the uuid of the identity and uuids named by the row
+func interleaveKeys(row map[string]string, uuids map[string]string) (keys []string) {
+	if id := strings.TrimSpace(row["identity_id"]); id != "" {
+		keys = append(keys, "id:"+id)
+		if uuid, ok := uuids[id]; ok {
+			keys = append(keys, "uuid:"+uuid)
+		}
+	}
+	for _, col := range []string{"uuid", "merge_into_uuid"} {
+		if uuid := strings.TrimSpace(row[col]); uuid != "" {
+			keys = append(keys, "uuid:"+uuid)
+		}
+	}
+	return
+}
+
+// csvRow - data row n of the input as a map
+func csvRow(hdr, line []string) map[string]string {
+	row := map[string]string{}
+	for c, col := range line {
+		if c < len(hdr) {
+			row[hdr[c]] = col
+		}
+	}
+	return row
+}
+
+// inputIDs - identity_ids of all data rows of inputs
+func inputIDs(inputs []csvInput) (ids []string) {
+	seen := make(map[string]struct{})
+	for _, input := range inputs {
+		if len(input.lines) < 2 {
+			continue
+		}
+		idx := columnIndex(input.lines[0], "identity_id")
+		if idx < 0 {
+			continue
+		}
+		for _, line := range input.lines[1:] {
+			if idx >= len(line) {
+				continue
+			}
+			id := strings.TrimSpace(line[idx])
+			if _, ok := seen[id]; id != "" && !ok {
+				seen[id] = struct{}{}
+				ids = append(ids, id)
+			}
+		}
+	}
+	return
+}
+
+// newInterleaved - finds which affiliations rows depend on identities rows, nil when there is nothing to interleave
+func newInterleaved(db *sql.DB, identities, affiliations []csvInput) (p *interleaved, err error) {
+	if !gInterleave || dataRows(identities) == 0 || dataRows(affiliations) == 0 {
+		return
+	}
+	p = &interleaved{keys: make(map[string]struct{})}
+	var identityUUIDsMap map[string]string
+	identityUUIDsMap, err = identityUUIDs(db, inputIDs(identities))
+	if err != nil {
+		return
+	}
+	for _, input := range identities {
+		for _, line := range input.lines[1:] {
+			keys := interleaveKeys(csvRow(input.lines[0], line), identityUUIDsMap)
+			if len(keys) == 0 {
+				// identity found by email fallback, any enrollment can depend on it
+				p.all = true
+			}
+			for _, key := range keys {
+				p.keys[key] = struct{}{}
+			}
+		}
+	}
+	p.uuids, err = identityUUIDs(db, inputIDs(affiliations))
+	if err != nil {
+		return
+	}
+	n := len(affiliations)
+	p.started, p.results, p.failed, p.remaining, p.deferred = make([]bool, n), make([]*rowResults, n), make([][]int, n), make([][]int, n), make([][]int, n)
+	independent := 0
+	for i, input := range affiliations {
+		for r, line := range input.lines {
+			if r == 0 {
+				continue
+			}
+			if p.depends(csvRow(input.lines[0], line)) {
+				p.deferred[i] = append(p.deferred[i], r)
+			} else {
+				independent++
+			}
+		}
+	}
+	fmt.Printf("INTERLEAVE: %d/%d enrollments rows don't depend on identities rows and are imported concurrently with them\n", independent, dataRows(affiliations))
+	return
+}
+
+// depends - affiliations row touches an identity or uuid changed by identities rows
+func (p *interleaved) depends(row map[string]string) bool {
+	if p.all || strings.TrimSpace(row["identity_id"]) == "" {
+		return true
+	}
+	for _, key := range interleaveKeys(row, p.uuids) {
+		if _, ok := p.keys[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// phase - row processor running only rows that depend on identities rows (dependent) or only the other ones
+func (p *interleaved) phase(dependent bool, fn rowProcessor) rowProcessor {
+	return func(db *sql.DB, dbg, dry bool, row map[string]string) error {
+		if p.depends(row) != dependent {
+			return errDeferred
+		}
+		return fn(db, dbg, dry, row)
+	}
+}
+
+// start - imports affiliations rows not depending on identities rows in the background
+func (p *interleaved) start(db *sql.DB, dbg, dry bool, thrN int, policy *errorPolicy, ledger *importLedger, affiliations []csvInput) {
+	if p == nil {
+		return
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for i, input := range affiliations {
+			fn, err := ledger.prepare("enrollments", input.lines, hookRow("affiliations", retryConcurrent(enrollmentProcessor())))
+			if err != nil {
+				p.err = err
+				return
+			}
+			p.started[i] = true
+			p.results[i] = newRowResults(dry)
+			p.failed[i], p.remaining[i], err = processRows(db, dbg, dry, thrN, "Enrollments (interleaved)", input.lines, policy, p.results[i], p.phase(false, fn))
+			if err != nil {
+				p.err = err
+				return
+			}
+		}
+	}()
+}
+
+// wait - waits for the background enrollments phase, returns its error
+func (p *interleaved) wait() error {
+	if p == nil {
+		return nil
+	}
+	p.wg.Wait()
+	return p.err
+}
+
+// finish - combines failed and remaining rows of both phases of the affiliations file i
+func (p *interleaved) finish(i int, failed, remaining []int) ([]int, []int) {
+	failed = append(append([]int{}, p.failed[i]...), failed...)
+	remaining = append(append([]int{}, p.remaining[i]...), remaining...)
+	sort.Ints(failed)
+	sort.Ints(remaining)
+	return failed, remaining
+}
+
+// writeUnfinished - when the import stops before the regular enrollments phase of affiliations files from the
+// given one, writes failed rows and results of the background phase and all rows not applied yet as remaining rows
+// (without INTERLEAVE these affiliations files are unstarted)
+func (p *interleaved) writeUnfinished(affiliations []csvInput, from int, runID string) (err error) {
+	multi := len(affiliations) > 1
+	if p == nil {
+		return writeUnstarted(affiliations[from:], runID, multi)
+	}
+	_ = p.wait()
+	for i, input := range affiliations {
+		if i < from {
+			continue
+		}
+		if !p.started[i] {
+			err = writeRemaining(input, nil, runID, multi)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		err = writeFailedRows(input.name, runID, multi, input, p.failed[i])
+		if err == nil {
+			err = writeResults(input.name, runID, multi, input, p.results[i])
+		}
+		if err != nil {
+			return
+		}
+		_, rows := p.finish(i, nil, p.deferred[i])
+		if len(rows) == 0 {
+			continue
+		}
+		err = writeRemaining(input, rows, runID, multi)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
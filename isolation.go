@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+)
+
+var (
+	// gTxOptions - options of row transactions, nil means the server default (REPEATABLE READ for InnoDB)
+	gTxOptions *sql.TxOptions
+	// gLockRows - lock rows read before the transaction with select ... for update and check they didn't change
+	gLockRows bool
+)
+
+// setIsolation - TX_ISOLATION: read-uncommitted, read-committed, repeatable-read or serializable; LOCK_ROWS
+func setIsolation() (err error) {
+	gTxOptions = nil
+	gLockRows = os.Getenv("LOCK_ROWS") != ""
+	levels := map[string]sql.IsolationLevel{
+		"read-uncommitted": sql.LevelReadUncommitted,
+		"read-committed":   sql.LevelReadCommitted,
+		"repeatable-read":  sql.LevelRepeatableRead,
+		"serializable":     sql.LevelSerializable,
+	}
+	s := os.Getenv("TX_ISOLATION")
+	if s == "" {
+		return
+	}
+	level, ok := levels[s]
+	if !ok {
+		err = fmt.Errorf("invalid TX_ISOLATION=%s, allowed: read-uncommitted, read-committed, repeatable-read, serializable", s)
+		return
+	}
+	gTxOptions = &sql.TxOptions{Isolation: level}
+	return
+}
+
+// beginTx - starts row transaction with the configured isolation level, ROW_TIMEOUT limits the whole transaction
+// cancel must be called after the transaction is committed or rolled back
+func beginTx(db *sql.DB) (tx *sql.Tx, cancel context.CancelFunc, err error) {
+	err = readOnlyGuard("begin")
+	if err != nil {
+		return
+	}
+	var ctx context.Context
+	ctx, cancel = stmtContext()
+	tx, err = db.BeginTx(ctx, gTxOptions)
+	if err != nil {
+		cancel()
+		cancel = nil
+	}
+	return
+}
+
+// lockedRowExists - runs select ... for update in the transaction, returns if any row matched
+func lockedRowExists(tx *sql.Tx, query string, args ...interface{}) (exists bool, err error) {
+	var rows *sql.Rows
+	query = adaptQuery(query)
+	ctx, cancel := stmtContext()
+	defer cancel()
+	rows, err = tx.QueryContext(ctx, query+" for update", args...)
+	if err != nil {
+		queryOut(query+" for update", args...)
+		return
+	}
+	exists = rows.Next()
+	err = rows.Err()
+	if err != nil {
+		_ = rows.Close()
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+// lockIdentity - locks identity row, fails when another writer changed it since it was read
+func lockIdentity(tx *sql.Tx, id, name, username, email string) (err error) {
+	if !gLockRows {
+		return
+	}
+	var exists bool
+	exists, err = lockedRowExists(
+		tx,
+		"select 1 from identities where id = ? and trim(coalesce(name, '')) = ? and trim(coalesce(username, '')) = ? and trim(coalesce(email, '')) = ?",
+		id, name, username, email,
+	)
+	if err == nil && !exists {
+		err = fmt.Errorf("identity_id %s was changed by another writer since it was read", id)
+	}
+	return
+}
+
+// lockEnrollment - locks enrollment row (or the unique identity when a new enrollment is inserted),
+// fails when another writer changed it since it was read
+func lockEnrollment(tx *sql.Tx, eid int, uuid string, orgID int, startDate, endDate string) (err error) {
+	if !gLockRows {
+		return
+	}
+	var exists bool
+	if eid > 0 {
+		exists, err = lockedRowExists(
+			tx,
+			"select 1 from enrollments where id = ? and uuid = ? and organization_id = ? and start = str_to_date(?, ?) and end = str_to_date(?, ?)",
+			eid, uuid, orgID, startDate, cDateTimeFormat, endDate, cDateTimeFormat,
+		)
+		if err == nil && !exists {
+			err = fmt.Errorf("enrollment %d was changed by another writer since it was read", eid)
+		}
+		return
+	}
+	exists, err = lockedRowExists(tx, "select 1 from uidentities where uuid = ?", uuid)
+	if err == nil && !exists {
+		err = fmt.Errorf("unique identity %s was removed by another writer since it was read", uuid)
+	}
+	return
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// cTerminatedExitCode - 128 + SIGTERM, the run was stopped by a signal and can be resumed
+	cTerminatedExitCode = 143
+	// cDefaultTerminationLog - Kubernetes terminationMessagePath default
+	cDefaultTerminationLog = "/dev/termination-log"
+)
+
+var (
+	// gTerminating - SIGTERM/SIGINT received, no more rows are started
+	gTerminating int32
+	// gActiveRuns - imports in progress, the process exits on a signal once it drops to 0
+	gActiveRuns int32
+	// gRemainingFiles - files with rows not processed because of the signal
+	gRemainingFiles    []string
+	gRemainingFilesMtx = &sync.Mutex{}
+	// gExitOnce - the signal handler and main can both finish the terminated process
+	gExitOnce sync.Once
+	// errTerminated - run stopped by a signal, rows not processed are written to remaining rows files
+	errTerminated = fmt.Errorf("terminated by signal, not processed rows written to remaining rows files")
+)
+
+// terminationStatus - structured status written to TERMINATION_LOG when the process ends
+type terminationStatus struct {
+	Status         string    `json:"status"`
+	ExitCode       int       `json:"exit_code"`
+	Error          string    `json:"error,omitempty"`
+	Warnings       int       `json:"warnings"`
+	RemainingFiles []string  `json:"remaining_files,omitempty"`
+	Time           time.Time `json:"time"`
+}
+
+// terminating - a signal was received
+func terminating() bool {
+	return atomic.LoadInt32(&gTerminating) != 0
+}
+
+// trackRun - counts the import in progress, returns the function ending it
+func trackRun() func() {
+	atomic.AddInt32(&gActiveRuns, 1)
+	return func() {
+		atomic.AddInt32(&gActiveRuns, -1)
+	}
+}
+
+// handleSignals - first SIGTERM/SIGINT stops starting new rows, in-flight rows finish, rows not processed are
+// written to remaining rows files and the process exits with 143 once no import is running; second signal exits now
+func handleSignals() {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-ch
+		atomic.StoreInt32(&gTerminating, 1)
+		fmt.Printf("Received %v, finishing rows in progress\n", sig)
+		go func() {
+			sig := <-ch
+			fmt.Printf("Received %v again, exiting now\n", sig)
+			shutdown()
+			os.Exit(cTerminatedExitCode)
+		}()
+		for atomic.LoadInt32(&gActiveRuns) > 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		exitTerminated()
+	}()
+}
+
+// exitTerminated - writes the termination status and exits with 143
+func exitTerminated() {
+	gExitOnce.Do(func() {
+		writeTerminationStatus("terminated", cTerminatedExitCode, errTerminated)
+		fmt.Printf("Exiting with code %d: %v\n", cTerminatedExitCode, errTerminated)
+		shutdown()
+		os.Exit(cTerminatedExitCode)
+	})
+}
+
+// writeTerminationStatus - TERMINATION_LOG (default /dev/termination-log when it exists) gets JSON status
+func writeTerminationStatus(status string, code int, err error) {
+	path := os.Getenv("TERMINATION_LOG")
+	if path == "" {
+		if _, e := os.Stat(cDefaultTerminationLog); e != nil {
+			return
+		}
+		path = cDefaultTerminationLog
+	}
+	ts := terminationStatus{Status: status, ExitCode: code, Time: time.Now().UTC()}
+	if err != nil {
+		ts.Error = anonymize(err.Error())
+	}
+	for _, n := range gProcessWarnings {
+		ts.Warnings += n
+	}
+	gRemainingFilesMtx.Lock()
+	ts.RemainingFiles = append(ts.RemainingFiles, gRemainingFiles...)
+	gRemainingFilesMtx.Unlock()
+	data, e := json.Marshal(ts)
+	if e == nil {
+		e = ioutil.WriteFile(path, append(data, '\n'), 0644)
+	}
+	if e != nil {
+		fmt.Printf("WARNING: cannot write termination status to %s: %v\n", path, e)
+	}
+}
+
+// writeRemaining - writes rows not processed because of the signal (all data rows when rows is nil)
+// to user_identities_remaining_<runid>.csv (in CHECKPOINT_DIR, default the input file's directory),
+// the file can be imported to resume, trace columns point to the original input
+func writeRemaining(input csvInput, rows []int, runID string, multi bool) (err error) {
+	if len(input.lines) < 2 {
+		return
+	}
+	if rows == nil {
+		for n := 1; n < len(input.lines); n++ {
+			rows = append(rows, n)
+		}
+	}
+	if len(rows) == 0 {
+		return
+	}
+	outName := outputFileName(input.name, "remaining", runID, multi, os.Getenv("CHECKPOINT_DIR"))
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	err = w.Write(traceHeader(input.lines[0]))
+	for _, n := range rows {
+		if err != nil {
+			break
+		}
+		err = w.Write(withTrace(input, n, input.lines[n]))
+	}
+	if err == nil {
+		w.Flush()
+		err = w.Error()
+	}
+	if err == nil {
+		err = writeOutput(outName, buf.Bytes())
+	}
+	if err != nil {
+		return
+	}
+	fmt.Printf("%d not processed rows written to %s\n", len(rows), outName)
+	gRemainingFilesMtx.Lock()
+	gRemainingFiles = append(gRemainingFiles, outName)
+	gRemainingFilesMtx.Unlock()
+	return
+}
+
+// writeUnstarted - all rows of inputs not started because of the signal
+func writeUnstarted(inputs []csvInput, runID string, multi bool) (err error) {
+	for _, input := range inputs {
+		err = writeRemaining(input, nil, runID, multi)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// startHealth - HEALTH_ADDR (for example ":8081") serves /healthz (process is alive) and /readyz
+// (databases are reachable and no termination signal was received) for Kubernetes probes
+func startHealth(dbs []*shDatabase) {
+	addr := os.Getenv("HEALTH_ADDR")
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "ok\n")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if terminating() {
+			http.Error(w, "terminating", http.StatusServiceUnavailable)
+			return
+		}
+		for _, shdb := range dbs {
+			ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+			err := shdb.db.PingContext(ctx)
+			cancel()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("%s: %v", shdb.name, err), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		_, _ = fmt.Fprintf(w, "ok\n")
+	})
+	go func() {
+		fmt.Printf("Serving health probes on %s\n", addr)
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			fmt.Printf("WARNING: health probes server: %v\n", err)
+		}
+	}()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// cLatencySamples - per statement type, more statements are reservoir sampled
+	cLatencySamples = 100000
+)
+
+// queryLatency - latency percentiles of one statement type, for example "update identities"
+type queryLatency struct {
+	Statement string `json:"statement"`
+	Count     int    `json:"count"`
+	P50       string `json:"p50"`
+	P95       string `json:"p95"`
+	P99       string `json:"p99"`
+	Max       string `json:"max"`
+}
+
+// latencyStats - samples of one statement type
+type latencyStats struct {
+	count   int
+	max     time.Duration
+	samples []time.Duration
+}
+
+var (
+	gLatencies   = make(map[string]*latencyStats)
+	gLatencyMtx  = &sync.Mutex{}
+	gSlowQuery   time.Duration
+	gLatencyRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// setSlowQuery - SLOW_QUERY_MS, statements taking longer are logged with their arguments, 0 disables
+func setSlowQuery() (err error) {
+	gSlowQuery = 0
+	s := os.Getenv("SLOW_QUERY_MS")
+	if s == "" {
+		return
+	}
+	ms, e := strconv.Atoi(s)
+	if e != nil || ms < 0 {
+		err = fmt.Errorf("invalid SLOW_QUERY_MS=%s", s)
+		return
+	}
+	gSlowQuery = time.Duration(ms) * time.Millisecond
+	return
+}
+
+// resetLatencies - clears statistics of the previous run
+func resetLatencies() {
+	gLatencyMtx.Lock()
+	gLatencies = make(map[string]*latencyStats)
+	gLatencyMtx.Unlock()
+}
+
+// statementType - statement keyword and the table it works on
+func statementType(query string) string {
+	words := strings.Fields(strings.ToLower(query))
+	if len(words) == 0 {
+		return "?"
+	}
+	after := func(keyword string) string {
+		for i, word := range words[:len(words)-1] {
+			if word == keyword {
+				return strings.TrimRight(strings.SplitN(words[i+1], "(", 2)[0], ",;")
+			}
+		}
+		return "?"
+	}
+	switch words[0] {
+	case "select", "delete":
+		return words[0] + " " + after("from")
+	case "insert", "replace":
+		return words[0] + " " + after("into")
+	case "update":
+		return words[0] + " " + after("update")
+	}
+	return words[0]
+}
+
+// recordLatency - records statement duration, logs slow statements
+func recordLatency(query string, dt time.Duration, args ...interface{}) {
+	if gSlowQuery > 0 && dt > gSlowQuery {
+		fmt.Printf("Slow query (%v):\n", dt)
+		queryOut(query, args...)
+	}
+	typ := statementType(query)
+	gLatencyMtx.Lock()
+	defer gLatencyMtx.Unlock()
+	stats, ok := gLatencies[typ]
+	if !ok {
+		stats = &latencyStats{}
+		gLatencies[typ] = stats
+	}
+	stats.count++
+	if dt > stats.max {
+		stats.max = dt
+	}
+	if len(stats.samples) < cLatencySamples {
+		stats.samples = append(stats.samples, dt)
+		return
+	}
+	i := gLatencyRand.Intn(stats.count)
+	if i < cLatencySamples {
+		stats.samples[i] = dt
+	}
+}
+
+// percentile - p-th percentile of sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p/100.0+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// latencyReport - percentiles per statement type, most frequent first
+func latencyReport() (report []queryLatency) {
+	gLatencyMtx.Lock()
+	defer gLatencyMtx.Unlock()
+	for typ, stats := range gLatencies {
+		sorted := append([]time.Duration{}, stats.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		report = append(report, queryLatency{
+			Statement: typ,
+			Count:     stats.count,
+			P50:       percentile(sorted, 50).String(),
+			P95:       percentile(sorted, 95).String(),
+			P99:       percentile(sorted, 99).String(),
+			Max:       stats.max.String(),
+		})
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Count != report[j].Count {
+			return report[i].Count > report[j].Count
+		}
+		return report[i].Statement < report[j].Statement
+	})
+	return
+}
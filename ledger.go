@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// importLedger - idempotency ledger, content hashes of applied rows are stored in import_ledger table
+// rows whose hash is already in the ledger (for a given scope) are skipped
+// LEDGER - enables the ledger
+// LEDGER_SCOPE - ledger scope, default "default", use different scopes to apply the same rows again
+type importLedger struct {
+	db      *sql.DB
+	scope   string
+	runID   string
+	mtx     *sync.Mutex
+	applied map[string]struct{}
+}
+
+func newLedger(db *sql.DB, dry bool, runID string) (ledger *importLedger, err error) {
+	if os.Getenv("LEDGER") == "" || gShadow || gQuiet {
+		return
+	}
+	scope := os.Getenv("LEDGER_SCOPE")
+	if scope == "" {
+		scope = "default"
+	}
+	ledger = &importLedger{db: db, scope: scope, runID: runID, mtx: &sync.Mutex{}, applied: make(map[string]struct{})}
+	if dry {
+		return
+	}
+	_, err = execDB(
+		db,
+		"create table if not exists import_ledger(scope varchar(64) not null, row_hash char(64) not null, run_id varchar(32) not null, "+
+			"applied_at datetime not null, primary key(scope, row_hash)) engine=InnoDB default charset=utf8mb4",
+	)
+	return
+}
+
+// rowHash - content hash of a row: kind and all columns sorted by name with trimmed values
+// trace columns of re-imported failed rows files are not content, the row hashes the same as in the original file
+func rowHash(kind string, row map[string]string) string {
+	keys := []string{}
+	for k := range row {
+		if k == traceColumns[0] || k == traceColumns[1] {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	_, _ = h.Write([]byte(kind))
+	for _, k := range keys {
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(k))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(strings.TrimSpace(row[k])))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// load - loads which of the given hashes are already in the ledger, queries in batches
+func (l *importLedger) load(hashes []string) (err error) {
+	for from := 0; from < len(hashes); from += cReconcileBatch {
+		to := from + cReconcileBatch
+		if to > len(hashes) {
+			to = len(hashes)
+		}
+		args := []interface{}{l.scope}
+		for _, hash := range hashes[from:to] {
+			args = append(args, hash)
+		}
+		var rows *stmtRows
+		rows, err = query(l.db, "select row_hash from import_ledger where scope = ? and row_hash in ("+strings.TrimSuffix(strings.Repeat("?,", to-from), ",")+")", args...)
+		if err != nil {
+			if strings.Contains(err.Error(), "Error 1146") {
+				// table doesn't exist yet (dry run before the first real one)
+				err = nil
+			}
+			return
+		}
+		hash := ""
+		for rows.Next() {
+			err = rows.Scan(&hash)
+			if err != nil {
+				_ = rows.Close()
+				return
+			}
+			l.applied[hash] = struct{}{}
+		}
+		err = rows.Err()
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// contains - was the row already applied
+func (l *importLedger) contains(hash string) bool {
+	l.mtx.Lock()
+	_, ok := l.applied[hash]
+	l.mtx.Unlock()
+	return ok
+}
+
+// add - records applied row
+func (l *importLedger) add(hash string) (err error) {
+	_, err = execDB(l.db, "insert ignore into import_ledger(scope, row_hash, run_id, applied_at) values(?, ?, ?, now())", l.scope, hash, l.runID)
+	if err != nil {
+		err = fmt.Errorf("error adding row hash %s to the ledger: %v", hash, err)
+		return
+	}
+	l.mtx.Lock()
+	l.applied[hash] = struct{}{}
+	l.mtx.Unlock()
+	return
+}
+
+// wrap - returns row processor that skips already applied rows and records newly applied ones
+func (l *importLedger) wrap(kind string, fn rowProcessor) rowProcessor {
+	return func(db *sql.DB, dbg, dry bool, row map[string]string) error {
+		hash := rowHash(kind, row)
+		if l.contains(hash) {
+			if dbg {
+				fmt.Printf("%s row already applied (ledger %s): %v\n", kind, hash, row)
+			}
+			gSummaryMtx.Lock()
+			if gSummary != nil {
+				gSummary.LedgerSkipped++
+			}
+			gSummaryMtx.Unlock()
+			return nil
+		}
+		err := fn(db, dbg, dry, row)
+		if err != nil || dry {
+			return err
+		}
+		return l.add(hash)
+	}
+}
+
+// prepare - loads ledger state for all data rows of a CSV and wraps the row processor
+func (l *importLedger) prepare(kind string, lines [][]string, fn rowProcessor) (rowProcessor, error) {
+	if l == nil || len(lines) < 2 {
+		return fn, nil
+	}
+	hdr := lines[0]
+	hashes := []string{}
+	for _, line := range lines[1:] {
+		row := map[string]string{}
+		for c, col := range line {
+			row[hdr[c]] = col
+		}
+		hashes = append(hashes, rowHash(kind, row))
+	}
+	err := l.load(hashes)
+	if err != nil {
+		return nil, err
+	}
+	return l.wrap(kind, fn), nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// manifestEntry - expected checksum and data row count of an input file
+type manifestEntry struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+	Rows   *int   `json:"rows"`
+}
+
+// inputFileHashes - SHA256 of all input files, stored in the run summary and import_runs
+func inputFileHashes(files []string) (runFiles []runFile, err error) {
+	for _, file := range files {
+		var sum string
+		sum, err = fileSHA256(file)
+		if err != nil {
+			return
+		}
+		runFiles = append(runFiles, runFile{Name: filepath.Base(file), SHA256: sum})
+	}
+	return
+}
+
+// loadManifest - MANIFEST=path to JSON array of {"name", "sha256", "rows"}, names are file base names
+func loadManifest() (manifest map[string]manifestEntry, err error) {
+	path := os.Getenv("MANIFEST")
+	if path == "" {
+		return
+	}
+	var data []byte
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var entries []manifestEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		err = fmt.Errorf("invalid manifest %s: %v", path, err)
+		return
+	}
+	manifest = make(map[string]manifestEntry)
+	for _, entry := range entries {
+		manifest[filepath.Base(entry.Name)] = entry
+	}
+	return
+}
+
+// verifyManifest - every input file must be listed in the manifest with the same SHA256 and data row count,
+// so truncated or tampered files are never applied; rows are counted before any row selection
+func verifyManifest(runFiles []runFile, inputs []csvInput) (err error) {
+	var manifest map[string]manifestEntry
+	manifest, err = loadManifest()
+	if err != nil || manifest == nil {
+		return
+	}
+	rows := make(map[string]int)
+	for _, input := range inputs {
+		if len(input.lines) > 0 {
+			rows[filepath.Base(input.name)] = len(input.lines) - 1
+		}
+	}
+	problems := []string{}
+	for _, file := range runFiles {
+		entry, ok := manifest[file.Name]
+		if !ok {
+			problems = append(problems, file.Name+" is not in the manifest")
+			continue
+		}
+		if entry.SHA256 != "" && !strings.EqualFold(entry.SHA256, file.SHA256) {
+			problems = append(problems, fmt.Sprintf("%s SHA256 %s, manifest has %s", file.Name, file.SHA256, entry.SHA256))
+		}
+		if entry.Rows != nil && *entry.Rows != rows[file.Name] {
+			problems = append(problems, fmt.Sprintf("%s has %d rows, manifest has %d", file.Name, rows[file.Name], *entry.Rows))
+		}
+	}
+	if len(problems) > 0 {
+		err = fmt.Errorf("manifest verification failed: %s", strings.Join(problems, "; "))
+		return
+	}
+	fmt.Printf("Manifest verified: %d files\n", len(runFiles))
+	return
+}
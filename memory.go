@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// cMemoryCheckInterval - heap size is read at most this often (ReadMemStats stops the world)
+	cMemoryCheckInterval = time.Second
+	// cMemoryGCPercent - GC target used with MAX_MEMORY unless GOGC is set
+	cMemoryGCPercent = 50
+)
+
+var (
+	// gMaxMemory - MAX_MEMORY in bytes, 0 - unbounded
+	gMaxMemory uint64
+	// gSpillDir - SPILL_DIR, where change and warning logs are spilled
+	gSpillDir string
+	// gMemoryMtx - guards gMemoryChecked and gMemoryOver
+	gMemoryMtx     sync.Mutex
+	gMemoryChecked time.Time
+	gMemoryOver    bool
+)
+
+// parseSize - byte size with optional K, M, G suffix (powers of 1024, optional B/iB): 512M, 2GiB, 1048576
+func parseSize(s string) (size uint64, err error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "B"), "I")
+	mult := uint64(1)
+	switch {
+	case strings.HasSuffix(v, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(v, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(v, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		v = v[:len(v)-1]
+	}
+	size, err = strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+	if err != nil || size == 0 {
+		err = fmt.Errorf("invalid size '%s', expected a positive number with optional K, M or G suffix", s)
+		return
+	}
+	size *= mult
+	return
+}
+
+// setMaxMemory - MAX_MEMORY=512M bounds the run's change log and warning messages: once the heap exceeds it, they
+// are spilled to files in SPILL_DIR (default the system temporary directory) and the summary keeps
+// only messages recorded since the last spill, GC also runs more often (GOGC=50 unless GOGC is set)
+func setMaxMemory() (err error) {
+	gMaxMemory = 0
+	gMemoryOver = false
+	gMemoryChecked = time.Time{}
+	s := os.Getenv("MAX_MEMORY")
+	if s == "" {
+		return
+	}
+	gMaxMemory, err = parseSize(s)
+	if err != nil {
+		err = fmt.Errorf("MAX_MEMORY: %v", err)
+		return
+	}
+	gSpillDir = os.Getenv("SPILL_DIR")
+	if gSpillDir == "" {
+		gSpillDir = os.TempDir()
+	}
+	if os.Getenv("GOGC") == "" {
+		debug.SetGCPercent(cMemoryGCPercent)
+	}
+	return
+}
+
+// overMemory - heap is above MAX_MEMORY, the heap size is re-read at most once per cMemoryCheckInterval
+func overMemory() bool {
+	if gMaxMemory == 0 {
+		return false
+	}
+	gMemoryMtx.Lock()
+	defer gMemoryMtx.Unlock()
+	if time.Since(gMemoryChecked) < cMemoryCheckInterval {
+		return gMemoryOver
+	}
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	gMemoryChecked = time.Now()
+	over := stats.HeapAlloc > gMaxMemory
+	if over && !gMemoryOver {
+		fmt.Printf("Heap %d MiB exceeds MAX_MEMORY %d MiB, spilling change and warning logs to %s\n", stats.HeapAlloc>>20, gMaxMemory>>20, gSpillDir)
+	}
+	gMemoryOver = over
+	return over
+}
+
+// spillLines - appends messages to the run's spill file of the kind (changes, warnings), one message per line
+// (newlines escaped), the file name is set on the first spill
+func spillLines(runID, kind string, path *string, lines []string) (err error) {
+	if *path == "" {
+		*path = filepath.Join(gSpillDir, "import_"+runID+"_"+kind+".log")
+	}
+	var f *os.File
+	f, err = os.OpenFile(*path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(f)
+	for _, line := range lines {
+		_, err = w.WriteString(strings.Replace(line, "\n", "\\n", -1) + "\n")
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	e := f.Close()
+	if err == nil {
+		err = e
+	}
+	return
+}
+
+// spillSummary - moves the change log and warning messages to spill files when the heap is over MAX_MEMORY,
+// gSummaryMtx must be held
+func spillSummary() {
+	if gSummary == nil || !overMemory() {
+		return
+	}
+	s := gSummary
+	if len(s.Changes) > 0 {
+		if err := spillLines(s.RunID, "changes", &s.ChangesFile, s.Changes); err != nil {
+			fmt.Printf("WARNING: cannot spill %d changes: %v\n", len(s.Changes), err)
+			return
+		}
+		s.SpilledChanges += len(s.Changes)
+		s.Changes = nil
+	}
+	if len(s.WarningMessages) > 0 {
+		if err := spillLines(s.RunID, "warnings", &s.WarningsFile, s.WarningMessages); err != nil {
+			fmt.Printf("WARNING: cannot spill %d warning messages: %v\n", len(s.WarningMessages), err)
+			return
+		}
+		s.SpilledWarnings += len(s.WarningMessages)
+		s.WarningMessages = nil
+	}
+}
+
+// ChangesCount - all changes of the run, including spilled ones (also used by SMTP templates)
+func (s *importSummary) ChangesCount() int {
+	return len(s.Changes) + s.SpilledChanges
+}
+
+// readSpilled - messages of a spill file, empty path means nothing was spilled
+func readSpilled(path string) (lines []string, err error) {
+	if path == "" {
+		return
+	}
+	var f *os.File
+	f, err = os.Open(path)
+	if err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, strings.Replace(scanner.Text(), "\\n", "\n", -1))
+	}
+	err = scanner.Err()
+	_ = f.Close()
+	return
+}
+
+// allChanges - the full change log: spilled changes followed by the ones still in memory
+func (s *importSummary) allChanges() (changes []string, err error) {
+	changes, err = readSpilled(s.ChangesFile)
+	if err != nil {
+		return
+	}
+	changes = append(changes, s.Changes...)
+	return
+}
+
+// allWarnings - all warning messages: spilled ones followed by the ones still in memory
+func (s *importSummary) allWarnings() (warnings []string, err error) {
+	warnings, err = readSpilled(s.WarningsFile)
+	if err != nil {
+		return
+	}
+	warnings = append(warnings, s.WarningMessages...)
+	return
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	var testCases = []struct {
+		size     string
+		expected uint64
+	}{
+		{size: "1048576", expected: 1048576},
+		{size: "1", expected: 1},
+		{size: "100B", expected: 100},
+		{size: "1K", expected: 1 << 10},
+		{size: "1kb", expected: 1 << 10},
+		{size: "4KiB", expected: 4 << 10},
+		{size: "512M", expected: 512 << 20},
+		{size: "512m", expected: 512 << 20},
+		{size: "256MB", expected: 256 << 20},
+		{size: "2GiB", expected: 2 << 30},
+		{size: "3g", expected: 3 << 30},
+		{size: " 64 M ", expected: 64 << 20},
+	}
+	for index, test := range testCases {
+		got, err := parseSize(test.size)
+		if err != nil {
+			t.Errorf("test number %d, parsing '%s' failed: %v", index+1, test.size, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("test number %d, expected %d, got %d for '%s'", index+1, test.expected, got, test.size)
+		}
+	}
+}
+
+func TestParseSizeErrors(t *testing.T) {
+	var testCases = []string{
+		"",
+		"0",
+		"0M",
+		"-1",
+		"-1M",
+		"M",
+		"1T",
+		"1.5G",
+		"abc",
+		"1 0M",
+	}
+	for index, test := range testCases {
+		_, err := parseSize(test)
+		if err == nil {
+			t.Errorf("test number %d, expected an error for '%s'", index+1, test)
+		}
+	}
+}
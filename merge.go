@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const cMergeDateFormat = "2006-01-02 15:04:05"
+
+var (
+	// gMergeEnrollments - consolidate enrollments of uuids changed by the run (MERGE_ENROLLMENTS)
+	gMergeEnrollments bool
+	// gMergeUUIDs - uuids whose enrollments were added or changed
+	gMergeUUIDs map[string]struct{}
+	// gKeepEnrollmentHistory - ENROLLMENT_HISTORY=keep, replaced enrollments are end-dated instead of overwritten
+	gKeepEnrollmentHistory bool
+)
+
+// mergeEnrollment - enrollment range of a unique identity
+type mergeEnrollment struct {
+	id          int
+	orgID       int
+	projectSlug string
+	start       time.Time
+	end         time.Time
+}
+
+// setMergeEnrollments - MERGE_ENROLLMENTS, resets uuids to merge
+func setMergeEnrollments() {
+	gMergeEnrollments = os.Getenv("MERGE_ENROLLMENTS") != "" && !gShadow
+	gMergeUUIDs = make(map[string]struct{})
+}
+
+// recordMerge - remembers uuid whose enrollments were changed
+func recordMerge(uuid string) {
+	if !gMergeEnrollments {
+		return
+	}
+	if gMtx != nil {
+		gMtx.Lock()
+	}
+	gMergeUUIDs[uuid] = struct{}{}
+	if gMtx != nil {
+		gMtx.Unlock()
+	}
+}
+
+// setEnrollmentHistory - ENROLLMENT_HISTORY: "replace" (default) - a row moving an enrollment to a later start
+// overwrites it, "keep" - the existing enrollment ends at the new start (or is left unchanged when it already
+// ended) and the new range is inserted, so the employment history is preserved, it cannot be used with
+// MERGE_ENROLLMENTS which would merge the kept history back into a single range
+func setEnrollmentHistory() (err error) {
+	switch policy := strings.ToLower(strings.TrimSpace(os.Getenv("ENROLLMENT_HISTORY"))); policy {
+	case "", "replace":
+		gKeepEnrollmentHistory = false
+	case "keep":
+		gKeepEnrollmentHistory = true
+		if gMergeEnrollments {
+			err = fmt.Errorf("ENROLLMENT_HISTORY=keep cannot be used with MERGE_ENROLLMENTS, it would merge the kept history back into a single range")
+		}
+	default:
+		err = fmt.Errorf("invalid ENROLLMENT_HISTORY=%s, allowed: replace, keep", policy)
+	}
+	return
+}
+
+// uuidEnrollments - enrollments of uuid ordered by organization, project and start date
+func uuidEnrollments(db *sql.DB, uuid string) (enrollments []mergeEnrollment, err error) {
+	var rows *stmtRows
+	rows, err = query(
+		db,
+		"select id, organization_id, coalesce(project_slug, ''), date_format(start, '%Y-%m-%d %H:%i:%s'), date_format(end, '%Y-%m-%d %H:%i:%s') "+
+			"from enrollments where uuid = ? order by organization_id, project_slug, start, id",
+		uuid,
+	)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var (
+			e          mergeEnrollment
+			start, end string
+		)
+		err = rows.Scan(&e.id, &e.orgID, &e.projectSlug, &start, &end)
+		if err == nil {
+			e.start, err = time.Parse(cMergeDateFormat, start)
+		}
+		if err == nil {
+			e.end, err = time.Parse(cMergeDateFormat, end)
+		}
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		enrollments = append(enrollments, e)
+	}
+	err = rows.Err()
+	if err != nil {
+		_ = rows.Close()
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+// mergeRanges - collapses overlapping or adjacent (starting at most a day after the previous end) enrollments
+// of the same organization and project, returns merged ranges and the enrollments merged into each of them
+func mergeRanges(enrollments []mergeEnrollment) (merged []mergeEnrollment, absorbed map[int][]int) {
+	absorbed = make(map[int][]int)
+	for _, e := range enrollments {
+		n := len(merged)
+		if n > 0 {
+			last := &merged[n-1]
+			if last.orgID == e.orgID && last.projectSlug == e.projectSlug && !e.start.After(last.end.AddDate(0, 0, 1)) {
+				if e.end.After(last.end) {
+					last.end = e.end
+				}
+				absorbed[last.id] = append(absorbed[last.id], e.id)
+				continue
+			}
+		}
+		merged = append(merged, e)
+	}
+	return
+}
+
+// mergeUUIDEnrollments - merges enrollments of a single uuid in one transaction
+func mergeUUIDEnrollments(db *sql.DB, dbg, dry bool, uuid string) (n int, err error) {
+	var enrollments []mergeEnrollment
+	enrollments, err = uuidEnrollments(db, uuid)
+	if err != nil {
+		return
+	}
+	merged, absorbed := mergeRanges(enrollments)
+	if len(absorbed) == 0 {
+		return
+	}
+	who := "merge-enrollments"
+	var tx *sql.Tx
+	if !dry {
+		var cancelTx context.CancelFunc
+		tx, cancelTx, err = beginTx(db)
+		if err != nil {
+			err = fmt.Errorf("error starting transaction %v", err)
+			return
+		}
+		defer cancelTx()
+		defer func() {
+			if tx != nil {
+				fmt.Printf("rollback merge of uuid %s enrollments\n", uuid)
+				_ = tx.Rollback()
+			}
+		}()
+	}
+	msgs := []string{}
+	for _, e := range merged {
+		ids, ok := absorbed[e.id]
+		if !ok {
+			continue
+		}
+		sort.Ints(ids)
+		msg := fmt.Sprintf("merge enrollments uuid %s org %d project '%s': %v into %d %s - %s", uuid, e.orgID, e.projectSlug, ids, e.id, e.start.Format(cMergeDateFormat), e.end.Format(cMergeDateFormat))
+		fmt.Printf("%s\n", msg)
+		n += len(ids)
+		if dry {
+			addChange(msg)
+			recordPlanned(uuid)
+			continue
+		}
+		for _, id := range ids {
+			var before *enrollmentState
+			before, err = getEnrollmentState(db, id)
+			if err != nil {
+				err = fmt.Errorf("error getting enrollment %d state %v", id, err)
+				return
+			}
+			_, err = exec(tx, "", "delete from enrollments where id = ?", id)
+			if err != nil {
+				err = fmt.Errorf("error deleting merged enrollment %d: %v", id, err)
+				return
+			}
+			err = auditEnrollmentDeletion(tx, id, before, who)
+			if err != nil {
+				err = fmt.Errorf("error auditing merged enrollment %d deletion: %v", id, err)
+				return
+			}
+		}
+		args := []interface{}{e.start.Format(cMergeDateFormat), e.end.Format(cMergeDateFormat)}
+		args = append(args, auditArgs("enrollments", who)...)
+		args = append(args, e.id)
+		_, err = exec(tx, "", "update enrollments set start = ?, end = ?, "+auditSet("enrollments")+" where id = ?", args...)
+		if err != nil {
+			err = fmt.Errorf("error updating merged enrollment %d: %v", e.id, err)
+			return
+		}
+		msgs = append(msgs, msg)
+	}
+	if dry {
+		return
+	}
+	err = claimPlanned(msgs...)
+	if err != nil {
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		unclaimPlanned(msgs...)
+		err = fmt.Errorf("error committing transaction %v", err)
+		return
+	}
+	tx = nil
+	for _, msg := range msgs {
+		addChange(msg)
+	}
+	return
+}
+
+// mergeEnrollments - MERGE_ENROLLMENTS cleanup pass, as SortingHat's merge enrollments: for every uuid
+// with added or changed enrollments collapses overlapping or adjacent ranges per organization and project
+func mergeEnrollments(db *sql.DB, dbg, dry bool) (err error) {
+	if !gMergeEnrollments || len(gMergeUUIDs) == 0 {
+		return
+	}
+	uuids := []string{}
+	for uuid := range gMergeUUIDs {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	total := 0
+	for _, uuid := range uuids {
+		var n int
+		n, err = mergeUUIDEnrollments(db, dbg, dry, uuid)
+		if err != nil {
+			err = fmt.Errorf("merging enrollments of uuid %s: %v", uuid, err)
+			return
+		}
+		total += n
+	}
+	fmt.Printf("Merged %d enrollments of %d uuids\n", total, len(uuids))
+	return
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// shDatabase - SortingHat database the import is applied to
+type shDatabase struct {
+	name    string
+	dsn     string
+	charset string
+	db      *sql.DB
+	ro      *sql.DB
+}
+
+var (
+	// gDatabase - name of the database the current run imports into (only set with multiple databases)
+	gDatabase string
+	// gReplica - read replica of the current database
+	gReplica *sql.DB
+)
+
+// replica - returns read replica for lookups when configured, db otherwise
+// Only lookups that don't depend on the import's own writes should use it
+func replica(db *sql.DB) *sql.DB {
+	if gReplica != nil {
+		return gReplica
+	}
+	return db
+}
+
+// dsnName - host:port/db part of DSN, without credentials
+func dsnName(dsn string) string {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "?"
+	}
+	return cfg.Addr + "/" + cfg.DBName
+}
+
+// openDatabases - primary database from SH_* variables, additional ones from SH_DSN_2, SH_DSN_3, ...
+func openDatabases() (dbs []*shDatabase, err error) {
+	dsns := []string{getConnectString("SH_")}
+	for i := 2; ; i++ {
+		dsn := os.Getenv("SH_DSN_" + strconv.Itoa(i))
+		if dsn == "" {
+			break
+		}
+		dsns = append(dsns, dsn)
+	}
+	for i, dsn := range dsns {
+		shdb := &shDatabase{name: dsnName(dsn), dsn: dsn, charset: dsnCharset(dsn)}
+		shdb.db, err = openMySQL(readOnlyDSN(dsn, i == 0))
+		if err != nil {
+			closeDatabases(dbs)
+			return
+		}
+		dbs = append(dbs, shdb)
+	}
+	// SH_RO_DSN - read replica of the primary database used for identity, organization and slug lookups
+	roDSN := os.Getenv("SH_RO_DSN")
+	if roDSN != "" {
+		dbs[0].ro, err = openMySQL(readOnlyDSN(roDSN, false))
+		if err != nil {
+			closeDatabases(dbs)
+			return
+		}
+		gReplica = dbs[0].ro
+	}
+	return
+}
+
+// closeDatabases - closes all databases
+func closeDatabases(dbs []*shDatabase) {
+	for _, shdb := range dbs {
+		_ = shdb.db.Close()
+		if shdb.ro != nil {
+			_ = shdb.ro.Close()
+		}
+	}
+}
+
+// use - makes database the current one for the following import
+func (shdb *shDatabase) use(multi bool) {
+	gConnCharset = shdb.charset
+	gReplica = shdb.ro
+	gDatabase = ""
+	if multi {
+		gDatabase = shdb.name
+	}
+}
+
+// importIntoDatabases - imports the same files into all databases, one after another
+// MULTI_DB_ABORT - check all databases are reachable and dry-run the import against all of them first,
+// then stop at the first failing database; changes already committed to previous databases are not reverted
+// without MULTI_DB_ABORT a failing database doesn't stop importing into the others
+// summaries of all databases the import ran against are returned, in order of databases
+func importIntoDatabases(dbs []*shDatabase, dbg, dry bool, inputs inputFiles, opts runOptions) (summaries []*importSummary, err error) {
+	if len(dbs) == 1 {
+		dbs[0].use(false)
+		var summary *importSummary
+		summary, err = importCSVfiles(dbs[0].db, dbg, dry, inputs, opts)
+		if summary != nil {
+			summaries = append(summaries, summary)
+		}
+		return
+	}
+	abortAll := os.Getenv("MULTI_DB_ABORT") != ""
+	if abortAll {
+		for _, shdb := range dbs {
+			err = shdb.db.Ping()
+			if err != nil {
+				err = fmt.Errorf("database %s is not reachable: %v", shdb.name, err)
+				return
+			}
+		}
+		if !dry {
+			for _, shdb := range dbs {
+				fmt.Printf("Dry-run against %s\n", shdb.name)
+				shdb.use(true)
+				_, err = importCSVfiles(shdb.db, dbg, true, inputs, runOptions{quiet: true})
+				if err != nil {
+					err = fmt.Errorf("dry-run against %s failed, nothing was imported: %v", shdb.name, err)
+					return
+				}
+			}
+		}
+	}
+	failed := 0
+	for _, shdb := range dbs {
+		fmt.Printf("Importing into %s\n", shdb.name)
+		shdb.use(true)
+		summary, e := importCSVfiles(shdb.db, dbg, dry, inputs, opts)
+		if summary != nil {
+			summaries = append(summaries, summary)
+		}
+		if e != nil {
+			failed++
+			fmt.Printf("WARNING: import into %s failed: %v\n", shdb.name, e)
+			if err == nil {
+				err = fmt.Errorf("import into %s failed: %v", shdb.name, e)
+			}
+			if abortAll {
+				break
+			}
+		}
+	}
+	gDatabase = ""
+	for _, summary := range summaries {
+		fmt.Printf("%s", summary.text())
+	}
+	if failed > 0 {
+		err = fmt.Errorf("%d/%d databases failed, first error: %v", failed, len(dbs), err)
+	}
+	return
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	// cNameOrderComma - "Last, First" compares equal to "First Last"
+	cNameOrderComma = "comma"
+	// cNameOrderAny - also the same words in any order compare equal ("Zhang Wei" and "Wei Zhang")
+	cNameOrderAny = "any"
+	// cDefaultFamilyFirst - countries where the family name usually comes first
+	cDefaultFamilyFirst = "CN,HK,MO,TW,JP,KR,KP,VN,HU,KH,MN"
+)
+
+var (
+	// gNameOrder - name ordering policy, empty compares names as they are
+	gNameOrder string
+	// gFamilyFirst - profile country codes where any word order is accepted, nil means all countries
+	gFamilyFirst map[string]struct{}
+	// gTransliterate - ASCII values equal to the transliterated DB value are formatting differences
+	gTransliterate bool
+	// gTranslit - letters that have no ASCII compatibility decomposition
+	gTranslit = map[rune]string{
+		'ß': "ss", 'ẞ': "SS", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE", 'ø': "o", 'Ø': "O", 'đ': "d", 'Đ': "D",
+		'ð': "d", 'Ð': "D", 'ł': "l", 'Ł': "L", 'þ': "th", 'Þ': "Th", 'ı': "i", 'ħ': "h", 'Ħ': "H", 'ŧ': "t",
+		'Ŧ': "T", 'ŋ': "ng", 'Ŋ': "NG", 'ĸ': "k", 'ſ': "s",
+	}
+)
+
+// setNameCompare - NAME_ORDER: comma or any, NAME_ORDER_COUNTRIES (for any, default family-name-first countries,
+// "*" for all), TRANSLITERATE
+func setNameCompare() (err error) {
+	gTransliterate = os.Getenv("TRANSLITERATE") != ""
+	gNameOrder = strings.ToLower(strings.TrimSpace(os.Getenv("NAME_ORDER")))
+	switch gNameOrder {
+	case "", cNameOrderComma, cNameOrderAny:
+	default:
+		err = fmt.Errorf("invalid NAME_ORDER=%s, allowed: %s, %s", gNameOrder, cNameOrderComma, cNameOrderAny)
+		return
+	}
+	countries := os.Getenv("NAME_ORDER_COUNTRIES")
+	if countries == "" {
+		countries = cDefaultFamilyFirst
+	}
+	gFamilyFirst = nil
+	if strings.TrimSpace(countries) == "*" {
+		return
+	}
+	gFamilyFirst = make(map[string]struct{})
+	for _, code := range strings.Split(countries, ",") {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if code != "" {
+			gFamilyFirst[code] = struct{}{}
+		}
+	}
+	return
+}
+
+// transliterate - ASCII fallback of the value: accents removed, special Latin letters spelled out,
+// other scripts are kept as they are
+func transliterate(s string) string {
+	var b strings.Builder
+	for _, r := range unaccent(s) {
+		if t, ok := gTranslit[r]; ok {
+			b.WriteString(t)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// isASCII - value only has ASCII characters
+func isASCII(s string) bool {
+	for _, r := range s {
+		if r > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
+
+// commaName - "Last, First" -> "First Last", other names are returned unchanged
+func commaName(s string) string {
+	ary := strings.Split(s, ",")
+	if len(ary) != 2 || strings.TrimSpace(ary[0]) == "" || strings.TrimSpace(ary[1]) == "" {
+		return s
+	}
+	return strings.TrimSpace(ary[1]) + " " + strings.TrimSpace(ary[0])
+}
+
+// nameWords - words of the name sorted
+func nameWords(s string) string {
+	words := strings.Fields(s)
+	sort.Strings(words)
+	return strings.Join(words, " ")
+}
+
+// familyFirst - profile of the unique identity is from a country where any name word order is accepted
+func familyFirst(db *sql.DB, uuid string) (bool, error) {
+	if gFamilyFirst == nil {
+		return true, nil
+	}
+	code := ""
+	found, err := queryFirst(replica(db), []interface{}{&code}, "select coalesce(country_code, '') from profiles where uuid = ?", uuid)
+	if err != nil || !found {
+		return false, err
+	}
+	_, ok := gFamilyFirst[strings.ToUpper(code)]
+	return ok, nil
+}
+
+// equivalentName - new name only differs from the DB name by formatting allowed by NAME_ORDER and TRANSLITERATE,
+// so it is not an update: "Smith, John" vs "John Smith", "Jose Garcia" vs "José García" (ASCII fallback of the
+// DB value), only ASCII new values are transliterated fallbacks, so "Jose" -> "José" is still applied
+func equivalentName(db *sql.DB, uuid, name, newName string) (same bool, err error) {
+	if name == newName {
+		same = true
+		return
+	}
+	if name == "" || newName == "" || (gNameOrder == "" && !gTransliterate) {
+		return
+	}
+	a, b := name, newName
+	if gTransliterate && isASCII(newName) {
+		a = transliterate(a)
+	}
+	if gNameOrder != "" {
+		a, b = commaName(a), commaName(b)
+	}
+	a, b = strings.Join(strings.Fields(a), " "), strings.Join(strings.Fields(b), " ")
+	if a == b {
+		same = true
+		return
+	}
+	if gNameOrder != cNameOrderAny || nameWords(a) != nameWords(b) {
+		return
+	}
+	same, err = familyFirst(db, uuid)
+	return
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	gNormalizeNFC    bool
+	gNormalizeInvis  bool
+	gNormalizeSpaces bool
+	// Zero-width and bidi control characters that are invisible in names, ZWJ/ZWNJ are kept because they
+	// are meaningful in Indic/Persian scripts and emoji sequences
+	gInvisible = map[rune]struct{}{
+		0x00AD: {}, 0x180E: {}, 0x200B: {}, 0x200E: {}, 0x200F: {}, 0x202A: {}, 0x202B: {}, 0x202C: {},
+		0x202D: {}, 0x202E: {}, 0x2060: {}, 0x2061: {}, 0x2062: {}, 0x2063: {}, 0x2064: {}, 0x2066: {},
+		0x2067: {}, 0x2068: {}, 0x2069: {}, 0xFEFF: {},
+	}
+)
+
+// nfc - Unicode canonical composition (NFC)
+func nfc(s string) string {
+	return norm.NFC.String(s)
+}
+
+// unaccent - compatibility decomposition (NFKD) with combining marks removed, as SortingHat's unaccent_string
+func unaccent(s string) string {
+	result, _, err := transform.String(transform.Chain(norm.NFKD, runes.Remove(runes.In(unicode.Mn))), s)
+	if err != nil {
+		return s
+	}
+	return result
+}
+
+// setNormalize - configures normalization applied to identity name/username/email before comparison
+// NORMALIZE - comma separated list of: nfc (Unicode NFC), invisible (strip zero-width and bidi control characters),
+// spaces (non-breaking and other Unicode spaces to a single ASCII space); "all" enables all of them
+func setNormalize(spec string) (err error) {
+	gNormalizeNFC, gNormalizeInvis, gNormalizeSpaces = false, false, false
+	for _, item := range strings.Split(spec, ",") {
+		switch strings.TrimSpace(strings.ToLower(item)) {
+		case "":
+		case "all", "1", "true":
+			gNormalizeNFC, gNormalizeInvis, gNormalizeSpaces = true, true, true
+		case "nfc":
+			gNormalizeNFC = true
+		case "invisible":
+			gNormalizeInvis = true
+		case "spaces":
+			gNormalizeSpaces = true
+		default:
+			err = fmt.Errorf("invalid NORMALIZE item '%s', allowed: nfc, invisible, spaces, all", item)
+			return
+		}
+	}
+	return
+}
+
+// normalizeValue - applies configured normalization and trims the value
+func normalizeValue(s string) string {
+	if gNormalizeInvis {
+		s = strings.Map(func(r rune) rune {
+			if _, ok := gInvisible[r]; ok {
+				return -1
+			}
+			return r
+		}, s)
+	}
+	if gNormalizeSpaces {
+		s = strings.Join(strings.FieldsFunc(s, unicode.IsSpace), " ")
+	}
+	if gNormalizeNFC {
+		s = nfc(s)
+	}
+	return strings.TrimSpace(s)
+}
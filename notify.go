@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// postJSON - posts JSON payload to URL, non 2xx responses are errors
+func postJSON(url string, payload interface{}) (err error) {
+	var data []byte
+	data, err = json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	var resp *http.Response
+	resp, err = client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("POST %s returned %d: %s", url, resp.StatusCode, string(body))
+	}
+	return
+}
+
+// notifyRun - posts run summary to configured webhooks
+// SLACK_WEBHOOK - Slack incoming webhook URL
+// TEAMS_WEBHOOK - MS Teams incoming webhook URL
+// WEBHOOK_URL - generic webhook, receives summary JSON (without the list of changes and warnings)
+// NOTIFY_ON - "all" (default) or "failure" to only notify about aborted runs
+// Email is sent as well when SMTP_HOST is configured, see emailRun
+func notifyRun(dbg bool, summary *importSummary) {
+	if os.Getenv("NOTIFY_ON") == "failure" && summary.Error == "" {
+		return
+	}
+	text := summary.text()
+	generic := *summary
+	generic.Changes = nil
+	generic.WarningMessages = nil
+	hooks := []struct {
+		env     string
+		payload interface{}
+	}{
+		{env: "SLACK_WEBHOOK", payload: map[string]string{"text": "```" + text + "```"}},
+		{env: "TEAMS_WEBHOOK", payload: map[string]string{"text": "<pre>" + text + "</pre>"}},
+		{env: "WEBHOOK_URL", payload: generic},
+	}
+	for _, hook := range hooks {
+		url := os.Getenv(hook.env)
+		if url == "" {
+			continue
+		}
+		err := postJSON(url, hook.payload)
+		if err != nil {
+			fmt.Printf("WARNING: %s notification failed: %v\n", hook.env, err)
+			continue
+		}
+		if dbg {
+			fmt.Printf("%s notification sent\n", hook.env)
+		}
+	}
+	err := emailRun(dbg, summary)
+	if err != nil {
+		fmt.Printf("WARNING: email notification failed: %v\n", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+const (
+	// cVersionColumn - last_modified used as a row version, read and compared as a string
+	cVersionColumn = "coalesce(date_format(last_modified, '%Y-%m-%d %H:%i:%s.%f'), '')"
+	// cDefaultOptimisticRetries - how many times a row is re-read and re-applied after a concurrent modification
+	cDefaultOptimisticRetries = 3
+)
+
+var (
+	// gOptimistic - updates and deletes only succeed when last_modified is still the value that was read
+	gOptimistic bool
+	// gOptimisticRetries - retries of rows modified concurrently
+	gOptimisticRetries int
+)
+
+// errConcurrent - row was modified by another writer between the read and the write
+type errConcurrent struct {
+	msg string
+}
+
+func (e errConcurrent) Error() string {
+	return e.msg
+}
+
+// concurrentf - returns concurrent modification error
+func concurrentf(f string, a ...interface{}) error {
+	return errConcurrent{msg: fmt.Sprintf(f, a...)}
+}
+
+// setOptimistic - OPTIMISTIC enables last_modified version checks, OPTIMISTIC_RETRIES (default 3)
+func setOptimistic() (err error) {
+	gOptimistic = os.Getenv("OPTIMISTIC") != ""
+	gOptimisticRetries = cDefaultOptimisticRetries
+	s := os.Getenv("OPTIMISTIC_RETRIES")
+	if s == "" {
+		return
+	}
+	gOptimisticRetries, err = strconv.Atoi(s)
+	if err != nil || gOptimisticRetries < 0 {
+		err = fmt.Errorf("invalid OPTIMISTIC_RETRIES=%s", s)
+	}
+	return
+}
+
+// versionDB - versions must be read from the primary database, a lagging replica would always conflict
+func versionDB(db *sql.DB) *sql.DB {
+	if gOptimistic {
+		return db
+	}
+	return replica(db)
+}
+
+// versionCheck - where clause suffix and argument comparing the row version with the one read
+func versionCheck(version string) (string, []interface{}) {
+	if !gOptimistic {
+		return "", nil
+	}
+	return " and " + cVersionColumn + " = ?", []interface{}{version}
+}
+
+// retryConcurrent - re-processes rows that hit a concurrent modification, every attempt reads the row again,
+// so the stale-export check and the conflict strategy see the other writer's changes
+func retryConcurrent(fn rowProcessor) rowProcessor {
+	return func(db *sql.DB, dbg, dry bool, row map[string]string) (err error) {
+		for attempt := 0; ; attempt++ {
+			err = fn(db, dbg, dry, row)
+			if _, ok := err.(errConcurrent); !ok || attempt >= gOptimisticRetries {
+				return
+			}
+			fmt.Printf("%v, retrying (%d/%d)\n", err, attempt+1, gOptimisticRetries)
+		}
+	}
+}
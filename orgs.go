@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	// gUpdatedOrganizations - organizations (by id) created, renamed or with changed domains
+	gUpdatedOrganizations map[string]struct{}
+)
+
+// orgDomain - domains_organizations row
+type orgDomain struct {
+	ID             int64  `json:"id"`
+	Domain         string `json:"domain"`
+	IsTopDomain    bool   `json:"is_top_domain"`
+	OrganizationID int    `json:"organization_id"`
+}
+
+// updateOrganization - processes a single user_organizations_*.csv row
+// action org_name new_org_name domain is_top_domain user_name user_email user_sfid
+// actions: create (org_name), rename (org_name to new_org_name), add_domain (domain to org_name, a domain mapped
+// to another organization is moved) and remove_domain (domain from org_name)
+func updateOrganization(db *sql.DB, dbg, dry bool, row map[string]string) (err error) {
+	if dbg {
+		fmt.Printf("%v\n", row)
+	}
+	action := strings.ToLower(strings.TrimSpace(row["action"]))
+	orgName := strings.TrimSpace(row["org_name"])
+	if orgName == "" {
+		err = fmt.Errorf("org_name cannot be empty in %v", row)
+		return
+	}
+	who := "email:" + strings.TrimSpace(row["user_email"]) + ",sfid:" + strings.TrimSpace(row["user_sfid"])
+	if action != "create" {
+		if reason := protectedOrg(orgName); reason != "" {
+			err = protectedf(reason, row)
+			return
+		}
+	}
+	orgID := 0
+	found, err := queryFirst(db, []interface{}{&orgID}, "select id from organizations where name = ?", orgName)
+	if err != nil {
+		err = fmt.Errorf("error looking up organization %s: %v in %v", orgName, err, row)
+		return
+	}
+	var (
+		queries []string
+		args    [][]interface{}
+		audit   func(tx *sql.Tx, res []sql.Result) error
+		msg     string
+		// table and id of the changed row for shadow runs, nil id - an inserted row
+		table string
+		key   interface{}
+	)
+	switch action {
+	case "create":
+		if mapped, skip := placeholderOrg(orgName); skip || mapped != orgName {
+			err = skipf(cWarnOther, "organization %s is a placeholder, not created with PLACEHOLDER_ORGS_POLICY=%s (row %v)\n", orgName, gPlaceholderPolicy, row)
+			return
+		}
+		if found {
+			err = skippedf("organization %s already exists with id %d (row %v)", orgName, orgID, row)
+			return
+		}
+		queries = []string{"insert into organizations(name) values(?)"}
+		args = [][]interface{}{{orgName}}
+		table = "organizations"
+		msg = fmt.Sprintf("new organization %q by %s", orgName, who)
+		audit = func(tx *sql.Tx, res []sql.Result) error {
+			id, e := res[0].LastInsertId()
+			if e != nil {
+				return e
+			}
+			orgID = int(id)
+			return auditOrgChange(tx, "insert", "organizations", id, nil, map[string]interface{}{"id": id, "name": orgName}, who)
+		}
+	case "rename":
+		newOrgName := strings.TrimSpace(row["new_org_name"])
+		if newOrgName == "" {
+			err = fmt.Errorf("new_org_name cannot be empty for rename in %v", row)
+			return
+		}
+		newOrgID := 0
+		var newFound bool
+		newFound, err = queryFirst(db, []interface{}{&newOrgID}, "select id from organizations where name = ?", newOrgName)
+		if err != nil {
+			err = fmt.Errorf("error looking up organization %s: %v in %v", newOrgName, err, row)
+			return
+		}
+		switch {
+		case !found && newFound:
+			err = skippedf("organization %s already renamed to %s (row %v)", orgName, newOrgName, row)
+			return
+		case !found:
+			err = notFoundf("cannot find organization %s (row %v)", orgName, row)
+			return
+		case newFound && newOrgID != orgID:
+			err = fmt.Errorf("cannot rename organization %s to %s, it already exists with id %d, merging organizations is not supported (row %v)", orgName, newOrgName, newOrgID, row)
+			return
+		case newOrgName == orgName:
+			err = skippedf("organization %s already has that name (row %v)", orgName, row)
+			return
+		}
+		queries = []string{"update organizations set name = ? where id = ?"}
+		args = [][]interface{}{{newOrgName, orgID}}
+		table, key = "organizations", orgID
+		msg = fmt.Sprintf("organization %d %sby %s", orgID, fieldChange("name", orgName, newOrgName), who)
+		audit = func(tx *sql.Tx, res []sql.Result) error {
+			return auditOrgChange(tx, "update", "organizations", int64(orgID), map[string]interface{}{"name": orgName}, map[string]interface{}{"name": newOrgName}, who)
+		}
+	case "add_domain", "remove_domain":
+		if !found {
+			err = notFoundf("cannot find organization %s (row %v)", orgName, row)
+			return
+		}
+		domain := strings.ToLower(strings.TrimSpace(row["domain"]))
+		if domain == "" || strings.ContainsAny(domain, " @/,") || !strings.Contains(domain, ".") {
+			err = fmt.Errorf("invalid domain '%s' in %v", row["domain"], row)
+			return
+		}
+		var current *orgDomain
+		current, err = getOrgDomain(db, domain)
+		if err != nil {
+			err = fmt.Errorf("error looking up domain %s: %v in %v", domain, err, row)
+			return
+		}
+		if action == "remove_domain" {
+			if current == nil || current.OrganizationID != orgID {
+				err = skippedf("domain %s is not mapped to organization %s (row %v)", domain, orgName, row)
+				return
+			}
+			queries = []string{"delete from domains_organizations where id = ?"}
+			args = [][]interface{}{{current.ID}}
+			table, key = "domains_organizations", current.ID
+			msg = fmt.Sprintf("removed domain %s from organization %s/%d by %s", domain, orgName, orgID, who)
+			audit = func(tx *sql.Tx, res []sql.Result) error {
+				return auditOrgChange(tx, "delete", "domains_organizations", current.ID, current, nil, who)
+			}
+			break
+		}
+		top := false
+		if s := strings.TrimSpace(row["is_top_domain"]); s != "" {
+			top, err = strconv.ParseBool(s)
+			if err != nil {
+				err = fmt.Errorf("invalid is_top_domain '%s' in %v", s, row)
+				return
+			}
+		}
+		after := &orgDomain{Domain: domain, IsTopDomain: top, OrganizationID: orgID}
+		if current == nil {
+			queries = []string{"insert into domains_organizations(domain, is_top_domain, organization_id) values(?, ?, ?)"}
+			args = [][]interface{}{{domain, top, orgID}}
+			table = "domains_organizations"
+			msg = fmt.Sprintf("new domain %s (top %v) of organization %s/%d by %s", domain, top, orgName, orgID, who)
+			audit = func(tx *sql.Tx, res []sql.Result) error {
+				id, e := res[0].LastInsertId()
+				if e != nil {
+					return e
+				}
+				after.ID = id
+				return auditOrgChange(tx, "insert", "domains_organizations", id, nil, after, who)
+			}
+			break
+		}
+		if current.OrganizationID == orgID && current.IsTopDomain == top {
+			err = skippedf("domain %s is already mapped to organization %s (row %v)", domain, orgName, row)
+			return
+		}
+		if current.OrganizationID != orgID {
+			var fromName string
+			_, err = queryFirst(db, []interface{}{&fromName}, "select name from organizations where id = ?", current.OrganizationID)
+			if err != nil {
+				err = fmt.Errorf("error looking up organization %d: %v in %v", current.OrganizationID, err, row)
+				return
+			}
+			if reason := protectedOrg(fromName); reason != "" {
+				err = protectedf(reason, row)
+				return
+			}
+			msg = fmt.Sprintf("domain %s %s", domain, fieldChange("org", fmt.Sprintf("%s/%d", fromName, current.OrganizationID), fmt.Sprintf("%s/%d", orgName, orgID)))
+		} else {
+			msg = fmt.Sprintf("domain %s of organization %s/%d ", domain, orgName, orgID)
+		}
+		if current.IsTopDomain != top {
+			msg += fieldChange("is_top_domain", strconv.FormatBool(current.IsTopDomain), strconv.FormatBool(top))
+		}
+		msg += "by " + who
+		after.ID = current.ID
+		queries = []string{"update domains_organizations set organization_id = ?, is_top_domain = ? where id = ?"}
+		args = [][]interface{}{{orgID, top, current.ID}}
+		table, key = "domains_organizations", current.ID
+		audit = func(tx *sql.Tx, res []sql.Result) error {
+			return auditOrgChange(tx, "update", "domains_organizations", current.ID, current, after, who)
+		}
+	default:
+		err = fmt.Errorf("unknown organizations action '%s', allowed: create, rename, add_domain, remove_domain (row %v)", row["action"], row)
+		return
+	}
+	if dry {
+		fmt.Printf("%s\n", msg)
+		addChange(msg)
+		if dbg {
+			fmt.Printf("(%v,%v)\n", queries, args)
+		}
+		return
+	}
+	var tx *sql.Tx
+	var cancelTx context.CancelFunc
+	tx, cancelTx, err = beginTx(db)
+	if err != nil {
+		err = fmt.Errorf("error starting transaction %v for row %v", err, row)
+		return
+	}
+	defer cancelTx()
+	defer func() {
+		if tx != nil {
+			fmt.Printf("rollback %s\n", msg)
+			_ = tx.Rollback()
+		}
+	}()
+	// shadow runs apply the change and roll it back, organization changes are not published as change events
+	var shadow *shadowTx
+	if gShadow {
+		shadow = newShadow(tx, "")
+	}
+	err = shadow.capture(table, "id", key)
+	if err != nil {
+		err = fmt.Errorf("error reading %s row %v for row %v", table, err, row)
+		return
+	}
+	results := []sql.Result{}
+	for i, q := range queries {
+		var res sql.Result
+		res, err = exec(tx, "Error 1062", q, args[i]...)
+		if err != nil {
+			if strings.Contains(err.Error(), "Error 1062") {
+				err = collisionf("%s: collision", msg)
+				addCollision()
+				return
+			}
+			err = fmt.Errorf("error updating organizations %v for (%s,%v) for row %v", err, q, args[i], row)
+			return
+		}
+		results = append(results, res)
+	}
+	if key == nil {
+		id, e := results[0].LastInsertId()
+		if e == nil {
+			shadow.rekey(table, id)
+		}
+	}
+	err = audit(tx, results)
+	if err != nil {
+		err = fmt.Errorf("error recording organization change in the audit trail %v for row %v", err, row)
+		return
+	}
+	err = shadow.commit(tx, msg)
+	if err != nil {
+		err = fmt.Errorf("error committing transaction %v for row %v", err, row)
+		return
+	}
+	tx = nil
+	addChange(msg)
+	forgetOrgs()
+	if gMtx != nil {
+		gMtx.Lock()
+	}
+	gUpdatedOrganizations[strconv.Itoa(orgID)] = struct{}{}
+	if gMtx != nil {
+		gMtx.Unlock()
+	}
+	return
+}
+
+// getOrgDomain - domains_organizations row of the domain, nil when the domain is not mapped
+func getOrgDomain(db *sql.DB, domain string) (current *orgDomain, err error) {
+	d := orgDomain{}
+	var found bool
+	found, err = queryFirst(db, []interface{}{&d.ID, &d.Domain, &d.IsTopDomain, &d.OrganizationID}, "select id, domain, coalesce(is_top_domain, 0), organization_id from domains_organizations where domain = ?", domain)
+	if err == nil && found {
+		current = &d
+	}
+	return
+}
+
+// forgetOrgs - organization names, ids and domains cached by the run are no longer valid
+func forgetOrgs() {
+	if gMtx != nil {
+		gMtx.Lock()
+	}
+	gOrgMap = make(map[string]int)
+	gOrgMiss = make(map[string]struct{})
+	gDomainOrgMap = make(map[string]string)
+	if gMtx != nil {
+		gMtx.Unlock()
+	}
+}
+
+// auditOrgChange - records organization or domain change in the same transaction as the change
+func auditOrgChange(tx *sql.Tx, action, table string, rowID int64, before, after interface{}, who string) (err error) {
+	if !gAudit {
+		return
+	}
+	values := []interface{}{nil, nil}
+	for i, state := range []interface{}{before, after} {
+		if state == nil {
+			continue
+		}
+		var data []byte
+		data, err = json.Marshal(state)
+		if err != nil {
+			return
+		}
+		values[i] = string(data)
+	}
+	_, err = exec(
+		tx,
+		"",
+		"insert into import_audit(run_id, action, table_name, row_id, before_json, after_json, who, created_at) values(?, ?, ?, ?, ?, ?, ?, now())",
+		gAuditRunID, action, table, rowID, values[0], values[1], anonymize(who),
+	)
+	return
+}
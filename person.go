@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// personIdentity - identity of a unique identity
+type personIdentity struct {
+	id       string
+	name     string
+	username string
+	email    string
+	source   string
+}
+
+// personIdentities - all identities of a unique identity
+func personIdentities(db *sql.DB, uuid string) (identities []personIdentity, err error) {
+	var rows *stmtRows
+	rows, err = query(db, "select id, trim(coalesce(name, '')), trim(coalesce(username, '')), trim(coalesce(email, '')), trim(source) from identities where uuid = ? order by id", uuid)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var identity personIdentity
+		err = rows.Scan(&identity.id, &identity.name, &identity.username, &identity.email, &identity.source)
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		identities = append(identities, identity)
+	}
+	err = rows.Err()
+	if err != nil {
+		_ = rows.Close()
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+// updatePerson - identities row keyed by uuid instead of identity_id, changes the person's profile
+// identity_name and identity_email update profile name and email (blank values are left unchanged),
+// profile_* columns work as for identity rows
+// UUID_ALL_IDENTITIES - also apply the new name and email to every identity of the uuid (as identity rows)
+func updatePerson(db *sql.DB, dbg, dry bool, row map[string]string) (err error) {
+	uuid := strings.TrimSpace(row["uuid"])
+	var name, email string
+	rows, err := query(replica(db), "select trim(coalesce(name, '')), trim(coalesce(email, '')) from profiles where uuid = ?", uuid)
+	if err != nil {
+		return
+	}
+	found := false
+	for rows.Next() {
+		err = rows.Scan(&name, &email)
+		found = true
+		break
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	e := rows.Close()
+	if err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+	if !found {
+		err = skipf(cWarnNotFound, "cannot find profile with uuid=%s (row %v)\n", uuid, row)
+		return
+	}
+	registerPII(name, email)
+	if reason := protectedIdentity("", uuid); reason != "" {
+		err = protectedf(reason, row)
+		return
+	}
+	newName, newEmail := normalizeValue(row["identity_name"]), normalizeValue(row["identity_email"])
+	if newName == "" || normalizeValue(name) == newName {
+		newName = name
+	}
+	sameName, err := equivalentName(db, uuid, normalizeValue(name), newName)
+	if err != nil {
+		err = fmt.Errorf("uuid %s name comparison: %v in %v", uuid, err, row)
+		return
+	}
+	if sameName {
+		newName = name
+	}
+	newName = allowedValue(dbg, "uuid "+uuid, "name", name, newName)
+	newEmail = allowedValue(dbg, "uuid "+uuid, "email", email, newEmail)
+	if newEmail == "" || normalizeValue(email) == newEmail || (gIgnoreCaseEmail && strings.EqualFold(normalizeValue(email), newEmail)) {
+		newEmail = email
+	}
+	for field, value := range map[string]string{"identity_name": newName, "identity_email": newEmail} {
+		err = validateCharset(field, value)
+		if err != nil {
+			err = fmt.Errorf("uuid %s %v in %v", uuid, err, row)
+			return
+		}
+	}
+	var (
+		profileQuery string
+		profileArgs  []interface{}
+		profileMsg   string
+	)
+	profileQuery, profileArgs, profileMsg, err = profileChanges(db, dbg, "", uuid, newName, "", newEmail, row)
+	if err != nil {
+		err = fmt.Errorf("uuid %s %v in %v", uuid, err, row)
+		return
+	}
+	msg := "uuid " + uuid + " "
+	if newName != name {
+		profileQuery += "name = ?, "
+		profileArgs = append(profileArgs, newName)
+		msg += fieldChange("name", name, newName)
+	}
+	if newEmail != email {
+		profileQuery += "email = ?, "
+		profileArgs = append(profileArgs, newEmail)
+		msg += fieldChange("email", email, newEmail)
+	}
+	if profileQuery != "" {
+		msg += profileMsg
+		who := "email:" + strings.TrimSpace(row["user_email"]) + ",sfid:" + strings.TrimSpace(row["user_sfid"])
+		msg += " by " + who
+		profileQuery = "update profiles set " + profileQuery + auditSet("profiles") + " where uuid = ?"
+		profileArgs = append(profileArgs, auditArgs("profiles", who)...)
+		profileArgs = append(profileArgs, uuid)
+		err = applyPersonProfile(db, dbg, dry, uuid, who, msg, profileQuery, profileArgs)
+		if err != nil {
+			err = fmt.Errorf("%v in %v", err, row)
+			return
+		}
+	} else if dbg {
+		fmt.Printf("uuid %s (%s,%s) profile nothing changed in %v\n", uuid, name, email, row)
+	}
+	if os.Getenv("UUID_ALL_IDENTITIES") == "" {
+		return
+	}
+	var identities []personIdentity
+	identities, err = personIdentities(replica(db), uuid)
+	if err != nil {
+		return
+	}
+	for _, identity := range identities {
+		identityRow := map[string]string{
+			"identity_id":       identity.id,
+			"identity_name":     identity.name,
+			"identity_username": identity.username,
+			"identity_email":    identity.email,
+			"identity_source":   identity.source,
+			"user_email":        row["user_email"],
+			"user_sfid":         row["user_sfid"],
+		}
+		if strings.TrimSpace(row["identity_name"]) != "" {
+			identityRow["identity_name"] = row["identity_name"]
+		}
+		if strings.TrimSpace(row["identity_email"]) != "" {
+			identityRow["identity_email"] = row["identity_email"]
+		}
+		e := updateIdentity(db, dbg, dry, identityRow)
+		if e != nil {
+			if isSkipped(e) {
+				continue
+			}
+			err = fmt.Errorf("uuid %s identity %s: %v", uuid, identity.id, e)
+			return
+		}
+	}
+	return
+}
+
+// applyPersonProfile - updates profile and touches the unique identity in one transaction
+func applyPersonProfile(db *sql.DB, dbg, dry bool, uuid, who, msg, profileQuery string, profileArgs []interface{}) (err error) {
+	if dry {
+		fmt.Printf("%s\n", msg)
+		addChange(msg)
+		recordPlanned(uuid)
+		if dbg {
+			fmt.Printf("(%s,%v)\n", profileQuery, profileArgs)
+		}
+		return
+	}
+	var tx *sql.Tx
+	var cancelTx context.CancelFunc
+	tx, cancelTx, err = beginTx(db)
+	if err != nil {
+		err = fmt.Errorf("error starting transaction %v", err)
+		return
+	}
+	defer cancelTx()
+	defer func() {
+		if tx != nil {
+			fmt.Printf("rollback %s\n", msg)
+			_ = tx.Rollback()
+		}
+	}()
+	var (
+		res       sql.Result
+		affectedP int64
+		affectedU int64
+	)
+	shadow := newShadow(tx, uuid)
+	err = shadow.capture("profiles", "uuid", uuid)
+	if err == nil {
+		err = shadow.capture("uidentities", "uuid", uuid)
+	}
+	if err != nil {
+		err = fmt.Errorf("error capturing shadow state %v for uuid %s", err, uuid)
+		return
+	}
+	res, err = exec(tx, "", profileQuery, profileArgs...)
+	if err != nil {
+		err = fmt.Errorf("error updating profiles %v for uuid %s", err, uuid)
+		return
+	}
+	affectedP, _ = res.RowsAffected()
+	touchU := !gNoTouchUIdentities && gTouchBatch == 0
+	if touchU {
+		res, err = exec(tx, "", "update uidentities set "+auditSet("uidentities")+" where uuid = ?", append(auditArgs("uidentities", who), uuid)...)
+		if err != nil {
+			err = fmt.Errorf("error updating uidentities %v for uuid %s", err, uuid)
+			return
+		}
+		affectedU, _ = res.RowsAffected()
+	}
+	if affectedP <= 0 || (touchU && affectedU <= 0) {
+		err = skipf(cWarnPartial, "%s: didn't affect profiles or uidentities: (%d,%d)\n", msg, affectedP, affectedU)
+		return
+	}
+	err = shadow.commit(tx, msg)
+	if err != nil {
+		err = fmt.Errorf("error committing transaction %v", err)
+		return
+	}
+	tx = nil
+	addChange(msg)
+	recordAffected(uuid, "")
+	if gTouchBatch > 0 && !gNoTouchUIdentities {
+		recordTouch("uidentities", uuid, who)
+	}
+	if gMtx != nil {
+		gMtx.Lock()
+	}
+	gUpdatedProfiles[uuid] = struct{}{}
+	if affectedU > 0 {
+		gUpdatedUIdentities[uuid] = struct{}{}
+	}
+	if gMtx != nil {
+		gMtx.Unlock()
+	}
+	return
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// cDefaultIndependentOrg - organization of individuals not affiliated with any company (LF SortingHat convention)
+	cDefaultIndependentOrg = "Individual - No Account"
+	// cDefaultPlaceholderOrgs - to_org_name values that don't name an organization
+	cDefaultPlaceholderOrgs = "unknown,none,n/a,na,null,-,?,individual,independent,self,self-employed,freelance,freelancer,unemployed,unaffiliated,no company,private"
+)
+
+var (
+	// gPlaceholderPolicy - PLACEHOLDER_ORGS_POLICY: "keep" (default), "independent" or "skip"
+	gPlaceholderPolicy string
+	// gIndependentOrg - INDEPENDENT_ORG
+	gIndependentOrg string
+	// gPlaceholderOrgs - lower case placeholder value -> organization it maps to, empty uses the policy
+	gPlaceholderOrgs map[string]string
+)
+
+// setPlaceholderOrgs - PLACEHOLDER_ORGS_POLICY decides what happens to to_org_name values like "Unknown" or "None":
+// "keep" (default) - used as organization names, "independent" - mapped to INDEPENDENT_ORG (default
+// "Individual - No Account"), "skip" - rows are skipped
+// PLACEHOLDER_ORGS - comma separated placeholder values replacing the default list, "value=organization" maps
+// the value to that organization regardless of the policy
+func setPlaceholderOrgs() (err error) {
+	gPlaceholderPolicy = strings.ToLower(strings.TrimSpace(os.Getenv("PLACEHOLDER_ORGS_POLICY")))
+	switch gPlaceholderPolicy {
+	case "":
+		gPlaceholderPolicy = "keep"
+	case "keep", "independent", "skip":
+	default:
+		err = fmt.Errorf("invalid PLACEHOLDER_ORGS_POLICY=%s, allowed: keep, independent, skip", gPlaceholderPolicy)
+		return
+	}
+	gIndependentOrg = strings.TrimSpace(os.Getenv("INDEPENDENT_ORG"))
+	if gIndependentOrg == "" {
+		gIndependentOrg = cDefaultIndependentOrg
+	}
+	values := os.Getenv("PLACEHOLDER_ORGS")
+	if values == "" {
+		values = cDefaultPlaceholderOrgs
+	}
+	gPlaceholderOrgs = make(map[string]string)
+	for _, item := range strings.Split(values, ",") {
+		ary := strings.SplitN(item, "=", 2)
+		value := strings.ToLower(strings.TrimSpace(ary[0]))
+		if value == "" {
+			continue
+		}
+		target := ""
+		if len(ary) == 2 {
+			target = strings.TrimSpace(ary[1])
+			if target == "" {
+				err = fmt.Errorf("invalid PLACEHOLDER_ORGS item '%s', expected value or value=organization", item)
+				return
+			}
+		}
+		gPlaceholderOrgs[value] = target
+	}
+	return
+}
+
+// placeholderOrg - organization a to_org_name placeholder value maps to, skip - the row should be skipped
+// non placeholder names (and placeholders under the "keep" policy) are returned unchanged
+func placeholderOrg(orgName string) (mapped string, skip bool) {
+	mapped = orgName
+	target, ok := gPlaceholderOrgs[strings.ToLower(strings.TrimSpace(orgName))]
+	if !ok || strings.EqualFold(orgName, gIndependentOrg) {
+		return
+	}
+	switch {
+	case target != "":
+		mapped = target
+	case gPlaceholderPolicy == "independent":
+		mapped = gIndependentOrg
+	case gPlaceholderPolicy == "skip":
+		skip = true
+	}
+	return
+}
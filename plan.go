@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// gPlanFile - PLAN, dry run writes the signed plan there
+	gPlanFile string
+	// gApplyPlan - APPLY_PLAN, the run only applies when the DB still matches the plan's before state
+	gApplyPlan *importPlan
+	// gPlannedUUIDs - uuids with planned changes in the dry run
+	gPlannedUUIDs map[string]struct{}
+	// gPlanPending - APPLY_PLAN: planned changes not applied yet and how many times each is still expected
+	gPlanPending map[string]int
+	// gPlanMtx - guards gPlanPending
+	gPlanMtx sync.Mutex
+)
+
+// importPlan - changes planned by a dry run and the state of every affected uuid, signed with PLAN_KEY
+type importPlan struct {
+	RunID     string            `json:"run_id"`
+	Created   time.Time         `json:"created"`
+	Operator  string            `json:"operator"`
+	Database  string            `json:"database,omitempty"`
+	Files     []runFile         `json:"files"`
+	Changes   []string          `json:"changes"`
+	Before    map[string]string `json:"before"`
+	Signature string            `json:"signature,omitempty"`
+}
+
+// sign - HMAC-SHA256 of the plan without its signature
+func (p importPlan) sign(key string) (string, error) {
+	p.Signature = ""
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	_, _ = mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// setPlan - PLAN=file (requires DRY) or APPLY_PLAN=file (requires non-dry run), both need PLAN_KEY
+// PLAN_ALLOW_SAME_OPERATOR allows applying a plan by the operator who created it
+// plan - changes verified by the staging phase, applied like APPLY_PLAN without before states and a signature
+func setPlan(dry bool, plan *importPlan) (err error) {
+	gPlanFile, gApplyPlan, gPlannedUUIDs, gPlanPending = os.Getenv("PLAN"), nil, make(map[string]struct{}), nil
+	if plan != nil && !dry {
+		applyPlan(plan)
+		return
+	}
+	applyFile := os.Getenv("APPLY_PLAN")
+	if gPlanFile == "" && applyFile == "" {
+		return
+	}
+	key := os.Getenv("PLAN_KEY")
+	switch {
+	case gPlanFile != "" && applyFile != "":
+		err = fmt.Errorf("PLAN and APPLY_PLAN cannot be used together")
+	case key == "":
+		err = fmt.Errorf("PLAN_KEY is required to sign and verify plans")
+	case gPlanFile != "" && !dry:
+		err = fmt.Errorf("PLAN can only be used with DRY")
+	case applyFile != "" && (dry || gShadow):
+		err = fmt.Errorf("APPLY_PLAN cannot be used with DRY or SHADOW")
+	}
+	if err != nil || applyFile == "" {
+		return
+	}
+	var data []byte
+	data, err = ioutil.ReadFile(applyFile)
+	if err != nil {
+		return
+	}
+	plan = &importPlan{}
+	err = json.Unmarshal(data, plan)
+	if err != nil {
+		err = fmt.Errorf("%s: %v", applyFile, err)
+		return
+	}
+	var signature string
+	signature, err = plan.sign(key)
+	if err != nil {
+		return
+	}
+	if !hmac.Equal([]byte(signature), []byte(plan.Signature)) {
+		err = fmt.Errorf("%s: invalid plan signature", applyFile)
+		return
+	}
+	if plan.Operator == runOperator() && os.Getenv("PLAN_ALLOW_SAME_OPERATOR") == "" {
+		err = fmt.Errorf("%s: plan was created by %s, it must be applied by another operator", applyFile, plan.Operator)
+		return
+	}
+	applyPlan(plan)
+	fmt.Printf("Applying plan %s (run %s by %s, %d changes, %d uuids)\n", applyFile, plan.RunID, plan.Operator, len(plan.Changes), len(plan.Before))
+	return
+}
+
+// recordPlanned - remembers uuid with a change planned in dry mode
+func recordPlanned(uuid string) {
+	if gPlanFile == "" || uuid == "" {
+		return
+	}
+	if gMtx != nil {
+		gMtx.Lock()
+	}
+	gPlannedUUIDs[uuid] = struct{}{}
+	if gMtx != nil {
+		gMtx.Unlock()
+	}
+}
+
+// applyPlan - changes of the run must be the plan's ones
+func applyPlan(plan *importPlan) {
+	gApplyPlan = plan
+	gPlanPending = make(map[string]int)
+	for _, change := range plan.Changes {
+		gPlanPending[change]++
+	}
+}
+
+// claimPlanned - APPLY_PLAN: called before committing a transaction with its changes, errors when any of them
+// is not (or no longer) planned, the caller must then roll the transaction back
+func claimPlanned(msgs ...string) (err error) {
+	if gApplyPlan == nil {
+		return
+	}
+	gPlanMtx.Lock()
+	defer gPlanMtx.Unlock()
+	for i, msg := range msgs {
+		change := anonymize(msg)
+		if gPlanPending[change] <= 0 {
+			for _, claimed := range msgs[:i] {
+				gPlanPending[anonymize(claimed)]++
+			}
+			err = fmt.Errorf("change was not planned, rolled back: %s", change)
+			return
+		}
+		gPlanPending[change]--
+	}
+	return
+}
+
+// unclaimPlanned - APPLY_PLAN: changes claimed by claimPlanned were not committed after all
+func unclaimPlanned(msgs ...string) {
+	if gApplyPlan == nil {
+		return
+	}
+	gPlanMtx.Lock()
+	for _, msg := range msgs {
+		gPlanPending[anonymize(msg)]++
+	}
+	gPlanMtx.Unlock()
+}
+
+// uuidState - SHA256 of identities, enrollments and profile values of the uuid, audit columns are not included
+func uuidState(db *sql.DB, uuid string) (state string, err error) {
+	h := sha256.New()
+	for _, q := range []string{
+		"select id, trim(coalesce(name, '')), trim(coalesce(username, '')), trim(coalesce(email, '')), trim(source) from identities where uuid = ? order by id",
+		"select id, organization_id, coalesce(project_slug, ''), date_format(start, '%Y-%m-%d %H:%i:%s'), date_format(end, '%Y-%m-%d %H:%i:%s') from enrollments where uuid = ? order by id",
+		"select coalesce(name, ''), coalesce(email, ''), coalesce(is_bot, 0), coalesce(country_code, ''), coalesce(gender, ''), coalesce(gender_acc, 0) from profiles where uuid = ?",
+	} {
+		var rows *stmtRows
+		rows, err = query(db, q, uuid)
+		if err != nil {
+			return
+		}
+		var columns []string
+		columns, err = rows.Columns()
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		values := make([]string, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		for rows.Next() {
+			err = rows.Scan(dest...)
+			if err != nil {
+				_ = rows.Close()
+				return
+			}
+			_, _ = h.Write([]byte(strings.Join(values, "\x00") + "\n"))
+		}
+		err = rows.Err()
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+		_, _ = h.Write([]byte{0})
+	}
+	state = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+// checkPlan - APPLY_PLAN: input files must be the planned ones and every planned uuid must still be in its before state
+func checkPlan(db *sql.DB, summary *importSummary) (err error) {
+	plan := gApplyPlan
+	if plan == nil {
+		return
+	}
+	if plan.Database != "" && summary.Database != "" && plan.Database != summary.Database {
+		err = fmt.Errorf("plan was created for database %s, not %s", plan.Database, summary.Database)
+		return
+	}
+	planned := make(map[string]string)
+	for _, file := range plan.Files {
+		planned[file.Name] = file.SHA256
+	}
+	for _, file := range summary.Files {
+		sum, ok := planned[file.Name]
+		if !ok || sum != file.SHA256 {
+			err = fmt.Errorf("input file %s is not the one the plan was created from", file.Name)
+			return
+		}
+		delete(planned, file.Name)
+	}
+	for name := range planned {
+		err = fmt.Errorf("planned input file %s is missing", name)
+		return
+	}
+	changed := []string{}
+	for uuid, before := range plan.Before {
+		var state string
+		state, err = uuidState(db, uuid)
+		if err != nil {
+			return
+		}
+		if state != before {
+			changed = append(changed, uuid)
+		}
+	}
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		err = fmt.Errorf("%d uuids changed since the plan was created, nothing applied: %s", len(changed), strings.Join(changed, ", "))
+		return
+	}
+	fmt.Printf("Plan verified: %d uuids still match their before state\n", len(plan.Before))
+	return
+}
+
+// finishPlan - PLAN: writes the signed plan, APPLY_PLAN: warns about planned changes that were not applied
+func finishPlan(db *sql.DB, summary *importSummary) (err error) {
+	gSummaryMtx.Lock()
+	changes, err := summary.allChanges()
+	gSummaryMtx.Unlock()
+	if err != nil {
+		err = fmt.Errorf("cannot read spilled changes: %v", err)
+		return
+	}
+	if gApplyPlan != nil {
+		// changes that were not planned are refused before their transactions commit
+		gPlanMtx.Lock()
+		for change, n := range gPlanPending {
+			for i := 0; i < n; i++ {
+				warnf(cWarnOther, "planned change not applied: %s\n", change)
+			}
+		}
+		gPlanMtx.Unlock()
+		return
+	}
+	if gPlanFile == "" {
+		return
+	}
+	plan := importPlan{
+		RunID:    summary.RunID,
+		Created:  time.Now().UTC(),
+		Operator: runOperator(),
+		Database: summary.Database,
+		Files:    summary.Files,
+		Changes:  changes,
+		Before:   make(map[string]string),
+	}
+	for uuid := range gPlannedUUIDs {
+		plan.Before[uuid], err = uuidState(db, uuid)
+		if err != nil {
+			return
+		}
+	}
+	plan.Signature, err = plan.sign(os.Getenv("PLAN_KEY"))
+	if err != nil {
+		return
+	}
+	var data []byte
+	data, err = json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return
+	}
+	path := strings.Replace(gPlanFile, "{run_id}", summary.RunID, -1)
+	err = writeOutput(path, append(data, '\n'))
+	if err == nil {
+		fmt.Printf("Plan with %d changes of %d uuids written to %s\n", len(plan.Changes), len(plan.Before), path)
+	}
+	return
+}
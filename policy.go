@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	cOnErrorAbort     = "abort"
+	cOnErrorSkip      = "skip"
+	cOnErrorThreshold = "threshold"
+)
+
+// errorPolicy - what to do when processing a row returns an error
+// abort - stop the import on the first error (default)
+// skip - report the error, write the row to the failed rows file and continue
+// threshold:N - like skip, but abort once more than N rows (in both files) failed
+type errorPolicy struct {
+	mode      string
+	threshold int
+	failed    int
+	mtx       sync.Mutex
+}
+
+// errRowSkipped - row was not applied (identity not found, collision, ...) but it doesn't count as an error
+// such rows are written to the failed rows file too
+// category - warning category the row was reported with (collision for collisions), empty when not reported
+type errRowSkipped struct {
+	reason   string
+	category string
+}
+
+func (e errRowSkipped) Error() string {
+	return e.reason
+}
+
+// skippedf - marks row as skipped
+func skippedf(f string, a ...interface{}) error {
+	return errRowSkipped{reason: strings.TrimSpace(fmt.Sprintf(f, a...))}
+}
+
+// collisionf - marks row as skipped because of unique key collision
+func collisionf(f string, a ...interface{}) error {
+	return errRowSkipped{reason: strings.TrimSpace(fmt.Sprintf(f, a...)), category: cWarnCollision}
+}
+
+// isCollision - true when row was skipped because of unique key collision
+func isCollision(err error) bool {
+	var skipped errRowSkipped
+	return errors.As(err, &skipped) && skipped.category == cWarnCollision
+}
+
+// isSkipped - true when error only marks row as skipped
+func isSkipped(err error) bool {
+	var skipped errRowSkipped
+	return errors.As(err, &skipped)
+}
+
+// errNotFound - lookup found nothing, unlike database errors rows with such values are skipped
+type errNotFound struct {
+	msg string
+}
+
+func (e errNotFound) Error() string {
+	return e.msg
+}
+
+// notFoundf - returns lookup not found error
+func notFoundf(f string, a ...interface{}) error {
+	return errNotFound{msg: fmt.Sprintf(f, a...)}
+}
+
+// isNotFound - true when lookup found nothing
+func isNotFound(err error) bool {
+	var notFound errNotFound
+	return errors.As(err, &notFound)
+}
+
+// skipf - prints a warning of the category and marks row as skipped
+func skipf(category, f string, a ...interface{}) error {
+	warnf(category, f, a...)
+	return errRowSkipped{reason: strings.TrimSpace(fmt.Sprintf(f, a...)), category: category}
+}
+
+func parseErrorPolicy(s string) (policy *errorPolicy, err error) {
+	s = strings.TrimSpace(s)
+	policy = &errorPolicy{mode: cOnErrorAbort}
+	switch {
+	case s == "" || s == cOnErrorAbort:
+	case s == cOnErrorSkip:
+		policy.mode = cOnErrorSkip
+	case strings.HasPrefix(s, cOnErrorThreshold+":"):
+		policy.mode = cOnErrorThreshold
+		policy.threshold, err = strconv.Atoi(strings.TrimPrefix(s, cOnErrorThreshold+":"))
+		if err == nil && policy.threshold < 0 {
+			err = fmt.Errorf("threshold cannot be negative")
+		}
+		if err != nil {
+			err = fmt.Errorf("invalid ON_ERROR=%s: %v", s, err)
+		}
+	default:
+		err = fmt.Errorf("invalid ON_ERROR=%s, allowed: %s, %s, %s:N", s, cOnErrorAbort, cOnErrorSkip, cOnErrorThreshold)
+	}
+	return
+}
+
+// outputFileName - user_identities_202201061433.csv -> user_identities_<suffix>_<runid>.csv in dir
+// when multiple files of the same type are imported: user_identities_202201061433_<suffix>_<runid>.csv
+// empty dir means the input file's directory
+func outputFileName(fileName, suffix, runID string, multi bool, dir string) string {
+	if dir == "" {
+		dir = filepath.Dir(fileName)
+	}
+	base := strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+	if !multi {
+		if m := gIdentitiesFileRE.FindStringSubmatch(filepath.Base(fileName)); m != nil {
+			base = "user_identities"
+		} else if m := gAffiliationsFileRE.FindStringSubmatch(filepath.Base(fileName)); m != nil {
+			base = "user_affiliations"
+		}
+	}
+	return joinPath(dir, base+"_"+suffix+"_"+runID+".csv")
+}
+
+// failedRowsFileName - user_identities_202201061433.csv -> user_identities_failed_<runid>.csv
+// when multiple files of the same type are imported: user_identities_202201061433_failed_<runid>.csv
+// FAILED_DIR - where to write failed rows files (directory, s3:// prefix or http(s):// URL), default is the input file's directory
+func failedRowsFileName(fileName, runID string, multi bool) string {
+	return outputFileName(fileName, "failed", runID, multi, os.Getenv("FAILED_DIR"))
+}
+
+// traceColumns - source_line and raw_line columns added to failed rows and results files
+var traceColumns = []string{"source_line", "raw_line"}
+
+// hasTraceColumns - header already has trace columns (a failed rows file is re-imported), they keep the original values
+func hasTraceColumns(hdr []string) bool {
+	return columnIndex(hdr, traceColumns[0]) >= 0 && columnIndex(hdr, traceColumns[1]) >= 0
+}
+
+// traceHeader - header with trace columns
+func traceHeader(hdr []string) []string {
+	if hasTraceColumns(hdr) {
+		return append([]string{}, hdr...)
+	}
+	return append(append([]string{}, hdr...), traceColumns...)
+}
+
+// withTrace - line n with appended source_line (line number in the input file) and raw_line (original CSV text)
+// unless the header already has them, empty when the raw text is unknown
+func withTrace(input csvInput, n int, line []string) []string {
+	if hasTraceColumns(input.lines[0]) {
+		return append([]string{}, line...)
+	}
+	trace := []string{"", ""}
+	if n < len(input.raw) {
+		trace = []string{strconv.Itoa(input.raw[n].line), input.raw[n].text}
+	}
+	return append(append([]string{}, line...), trace...)
+}
+
+// writeFailedRows - writes header and failed/skipped rows verbatim, so the producer can fix and re-submit only them
+// values are quoted when needed (commas, quotes, newlines), so the file can be imported again without any loss,
+// source_line and raw_line columns point to the original input and are ignored by the import
+func writeFailedRows(fileName, runID string, multi bool, input csvInput, failed []int) (err error) {
+	lines := input.lines
+	if len(failed) == 0 || len(lines) == 0 {
+		return
+	}
+	gSummaryMtx.Lock()
+	if gSummary != nil {
+		gSummary.FailedRows += len(failed)
+	}
+	gSummaryMtx.Unlock()
+	outName := failedRowsFileName(fileName, runID, multi)
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	err = w.Write(traceHeader(lines[0]))
+	for _, n := range failed {
+		if err != nil {
+			break
+		}
+		err = w.Write(withTrace(input, n, lines[n]))
+	}
+	if err == nil {
+		w.Flush()
+		err = w.Error()
+	}
+	if err == nil {
+		err = writeOutput(outName, buf.Bytes())
+	}
+	if err == nil {
+		fmt.Printf("%d failed rows written to %s\n", len(failed), outName)
+	}
+	return
+}
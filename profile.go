@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// profileState - profile values that can be updated by the identities import
+type profileState struct {
+	isBot       int
+	countryCode string
+	gender      string
+	genderAcc   int
+}
+
+var (
+	// gAllowGender - ALLOW_GENDER_UPDATES, some deployments must not store gender
+	gAllowGender bool
+	gGenderOnce  *sync.Once
+)
+
+// setProfileUpdates - configures which profile fields can be updated
+func setProfileUpdates() {
+	gAllowGender = os.Getenv("ALLOW_GENDER_UPDATES") != ""
+	gGenderOnce = &sync.Once{}
+	gTimezoneOnce = &sync.Once{}
+}
+
+// profileColumns - identities CSV columns updating profiles
+var profileColumns = []string{"profile_is_bot", "profile_country", "profile_gender"}
+
+// needProfile - true when the row (or configuration) can change profile values
+func needProfile(row map[string]string) bool {
+	if len(gBots) > 0 {
+		return true
+	}
+	for _, col := range profileColumns {
+		if strings.TrimSpace(row[col]) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// getProfile - returns current profile values, nil when there is no profile for uuid
+func getProfile(db *sql.DB, uuid string) (profile *profileState, err error) {
+	var rows *stmtRows
+	rows, err = query(db, "select coalesce(is_bot, 0), coalesce(country_code, ''), coalesce(gender, ''), coalesce(gender_acc, 0) from profiles where uuid = ?", uuid)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		profile = &profileState{}
+		err = rows.Scan(&profile.isBot, &profile.countryCode, &profile.gender, &profile.genderAcc)
+		break
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	e := rows.Close()
+	if err == nil {
+		err = e
+	}
+	return
+}
+
+// parseFlag - parses 1/0, true/false, yes/no, y/n; set is false for blank values
+func parseFlag(s string) (value, set bool, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "":
+		return
+	case "1", "true", "yes", "y", "t":
+		value, set = true, true
+	case "0", "false", "no", "n", "f":
+		set = true
+	default:
+		err = fmt.Errorf("invalid flag value '%s'", s)
+	}
+	return
+}
+
+// profileChanges - returns profiles "column = ?, " update fragment, its args and change message
+func profileChanges(db *sql.DB, dbg bool, id, uuid, name, username, email string, row map[string]string) (query string, args []interface{}, msg string, err error) {
+	if !needProfile(row) {
+		return
+	}
+	var profile *profileState
+	profile, err = getProfile(db, uuid)
+	if err != nil || profile == nil {
+		return
+	}
+	var isBot, set bool
+	isBot, set, err = parseFlag(row["profile_is_bot"])
+	if err != nil {
+		err = fmt.Errorf("profile_is_bot: %v", err)
+		return
+	}
+	if !set && matchBot(id, name, username, email) {
+		isBot, set = true, true
+		if dbg {
+			fmt.Printf("identity_id %s/%s matches bots list\n", id, uuid)
+		}
+	}
+	if set {
+		newIsBot := 0
+		if isBot {
+			newIsBot = 1
+		}
+		if newIsBot != profile.isBot {
+			query += "is_bot = ?, "
+			args = append(args, newIsBot)
+			msg += fieldChange("is_bot", strconv.Itoa(profile.isBot), strconv.Itoa(newIsBot))
+		}
+	}
+	country := strings.TrimSpace(row["profile_country"])
+	if country != "" {
+		code := ""
+		code, err = countryCode(db, country)
+		if err != nil {
+			err = fmt.Errorf("profile_country: %v", err)
+			return
+		}
+		if dbg {
+			fmt.Printf("identity_id %s/%s country '%s' -> '%s'\n", id, uuid, country, code)
+		}
+		if code != "" && code != profile.countryCode {
+			query += "country_code = ?, "
+			args = append(args, code)
+			msg += fieldChange("country_code", profile.countryCode, code)
+		}
+	}
+	gender := strings.TrimSpace(row["profile_gender"])
+	if gender != "" && !gAllowGender {
+		gGenderOnce.Do(func() {
+			warnf(cWarnOther, "profile_gender column ignored, set ALLOW_GENDER_UPDATES to update gender\n")
+		})
+	} else if gender != "" {
+		// manually provided gender has 100% accuracy, cleared gender has no accuracy
+		newGender, newGenderAcc := gender, 100
+		switch strings.ToLower(gender) {
+		case "-", "none", "null", "clear":
+			newGender, newGenderAcc = "", 0
+		}
+		if newGender != profile.gender || newGenderAcc != profile.genderAcc {
+			if newGender == "" {
+				query += "gender = null, gender_acc = null, "
+			} else {
+				query += "gender = ?, gender_acc = ?, "
+				args = append(args, newGender, newGenderAcc)
+			}
+			msg += fieldChange("gender", fmt.Sprintf("%s/%d", profile.gender, profile.genderAcc), fmt.Sprintf("%s/%d", newGender, newGenderAcc))
+		}
+	}
+	return
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// gUTCOffsetRE - timezone given as an offset: +02:00, -0530, UTC+2, GMT-3
+	gUTCOffsetRE = regexp.MustCompile(`^(?i:UTC|GMT)?[+-]\d{1,2}(:?\d{2})?$`)
+	// gTimezoneOnce - missing profiles timezone column is reported once per run
+	gTimezoneOnce = &sync.Once{}
+)
+
+// validTimezone - IANA timezone name (Europe/Warsaw) or UTC offset
+func validTimezone(tz string) bool {
+	if gUTCOffsetRE.MatchString(tz) {
+		return true
+	}
+	_, err := time.LoadLocation(tz)
+	return err == nil && tz != "Local"
+}
+
+// updateProfile - processes a single user_profiles_*.csv row, applied to the profile of the uuid
+// independently of identities
+// uuid profile_name profile_email profile_country profile_timezone profile_is_bot profile_gender user_name user_email user_sfid
+// blank values are left unchanged, profile_timezone is only applied when profiles table has a timezone column
+func updateProfile(db *sql.DB, dbg, dry bool, row map[string]string) (err error) {
+	if dbg {
+		fmt.Printf("%v\n", row)
+	}
+	uuid := strings.TrimSpace(row["uuid"])
+	if uuid == "" {
+		err = fmt.Errorf("uuid cannot be empty in %v", row)
+		return
+	}
+	var name, email, timezone string
+	timezoneColumn := hasSchemaColumn("profiles", "timezone")
+	q := "select trim(coalesce(name, '')), trim(coalesce(email, '')), "
+	if timezoneColumn {
+		q += "trim(coalesce(timezone, ''))"
+	} else {
+		q += "''"
+	}
+	found, err := queryFirst(replica(db), []interface{}{&name, &email, &timezone}, q+" from profiles where uuid = ?", uuid)
+	if err != nil {
+		err = fmt.Errorf("uuid %s profile lookup: %v in %v", uuid, err, row)
+		return
+	}
+	if !found {
+		err = skipf(cWarnNotFound, "cannot find profile with uuid=%s (row %v)\n", uuid, row)
+		return
+	}
+	registerPII(name, email)
+	if reason := protectedIdentity("", uuid); reason != "" {
+		err = protectedf(reason, row)
+		return
+	}
+	newName, newEmail := normalizeValue(row["profile_name"]), normalizeValue(row["profile_email"])
+	if newName == "" || normalizeValue(name) == newName {
+		newName = name
+	}
+	if newEmail == "" || normalizeValue(email) == newEmail || (gIgnoreCaseEmail && strings.EqualFold(normalizeValue(email), newEmail)) {
+		newEmail = email
+	}
+	newName = allowedValue(dbg, "uuid "+uuid, "name", name, newName)
+	newEmail = allowedValue(dbg, "uuid "+uuid, "email", email, newEmail)
+	for field, value := range map[string]string{"profile_name": newName, "profile_email": newEmail} {
+		err = validateCharset(field, value)
+		if err != nil {
+			err = fmt.Errorf("uuid %s %v in %v", uuid, err, row)
+			return
+		}
+	}
+	newTimezone := strings.TrimSpace(row["profile_timezone"])
+	if newTimezone != "" && !timezoneColumn {
+		gTimezoneOnce.Do(func() {
+			warnf(cWarnOther, "profile_timezone column ignored, %s table has no timezone column\n", schemaTable("profiles"))
+		})
+		newTimezone = ""
+	}
+	if newTimezone != "" && !validTimezone(newTimezone) {
+		err = fmt.Errorf("uuid %s invalid profile_timezone '%s', expected IANA name or UTC offset in %v", uuid, newTimezone, row)
+		return
+	}
+	var (
+		profileQuery string
+		profileArgs  []interface{}
+		profileMsg   string
+	)
+	profileQuery, profileArgs, profileMsg, err = profileChanges(db, dbg, "", uuid, newName, "", newEmail, row)
+	if err != nil {
+		err = fmt.Errorf("uuid %s %v in %v", uuid, err, row)
+		return
+	}
+	msg := "profile uuid " + uuid + " "
+	if newName != name {
+		profileQuery += "name = ?, "
+		profileArgs = append(profileArgs, newName)
+		msg += fieldChange("name", name, newName)
+	}
+	if newEmail != email {
+		profileQuery += "email = ?, "
+		profileArgs = append(profileArgs, newEmail)
+		msg += fieldChange("email", email, newEmail)
+	}
+	if newTimezone != "" && newTimezone != timezone {
+		profileQuery += "timezone = ?, "
+		profileArgs = append(profileArgs, newTimezone)
+		msg += fieldChange("timezone", timezone, newTimezone)
+	}
+	if profileQuery == "" {
+		if dbg {
+			fmt.Printf("uuid %s profile nothing changed in %v\n", uuid, row)
+		}
+		return
+	}
+	msg += profileMsg
+	who := "email:" + strings.TrimSpace(row["user_email"]) + ",sfid:" + strings.TrimSpace(row["user_sfid"])
+	msg += " by " + who
+	profileQuery = "update profiles set " + profileQuery + auditSet("profiles") + " where uuid = ?"
+	profileArgs = append(profileArgs, auditArgs("profiles", who)...)
+	profileArgs = append(profileArgs, uuid)
+	err = applyPersonProfile(db, dbg, dry, uuid, who, msg, profileQuery, profileArgs)
+	if err != nil {
+		err = fmt.Errorf("%v in %v", err, row)
+	}
+	return
+}
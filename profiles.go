@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	// gProfile - active environment profile name
+	gProfile string
+	// gEnvNameRE - names of variables a profile can set
+	gEnvNameRE = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+)
+
+// setProfile - PROFILES_FILE is a YAML file mapping profile names to environment variables (DSNs, endpoints,
+// notification channels), PROFILE selects one and is required when the file is given
+// a variable already set in the environment to a different value is an error, unless PROFILE_ALLOW_OVERRIDE is set
+// (then the environment wins), the active profile is printed to stdout and stderr
+func setProfile() (err error) {
+	fileName := os.Getenv("PROFILES_FILE")
+	gProfile = os.Getenv("PROFILE")
+	if fileName == "" {
+		if gProfile != "" {
+			err = fmt.Errorf("PROFILE=%s requires PROFILES_FILE", gProfile)
+		}
+		return
+	}
+	var data []byte
+	data, err = ioutil.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+	profiles := make(map[string]map[string]string)
+	err = yaml.Unmarshal(data, &profiles)
+	if err != nil {
+		err = fmt.Errorf("cannot parse PROFILES_FILE %s: %v", fileName, err)
+		return
+	}
+	names := []string{}
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	env, ok := profiles[gProfile]
+	if !ok {
+		err = fmt.Errorf("PROFILE=%s not found in %s, available profiles: %s", gProfile, fileName, strings.Join(names, ", "))
+		return
+	}
+	override := os.Getenv("PROFILE_ALLOW_OVERRIDE") != ""
+	keys := []string{}
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !gEnvNameRE.MatchString(key) || key == "PROFILE" || key == "PROFILES_FILE" {
+			err = fmt.Errorf("profile %s in %s: invalid variable name '%s'", gProfile, fileName, key)
+			return
+		}
+		value, set := os.LookupEnv(key)
+		if set && value != env[key] {
+			if !override {
+				err = fmt.Errorf("profile %s sets %s, but the environment has a different value, unset it or set PROFILE_ALLOW_OVERRIDE", gProfile, key)
+				return
+			}
+			fmt.Printf("WARNING: %s from the environment overrides profile %s\n", key, gProfile)
+			continue
+		}
+		err = os.Setenv(key, env[key])
+		if err != nil {
+			return
+		}
+	}
+	banner := fmt.Sprintf("===== PROFILE: %s (%s, %d variables) =====", strings.ToUpper(gProfile), fileName, len(keys))
+	fmt.Printf("%s\n", banner)
+	fmt.Fprintf(os.Stderr, "%s\n", banner)
+	return
+}
+
+// checkProfileInputs - PROFILE_INPUT_PATTERN (usually set by a profile) is a regexp every input file path must match,
+// so for example production files cannot be imported with the staging profile
+func checkProfileInputs(files []string) (err error) {
+	pattern := os.Getenv("PROFILE_INPUT_PATTERN")
+	if pattern == "" {
+		return
+	}
+	var re *regexp.Regexp
+	re, err = regexp.Compile(pattern)
+	if err != nil {
+		err = fmt.Errorf("invalid PROFILE_INPUT_PATTERN=%s: %v", pattern, err)
+		return
+	}
+	for _, file := range files {
+		if !re.MatchString(file) {
+			err = fmt.Errorf("input file %s doesn't match PROFILE_INPUT_PATTERN=%s of profile '%s'", file, pattern, gProfile)
+			return
+		}
+	}
+	return
+}
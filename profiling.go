@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/trace"
+	"sync"
+)
+
+var (
+	// gTraceFile - TRACE_FILE being written by runtime/trace, nil when not tracing
+	gTraceFile *os.File
+	// gTraceMtx - guards gTraceFile, tracing is stopped once on any exit path
+	gTraceMtx sync.Mutex
+)
+
+// setProfiling - PPROF_ADDR (for example "localhost:6060") serves net/http/pprof endpoints under /debug/pprof/,
+// PPROF_BLOCK=1 also samples blocking and mutex contention (DB connection pool waits, gMtx), TRACE_FILE writes an
+// execution trace of the whole run (go tool trace TRACE_FILE)
+func setProfiling() (err error) {
+	if os.Getenv("PPROF_BLOCK") != "" {
+		runtime.SetBlockProfileRate(1)
+		runtime.SetMutexProfileFraction(1)
+	}
+	if addr := os.Getenv("PPROF_ADDR"); addr != "" {
+		// pprof handlers are registered on a separate mux, never on the API server of SERVE_ADDR
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		go func() {
+			fmt.Printf("Serving pprof on %s/debug/pprof/\n", addr)
+			err := http.ListenAndServe(addr, mux)
+			if err != nil {
+				fmt.Printf("WARNING: pprof server: %v\n", err)
+			}
+		}()
+	}
+	path := os.Getenv("TRACE_FILE")
+	if path == "" {
+		return
+	}
+	var f *os.File
+	f, err = os.Create(path)
+	if err != nil {
+		err = fmt.Errorf("TRACE_FILE: %v", err)
+		return
+	}
+	err = trace.Start(f)
+	if err != nil {
+		_ = f.Close()
+		err = fmt.Errorf("TRACE_FILE: %v", err)
+		return
+	}
+	gTraceMtx.Lock()
+	gTraceFile = f
+	gTraceMtx.Unlock()
+	return
+}
+
+// stopTrace - stops the execution trace started by TRACE_FILE and closes the file
+func stopTrace() {
+	gTraceMtx.Lock()
+	defer gTraceMtx.Unlock()
+	if gTraceFile == nil {
+		return
+	}
+	trace.Stop()
+	err := gTraceFile.Close()
+	if err != nil {
+		fmt.Printf("WARNING: TRACE_FILE: %v\n", err)
+	} else {
+		fmt.Printf("Execution trace written to %s\n", gTraceFile.Name())
+	}
+	gTraceFile = nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	// gProtectedUUIDs, gProtectedIDs, gProtectedOrgs - never modified by imports, loaded from PROTECTED_FILE
+	gProtectedUUIDs map[string]struct{}
+	gProtectedIDs   map[string]struct{}
+	gProtectedOrgs  map[string]struct{}
+)
+
+// setProtections - PROTECTED_FILE, one item per line: uuid,<uuid> identity_id,<id> or org,<organization name>
+// blank lines and # comments are ignored, organization names are case insensitive
+func setProtections() (err error) {
+	gProtectedUUIDs, gProtectedIDs, gProtectedOrgs = nil, nil, nil
+	fileName := os.Getenv("PROTECTED_FILE")
+	if fileName == "" {
+		return
+	}
+	var f *os.File
+	f, err = os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	gProtectedUUIDs = make(map[string]struct{})
+	gProtectedIDs = make(map[string]struct{})
+	gProtectedOrgs = make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ary := strings.SplitN(line, ",", 2)
+		value := ""
+		if len(ary) == 2 {
+			value = strings.TrimSpace(ary[1])
+		}
+		if value == "" {
+			err = fmt.Errorf("%s:%d: expected uuid,<uuid>, identity_id,<id> or org,<name>, got '%s'", fileName, n, line)
+			return
+		}
+		switch strings.ToLower(strings.TrimSpace(ary[0])) {
+		case "uuid":
+			gProtectedUUIDs[value] = struct{}{}
+		case "identity_id":
+			gProtectedIDs[value] = struct{}{}
+		case "org":
+			gProtectedOrgs[strings.ToLower(value)] = struct{}{}
+		default:
+			err = fmt.Errorf("%s:%d: unknown protection '%s', allowed: uuid, identity_id, org", fileName, n, ary[0])
+			return
+		}
+	}
+	err = scanner.Err()
+	if err == nil {
+		fmt.Printf("Protected %d uuids, %d identity_ids, %d organizations from %s\n", len(gProtectedUUIDs), len(gProtectedIDs), len(gProtectedOrgs), fileName)
+	}
+	return
+}
+
+// protectedIdentity - returns a reason when the identity or its unique identity is protected
+func protectedIdentity(id, uuid string) string {
+	if _, ok := gProtectedIDs[id]; ok && id != "" {
+		return "identity_id " + id + " is protected"
+	}
+	if _, ok := gProtectedUUIDs[uuid]; ok && uuid != "" {
+		return "uuid " + uuid + " is protected"
+	}
+	return ""
+}
+
+// protectedOrg - returns a reason when the organization (or the one its alias resolves to) is protected
+func protectedOrg(orgName string) string {
+	orgName = strings.TrimSpace(orgName)
+	if orgName == "" || len(gProtectedOrgs) == 0 {
+		return ""
+	}
+	names := []string{orgName}
+	if canonical, err := resolveOrgAlias(orgName); err == nil && canonical != orgName {
+		names = append(names, canonical)
+	}
+	for _, name := range names {
+		if _, ok := gProtectedOrgs[strings.ToLower(name)]; ok {
+			return "organization " + name + " is protected"
+		}
+	}
+	return ""
+}
+
+// protectedf - skips a row touching protected data, reported as a warning and counted in the summary
+func protectedf(reason string, row map[string]string) error {
+	gSummaryMtx.Lock()
+	if gSummary != nil {
+		gSummary.ProtectedRows++
+	}
+	gSummaryMtx.Unlock()
+	return skipf(cWarnOther, "%s, row not applied (row %v)\n", reason, row)
+}
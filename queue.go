@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	cQueueDefaultWait   = 20
+	cKafkaDefaultGroup  = "import-individual-dashboard"
+	cKafkaContentType   = "application/vnd.kafka.v2+json"
+	cKafkaJSONRecords   = "application/vnd.kafka.json.v2+json"
+	cSQSMaxMessages     = 10
+	cQueueFailedBackoff = 30 * time.Second
+)
+
+// queueMessage - single change request received from the queue
+type queueMessage struct {
+	id     string
+	handle string
+	body   []byte
+}
+
+// queueConsumer - source of change request messages
+// ack is only called after the messages were imported and committed, reset makes unacknowledged
+// messages available again
+type queueConsumer interface {
+	receive() ([]queueMessage, error)
+	ack([]queueMessage) error
+	reset() error
+	close()
+}
+
+// sqsConsumer - SQS queue read via AWS CLI, unacknowledged messages reappear after the visibility timeout
+type sqsConsumer struct {
+	url  string
+	wait int
+	dbg  bool
+}
+
+// awsSQS - runs AWS CLI sqs command, returns its JSON output
+func awsSQS(dbg bool, args ...string) ([]byte, error) {
+	args = append([]string{"sqs"}, args...)
+	args = append(args, "--output", "json")
+	if dbg {
+		fmt.Printf("aws %s\n", strings.Join(args, " "))
+	}
+	var stderr bytes.Buffer
+	cmd := osexec.Command("aws", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("aws %s: %v: %s", strings.Join(args, " "), err, stderr.String())
+	}
+	return out, nil
+}
+
+func (c *sqsConsumer) receive() (msgs []queueMessage, err error) {
+	var out []byte
+	out, err = awsSQS(c.dbg, "receive-message", "--queue-url", c.url, "--max-number-of-messages", strconv.Itoa(cSQSMaxMessages), "--wait-time-seconds", strconv.Itoa(c.wait))
+	if err != nil || len(bytes.TrimSpace(out)) == 0 {
+		return
+	}
+	var result struct {
+		Messages []struct {
+			MessageID     string `json:"MessageId"`
+			ReceiptHandle string `json:"ReceiptHandle"`
+			Body          string `json:"Body"`
+		} `json:"Messages"`
+	}
+	err = json.Unmarshal(out, &result)
+	if err != nil {
+		return
+	}
+	for _, msg := range result.Messages {
+		msgs = append(msgs, queueMessage{id: msg.MessageID, handle: msg.ReceiptHandle, body: []byte(msg.Body)})
+	}
+	return
+}
+
+func (c *sqsConsumer) ack(msgs []queueMessage) (err error) {
+	for from := 0; from < len(msgs); from += cSQSMaxMessages {
+		to := from + cSQSMaxMessages
+		if to > len(msgs) {
+			to = len(msgs)
+		}
+		entries := []map[string]string{}
+		for i, msg := range msgs[from:to] {
+			entries = append(entries, map[string]string{"Id": strconv.Itoa(i), "ReceiptHandle": msg.handle})
+		}
+		data, _ := json.Marshal(entries)
+		var out []byte
+		out, err = awsSQS(c.dbg, "delete-message-batch", "--queue-url", c.url, "--entries", string(data))
+		if err != nil {
+			return
+		}
+		var result struct {
+			Failed []struct {
+				ID      string `json:"Id"`
+				Message string `json:"Message"`
+			} `json:"Failed"`
+		}
+		if json.Unmarshal(out, &result) == nil && len(result.Failed) > 0 {
+			err = fmt.Errorf("cannot delete %d SQS messages, first: %s", len(result.Failed), result.Failed[0].Message)
+			return
+		}
+	}
+	return
+}
+
+func (c *sqsConsumer) reset() error {
+	return nil
+}
+
+func (c *sqsConsumer) close() {}
+
+// kafkaConsumer - Kafka topic read via Kafka REST Proxy (v2 API) with auto commit disabled
+// on reset the consumer instance is recreated, so it resumes from the last committed offsets
+type kafkaConsumer struct {
+	url     string
+	topic   string
+	group   string
+	baseURI string
+	http    *http.Client
+	dbg     bool
+}
+
+// do - executes REST Proxy request, decodes JSON response into out (if not nil)
+func (c *kafkaConsumer) do(method, url, accept string, payload, out interface{}) (err error) {
+	var body *bytes.Reader
+	if payload != nil {
+		var data []byte
+		data, err = json.Marshal(payload)
+		if err != nil {
+			return
+		}
+		body = bytes.NewReader(data)
+	} else {
+		body = bytes.NewReader(nil)
+	}
+	var req *http.Request
+	req, err = http.NewRequest(method, url, body)
+	if err != nil {
+		return
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", cKafkaContentType)
+	}
+	req.Header.Set("Accept", accept)
+	if c.dbg {
+		fmt.Printf("Kafka REST %s %s\n", method, url)
+	}
+	var resp *http.Response
+	resp, err = c.http.Do(req)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = fmt.Errorf("Kafka REST %s %s returned %d: %s", method, url, resp.StatusCode, string(data))
+		return
+	}
+	if out != nil && len(data) > 0 {
+		err = json.Unmarshal(data, out)
+	}
+	return
+}
+
+// subscribe - creates consumer instance in the group and subscribes it to the topic
+func (c *kafkaConsumer) subscribe() (err error) {
+	var instance struct {
+		InstanceID string `json:"instance_id"`
+		BaseURI    string `json:"base_uri"`
+	}
+	name := fmt.Sprintf("%s-%d-%d", c.group, os.Getpid(), time.Now().UnixNano())
+	err = c.do(
+		http.MethodPost,
+		strings.TrimSuffix(c.url, "/")+"/consumers/"+c.group,
+		cKafkaContentType,
+		map[string]string{"name": name, "format": "json", "auto.offset.reset": "earliest", "auto.commit.enable": "false"},
+		&instance,
+	)
+	if err != nil {
+		return
+	}
+	c.baseURI = instance.BaseURI
+	return c.do(http.MethodPost, c.baseURI+"/subscription", cKafkaContentType, map[string][]string{"topics": {c.topic}}, nil)
+}
+
+func (c *kafkaConsumer) receive() (msgs []queueMessage, err error) {
+	var records []struct {
+		Partition int             `json:"partition"`
+		Offset    int64           `json:"offset"`
+		Value     json.RawMessage `json:"value"`
+	}
+	err = c.do(http.MethodGet, c.baseURI+"/records", cKafkaJSONRecords, nil, &records)
+	if err != nil {
+		return
+	}
+	for _, record := range records {
+		msgs = append(msgs, queueMessage{id: fmt.Sprintf("%s/%d@%d", c.topic, record.Partition, record.Offset), body: record.Value})
+	}
+	return
+}
+
+// ack - commits offsets of all records fetched so far, they were all processed by then
+func (c *kafkaConsumer) ack(msgs []queueMessage) error {
+	return c.do(http.MethodPost, c.baseURI+"/offsets", cKafkaContentType, nil, nil)
+}
+
+func (c *kafkaConsumer) reset() error {
+	c.close()
+	return c.subscribe()
+}
+
+func (c *kafkaConsumer) close() {
+	if c.baseURI == "" {
+		return
+	}
+	err := c.do(http.MethodDelete, c.baseURI, cKafkaContentType, nil, nil)
+	if err != nil {
+		fmt.Printf("WARNING: cannot delete Kafka consumer instance: %v\n", err)
+	}
+	c.baseURI = ""
+}
+
+// queueKind - maps message kind to identities or enrollments
+func queueKind(kind string) string {
+	switch strings.ToLower(strings.TrimSpace(kind)) {
+	case "identity", "identities":
+		return "identities"
+	case "enrollment", "enrollments", "affiliation", "affiliations":
+		return "enrollments"
+	}
+	return ""
+}
+
+// parseQueueMessage - {"kind": "identity"|"enrollment", "row": {"column": "value", ...}}
+// row uses the same columns as identities and affiliations CSV files
+func parseQueueMessage(body []byte) (kind string, row map[string]string, err error) {
+	var msg struct {
+		Kind string                 `json:"kind"`
+		Row  map[string]interface{} `json:"row"`
+	}
+	err = json.Unmarshal(body, &msg)
+	if err != nil {
+		return
+	}
+	kind = queueKind(msg.Kind)
+	if kind == "" {
+		err = fmt.Errorf("unknown kind '%s', expected identity or enrollment", msg.Kind)
+		return
+	}
+	if len(msg.Row) == 0 {
+		err = fmt.Errorf("no row data")
+		return
+	}
+	row = make(map[string]string)
+	for k, v := range msg.Row {
+		switch value := v.(type) {
+		case nil:
+			row[k] = ""
+		case string:
+			row[k] = value
+		case bool, float64:
+			row[k] = fmt.Sprintf("%v", value)
+		default:
+			err = fmt.Errorf("unsupported value of %s: %v", k, v)
+			return
+		}
+	}
+	return
+}
+
+// writeQueueRows - writes rows as CSV file, columns sorted by name
+func writeQueueRows(fileName string, rows []map[string]string) (err error) {
+	columns := make(map[string]struct{})
+	for _, row := range rows {
+		for column := range row {
+			columns[column] = struct{}{}
+		}
+	}
+	hdr := []string{}
+	for column := range columns {
+		hdr = append(hdr, column)
+	}
+	sort.Strings(hdr)
+	var f *os.File
+	f, err = os.Create(fileName)
+	if err != nil {
+		return
+	}
+	w := csv.NewWriter(f)
+	if len(hdr) > 0 {
+		_ = w.Write(hdr)
+	}
+	for _, row := range rows {
+		line := make([]string, len(hdr))
+		for i, column := range hdr {
+			line[i] = row[column]
+		}
+		_ = w.Write(line)
+	}
+	w.Flush()
+	err = w.Error()
+	e := f.Close()
+	if err == nil {
+		err = e
+	}
+	return
+}
+
+// importQueueMessages - imports batch of messages as one run, invalid messages are reported and dropped
+func importQueueMessages(dbs []*shDatabase, dbg, dry bool, msgs []queueMessage) (err error) {
+	rows := map[string][]map[string]string{"identities": {}, "enrollments": {}}
+	for _, msg := range msgs {
+		kind, row, e := parseQueueMessage(msg.body)
+		if e != nil {
+			fmt.Printf("WARNING: dropping invalid message %s: %v: %s\n", msg.id, e, string(msg.body))
+			continue
+		}
+		rows[kind] = append(rows[kind], row)
+	}
+	if len(rows["identities"]) == 0 && len(rows["enrollments"]) == 0 {
+		return
+	}
+	var dir string
+	dir, err = ioutil.TempDir(os.Getenv("QUEUE_DIR"), "queue-")
+	if err != nil {
+		return
+	}
+	if os.Getenv("QUEUE_DIR") == "" {
+		defer func() {
+			_ = os.RemoveAll(dir)
+		}()
+	}
+	ts := time.Now().UTC().Format("200601021504")
+	identitiesFile := filepath.Join(dir, "user_identities_"+ts+".csv")
+	affiliationsFile := filepath.Join(dir, "user_affiliations_"+ts+".csv")
+	err = writeQueueRows(identitiesFile, rows["identities"])
+	if err != nil {
+		return
+	}
+	err = writeQueueRows(affiliationsFile, rows["enrollments"])
+	if err != nil {
+		return
+	}
+	fmt.Printf("Importing %d identities and %d enrollments messages\n", len(rows["identities"]), len(rows["enrollments"]))
+	_, err = importFiles(dbs, dbg, dry, inputFiles{identities: []string{identitiesFile}, affiliations: []string{affiliationsFile}}, runOptions{})
+	return
+}
+
+// consumeQueue - continuously imports change requests from SQS queue or Kafka topic
+// QUEUE_URL - SQS queue URL (read via AWS CLI), QUEUE_WAIT - long polling seconds (default 20)
+// KAFKA_REST_URL, KAFKA_TOPIC, KAFKA_GROUP - Kafka REST Proxy, topic and consumer group (default import-individual-dashboard)
+// QUEUE_DIR - where CSVs built from messages are kept (default temporary directory, removed afterwards)
+// QUEUE_ONCE - exit after the first batch of messages
+// Each received batch is imported as a separate run, messages are acknowledged (deleted from SQS, offsets committed
+// to Kafka) only after the import committed; failed batches are redelivered, in dry mode nothing is acknowledged
+func consumeQueue(dbs []*shDatabase, dbg, dry bool) (err error) {
+	wait := cQueueDefaultWait
+	if s := os.Getenv("QUEUE_WAIT"); s != "" {
+		wait, err = strconv.Atoi(s)
+		if err != nil || wait < 0 || wait > 20 {
+			err = fmt.Errorf("invalid QUEUE_WAIT=%s, expected 0-20 seconds", s)
+			return
+		}
+	}
+	var consumer queueConsumer
+	if url := os.Getenv("QUEUE_URL"); url != "" {
+		consumer = &sqsConsumer{url: url, wait: wait, dbg: dbg}
+		fmt.Printf("Consuming SQS queue %s\n", url)
+	} else {
+		group := os.Getenv("KAFKA_GROUP")
+		if group == "" {
+			group = cKafkaDefaultGroup
+		}
+		kafka := &kafkaConsumer{
+			url:   os.Getenv("KAFKA_REST_URL"),
+			topic: os.Getenv("KAFKA_TOPIC"),
+			group: group,
+			http:  &http.Client{Timeout: time.Duration(wait+60) * time.Second},
+			dbg:   dbg,
+		}
+		if kafka.topic == "" {
+			err = fmt.Errorf("KAFKA_TOPIC must be set")
+			return
+		}
+		err = kafka.subscribe()
+		if err != nil {
+			return
+		}
+		consumer = kafka
+		fmt.Printf("Consuming Kafka topic %s as %s\n", kafka.topic, group)
+	}
+	defer consumer.close()
+	once := os.Getenv("QUEUE_ONCE") != ""
+	for {
+		var msgs []queueMessage
+		msgs, err = consumer.receive()
+		if err != nil {
+			return
+		}
+		if len(msgs) == 0 {
+			if once {
+				return
+			}
+			if wait == 0 {
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		e := importQueueMessages(dbs, dbg, dry, msgs)
+		switch {
+		case e != nil:
+			fmt.Printf("WARNING: importing %d messages failed, they will be redelivered: %v\n", len(msgs), e)
+			err = consumer.reset()
+			if err != nil {
+				return
+			}
+			if once {
+				return e
+			}
+			time.Sleep(cQueueFailedBackoff)
+		case dry:
+			fmt.Printf("Dry mode, %d messages not acknowledged\n", len(msgs))
+		default:
+			err = consumer.ack(msgs)
+			if err != nil {
+				return
+			}
+			if dbg {
+				fmt.Printf("Acknowledged %d messages\n", len(msgs))
+			}
+		}
+		if once {
+			return
+		}
+	}
+}
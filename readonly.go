@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	// gEnforceReadOnly - dry run that must never write (ENFORCE_READONLY)
+	gEnforceReadOnly bool
+	// gReadOnlyVar - session variable making connections read only, empty to not set it
+	gReadOnlyVar string
+)
+
+// setEnforceReadOnly - ENFORCE_READONLY, only allowed with DRY
+// READONLY_SESSION_VAR - "transaction_read_only" (default, MySQL 5.7.20+, MariaDB 11.1+), "tx_read_only" (older servers)
+// or "-" to only rely on the write guard and READONLY_DSN
+func setEnforceReadOnly() (err error) {
+	gEnforceReadOnly = os.Getenv("ENFORCE_READONLY") != ""
+	if !gEnforceReadOnly {
+		return
+	}
+	if os.Getenv("DRY") == "" {
+		err = fmt.Errorf("ENFORCE_READONLY can only be used with DRY")
+		return
+	}
+	gReadOnlyVar = os.Getenv("READONLY_SESSION_VAR")
+	switch gReadOnlyVar {
+	case "":
+		gReadOnlyVar = "transaction_read_only"
+	case "-":
+		gReadOnlyVar = ""
+	case "transaction_read_only", "tx_read_only":
+	default:
+		err = fmt.Errorf("invalid READONLY_SESSION_VAR=%s, allowed: transaction_read_only, tx_read_only, -", gReadOnlyVar)
+	}
+	return
+}
+
+// readOnlyDSN - DSN whose every connection is read only when ENFORCE_READONLY is set
+// READONLY_DSN replaces the primary database DSN (for example a user with SELECT privileges only)
+func readOnlyDSN(dsn string, primary bool) string {
+	if !gEnforceReadOnly {
+		return dsn
+	}
+	if primary && os.Getenv("READONLY_DSN") != "" {
+		dsn = os.Getenv("READONLY_DSN")
+	}
+	if gReadOnlyVar == "" {
+		return dsn
+	}
+	if strings.Contains(dsn, "?") {
+		return dsn + "&" + gReadOnlyVar + "=1"
+	}
+	return dsn + "?" + gReadOnlyVar + "=1"
+}
+
+// readOnlyGuard - fails any write attempted in an ENFORCE_READONLY dry run before it reaches the database
+func readOnlyGuard(query string) error {
+	if gEnforceReadOnly {
+		return fmt.Errorf("write attempted in read-only dry run: %s", query)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	cReconcileBatch = 1000
+)
+
+// columnIndex - returns index of column in CSV header or -1
+func columnIndex(hdr []string, column string) int {
+	for i, col := range hdr {
+		if strings.TrimSpace(col) == column {
+			return i
+		}
+	}
+	return -1
+}
+
+// existingIdentities - returns set of ids that exist in identities table, queries in batches
+func existingIdentities(db *sql.DB, ids []string) (existing map[string]struct{}, err error) {
+	existing = make(map[string]struct{})
+	for from := 0; from < len(ids); from += cReconcileBatch {
+		to := from + cReconcileBatch
+		if to > len(ids) {
+			to = len(ids)
+		}
+		batch := ids[from:to]
+		args := []interface{}{}
+		for _, id := range batch {
+			args = append(args, id)
+		}
+		var rows *stmtRows
+		rows, err = query(replica(db), "select id from identities where id in ("+strings.TrimSuffix(strings.Repeat("?,", len(batch)), ",")+")", args...)
+		if err != nil {
+			return
+		}
+		id := ""
+		for rows.Next() {
+			err = rows.Scan(&id)
+			if err != nil {
+				_ = rows.Close()
+				return
+			}
+			existing[id] = struct{}{}
+		}
+		err = rows.Err()
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// reconcileFiles - cross checks identities and affiliations CSVs before any writes
+// Affiliations rows referencing identity_id absent from both the identities CSV and the database are orphans
+// RECONCILE - "report" (default) reports orphans, "abort" refuses to import when there are any, "off" disables the check
+// returns data row numbers of orphan affiliations rows (within their files)
+func reconcileFiles(db *sql.DB, dbg bool, identities, affiliations []csvInput) (orphans []int, err error) {
+	mode := os.Getenv("RECONCILE")
+	if mode == "off" || dataRows(affiliations) == 0 {
+		return
+	}
+	if mode != "" && mode != "report" && mode != "abort" {
+		err = fmt.Errorf("invalid RECONCILE=%s, allowed: report, abort, off", mode)
+		return
+	}
+	inFile := make(map[string]struct{})
+	for _, input := range identities {
+		if len(input.lines) == 0 {
+			continue
+		}
+		iIdx := columnIndex(input.lines[0], "identity_id")
+		if iIdx < 0 {
+			continue
+		}
+		for _, line := range input.lines[1:] {
+			inFile[strings.TrimSpace(line[iIdx])] = struct{}{}
+		}
+	}
+	missing := []string{}
+	seen := make(map[string]struct{})
+	for _, input := range affiliations {
+		if len(input.lines) == 0 {
+			continue
+		}
+		eIdx := columnIndex(input.lines[0], "identity_id")
+		if eIdx < 0 {
+			err = fmt.Errorf("affiliations file %s has no identity_id column: %v", input.name, input.lines[0])
+			return
+		}
+		for _, line := range input.lines[1:] {
+			id := strings.TrimSpace(line[eIdx])
+			if id == "" {
+				continue
+			}
+			if _, ok := inFile[id]; ok {
+				continue
+			}
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			seen[id] = struct{}{}
+			missing = append(missing, id)
+		}
+	}
+	var existing map[string]struct{}
+	existing, err = existingIdentities(db, missing)
+	if err != nil {
+		return
+	}
+	for _, input := range affiliations {
+		if len(input.lines) == 0 {
+			continue
+		}
+		eIdx := columnIndex(input.lines[0], "identity_id")
+		for i, line := range input.lines {
+			if i == 0 {
+				continue
+			}
+			id := strings.TrimSpace(line[eIdx])
+			if id == "" {
+				continue
+			}
+			_, ok1 := inFile[id]
+			_, ok2 := existing[id]
+			if !ok1 && !ok2 {
+				orphans = append(orphans, i)
+				warnf(cWarnNotFound, "%s row %d: orphan identity_id %s, not present in identities files nor in the database\n", input.name, i, id)
+			}
+		}
+	}
+	gSummaryMtx.Lock()
+	if gSummary != nil {
+		gSummary.OrphanRows = len(orphans)
+	}
+	gSummaryMtx.Unlock()
+	if dbg || len(orphans) > 0 {
+		fmt.Printf("Reconciliation: %d affiliations rows, %d identity_ids checked in the database, %d orphan rows\n", dataRows(affiliations), len(missing), len(orphans))
+	}
+	if mode == "abort" && len(orphans) > 0 {
+		err = fmt.Errorf("%d orphan affiliations rows found, refusing to import (RECONCILE=abort)", len(orphans))
+	}
+	return
+}
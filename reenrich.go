@@ -0,0 +1,73 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// reenrichTask - request to re-enrich dashboards of people and projects changed by a run
+type reenrichTask struct {
+	RunID    string    `json:"run_id"`
+	Database string    `json:"database,omitempty"`
+	Created  time.Time `json:"created"`
+	UUIDs    []string  `json:"uuids"`
+	Projects []string  `json:"projects"`
+}
+
+// triggerReenrichment - kicks off targeted re-enrichment of changed uuids and their projects
+// REENRICH_URL - job runner endpoint, receives reenrichTask JSON (REENRICH_METHOD, default POST; REENRICH_TOKEN bearer token)
+// REENRICH_DIR - directory to write reenrich_<run_id>.json task file to, for runners polling a shared volume or bucket sync
+// Failures are only reported, changes are already committed
+func triggerReenrichment(db *sql.DB, dbg bool, summary *importSummary) {
+	endpoint, dir := os.Getenv("REENRICH_URL"), os.Getenv("REENRICH_DIR")
+	if (endpoint == "" && dir == "") || len(gChangedUUIDs) == 0 {
+		return
+	}
+	projects, _, err := affectedProjects(db)
+	if err != nil {
+		warnf(cWarnOther, "cannot get affected projects, re-enrichment not triggered: %v\n", err)
+		return
+	}
+	task := reenrichTask{RunID: summary.RunID, Database: summary.Database, Created: time.Now(), Projects: projects}
+	for uuid := range gChangedUUIDs {
+		task.UUIDs = append(task.UUIDs, uuid)
+	}
+	sort.Strings(task.UUIDs)
+	if endpoint != "" {
+		method := os.Getenv("REENRICH_METHOD")
+		if method == "" {
+			method = http.MethodPost
+		}
+		err = callAPI(method, endpoint, os.Getenv("REENRICH_TOKEN"), task)
+		if err != nil {
+			warnf(cWarnOther, "re-enrichment trigger failed: %v\n", err)
+		} else {
+			fmt.Printf("Triggered re-enrichment of %d uuids in %d projects\n", len(task.UUIDs), len(task.Projects))
+		}
+	}
+	if dir != "" {
+		var data []byte
+		data, err = json.MarshalIndent(task, "", "  ")
+		if err == nil {
+			path := filepath.Join(dir, "reenrich_"+summary.RunID+".json")
+			// Write to a temporary name first, so pollers never see partial tasks
+			err = ioutil.WriteFile(path+".tmp", data, 0644)
+			if err == nil {
+				err = os.Rename(path+".tmp", path)
+			}
+			if err == nil && dbg {
+				fmt.Printf("Re-enrichment task written to %s\n", path)
+			}
+		}
+		if err != nil {
+			warnf(cWarnOther, "cannot write re-enrichment task: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// rowOutcome - result of a single row for the results file
+type rowOutcome struct {
+	status    string
+	message   string
+	appliedAt string
+}
+
+// rowResults - per-row results of a single input file, nil when neither RESULTS is set nor outcomes are kept
+type rowResults struct {
+	dry      bool
+	outcomes map[int]rowOutcome
+}
+
+// fileOutcomes - input file lines with their per-row outcomes, kept in the run summary
+type fileOutcomes struct {
+	lines    [][]string
+	outcomes map[int]rowOutcome
+}
+
+// newRowResults - RESULTS enables writing results CSV files
+func newRowResults(dry bool) *rowResults {
+	if os.Getenv("RESULTS") == "" && !gOutcomes {
+		return nil
+	}
+	return &rowResults{dry: dry, outcomes: make(map[int]rowOutcome)}
+}
+
+// record - records result of data row n
+// applied (planned in dry mode), collision, skipped or failed
+func (r *rowResults) record(n int, err error) {
+	if r == nil {
+		return
+	}
+	outcome := rowOutcome{}
+	switch {
+	case err == errTerminated:
+		outcome.status = "not processed"
+	case err == nil && r.dry:
+		outcome.status = "planned"
+	case err == nil:
+		outcome.status = "applied"
+		outcome.appliedAt = time.Now().UTC().Format(time.RFC3339)
+	case isCollision(err):
+		outcome.status = "collision"
+	case isSkipped(err):
+		outcome.status = "skipped"
+	default:
+		outcome.status = "failed"
+	}
+	if err != nil {
+		outcome.message = strings.TrimSpace(err.Error())
+	}
+	r.outcomes[n] = outcome
+}
+
+// writeResults - writes input rows with added status, message and applied_at columns (and source_line, raw_line)
+// rows that were not processed because the import was aborted have "not processed" status
+// RESULTS_DIR - where to write results files (directory, s3:// prefix or http(s):// URL), default is the input file's directory
+func writeResults(fileName, runID string, multi bool, input csvInput, results *rowResults) (err error) {
+	lines := input.lines
+	if results == nil || len(lines) == 0 || os.Getenv("RESULTS") == "" {
+		return
+	}
+	outName := outputFileName(fileName, "results", runID, multi, os.Getenv("RESULTS_DIR"))
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	hdr := append(traceHeader(lines[0]), "status", "message", "applied_at")
+	_ = w.Write(hdr)
+	for n, line := range lines[1:] {
+		outcome, ok := results.outcomes[n+1]
+		if !ok {
+			outcome.status = "not processed"
+		}
+		_ = w.Write(append(withTrace(input, n+1, line), outcome.status, outcome.message, outcome.appliedAt))
+	}
+	w.Flush()
+	err = w.Error()
+	if err == nil {
+		err = writeOutput(outName, buf.Bytes())
+	}
+	if err == nil {
+		fmt.Printf("Results written to %s\n", outName)
+	}
+	return
+}
+
+// keepOutcomes - keeps per-row outcomes of the input file in the summary (runOptions.outcomes)
+func (s *importSummary) keepOutcomes(input csvInput, results *rowResults) {
+	if !gOutcomes || results == nil {
+		return
+	}
+	s.outcomes = append(s.outcomes, fileOutcomes{lines: input.lines, outcomes: results.outcomes})
+}
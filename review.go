@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// cReviewAudit - audit entries shown in the review panel
+	cReviewAudit = 5
+)
+
+// reviewRow - data row n of the file of identities (or affiliations) inputs, text - the row as shown in the panel
+type reviewRow struct {
+	affiliations bool
+	file         int
+	n            int
+	text         string
+}
+
+// reviewPerson - pending rows of one person, key is the uuid or "identity_id <id>" for unknown identities,
+// inputs - the input files with only the person's rows
+type reviewPerson struct {
+	key    string
+	uuid   string
+	rows   []reviewRow
+	inputs *loadedInputs
+}
+
+// isTerminal - the file is an interactive terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// reviewRows - data rows of identities and affiliations inputs grouped by person (in order of first appearance):
+// rows of identity_ids by their identity's uuid, rows without identity_id by their uuid column, left - rows having
+// neither, every person's inputs are built once
+func reviewRows(db *sql.DB, loaded *loadedInputs) (people []*reviewPerson, left int, err error) {
+	ids := []string{}
+	byKey := make(map[string]*reviewPerson)
+	for k, inputs := range [][]csvInput{loaded.identities, loaded.affiliations} {
+		for f, input := range inputs {
+			if len(input.lines) < 2 {
+				continue
+			}
+			hdr := input.lines[0]
+			idIdx, uuidIdx := columnIndex(hdr, "identity_id"), columnIndex(hdr, "uuid")
+			for n, line := range input.lines[1:] {
+				id, uuid := "", ""
+				if idIdx >= 0 && idIdx < len(line) {
+					id = strings.TrimSpace(line[idIdx])
+				}
+				if uuidIdx >= 0 && uuidIdx < len(line) {
+					uuid = strings.TrimSpace(line[uuidIdx])
+				}
+				key, keyIdx := "identity_id "+id, idIdx
+				if id == "" {
+					key, keyIdx = uuid, uuidIdx
+				}
+				if key == "" {
+					left++
+					continue
+				}
+				values := []string{}
+				for i, value := range line {
+					if i < len(hdr) && i != keyIdx && strings.TrimSpace(value) != "" {
+						values = append(values, hdr[i]+"="+strings.TrimSpace(value))
+					}
+				}
+				person, ok := byKey[key]
+				if !ok {
+					person = &reviewPerson{key: key}
+					if id == "" {
+						person.uuid = uuid
+					} else {
+						ids = append(ids, id)
+					}
+					byKey[key] = person
+					people = append(people, person)
+				}
+				desc := key
+				if id == "" {
+					desc = "uuid " + uuid
+				}
+				text := fmt.Sprintf("%s:%d %s: %s", input.name, n+1, desc, strings.Join(values, " "))
+				person.rows = append(person.rows, reviewRow{affiliations: k == 1, file: f, n: n + 1, text: text})
+			}
+		}
+	}
+	var uuids map[string]string
+	uuids, err = identityUUIDs(db, ids)
+	if err != nil {
+		return
+	}
+	// identity_ids of the same uuid and rows keyed by that uuid are one person
+	merged := []*reviewPerson{}
+	byUUID := make(map[string]*reviewPerson)
+	for _, person := range people {
+		if person.uuid == "" {
+			if uuid := uuids[strings.TrimPrefix(person.key, "identity_id ")]; uuid != "" {
+				person.key, person.uuid = uuid, uuid
+			}
+		}
+		if person.uuid != "" {
+			if into, ok := byUUID[person.uuid]; ok {
+				into.rows = append(into.rows, person.rows...)
+				continue
+			}
+			byUUID[person.uuid] = person
+		}
+		merged = append(merged, person)
+	}
+	people = merged
+	for _, person := range people {
+		sort.SliceStable(person.rows, func(i, j int) bool {
+			a, b := person.rows[i], person.rows[j]
+			if a.affiliations != b.affiliations {
+				return !a.affiliations
+			}
+			if a.file != b.file {
+				return a.file < b.file
+			}
+			return a.n < b.n
+		})
+		person.inputs = personInputs(loaded, person.rows)
+	}
+	return
+}
+
+// personInputs - inputs with only the given rows (headers of all files are kept)
+func personInputs(loaded *loadedInputs, rows []reviewRow) *loadedInputs {
+	person := &loadedInputs{files: loaded.files}
+	for _, kind := range []struct {
+		affiliations bool
+		from         []csvInput
+		to           *[]csvInput
+	}{
+		{affiliations: false, from: loaded.identities, to: &person.identities},
+		{affiliations: true, from: loaded.affiliations, to: &person.affiliations},
+	} {
+		inputs := make([]csvInput, len(kind.from))
+		for f, input := range kind.from {
+			inputs[f].name = input.name
+			if len(input.lines) > 0 {
+				inputs[f].lines = [][]string{input.lines[0]}
+			}
+			if len(input.raw) > 0 {
+				inputs[f].raw = []rawRecord{input.raw[0]}
+			}
+		}
+		for _, row := range rows {
+			if row.affiliations != kind.affiliations {
+				continue
+			}
+			input := kind.from[row.file]
+			inputs[row.file].lines = append(inputs[row.file].lines, input.lines[row.n])
+			if row.n < len(input.raw) {
+				inputs[row.file].raw = append(inputs[row.file].raw, input.raw[row.n])
+			}
+		}
+		*kind.to = inputs
+	}
+	return person
+}
+
+// runForPerson - imports only the rows of the person, preview - a quiet shadow run (changes are rolled back and their
+// row diffs returned), otherwise the rows are applied as a part of the review session
+func runForPerson(db *sql.DB, dbg, dry, preview bool, inputs inputFiles, person *reviewPerson) (summary *importSummary, reports []string, err error) {
+	opts := runOptions{inputs: person.inputs, session: true}
+	if preview {
+		opts = runOptions{inputs: person.inputs, quiet: true, shadow: true}
+		reports = []string{}
+		gShadowMtx.Lock()
+		gShadowReports = &reports
+		gShadowMtx.Unlock()
+		defer func() {
+			gShadowMtx.Lock()
+			gShadowReports = nil
+			gShadowMtx.Unlock()
+		}()
+	}
+	summary, err = importCSVfiles(db, dbg, dry, inputs, opts)
+	return
+}
+
+// rawTerminal - switches the terminal on stdin to single key input without echo, returns the function restoring it
+func rawTerminal() (restore func(), err error) {
+	stty := func(args ...string) ([]byte, error) {
+		cmd := osexec.Command("stty", args...)
+		cmd.Stdin = os.Stdin
+		return cmd.Output()
+	}
+	var saved []byte
+	saved, err = stty("-g")
+	if err != nil {
+		return
+	}
+	_, err = stty("-icanon", "-echo", "min", "1")
+	if err != nil {
+		return
+	}
+	restore = func() {
+		_, _ = stty(strings.TrimSpace(string(saved)))
+	}
+	return
+}
+
+// readKey - next key pressed (raw terminal) or the first character of the next line (scripted input),
+// 0 at the end of input
+func readKey(reader *bufio.Reader, raw bool) byte {
+	if raw {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0
+		}
+		return b
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil && line == "" {
+		return 0
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return '\n'
+	}
+	return line[0]
+}
+
+// startReviewSession - summary of the whole review session: reported as a single run (import_runs record, run hooks,
+// SUMMARY_OUT, AFFECTED_UUIDS, notification) instead of one run per applied person
+func startReviewSession(db *sql.DB, dbg, dry bool, inputs inputFiles, files []runFile) (session *importSummary, err error) {
+	session = &importSummary{
+		IdentitiesFile:   strings.Join(inputs.identities, ", "),
+		AffiliationsFile: strings.Join(inputs.affiliations, ", "),
+		Dry:              dry,
+		Shadow:           os.Getenv("SHADOW") != "" && !dry,
+		Start:            time.Now(),
+		Database:         gDatabase,
+		Profile:          gProfile,
+	}
+	session.RunID = newRunID(session.Start)
+	session.Files = files
+	err = startRunRecord(db, session)
+	if err != nil {
+		return
+	}
+	err = preRunHook(dbg, session, inputs)
+	if err != nil {
+		finishReviewSession(db, dbg, session, nil, err)
+	}
+	return
+}
+
+// finishReviewSession - reports the review session with the applied people's changed uuids
+func finishReviewSession(db *sql.DB, dbg bool, session *importSummary, uuids map[string]struct{}, err error) {
+	session.finish(err)
+	finishRunRecord(db, session)
+	e := writeSummary(session)
+	if e != nil {
+		fmt.Printf("WARNING: cannot write summary: %v\n", e)
+	}
+	gChangedUUIDs = uuids
+	e = writeAffectedUUIDs(session)
+	if e != nil {
+		fmt.Printf("WARNING: cannot write affected uuids: %v\n", e)
+	}
+	postRunHook(dbg, session)
+	notifyRun(dbg, session)
+}
+
+// reviewChanges - "review" subcommand: curators review identities and affiliations rows person by person, every
+// person's rows are first applied in a shadow run (rolled back), the panel shows the current state, the pending rows
+// and the resulting row diffs, then the rows are applied (a) or skipped (s), q quits leaving the rest unapplied
+func reviewChanges(db *sql.DB, dbg, dry bool, args []string) (err error) {
+	var inputs inputFiles
+	inputs, err = classifyInputFiles(args)
+	if err != nil {
+		return
+	}
+	if len(inputs.organizations) > 0 || len(inputs.profiles) > 0 {
+		err = fmt.Errorf("review works with identities and affiliations files, import organizations and profiles files separately")
+		return
+	}
+	inputs.organizations, inputs.profiles = nil, nil
+	// files are verified, read and their rows selected once, every person is imported from their rows only
+	err = verifySignatures(dbg, inputs.all())
+	if err != nil {
+		return
+	}
+	var files []runFile
+	files, err = inputFileHashes(inputs.all())
+	if err != nil {
+		return
+	}
+	err = setComputedColumns()
+	if err == nil {
+		err = setSample()
+	}
+	if err != nil {
+		return
+	}
+	var loaded *loadedInputs
+	loaded, err = loadInputs(dbg, inputs, files)
+	if err != nil {
+		return
+	}
+	people, left, err := reviewRows(db, loaded)
+	if err != nil {
+		return
+	}
+	if left > 0 {
+		fmt.Printf("WARNING: %d rows without identity_id and uuid cannot be reviewed per person and are left out\n", left)
+	}
+	var session *importSummary
+	session, err = startReviewSession(db, dbg, dry, inputs, files)
+	if err != nil {
+		return
+	}
+	uuids := make(map[string]struct{})
+	defer func() {
+		finishReviewSession(db, dbg, session, uuids, err)
+	}()
+	interactive := isTerminal(os.Stdout)
+	reader := bufio.NewReader(os.Stdin)
+	raw := false
+	if interactive && isTerminal(os.Stdin) {
+		restore, e := rawTerminal()
+		if e == nil {
+			raw = true
+			defer restore()
+		}
+	}
+	applied, skipped, failed := []string{}, []string{}, []string{}
+	reviewed := 0
+	for i, person := range people {
+		if terminating() {
+			err = errTerminated
+			return
+		}
+		summary, reports, e := runForPerson(db, dbg, false, true, inputs, person)
+		var view *personView
+		if person.uuid != "" {
+			view, err = loadPersonView(replica(db), dbg, person.uuid, cReviewAudit)
+			if err != nil {
+				return
+			}
+		}
+		if interactive {
+			fmt.Print("\033[H\033[2J")
+		}
+		fmt.Printf("=== person %d/%d: %s ===\n", i+1, len(people), person.key)
+		if view != nil {
+			fmt.Printf("--- current state ---\n%s", view.text())
+		} else {
+			fmt.Printf("--- current state ---\nidentity not found\n")
+		}
+		fmt.Printf("--- pending rows (%d) ---\n", len(person.rows))
+		for _, row := range person.rows {
+			fmt.Printf("%s\n", row.text)
+		}
+		fmt.Printf("--- changes (shadow run, rolled back) ---\n")
+		if len(reports) == 0 {
+			fmt.Printf("no changes\n")
+		} else {
+			fmt.Printf("%s\n", strings.Join(reports, "\n"))
+		}
+		if e != nil {
+			fmt.Printf("error: %v\n", e)
+		}
+		if summary != nil {
+			if warnings, _ := summary.allWarnings(); len(warnings) > 0 {
+				fmt.Printf("--- warnings ---\n%s\n", strings.Join(warnings, "\n"))
+			}
+		}
+		action := byte(0)
+		prompt := true
+		for action == 0 {
+			if prompt {
+				fmt.Printf("[a]pply, [s]kip, [q]uit: ")
+			}
+			// a raw terminal ignores other keys silently, scripted input asks again
+			prompt = !raw
+			switch key := readKey(reader, raw); key {
+			case 0:
+				// end of input quits
+				action = 'q'
+			case 'a', 's', 'q':
+				action = key
+			case 'A', 'S', 'Q':
+				action = key - 'A' + 'a'
+			}
+		}
+		fmt.Printf("%c\n", action)
+		if action == 'q' {
+			break
+		}
+		reviewed++
+		if action == 's' {
+			skipped = append(skipped, person.key)
+			continue
+		}
+		summary, _, e = runForPerson(db, dbg, dry, false, inputs, person)
+		if summary != nil {
+			session.add(summary)
+			for uuid := range gChangedUUIDs {
+				uuids[uuid] = struct{}{}
+			}
+		}
+		if e != nil {
+			fmt.Printf("error applying rows of %s: %v\n", person.key, e)
+			failed = append(failed, person.key)
+		} else {
+			fmt.Printf("%s", summary.text())
+			applied = append(applied, person.key)
+		}
+		if interactive && i < len(people)-1 {
+			fmt.Printf("press any key to continue")
+			_ = readKey(reader, raw)
+			fmt.Printf("\n")
+		}
+	}
+	fmt.Printf("Reviewed %d/%d people: %d applied, %d skipped, %d failed\n", reviewed, len(people), len(applied), len(skipped), len(failed))
+	if len(skipped) > 0 {
+		fmt.Printf("Skipped: %s\n", strings.Join(skipped, ", "))
+	}
+	if len(failed) > 0 {
+		fmt.Printf("Failed: %s\n", strings.Join(failed, ", "))
+	}
+	return
+}
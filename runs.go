@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+)
+
+// runFile - input file of a run with its checksum
+type runFile struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+}
+
+// fileSHA256 - hex SHA256 of file contents
+func fileSHA256(path string) (sum string, err error) {
+	var f *os.File
+	f, err = os.Open(path)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return
+	}
+	sum = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+// runOperator - RUN_OPERATOR, or the OS user running the import
+func runOperator() string {
+	if operator := os.Getenv("RUN_OPERATOR"); operator != "" {
+		return operator
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// startRunRecord - RUN_HISTORY, records the run in import_runs table (created when missing)
+// dry, shadow and quiet runs are not recorded
+func startRunRecord(db *sql.DB, summary *importSummary) (err error) {
+	if os.Getenv("RUN_HISTORY") == "" || summary.Dry || summary.Shadow || gQuiet {
+		return
+	}
+	_, err = execDB(
+		db,
+		"create table if not exists import_runs(id bigint not null auto_increment primary key, run_id varchar(32) not null, "+
+			"database_name varchar(255), operator varchar(255), files text, start datetime not null, end datetime, "+
+			"identity_rows int, enrollment_rows int, updated_identities int, updated_enrollments int, updated_uidentities int, "+
+			"updated_profiles int, warnings int, collisions int, failed_rows int, status varchar(16) not null, error text, "+
+			"key import_runs_run_id(run_id)) engine=InnoDB default charset=utf8mb4",
+	)
+	if err != nil {
+		err = fmt.Errorf("cannot create import_runs table: %v", err)
+		return
+	}
+	var data []byte
+	data, err = json.Marshal(summary.Files)
+	if err != nil {
+		return
+	}
+	var res sql.Result
+	res, err = execDB(
+		db,
+		"insert into import_runs(run_id, database_name, operator, files, start, status) values(?, ?, ?, ?, ?, ?)",
+		summary.RunID, summary.Database, runOperator(), string(data), summary.Start, "running",
+	)
+	if err != nil {
+		err = fmt.Errorf("cannot record run in import_runs: %v", err)
+		return
+	}
+	summary.historyID, err = res.LastInsertId()
+	return
+}
+
+// finishRunRecord - stores final counts and outcome of the recorded run
+// it doesn't use the statement context, so it is stored even when RUN_TIMEOUT expired
+func finishRunRecord(db *sql.DB, summary *importSummary) {
+	if summary.historyID == 0 {
+		return
+	}
+	_, err := db.Exec(
+		"update import_runs set end = ?, identity_rows = ?, enrollment_rows = ?, updated_identities = ?, updated_enrollments = ?, "+
+			"updated_uidentities = ?, updated_profiles = ?, warnings = ?, collisions = ?, failed_rows = ?, status = ?, error = ? where id = ?",
+		summary.End, summary.IdentityRows, summary.EnrollmentRows, summary.UpdatedIdentities, summary.UpdatedEnrollments,
+		summary.UpdatedUIdentities, summary.UpdatedProfiles, summary.Warnings, summary.Collisions, summary.FailedRows,
+		summary.Status(), summary.Error, summary.historyID,
+	)
+	if err != nil {
+		fmt.Printf("WARNING: cannot update run %s in import_runs: %v\n", summary.RunID, err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// gLimit - process at most that many data rows of each file, 0 means all
+	gLimit int
+	// gSample - percentage of data rows of each file to process, 0 means all
+	gSample float64
+	// gSeed - seed of the sample selection
+	gSeed int64
+	// gStartRow, gEndRow - range of data rows (1-based, inclusive) of each file to process, 0 means no limit
+	gStartRow int
+	gEndRow   int
+	// gSelectedIDs - when not nil only rows with these identity_ids are processed
+	gSelectedIDs map[string]struct{}
+)
+
+// loadSelectedIDs - identity_ids from IDS_FILE, one per line (first CSV column), blank lines and # comments are ignored
+func loadSelectedIDs(fileName string) (err error) {
+	var f *os.File
+	f, err = os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	gSelectedIDs = make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		id := strings.TrimSpace(strings.SplitN(scanner.Text(), ",", 2)[0])
+		if id == "" || strings.HasPrefix(id, "#") || id == "identity_id" {
+			continue
+		}
+		gSelectedIDs[id] = struct{}{}
+	}
+	err = scanner.Err()
+	if err == nil {
+		fmt.Printf("Only processing rows of %d identity_ids from %s\n", len(gSelectedIDs), fileName)
+	}
+	return
+}
+
+// setSample - LIMIT=N, SAMPLE=P (or P%), SEED=S for trials on a subset of rows
+// START_ROW, END_ROW, IDS_FILE for partial reruns
+func setSample() (err error) {
+	gLimit, gSample, gSeed, gStartRow, gEndRow, gSelectedIDs = 0, 0, 0, 0, 0, nil
+	for env, value := range map[string]*int{"START_ROW": &gStartRow, "END_ROW": &gEndRow} {
+		if s := os.Getenv(env); s != "" {
+			*value, err = strconv.Atoi(s)
+			if err != nil || *value < 1 {
+				err = fmt.Errorf("invalid %s=%s, expected a data row number (first data row is 1)", env, s)
+				return
+			}
+		}
+	}
+	if gEndRow > 0 && gStartRow > gEndRow {
+		err = fmt.Errorf("START_ROW=%d is after END_ROW=%d", gStartRow, gEndRow)
+		return
+	}
+	if s := os.Getenv("IDS_FILE"); s != "" {
+		err = loadSelectedIDs(s)
+		if err != nil {
+			return
+		}
+	}
+	if s := os.Getenv("LIMIT"); s != "" {
+		gLimit, err = strconv.Atoi(s)
+		if err != nil || gLimit < 1 {
+			err = fmt.Errorf("invalid LIMIT=%s, expected a positive number", s)
+			return
+		}
+	}
+	if s := os.Getenv("SAMPLE"); s != "" {
+		gSample, err = strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || gSample <= 0 || gSample > 100 {
+			err = fmt.Errorf("invalid SAMPLE=%s, expected percentage in (0, 100]", s)
+			return
+		}
+	}
+	if s := os.Getenv("SEED"); s != "" {
+		gSeed, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			err = fmt.Errorf("invalid SEED=%s", s)
+			return
+		}
+	} else if gSample > 0 {
+		gSeed = time.Now().UnixNano()
+	}
+	return
+}
+
+// selectLines - header and the selected data rows: rows between START_ROW and END_ROW with identity_id from IDS_FILE
+// (files without identity_id column are not filtered by it), of them each row is selected with SAMPLE probability (the same SEED selects the same rows),
+// then only the first LIMIT selected rows are kept, raw records of the selected rows are returned too
+func selectLines(name string, lines [][]string, raw []rawRecord) ([][]string, []rawRecord) {
+	if len(lines) < 2 {
+		return lines, raw
+	}
+	// IDS_FILE only filters files with identity_id column, others (organizations, profiles files) are kept whole
+	selectedIDs := gSelectedIDs
+	idx := columnIndex(lines[0], "identity_id")
+	if idx < 0 {
+		selectedIDs = nil
+	}
+	if gLimit == 0 && gSample == 0 && gStartRow == 0 && gEndRow == 0 && selectedIDs == nil {
+		return lines, raw
+	}
+	rnd := rand.New(rand.NewSource(gSeed))
+	selected := [][]string{lines[0]}
+	var selectedRaw []rawRecord
+	if raw != nil {
+		selectedRaw = []rawRecord{raw[0]}
+	}
+	for n, line := range lines {
+		if n == 0 || n < gStartRow {
+			continue
+		}
+		if (gEndRow > 0 && n > gEndRow) || (gLimit > 0 && len(selected) == gLimit+1) {
+			break
+		}
+		if selectedIDs != nil {
+			if idx >= len(line) {
+				continue
+			}
+			if _, ok := selectedIDs[strings.TrimSpace(line[idx])]; !ok {
+				continue
+			}
+		}
+		if gSample > 0 && rnd.Float64()*100 >= gSample {
+			continue
+		}
+		selected = append(selected, line)
+		if raw != nil {
+			selectedRaw = append(selectedRaw, raw[n])
+		}
+	}
+	fmt.Printf("%s: processing %d/%d rows", name, len(selected)-1, len(lines)-1)
+	if gStartRow > 0 || gEndRow > 0 {
+		fmt.Printf(" START_ROW=%d END_ROW=%d", gStartRow, gEndRow)
+	}
+	if gSample > 0 {
+		fmt.Printf(" SAMPLE=%g%% SEED=%d", gSample, gSeed)
+	}
+	if gLimit > 0 {
+		fmt.Printf(" LIMIT=%d", gLimit)
+	}
+	fmt.Printf("\n")
+	return selected, selectedRaw
+}
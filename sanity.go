@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// cDefaultOrgSimilarity - organization names at least this similar are the same organization
+	cDefaultOrgSimilarity = 0.8
+	// cDefaultDateHorizonDays - explicit enrollment dates later than this many days from now are suspicious
+	cDefaultDateHorizonDays = 366
+	// cDefaultMaxDecades - enrollments with both dates given that are longer than this are suspicious
+	cDefaultMaxDecades = 5
+)
+
+var (
+	// gOrgSanity - ORG_SANITY: "" (off), "warn" or "skip"
+	gOrgSanity string
+	// gOrgSanityDB - expected organizations are also looked up in domains_organizations
+	gOrgSanityDB bool
+	// gOrgSimilarity - ORG_SANITY_SIMILARITY
+	gOrgSimilarity float64
+	// gExpectedOrgs - email domain -> expected organizations, from ORG_DOMAINS_FILE
+	gExpectedOrgs map[string][]string
+	// gDateSanity - DATE_SANITY: "" (off), "warn" or "reject"
+	gDateSanity string
+	// gDateMin - explicit enrollment dates before DATE_SANITY_MIN (default 1970-01-01) are suspicious
+	gDateMin time.Time
+	// gDateHorizon - DATE_SANITY_HORIZON_DAYS
+	gDateHorizon int
+	// gDateMaxDecades - DATE_SANITY_MAX_DECADES
+	gDateMaxDecades int
+)
+
+// setOrgSanity - ORG_SANITY=warn|skip flags enrollments assigning a person to an organization that doesn't match
+// the organizations expected for their email domains, flagged rows are reported (warn) or skipped (skip)
+// ORG_DOMAINS_FILE - lines "domain,organization name" (a domain can have more organizations, # comments)
+// domains_organizations is used for domains not in the file, unless ORG_SANITY_NO_DB is set
+// ORG_SANITY_SIMILARITY - names at least this similar (0-1, default 0.8) are the same organization
+func setOrgSanity() (err error) {
+	gOrgSanity = strings.ToLower(strings.TrimSpace(os.Getenv("ORG_SANITY")))
+	gExpectedOrgs = nil
+	switch gOrgSanity {
+	case "":
+		return
+	case "warn", "skip":
+	default:
+		err = fmt.Errorf("invalid ORG_SANITY=%s, allowed: warn, skip", gOrgSanity)
+		return
+	}
+	gOrgSanityDB = os.Getenv("ORG_SANITY_NO_DB") == ""
+	gOrgSimilarity = cDefaultOrgSimilarity
+	if s := os.Getenv("ORG_SANITY_SIMILARITY"); s != "" {
+		gOrgSimilarity, err = strconv.ParseFloat(s, 64)
+		if err != nil || gOrgSimilarity < 0 || gOrgSimilarity > 1 {
+			err = fmt.Errorf("invalid ORG_SANITY_SIMILARITY=%s, expected 0-1", s)
+			return
+		}
+	}
+	gExpectedOrgs = make(map[string][]string)
+	fileName := os.Getenv("ORG_DOMAINS_FILE")
+	if fileName == "" {
+		return
+	}
+	var f *os.File
+	f, err = os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ary := strings.SplitN(line, ",", 2)
+		if len(ary) != 2 || strings.TrimSpace(ary[0]) == "" || strings.TrimSpace(ary[1]) == "" {
+			err = fmt.Errorf("%s:%d: expected domain,organization name, got '%s'", fileName, n, line)
+			return
+		}
+		domain := strings.ToLower(strings.TrimSpace(ary[0]))
+		gExpectedOrgs[domain] = append(gExpectedOrgs[domain], strings.TrimSpace(ary[1]))
+	}
+	err = scanner.Err()
+	if err == nil {
+		fmt.Printf("Loaded expected organizations of %d domains from %s\n", len(gExpectedOrgs), fileName)
+	}
+	return
+}
+
+// expectedOrgs - organizations expected for the email domain (or its parent domains in the file), none when unknown
+func expectedOrgs(db *sql.DB, dbg bool, domain string) (orgs []string, err error) {
+	for candidate := domain; candidate != ""; {
+		if orgs = gExpectedOrgs[candidate]; len(orgs) > 0 {
+			return
+		}
+		i := strings.Index(candidate, ".")
+		if i < 0 {
+			break
+		}
+		candidate = candidate[i+1:]
+		if !strings.Contains(candidate, ".") {
+			break
+		}
+	}
+	if !gOrgSanityDB {
+		return
+	}
+	var orgName string
+	orgName, err = domainToOrgName(db, dbg, domain)
+	if err == nil && orgName != "" {
+		orgs = []string{orgName}
+	}
+	return
+}
+
+// sameOrg - names of the same organization: equal after resolving aliases, one contains the other as a word
+// sequence ("IBM" and "IBM Research") or similar (Levenshtein)
+func sameOrg(a, b string) bool {
+	if canonical, err := resolveOrgAlias(a); err == nil {
+		a = canonical
+	}
+	if canonical, err := resolveOrgAlias(b); err == nil {
+		b = canonical
+	}
+	a, b = orgWords(a), orgWords(b)
+	if a == b {
+		return true
+	}
+	if strings.HasPrefix(b+" ", a+" ") || strings.HasPrefix(a+" ", b+" ") {
+		return true
+	}
+	return similarity(a, b) >= gOrgSimilarity
+}
+
+// orgWords - lower case organization name words without punctuation: "Red Hat, Inc." -> "red hat inc"
+func orgWords(name string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// checkAffiliationSanity - flags a current (not yet ended) enrollment in orgName of a person whose email domains
+// expect other organizations, for example @ibm.com assigned to Google
+func checkAffiliationSanity(db *sql.DB, dbg bool, id, uuid, orgName string, end time.Time, row map[string]string) (err error) {
+	if gOrgSanity == "" || !end.After(time.Now()) {
+		return
+	}
+	var identities []personIdentity
+	identities, err = personIdentities(replica(db), uuid)
+	if err != nil {
+		err = fmt.Errorf("identity_id %s/%s identities lookup: %v in %v", id, uuid, err, row)
+		return
+	}
+	expected, domains := []string{}, []string{}
+	seen := make(map[string]struct{})
+	for _, identity := range identities {
+		ary := strings.Split(strings.ToLower(identity.email), "@")
+		if len(ary) != 2 {
+			continue
+		}
+		domain := ary[1]
+		if _, ok := seen[domain]; ok {
+			continue
+		}
+		seen[domain] = struct{}{}
+		var orgs []string
+		orgs, err = expectedOrgs(db, dbg, domain)
+		if err != nil {
+			err = fmt.Errorf("identity_id %s/%s domain %s organization lookup: %v in %v", id, uuid, domain, err, row)
+			return
+		}
+		for _, org := range orgs {
+			if sameOrg(org, orgName) {
+				return
+			}
+		}
+		if len(orgs) > 0 {
+			expected = append(expected, orgs...)
+			domains = append(domains, domain)
+		}
+	}
+	if len(expected) == 0 {
+		return
+	}
+	msg := fmt.Sprintf("suspicious affiliation: identity_id %s/%s with email domains %s enrolled in %s, expected %s", id, uuid, strings.Join(domains, ", "), orgName, strings.Join(expected, ", "))
+	gSummaryMtx.Lock()
+	if gSummary != nil {
+		gSummary.SuspiciousAffiliations = append(gSummary.SuspiciousAffiliations, anonymize(msg))
+	}
+	gSummaryMtx.Unlock()
+	if gOrgSanity == "skip" {
+		err = skipf(cWarnSuspicious, "%s, row not applied (row %v)\n", msg, row)
+		return
+	}
+	warnf(cWarnSuspicious, "%s (row %v)\n", msg, row)
+	return
+}
+
+// setDateSanity - DATE_SANITY=warn|reject flags new enrollment dates that usually come from spreadsheet date format
+// corruption: dates before DATE_SANITY_MIN (default 1970-01-01), dates more than DATE_SANITY_HORIZON_DAYS (default 366)
+// in the future, ranges shorter than a day and ranges longer than DATE_SANITY_MAX_DECADES (default 5) decades
+// open dates (empty, "present", ...) are SortingHat sentinels and are never flagged
+func setDateSanity() (err error) {
+	gDateSanity = strings.ToLower(strings.TrimSpace(os.Getenv("DATE_SANITY")))
+	switch gDateSanity {
+	case "":
+		return
+	case "warn", "reject":
+	default:
+		err = fmt.Errorf("invalid DATE_SANITY=%s, allowed: warn, reject", gDateSanity)
+		return
+	}
+	gDateMin = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	if s := os.Getenv("DATE_SANITY_MIN"); s != "" {
+		gDateMin, err = timeParseAny(s)
+		if err != nil {
+			err = fmt.Errorf("invalid DATE_SANITY_MIN=%s: %v", s, err)
+			return
+		}
+	}
+	for _, setting := range []struct {
+		name  string
+		def   int
+		value *int
+	}{
+		{name: "DATE_SANITY_HORIZON_DAYS", def: cDefaultDateHorizonDays, value: &gDateHorizon},
+		{name: "DATE_SANITY_MAX_DECADES", def: cDefaultMaxDecades, value: &gDateMaxDecades},
+	} {
+		*setting.value = setting.def
+		s := os.Getenv(setting.name)
+		if s == "" {
+			continue
+		}
+		*setting.value, err = strconv.Atoi(s)
+		if err != nil || *setting.value < 1 {
+			err = fmt.Errorf("invalid %s=%s, expected a positive integer", setting.name, s)
+			return
+		}
+	}
+	return
+}
+
+// checkDateSanity - flags the new enrollment range of the row, openStart/openEnd - the date was not given
+func checkDateSanity(id, uuid string, start, end time.Time, openStart, openEnd bool, row map[string]string) (err error) {
+	if gDateSanity == "" {
+		return
+	}
+	problems := []string{}
+	horizon := time.Now().AddDate(0, 0, gDateHorizon)
+	for _, date := range []struct {
+		name string
+		dt   time.Time
+		open bool
+	}{
+		{name: "to_start_date", dt: start, open: openStart},
+		{name: "to_end_date", dt: end, open: openEnd},
+	} {
+		switch {
+		case date.open:
+		case date.dt.Before(gDateMin):
+			problems = append(problems, fmt.Sprintf("%s %s is before %s", date.name, toYMDDate(date.dt), toYMDDate(gDateMin)))
+		case date.dt.After(horizon):
+			problems = append(problems, fmt.Sprintf("%s %s is more than %d days in the future", date.name, toYMDDate(date.dt), gDateHorizon))
+		}
+	}
+	if !openStart && !openEnd {
+		if end.Sub(start) < 24*time.Hour {
+			problems = append(problems, fmt.Sprintf("range %s - %s is shorter than a day", toYMDDate(start), toYMDDate(end)))
+		}
+		if end.After(start.AddDate(10*gDateMaxDecades, 0, 0)) {
+			problems = append(problems, fmt.Sprintf("range %s - %s is longer than %d decades", toYMDDate(start), toYMDDate(end), gDateMaxDecades))
+		}
+	}
+	if len(problems) == 0 {
+		return
+	}
+	msg := fmt.Sprintf("suspicious enrollment dates: identity_id %s/%s %s", id, uuid, strings.Join(problems, ", "))
+	gSummaryMtx.Lock()
+	if gSummary != nil {
+		gSummary.SuspiciousAffiliations = append(gSummary.SuspiciousAffiliations, anonymize(msg))
+	}
+	gSummaryMtx.Unlock()
+	if gDateSanity == "reject" {
+		err = fmt.Errorf("%s, rejected (DATE_SANITY=reject) in %v", msg, row)
+		return
+	}
+	warnf(cWarnSuspicious, "%s (row %v)\n", msg, row)
+	return
+}
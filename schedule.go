@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// gCronFields - minute, hour, day of month, month, day of week ranges
+	gCronFields = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	// gCronNames - month and day of week names
+	gCronNames = [5]map[string]int{
+		nil, nil, nil,
+		{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12},
+		{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6},
+	}
+	// gCronMacros - predefined schedules
+	gCronMacros = map[string]string{
+		"@yearly": "0 0 1 1 *", "@annually": "0 0 1 1 *", "@monthly": "0 0 1 * *", "@weekly": "0 0 * * 0",
+		"@daily": "0 0 * * *", "@midnight": "0 0 * * *", "@hourly": "0 * * * *",
+	}
+)
+
+// cronSchedule - parsed 5 field cron expression
+type cronSchedule struct {
+	fields [5]map[int]struct{}
+	// domAny, dowAny - day of month or day of week is "*", when both are restricted either can match
+	domAny bool
+	dowAny bool
+}
+
+// cronValue - number or name of field i
+func cronValue(i int, s string) (int, error) {
+	if v, ok := gCronNames[i][strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < gCronFields[i][0] || v > gCronFields[i][1] {
+		return 0, fmt.Errorf("invalid value '%s', allowed %d-%d", s, gCronFields[i][0], gCronFields[i][1])
+	}
+	return v, nil
+}
+
+// parseCron - "minute hour day-of-month month day-of-week" with *, lists, ranges, steps and names, or a @macro
+func parseCron(expr string) (schedule *cronSchedule, err error) {
+	expr = strings.TrimSpace(expr)
+	if macro, ok := gCronMacros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != 5 {
+		err = fmt.Errorf("invalid cron expression '%s', expected 5 fields: minute hour day-of-month month day-of-week", expr)
+		return
+	}
+	schedule = &cronSchedule{domAny: parts[2] == "*", dowAny: parts[4] == "*"}
+	for i, part := range parts {
+		schedule.fields[i] = make(map[int]struct{})
+		for _, item := range strings.Split(part, ",") {
+			rng, step := item, 1
+			if ary := strings.SplitN(item, "/", 2); len(ary) == 2 {
+				rng = ary[0]
+				step, err = strconv.Atoi(ary[1])
+				if err != nil || step < 1 {
+					err = fmt.Errorf("invalid cron step in '%s'", item)
+					return
+				}
+			}
+			from, to := gCronFields[i][0], gCronFields[i][1]
+			if rng != "*" {
+				ary := strings.SplitN(rng, "-", 2)
+				from, err = cronValue(i, ary[0])
+				if err == nil {
+					to = from
+					if len(ary) == 2 {
+						to, err = cronValue(i, ary[1])
+					} else if step > 1 {
+						to = gCronFields[i][1]
+					}
+				}
+				if err == nil && from > to {
+					err = fmt.Errorf("invalid cron range '%s'", rng)
+				}
+				if err != nil {
+					err = fmt.Errorf("cron expression '%s': %v", expr, err)
+					return
+				}
+			}
+			for v := from; v <= to; v += step {
+				schedule.fields[i][v] = struct{}{}
+			}
+		}
+	}
+	// Sunday is both 0 and 7
+	if schedule.has(4, 7) {
+		delete(schedule.fields[4], 7)
+		schedule.fields[4][0] = struct{}{}
+	}
+	return
+}
+
+// has - field i contains value v
+func (c *cronSchedule) has(i, v int) bool {
+	_, ok := c.fields[i][v]
+	return ok
+}
+
+// dayMatches - day of month and day of week rules (either matches when both are restricted)
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom, dow := c.has(2, t.Day()), c.has(4, int(t.Weekday()))
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next - first matching minute after t, zero time when nothing matches within 5 years
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !c.has(3, int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !c.has(1, t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !c.has(0, t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// runSchedule - SCHEDULE="0 3 * * *" runs the import of args (files, patterns or a directory, discovered again on
+// every run) on the cron schedule as a long-lived service, SCHEDULE_TZ (default UTC) is the schedule timezone
+// a run that is due while the previous one is still running is skipped, failed or panicking runs don't stop the service
+func runSchedule(dbs []*shDatabase, dbg, dry bool, expr string, args []string) (err error) {
+	var schedule *cronSchedule
+	schedule, err = parseCron(expr)
+	if err != nil {
+		return
+	}
+	loc := time.UTC
+	if tz := os.Getenv("SCHEDULE_TZ"); tz != "" {
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			return
+		}
+	}
+	var (
+		mtx     sync.Mutex
+		running bool
+		n       int
+	)
+	for {
+		next := schedule.next(time.Now().In(loc))
+		if next.IsZero() {
+			err = fmt.Errorf("cron expression '%s' never matches", expr)
+			return
+		}
+		fmt.Printf("Next scheduled run at %s\n", next.Format(time.RFC3339))
+		time.Sleep(time.Until(next))
+		mtx.Lock()
+		if running {
+			mtx.Unlock()
+			fmt.Printf("WARNING: scheduled run at %s skipped, the previous run is still running\n", next.Format(time.RFC3339))
+			continue
+		}
+		running = true
+		n++
+		mtx.Unlock()
+		go func(n int) {
+			start := time.Now()
+			fmt.Printf("Scheduled run #%d started\n", n)
+			e := scheduledRun(dbs, dbg, dry, n, args)
+			if e != nil {
+				fmt.Printf("Scheduled run #%d failed after %v: %v\n", n, time.Since(start), e)
+			} else {
+				fmt.Printf("Scheduled run #%d succeeded in %v\n", n, time.Since(start))
+			}
+			mtx.Lock()
+			running = false
+			mtx.Unlock()
+		}(n)
+	}
+}
+
+// scheduledRun - imports args, a panic of the run is logged with its stack and returned as the run's error
+// (the run's import_runs record is finished as failed by the import), so the schedule goes on
+func scheduledRun(dbs []*shDatabase, dbg, dry bool, n int, args []string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("Scheduled run #%d panicked: %v\n%s\n", n, r, string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	err = importArgs(dbs, dbg, dry, args)
+	return
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		dt, err := time.Parse("2006-01-02 15:04:05", s)
+		if err != nil {
+			t.Fatalf("invalid test time %s: %v", s, err)
+		}
+		return dt
+	}
+	var testCases = []struct {
+		expr     string
+		from     string
+		expected string
+	}{
+		// 2026-10-15 is a Thursday
+		{expr: "0 3 * * *", from: "2026-10-15 02:59:59", expected: "2026-10-15 03:00:00"},
+		{expr: "0 3 * * *", from: "2026-10-15 03:00:00", expected: "2026-10-16 03:00:00"},
+		{expr: "@hourly", from: "2026-10-15 10:59:30", expected: "2026-10-15 11:00:00"},
+		{expr: "*/15 * * * *", from: "2026-10-15 10:16:00", expected: "2026-10-15 10:30:00"},
+		{expr: "5,35 8-9 * * *", from: "2026-10-15 09:36:00", expected: "2026-10-16 08:05:00"},
+		// only day of month or only day of week restricted: it must match
+		{expr: "0 0 13 * *", from: "2026-10-15 12:00:00", expected: "2026-11-13 00:00:00"},
+		{expr: "0 0 * * 5", from: "2026-10-15 12:00:00", expected: "2026-10-16 00:00:00"},
+		{expr: "0 0 * * fri", from: "2026-10-16 00:00:00", expected: "2026-10-23 00:00:00"},
+		{expr: "0 12 * * 7", from: "2026-10-15 12:00:00", expected: "2026-10-18 12:00:00"},
+		{expr: "0 12 * * sun", from: "2026-10-15 12:00:00", expected: "2026-10-18 12:00:00"},
+		{expr: "0 0 1-7 * *", from: "2026-10-15 00:00:00", expected: "2026-11-01 00:00:00"},
+		// both restricted: either matches
+		{expr: "0 0 13 * 5", from: "2026-10-15 12:00:00", expected: "2026-10-16 00:00:00"},
+		{expr: "0 0 13 * 5", from: "2026-11-07 00:00:00", expected: "2026-11-13 00:00:00"},
+		{expr: "0 0 1-7 * mon", from: "2026-10-15 00:00:00", expected: "2026-10-19 00:00:00"},
+		{expr: "*/15 9-17 * * 1-5", from: "2026-10-16 17:50:00", expected: "2026-10-19 09:00:00"},
+		// month and year rollover
+		{expr: "30 23 31 * *", from: "2026-04-01 00:00:00", expected: "2026-05-31 23:30:00"},
+		{expr: "0 0 1 * *", from: "2026-01-31 23:59:00", expected: "2026-02-01 00:00:00"},
+		{expr: "@yearly", from: "2026-12-31 12:00:00", expected: "2027-01-01 00:00:00"},
+		{expr: "0 0 29 2 *", from: "2026-03-01 00:00:00", expected: "2028-02-29 00:00:00"},
+		{expr: "0 0 * jan,jul *", from: "2026-02-10 00:00:00", expected: "2026-07-01 00:00:00"},
+		{expr: "0 0 * 11-12/2 *", from: "2026-10-15 00:00:00", expected: "2026-11-01 00:00:00"},
+	}
+	for index, test := range testCases {
+		schedule, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("test number %d, parsing %s failed: %v", index+1, test.expr, err)
+			continue
+		}
+		got := schedule.next(at(test.from))
+		if !got.Equal(at(test.expected)) {
+			t.Errorf("test number %d, %s after %s: expected %s, got %s", index+1, test.expr, test.from, test.expected, got)
+		}
+	}
+}
+
+func TestCronNextNever(t *testing.T) {
+	schedule, err := parseCron("0 0 30 2 *")
+	if err != nil {
+		t.Fatalf("parsing failed: %v", err)
+	}
+	if got := schedule.next(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)); !got.IsZero() {
+		t.Errorf("expected zero time for February 30, got %s", got)
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	var testCases = []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"* * * foo *",
+		"@never",
+	}
+	for index, test := range testCases {
+		_, err := parseCron(test)
+		if err == nil {
+			t.Errorf("test number %d, expected an error for '%s'", index+1, test)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+var (
+	// gAuditColumns - columns recording who and when changed rows, with their expected data types
+	// SortingHat versions differ: older schemas have no locked_by, some have no last_modified_by
+	gAuditColumns = map[string][]string{
+		"last_modified":    {"datetime", "timestamp"},
+		"last_modified_by": {"varchar", "char", "tinytext", "text"},
+		"locked_by":        {"varchar", "char", "tinytext", "text"},
+	}
+	// gAuditTables - tables the import writes audit columns to
+	gAuditTables = []string{"enrollments", "identities", "profiles", "uidentities"}
+	// gOmittedColumns - table -> audit columns missing in the target database and left out of queries (SCHEMA_COMPAT)
+	gOmittedColumns map[string]map[string]struct{}
+	// gLFColumns - columns only the LF/CNCF fork of SortingHat has
+	gLFColumns = []string{"last_modified_by", "locked_by"}
+	// gSchemaColumns - table -> column -> data type of the target database, introspected by checkSchema
+	gSchemaColumns map[string]map[string]string
+)
+
+// vanillaFlavor - FLAVOR: "lf" (default) - LF/CNCF SortingHat fork, "vanilla" - upstream SortingHat without
+// last_modified_by and locked_by columns, they are never written or required; SCHEMA=django defaults to "vanilla"
+func vanillaFlavor() (vanilla bool, err error) {
+	switch os.Getenv("FLAVOR") {
+	case "":
+		vanilla = gDjango
+	case "lf":
+	case "vanilla":
+		vanilla = true
+	default:
+		err = fmt.Errorf("invalid FLAVOR=%s, allowed: lf, vanilla", os.Getenv("FLAVOR"))
+	}
+	return
+}
+
+// isLFColumn - if column only exists in the LF/CNCF SortingHat fork
+func isLFColumn(column string) bool {
+	for _, c := range gLFColumns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+// omitColumn - leaves audit column out of queries
+func omitColumn(table, column string) {
+	if _, ok := gOmittedColumns[table]; !ok {
+		gOmittedColumns[table] = make(map[string]struct{})
+	}
+	gOmittedColumns[table][column] = struct{}{}
+}
+
+// checkSchema - introspects tables the import writes to, warns about audit columns of unexpected types
+// and fails when last_modified_by or locked_by is missing, unless SCHEMA_COMPAT is set - then they are omitted from queries
+// FLAVOR=vanilla omits them without checking
+func checkSchema(db *sql.DB) (err error) {
+	gOmittedColumns = make(map[string]map[string]struct{})
+	compat := os.Getenv("SCHEMA_COMPAT") != ""
+	var vanilla bool
+	vanilla, err = vanillaFlavor()
+	if err != nil {
+		return
+	}
+	if vanilla {
+		for _, table := range gAuditTables {
+			for _, column := range gLFColumns {
+				omitColumn(table, column)
+			}
+		}
+	}
+	var columns map[string]map[string]string
+	columns, err = tableColumns(db)
+	if err != nil {
+		err = fmt.Errorf("cannot introspect schema: %v", err)
+		return
+	}
+	gSchemaColumns = columns
+	missing := []string{}
+	for _, table := range gAuditTables {
+		existing, ok := columns[schemaTable(table)]
+		if !ok {
+			err = fmt.Errorf("table %s is missing", schemaTable(table))
+			return
+		}
+		names := []string{}
+		for column := range gAuditColumns {
+			names = append(names, column)
+		}
+		sort.Strings(names)
+		for _, column := range names {
+			if !hasAuditColumn(table, column) {
+				continue
+			}
+			dataType, ok := existing[column]
+			if !ok {
+				if column == "last_modified" || !compat {
+					missing = append(missing, schemaTable(table)+"."+column)
+					continue
+				}
+				warnf(cWarnNotFound, "%s.%s is missing, it will not be set\n", schemaTable(table), column)
+				omitColumn(table, column)
+				continue
+			}
+			expected := false
+			for _, t := range gAuditColumns[column] {
+				if dataType == t {
+					expected = true
+					break
+				}
+			}
+			if !expected {
+				warnf(cWarnValidation, "%s.%s has unexpected type %s, expected one of: %s\n", schemaTable(table), column, dataType, strings.Join(gAuditColumns[column], ", "))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		err = fmt.Errorf("missing columns: %s (set SCHEMA_COMPAT to omit last_modified_by and locked_by)", strings.Join(missing, ", "))
+	}
+	return
+}
+
+// hasAuditColumn - if the audit column exists in the target database (it is not omitted)
+func hasAuditColumn(table, column string) bool {
+	_, omitted := gOmittedColumns[table][column]
+	return !omitted
+}
+
+// auditSet - "last_modified = now(), last_modified_by = ?, locked_by = ?" without omitted columns
+func auditSet(table string) string {
+	set := "last_modified = now()"
+	for _, column := range gLFColumns {
+		if hasAuditColumn(table, column) {
+			set += ", " + column + " = ?"
+		}
+	}
+	return set
+}
+
+// auditArgs - arguments of auditSet and auditInsert placeholders
+func auditArgs(table, who string) (args []interface{}) {
+	if hasAuditColumn(table, "last_modified_by") {
+		args = append(args, who)
+	}
+	if hasAuditColumn(table, "locked_by") {
+		args = append(args, "individual")
+	}
+	return
+}
+
+// auditInsert - ", last_modified_by, locked_by" columns and ", ?, ?" placeholders of an insert without omitted columns
+func auditInsert(table string) (columns, values string) {
+	for _, column := range gLFColumns {
+		if hasAuditColumn(table, column) {
+			columns += ", " + column
+			values += ", ?"
+		}
+	}
+	return
+}
+
+// auditColumn - audit column expression for selects, empty string when the column is omitted
+func auditColumn(table, column string) string {
+	if hasAuditColumn(table, column) {
+		return "coalesce(" + column + ", '')"
+	}
+	return "''"
+}
+
+// hasSchemaColumn - if the table has an optional column in the target database
+func hasSchemaColumn(table, column string) bool {
+	_, ok := gSchemaColumns[schemaTable(table)][column]
+	return ok
+}
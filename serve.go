@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverRun - import run requested via HTTP API
+type serverRun struct {
+	ID           int            `json:"id"`
+	Identities   string         `json:"identities"`
+	Affiliations string         `json:"affiliations"`
+	Dry          bool           `json:"dry"`
+	Status       string         `json:"status"`
+	Queued       time.Time      `json:"queued"`
+	Summary      *importSummary `json:"summary,omitempty"`
+}
+
+const (
+	// cServeMaxForm - maximal size of a non-upload request body
+	cServeMaxForm = 1 << 20
+)
+
+var (
+	// gUploadedIdentitiesRE, gUploadedAffiliationsRE - unique names generated for uploads without a valid file name
+	gUploadedIdentitiesRE   = regexp.MustCompile(`^user_identities_\d{12}_\d+\.csv$`)
+	gUploadedAffiliationsRE = regexp.MustCompile(`^user_affiliations_\d{12}_\d+\.csv$`)
+)
+
+// importServer - serves HTTP API, imports are executed one at a time in order of requests
+type importServer struct {
+	dbs       []*shDatabase
+	dbg       bool
+	dir       string
+	token     string
+	maxUpload int64
+	mtx       *sync.Mutex
+	runs      map[int]*serverRun
+	last      int
+	queue     chan *serverRun
+}
+
+// isLoopbackAddr - listen address only accepts connections from this host (localhost:port or a loopback IP)
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func jsonResponse(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func errorResponse(w http.ResponseWriter, status int, err error) {
+	fmt.Printf("HTTP %d: %v\n", status, err)
+	jsonResponse(w, status, map[string]string{"error": err.Error()})
+}
+
+// upload - POST /upload/identities or /upload/affiliations
+// Body is either raw CSV or multipart form with "file" field
+// Uploaded file name is used when it matches user_{identities,affiliations}_YYYYMMDDHHMI.csv (409 when such file
+// was already uploaded), otherwise a unique user_{identities,affiliations}_YYYYMMDDHHMI_*.csv name is generated
+func (s *importServer) upload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		errorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxUpload)
+	kind := strings.TrimPrefix(r.URL.Path, "/upload/")
+	re := gIdentitiesFileRE
+	switch kind {
+	case "identities":
+	case "affiliations":
+		re = gAffiliationsFileRE
+	default:
+		errorResponse(w, http.StatusNotFound, fmt.Errorf("unknown upload type '%s'", kind))
+		return
+	}
+	var (
+		body io.Reader
+		name string
+	)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, hdr, err := r.FormFile("file")
+		if err != nil {
+			errorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+		defer func() {
+			_ = file.Close()
+		}()
+		body = file
+		name = filepath.Base(hdr.Filename)
+	} else {
+		body = r.Body
+		name = r.URL.Query().Get("name")
+	}
+	var (
+		f   *os.File
+		err error
+	)
+	if re.MatchString(name) {
+		f, err = os.OpenFile(filepath.Join(s.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			errorResponse(w, http.StatusConflict, fmt.Errorf("file '%s' was already uploaded", name))
+			return
+		}
+	} else {
+		f, err = ioutil.TempFile(s.dir, "user_"+kind+"_"+time.Now().Format("200601021504")+"_*.csv")
+	}
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	path := f.Name()
+	name = filepath.Base(path)
+	n, err := io.Copy(f, body)
+	e := f.Close()
+	if err == nil {
+		err = e
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		errorResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	fmt.Printf("Uploaded %s (%d bytes)\n", path, n)
+	jsonResponse(w, http.StatusCreated, map[string]interface{}{"file": name, "bytes": n})
+}
+
+// uploadedFile - checks that name is an uploaded identities or affiliations file: a plain file name matching the
+// kind's pattern (given or generated by upload) of a regular file in the upload directory
+func (s *importServer) uploadedFile(kind, name string, res ...*regexp.Regexp) error {
+	matched := false
+	for _, re := range res {
+		if re.MatchString(name) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return fmt.Errorf("%s file '%s' is not a valid uploaded file name", kind, name)
+	}
+	info, err := os.Lstat(filepath.Join(s.dir, name))
+	if err != nil {
+		return fmt.Errorf("file '%s' was not uploaded: %v", name, err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("file '%s' is not a regular file", name)
+	}
+	return nil
+}
+
+// createRun - POST /runs?identities=file&affiliations=file&dry=1
+// 503 when the queue is full
+func (s *importServer) createRun(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, cServeMaxForm)
+	err := r.ParseForm()
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	run := &serverRun{
+		Identities:   r.Form.Get("identities"),
+		Affiliations: r.Form.Get("affiliations"),
+		Status:       "queued",
+		Queued:       time.Now(),
+	}
+	run.Dry, _ = strconv.ParseBool(r.Form.Get("dry"))
+	err = s.uploadedFile("identities", run.Identities, gIdentitiesFileRE, gUploadedIdentitiesRE)
+	if err == nil {
+		err = s.uploadedFile("affiliations", run.Affiliations, gAffiliationsFileRE, gUploadedAffiliationsRE)
+	}
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	s.mtx.Lock()
+	s.last++
+	run.ID = s.last
+	s.runs[run.ID] = run
+	s.mtx.Unlock()
+	select {
+	case s.queue <- run:
+	default:
+		s.mtx.Lock()
+		delete(s.runs, run.ID)
+		s.mtx.Unlock()
+		errorResponse(w, http.StatusServiceUnavailable, fmt.Errorf("run queue is full (%d runs), try again later", cap(s.queue)))
+		return
+	}
+	fmt.Printf("Queued run %d: %s, %s, dry: %v\n", run.ID, run.Identities, run.Affiliations, run.Dry)
+	jsonResponse(w, http.StatusAccepted, run)
+}
+
+// handleRuns - GET /runs, POST /runs, GET /runs/{id}, GET /runs/{id}/diff, GET /runs/{id}/summary
+func (s *importServer) handleRuns(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/runs"), "/")
+	if path == "" {
+		switch r.Method {
+		case http.MethodPost:
+			s.createRun(w, r)
+		case http.MethodGet:
+			s.mtx.Lock()
+			runs := []serverRun{}
+			for _, run := range s.runs {
+				item := *run
+				item.Summary = nil
+				runs = append(runs, item)
+			}
+			s.mtx.Unlock()
+			sort.Slice(runs, func(i, j int) bool { return runs[i].ID < runs[j].ID })
+			jsonResponse(w, http.StatusOK, runs)
+		default:
+			errorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		}
+		return
+	}
+	if r.Method != http.MethodGet {
+		errorResponse(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		return
+	}
+	ary := strings.Split(path, "/")
+	id, err := strconv.Atoi(ary[0])
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, fmt.Errorf("invalid run id '%s'", ary[0]))
+		return
+	}
+	s.mtx.Lock()
+	run, ok := s.runs[id]
+	var item serverRun
+	if ok {
+		item = *run
+	}
+	s.mtx.Unlock()
+	if !ok {
+		errorResponse(w, http.StatusNotFound, fmt.Errorf("run %d not found", id))
+		return
+	}
+	what := ""
+	if len(ary) > 1 {
+		what = ary[1]
+	}
+	switch what {
+	case "":
+		jsonResponse(w, http.StatusOK, item)
+	case "diff", "summary":
+		if item.Summary == nil {
+			errorResponse(w, http.StatusConflict, fmt.Errorf("run %d is %s", id, item.Status))
+			return
+		}
+		if what == "diff" {
+			changes, err := item.Summary.allChanges()
+			if err != nil {
+				errorResponse(w, http.StatusInternalServerError, err)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			for _, change := range changes {
+				_, _ = fmt.Fprintln(w, change)
+			}
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"run_%d_summary.json\"", id))
+		jsonResponse(w, http.StatusOK, item.Summary)
+	default:
+		errorResponse(w, http.StatusNotFound, fmt.Errorf("unknown run resource '%s'", what))
+	}
+}
+
+// execute - runs a single queued import (into all databases, through staging when configured), recovers from panics
+// so the server keeps running, run's summary is the one of the first database
+func (s *importServer) execute(run *serverRun) {
+	var (
+		summaries []*importSummary
+		summary   *importSummary
+		err       error
+	)
+	s.mtx.Lock()
+	run.Status = "running"
+	s.mtx.Unlock()
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("import panicked: %v", r)
+			}
+		}()
+		summaries, err = importFiles(s.dbs, s.dbg, run.Dry, inputFiles{identities: []string{filepath.Join(s.dir, run.Identities)}, affiliations: []string{filepath.Join(s.dir, run.Affiliations)}}, runOptions{})
+	}()
+	if len(summaries) > 0 {
+		summary = summaries[0]
+	} else {
+		summary = &importSummary{IdentitiesFile: run.Identities, AffiliationsFile: run.Affiliations, Dry: run.Dry, Start: time.Now()}
+		summary.finish(err)
+	}
+	s.mtx.Lock()
+	run.Summary = summary
+	if err != nil {
+		run.Status = "failed"
+	} else {
+		run.Status = "succeeded"
+	}
+	s.mtx.Unlock()
+	fmt.Printf("Run %d %s\n%s", run.ID, run.Status, summary.text())
+}
+
+// authorized - requires "Authorization: Bearer <token>" header when SERVE_TOKEN is set, compared in constant time
+func (s *importServer) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.token)) != 1 {
+			errorResponse(w, http.StatusUnauthorized, fmt.Errorf("unauthorized request to %s", r.URL.Path))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// serveHTTP - HTTP API for on-demand imports
+// SERVE_ADDR - listen address, for example ":8080"
+// SERVE_DIR - directory where uploaded CSVs are stored, default "uploads"
+// SERVE_TOKEN - requests must send "Authorization: Bearer <token>" header, required unless listening on localhost only
+// SERVE_MAX_UPLOAD - maximal size of an uploaded CSV, default 1G
+func serveHTTP(dbs []*shDatabase, addr string) error {
+	s := &importServer{
+		dbs:       dbs,
+		dbg:       os.Getenv("DEBUG") != "",
+		dir:       os.Getenv("SERVE_DIR"),
+		token:     os.Getenv("SERVE_TOKEN"),
+		maxUpload: 1 << 30,
+		mtx:       &sync.Mutex{},
+		runs:      make(map[int]*serverRun),
+		queue:     make(chan *serverRun, 1024),
+	}
+	if s.token == "" && !isLoopbackAddr(addr) {
+		return fmt.Errorf("SERVE_TOKEN is required when SERVE_ADDR=%s is not a localhost address", addr)
+	}
+	if v := os.Getenv("SERVE_MAX_UPLOAD"); v != "" {
+		size, err := parseSize(v)
+		if err != nil || size == 0 {
+			return fmt.Errorf("invalid SERVE_MAX_UPLOAD=%s", v)
+		}
+		s.maxUpload = int64(size)
+	}
+	if s.dir == "" {
+		s.dir = "uploads"
+	}
+	err := os.MkdirAll(s.dir, 0755)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for run := range s.queue {
+			s.execute(run)
+		}
+	}()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload/", s.authorized(s.upload))
+	mux.HandleFunc("/runs", s.authorized(s.handleRuns))
+	mux.HandleFunc("/runs/", s.authorized(s.handleRuns))
+	fmt.Printf("Serving HTTP API on %s, uploads in %s\n", addr, s.dir)
+	return http.ListenAndServe(addr, mux)
+}
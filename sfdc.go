@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	cSFDCDefaultLoginURL   = "https://login.salesforce.com"
+	cSFDCDefaultAPIVersion = "v53.0"
+)
+
+// sfdcClient - minimal Salesforce REST API client
+type sfdcClient struct {
+	http        *http.Client
+	instanceURL string
+	token       string
+	apiVersion  string
+	dbg         bool
+}
+
+// sfdcRecord - queried Salesforce record, fields are converted to strings
+type sfdcRecord struct {
+	object string
+	id     string
+	fields map[string]string
+}
+
+// sfdcLogin - OAuth2 username-password flow
+// SFDC_LOGIN_URL (default https://login.salesforce.com), SFDC_CLIENT_ID, SFDC_CLIENT_SECRET, SFDC_USERNAME,
+// SFDC_PASSWORD (with the security token appended if required), SFDC_API_VERSION (default v53.0)
+func sfdcLogin(dbg bool) (client *sfdcClient, err error) {
+	loginURL := os.Getenv("SFDC_LOGIN_URL")
+	if loginURL == "" {
+		loginURL = cSFDCDefaultLoginURL
+	}
+	apiVersion := os.Getenv("SFDC_API_VERSION")
+	if apiVersion == "" {
+		apiVersion = cSFDCDefaultAPIVersion
+	}
+	form := url.Values{
+		"grant_type":    {"password"},
+		"client_id":     {os.Getenv("SFDC_CLIENT_ID")},
+		"client_secret": {os.Getenv("SFDC_CLIENT_SECRET")},
+		"username":      {os.Getenv("SFDC_USERNAME")},
+		"password":      {os.Getenv("SFDC_PASSWORD")},
+	}
+	httpClient := &http.Client{Timeout: 60 * time.Second}
+	var resp *http.Response
+	resp, err = httpClient.PostForm(strings.TrimSuffix(loginURL, "/")+"/services/oauth2/token", form)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("SFDC login failed with %d: %s", resp.StatusCode, string(body))
+		return
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		InstanceURL string `json:"instance_url"`
+	}
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return
+	}
+	client = &sfdcClient{http: httpClient, instanceURL: strings.TrimSuffix(token.InstanceURL, "/"), token: token.AccessToken, apiVersion: apiVersion, dbg: dbg}
+	if dbg {
+		fmt.Printf("logged in to SFDC instance %s\n", client.instanceURL)
+	}
+	return
+}
+
+// do - executes API request, decodes JSON response into out (if not nil)
+func (c *sfdcClient) do(method, path string, payload, out interface{}) (err error) {
+	var body *bytes.Reader
+	if payload != nil {
+		var data []byte
+		data, err = json.Marshal(payload)
+		if err != nil {
+			return
+		}
+		body = bytes.NewReader(data)
+	} else {
+		body = bytes.NewReader(nil)
+	}
+	var req *http.Request
+	req, err = http.NewRequest(method, c.instanceURL+path, body)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	if c.dbg {
+		fmt.Printf("SFDC %s %s\n", method, path)
+	}
+	var resp *http.Response
+	resp, err = c.http.Do(req)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = fmt.Errorf("SFDC %s %s returned %d: %s", method, path, resp.StatusCode, string(data))
+		return
+	}
+	if out != nil && len(data) > 0 {
+		err = json.Unmarshal(data, out)
+	}
+	return
+}
+
+// query - runs SOQL query, follows nextRecordsUrl pagination
+func (c *sfdcClient) query(soql string) (records []sfdcRecord, err error) {
+	path := "/services/data/" + c.apiVersion + "/query?q=" + url.QueryEscape(soql)
+	for path != "" {
+		var result struct {
+			Done           bool                     `json:"done"`
+			NextRecordsURL string                   `json:"nextRecordsUrl"`
+			Records        []map[string]interface{} `json:"records"`
+		}
+		err = c.do(http.MethodGet, path, nil, &result)
+		if err != nil {
+			return
+		}
+		for _, raw := range result.Records {
+			record := sfdcRecord{fields: make(map[string]string)}
+			if attrs, ok := raw["attributes"].(map[string]interface{}); ok {
+				record.object, _ = attrs["type"].(string)
+			}
+			for k, v := range raw {
+				switch value := v.(type) {
+				case nil:
+					record.fields[k] = ""
+				case string:
+					record.fields[k] = value
+				case bool, float64:
+					record.fields[k] = fmt.Sprintf("%v", value)
+				}
+			}
+			record.id = record.fields["Id"]
+			records = append(records, record)
+		}
+		path = ""
+		if !result.Done {
+			path = result.NextRecordsURL
+		}
+	}
+	return
+}
+
+// mark - sets fields (status and message) of the record
+func (c *sfdcClient) mark(record sfdcRecord, fields map[string]string) error {
+	return c.do(http.MethodPatch, "/services/data/"+c.apiVersion+"/sobjects/"+record.object+"/"+record.id, fields, nil)
+}
+
+// sfdcColumn - Salesforce field name -> CSV column: SFDC_FIELD_MAP entries (column=Field,...) or
+// lower case field name without the __c suffix
+func sfdcColumn(fieldMap map[string]string, field string) string {
+	if column, ok := fieldMap[field]; ok {
+		return column
+	}
+	return strings.ToLower(strings.TrimSuffix(field, "__c"))
+}
+
+// cSFDCIDColumn - column with the record's Salesforce Id, ignored by the import, used to mark records by row outcomes
+const cSFDCIDColumn = "sfdc_id"
+
+// writeSFDCRecords - writes records as CSV file, columns sorted by name, then the record's Id (cSFDCIDColumn)
+func writeSFDCRecords(fileName string, records []sfdcRecord, fieldMap map[string]string) (err error) {
+	columns := make(map[string]string)
+	for _, record := range records {
+		for field := range record.fields {
+			if field == "attributes" || field == "Id" {
+				continue
+			}
+			columns[sfdcColumn(fieldMap, field)] = field
+		}
+	}
+	hdr := []string{}
+	for column := range columns {
+		hdr = append(hdr, column)
+	}
+	sort.Strings(hdr)
+	hdr = append(hdr, cSFDCIDColumn)
+	var f *os.File
+	f, err = os.Create(fileName)
+	if err != nil {
+		return
+	}
+	w := csv.NewWriter(f)
+	_ = w.Write(hdr)
+	for _, record := range records {
+		line := make([]string, len(hdr))
+		for i, column := range hdr[:len(hdr)-1] {
+			line[i] = record.fields[columns[column]]
+		}
+		line[len(hdr)-1] = record.id
+		_ = w.Write(line)
+	}
+	w.Flush()
+	err = w.Error()
+	e := f.Close()
+	if err == nil {
+		err = e
+	}
+	return
+}
+
+// sfdcOutcomes - outcomes of the pulled rows by their Salesforce Id: applied only when applied in all nDBs databases,
+// otherwise the first other outcome, rows not processed in every database are missing
+func sfdcOutcomes(summaries []*importSummary, nDBs int) map[string]rowOutcome {
+	outcomes := make(map[string]rowOutcome)
+	seen := make(map[string]int)
+	for _, summary := range summaries {
+		for _, file := range summary.outcomes {
+			if len(file.lines) == 0 {
+				continue
+			}
+			idx := columnIndex(file.lines[0], cSFDCIDColumn)
+			if idx < 0 {
+				continue
+			}
+			for n, outcome := range file.outcomes {
+				if n >= len(file.lines) || idx >= len(file.lines[n]) || file.lines[n][idx] == "" || outcome.status == "not processed" {
+					continue
+				}
+				id := file.lines[n][idx]
+				seen[id]++
+				if prev, ok := outcomes[id]; !ok || prev.status == "applied" {
+					outcomes[id] = outcome
+				}
+			}
+		}
+	}
+	for id, n := range seen {
+		if n < nDBs {
+			delete(outcomes, id)
+		}
+	}
+	return outcomes
+}
+
+// sfdcPull - pulls pending individual dashboard requests from Salesforce, imports them and marks them by row outcomes
+// SFDC_IDENTITIES_SOQL, SFDC_AFFILIATIONS_SOQL - queries returning pending identity/affiliation change requests
+// SFDC_FIELD_MAP - optional column=Field,... mapping of CSV columns to Salesforce fields
+// SFDC_STATUS_FIELD - field set on processed records (default Status__c) to SFDC_PROCESSED_VALUE for applied rows
+// (default Processed), SFDC_FAILED_VALUE for failed and colliding rows (default Failed) or SFDC_SKIPPED_VALUE for
+// skipped rows (default Skipped)
+// SFDC_MESSAGE_FIELD - field set to the reason of failed and skipped rows, cleared for applied rows
+// (default Status_Message__c, "-" disables it)
+// SFDC_DIR - where pulled CSVs are written (default temporary directory, removed afterwards)
+// Records of rows that were not processed (aborted import, not applied in every database) are left pending
+func sfdcPull(dbs []*shDatabase, dbg, dry bool) (err error) {
+	fieldMap := make(map[string]string)
+	for _, item := range strings.Split(os.Getenv("SFDC_FIELD_MAP"), ",") {
+		ary := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(ary) == 2 {
+			fieldMap[strings.TrimSpace(ary[1])] = strings.TrimSpace(ary[0])
+		}
+	}
+	statusField := os.Getenv("SFDC_STATUS_FIELD")
+	if statusField == "" {
+		statusField = "Status__c"
+	}
+	statusValues := map[string]string{"applied": "Processed", "failed": "Failed", "collision": "Failed", "skipped": "Skipped"}
+	for env, status := range map[string]string{"SFDC_PROCESSED_VALUE": "applied", "SFDC_FAILED_VALUE": "failed", "SFDC_SKIPPED_VALUE": "skipped"} {
+		if value := os.Getenv(env); value != "" {
+			statusValues[status] = value
+			if status == "failed" {
+				statusValues["collision"] = value
+			}
+		}
+	}
+	messageField := os.Getenv("SFDC_MESSAGE_FIELD")
+	if messageField == "" {
+		messageField = "Status_Message__c"
+	}
+	identitiesSOQL, affiliationsSOQL := os.Getenv("SFDC_IDENTITIES_SOQL"), os.Getenv("SFDC_AFFILIATIONS_SOQL")
+	if identitiesSOQL == "" || affiliationsSOQL == "" {
+		err = fmt.Errorf("SFDC_IDENTITIES_SOQL and SFDC_AFFILIATIONS_SOQL must be set")
+		return
+	}
+	var client *sfdcClient
+	client, err = sfdcLogin(dbg)
+	if err != nil {
+		return
+	}
+	var identities, affiliations []sfdcRecord
+	identities, err = client.query(identitiesSOQL)
+	if err != nil {
+		return
+	}
+	affiliations, err = client.query(affiliationsSOQL)
+	if err != nil {
+		return
+	}
+	fmt.Printf("Pulled %d identities and %d affiliations requests from SFDC\n", len(identities), len(affiliations))
+	if len(identities) == 0 && len(affiliations) == 0 {
+		return
+	}
+	dir := os.Getenv("SFDC_DIR")
+	if dir == "" {
+		dir, err = ioutil.TempDir("", "sfdc-")
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = os.RemoveAll(dir)
+		}()
+	}
+	ts := time.Now().UTC().Format("200601021504")
+	identitiesFile := filepath.Join(dir, "user_identities_"+ts+".csv")
+	affiliationsFile := filepath.Join(dir, "user_affiliations_"+ts+".csv")
+	err = writeSFDCRecords(identitiesFile, identities, fieldMap)
+	if err != nil {
+		return
+	}
+	err = writeSFDCRecords(affiliationsFile, affiliations, fieldMap)
+	if err != nil {
+		return
+	}
+	var summaries []*importSummary
+	summaries, err = importFiles(dbs, dbg, dry, inputFiles{identities: []string{identitiesFile}, affiliations: []string{affiliationsFile}}, runOptions{outcomes: true})
+	if dry {
+		return
+	}
+	outcomes := sfdcOutcomes(summaries, len(dbs))
+	marked := make(map[string]int)
+	for _, record := range append(identities, affiliations...) {
+		if record.object == "" || record.id == "" {
+			continue
+		}
+		outcome, ok := outcomes[record.id]
+		if !ok {
+			continue
+		}
+		value, ok := statusValues[outcome.status]
+		if !ok {
+			continue
+		}
+		fields := map[string]string{statusField: value}
+		if messageField != "-" {
+			message := outcome.message
+			if len(message) > 255 {
+				message = message[:252] + "..."
+			}
+			fields[messageField] = message
+		}
+		e := client.mark(record, fields)
+		if e != nil {
+			warnf(cWarnOther, "cannot mark SFDC %s %s %s: %v\n", record.object, record.id, value, e)
+			continue
+		}
+		marked[value]++
+	}
+	for _, value := range []string{statusValues["applied"], statusValues["failed"], statusValues["skipped"]} {
+		if marked[value] > 0 {
+			fmt.Printf("Marked %d SFDC records %s=%s\n", marked[value], statusField, value)
+			marked[value] = 0
+		}
+	}
+	return
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// gShadow - rows are applied in transactions which are then rolled back (SHADOW)
+	gShadow bool
+	// gShadowOut - file receiving row state diffs as JSON lines (SHADOW_OUT)
+	gShadowOut *os.File
+	// gShadowMtx - guards gShadowOut and gShadowReports
+	gShadowMtx sync.Mutex
+	// gShadowReports - when not nil receives printed diffs of shadow transactions (review panel)
+	gShadowReports *[]string
+)
+
+// shadowDiff - row state before and after a shadow transaction
+type shadowDiff struct {
+	Table  string            `json:"table"`
+	Key    string            `json:"key"`
+	Action string            `json:"action"`
+	Before map[string]string `json:"before,omitempty"`
+	After  map[string]string `json:"after,omitempty"`
+}
+
+// shadowState - row captured by a shadow transaction
+type shadowState struct {
+	table     string
+	keyColumn string
+	key       interface{}
+	before    map[string]string
+}
+
+// shadowTx - captures states of rows changed by a transaction
+type shadowTx struct {
+	tx     *sql.Tx
+	uuid   string
+	states []*shadowState
+}
+
+// setShadow - SHADOW enables shadow runs, SHADOW_OUT=path writes diffs as JSON lines
+// preview - shadow run regardless of SHADOW, SHADOW_OUT is not written
+func setShadow(preview bool) (err error) {
+	gShadow = os.Getenv("SHADOW") != "" || preview
+	if gShadowOut != nil {
+		_ = gShadowOut.Close()
+		gShadowOut = nil
+	}
+	path := os.Getenv("SHADOW_OUT")
+	if !gShadow || preview || path == "" {
+		return
+	}
+	gShadowOut, err = os.Create(path)
+	return
+}
+
+// newShadow - starts capturing row states of the transaction of uuid, nil when not in a shadow run
+// and change events are not published
+func newShadow(tx *sql.Tx, uuid string) *shadowTx {
+	if !gShadow && gEvents == nil {
+		return nil
+	}
+	return &shadowTx{tx: tx, uuid: uuid}
+}
+
+// rowState - all columns of the row as strings, nil when the row doesn't exist
+func rowState(tx *sql.Tx, table, keyColumn string, key interface{}) (state map[string]string, err error) {
+	var rows *sql.Rows
+	q := adaptQuery("select * from " + table + " where " + keyColumn + " = ?")
+	ctx, cancel := stmtContext()
+	defer cancel()
+	rows, err = tx.QueryContext(ctx, q, key)
+	if err != nil {
+		queryOut(q, key)
+		return
+	}
+	var columns []string
+	columns, err = rows.Columns()
+	if err != nil {
+		_ = rows.Close()
+		return
+	}
+	if rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		state = make(map[string]string)
+		for i, column := range columns {
+			if values[i].Valid {
+				state[column] = values[i].String
+			} else {
+				state[column] = "(null)"
+			}
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		_ = rows.Close()
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+// capture - records row state before the transaction changes it, nil key means a row to be inserted
+func (s *shadowTx) capture(table, keyColumn string, key interface{}) (err error) {
+	if s == nil {
+		return
+	}
+	state := &shadowState{table: table, keyColumn: keyColumn, key: key}
+	if key != nil {
+		state.before, err = rowState(s.tx, table, keyColumn, key)
+		if err != nil {
+			return
+		}
+	}
+	s.states = append(s.states, state)
+	return
+}
+
+// rekey - row last captured in table now has a different key (identity rekeyed, enrollment inserted)
+func (s *shadowTx) rekey(table string, key interface{}) {
+	if s == nil {
+		return
+	}
+	for i := len(s.states) - 1; i >= 0; i-- {
+		if s.states[i].table == table {
+			s.states[i].key = key
+			return
+		}
+	}
+}
+
+// commit - commits the transaction, in shadow runs reads row states after all changes
+// (including database defaults and triggers), reports the differences and rolls the transaction back
+// otherwise the differences are published as change events once the transaction is committed
+// with APPLY_PLAN the change must be a planned one, otherwise the transaction is not committed
+func (s *shadowTx) commit(tx *sql.Tx, msg string) (err error) {
+	if !gShadow {
+		err = claimPlanned(msg)
+		if err != nil {
+			return
+		}
+		defer func() {
+			if err != nil {
+				unclaimPlanned(msg)
+			}
+		}()
+	}
+	if s == nil {
+		return tx.Commit()
+	}
+	var diffs []shadowDiff
+	diffs, err = s.diffs()
+	if err != nil {
+		_ = tx.Rollback()
+		return
+	}
+	if !gShadow {
+		err = tx.Commit()
+		if err == nil {
+			publishChanges(s.uuid, msg, diffs)
+		}
+		return
+	}
+	err = tx.Rollback()
+	if err != nil {
+		err = fmt.Errorf("error rolling back shadow transaction %v", err)
+		return
+	}
+	reportShadow(msg, diffs)
+	return
+}
+
+// diffs - row states after all changes of the transaction compared with the captured ones
+func (s *shadowTx) diffs() (diffs []shadowDiff, err error) {
+	diffs = []shadowDiff{}
+	for _, state := range s.states {
+		var after map[string]string
+		if state.key != nil {
+			after, err = rowState(s.tx, state.table, state.keyColumn, state.key)
+			if err != nil {
+				return
+			}
+		}
+		diff := shadowDiff{Table: state.table, Key: fmt.Sprintf("%s=%v", state.keyColumn, state.key), Before: state.before, After: after}
+		switch {
+		case state.before == nil && after == nil:
+			continue
+		case state.before == nil:
+			diff.Action = "insert"
+		case after == nil:
+			diff.Action = "delete"
+		default:
+			diff.Action = "update"
+			before, changed := make(map[string]string), make(map[string]string)
+			for column, value := range after {
+				if state.before[column] != value {
+					before[column] = state.before[column]
+					changed[column] = value
+				}
+			}
+			if len(changed) == 0 {
+				continue
+			}
+			diff.Before, diff.After = before, changed
+		}
+		diffs = append(diffs, diff)
+	}
+	return
+}
+
+// reportShadow - prints row state diffs of a shadow transaction and writes them to SHADOW_OUT
+func reportShadow(msg string, diffs []shadowDiff) {
+	lines := []string{"shadow " + msg}
+	for _, diff := range diffs {
+		columns := []string{}
+		for column := range diff.After {
+			columns = append(columns, column)
+		}
+		for column := range diff.Before {
+			if _, ok := diff.After[column]; !ok {
+				columns = append(columns, column)
+			}
+		}
+		sort.Strings(columns)
+		changes := []string{}
+		for _, column := range columns {
+			switch diff.Action {
+			case "insert":
+				changes = append(changes, fmt.Sprintf("%s=%q", column, diff.After[column]))
+			case "delete":
+				changes = append(changes, fmt.Sprintf("%s=%q", column, diff.Before[column]))
+			default:
+				changes = append(changes, strings.TrimSpace(fieldChange(column, diff.Before[column], diff.After[column])))
+			}
+		}
+		lines = append(lines, fmt.Sprintf("  %s %s %s: %s", diff.Action, diff.Table, diff.Key, strings.Join(changes, ", ")))
+	}
+	gShadowMtx.Lock()
+	defer gShadowMtx.Unlock()
+	fmt.Printf("%s\n", strings.Join(lines, "\n"))
+	if gShadowReports != nil {
+		*gShadowReports = append(*gShadowReports, strings.Join(lines, "\n"))
+	}
+	if gShadowOut == nil {
+		return
+	}
+	data, err := json.Marshal(struct {
+		Change string       `json:"change"`
+		Diffs  []shadowDiff `json:"diffs"`
+	}{Change: msg, Diffs: diffs})
+	if err == nil {
+		_, err = gShadowOut.Write(append(data, '\n'))
+	}
+	if err != nil {
+		fmt.Printf("WARNING: cannot write shadow diff: %v\n", err)
+	}
+}
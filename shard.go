@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// gUUIDLocks - uuids of rows being applied, serializes rows of the same uuid applied by imports running at the
+	// same time in one process, entries are removed when the last row holding them finishes
+	gUUIDLocks = &uuidLocks{locks: make(map[string]*uuidLock)}
+)
+
+// uuidLocks - reference-counted registry of per-uuid locks, it only holds uuids currently locked or waited for
+// all - held shared by rows locking their uuids, exclusively by rows that can touch any uuid
+type uuidLocks struct {
+	all   sync.RWMutex
+	mtx   sync.Mutex
+	locks map[string]*uuidLock
+}
+
+// uuidLock - lock of a single uuid, refs - number of holders and waiters
+type uuidLock struct {
+	mtx  sync.Mutex
+	refs int
+}
+
+// lock - locks the uuids (in sorted order, so rows locking several uuids cannot deadlock), no uuids (or only
+// empty ones) lock all uuids exclusively, returns the function releasing the locks
+func (l *uuidLocks) lock(uuids ...string) (unlock func()) {
+	keys := []string{}
+	seen := make(map[string]struct{})
+	for _, uuid := range uuids {
+		if _, ok := seen[uuid]; ok || uuid == "" {
+			continue
+		}
+		seen[uuid] = struct{}{}
+		keys = append(keys, uuid)
+	}
+	if len(keys) == 0 {
+		l.all.Lock()
+		return l.all.Unlock
+	}
+	sort.Strings(keys)
+	l.all.RLock()
+	held := []*uuidLock{}
+	for _, key := range keys {
+		l.mtx.Lock()
+		lck, ok := l.locks[key]
+		if !ok {
+			lck = &uuidLock{}
+			l.locks[key] = lck
+		}
+		lck.refs++
+		l.mtx.Unlock()
+		lck.mtx.Lock()
+		held = append(held, lck)
+	}
+	return func() {
+		for i, lck := range held {
+			lck.mtx.Unlock()
+			l.mtx.Lock()
+			lck.refs--
+			if lck.refs == 0 {
+				delete(l.locks, keys[i])
+			}
+			l.mtx.Unlock()
+		}
+		l.all.RUnlock()
+	}
+}
+
+const (
+	// cSerialShard - row is processed alone, after all previous rows finished and before any next row starts
+	cSerialShard = -1
+)
+
+// identityUUIDs - returns identity id -> uuid for ids that exist, queries in batches
+// Uses the primary database, identities can be rekeyed by the current run
+func identityUUIDs(db *sql.DB, ids []string) (uuids map[string]string, err error) {
+	uuids = make(map[string]string)
+	for from := 0; from < len(ids); from += cReconcileBatch {
+		to := from + cReconcileBatch
+		if to > len(ids) {
+			to = len(ids)
+		}
+		args := []interface{}{}
+		for _, id := range ids[from:to] {
+			args = append(args, id)
+		}
+		var rows *stmtRows
+		rows, err = query(db, "select id, uuid from identities where id in ("+strings.TrimSuffix(strings.Repeat("?,", to-from), ",")+")", args...)
+		if err != nil {
+			return
+		}
+		id, uuid := "", ""
+		for rows.Next() {
+			err = rows.Scan(&id, &uuid)
+			if err != nil {
+				_ = rows.Close()
+				return
+			}
+			uuids[id] = uuid
+		}
+		err = rows.Err()
+		if err != nil {
+			_ = rows.Close()
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// shardRows - assigns data rows to thrN workers by the uuid of their identity, so all rows touching the same
+// uuid (and so the same identity, uidentity and profile) are processed by one worker in file order
+// rows keyed by uuid are sharded by that uuid, shards[0] is unused (header)
+// rows that can touch other uuids than their own get cSerialShard: merge rows (merge_into_uuid), bulk rows and
+// rows with a missing or unknown identity_id when ID_FALLBACK can resolve them to any identity, other rows with
+// unknown identity_id are sharded by the id itself
+// keys - uuid (or the unknown id) of each row, empty for cSerialShard rows
+func shardRows(db *sql.DB, lines [][]string, thrN int) (shards []int, keys []string, err error) {
+	shards = make([]int, len(lines))
+	keys = make([]string, len(lines))
+	if len(lines) < 2 {
+		return
+	}
+	idx := columnIndex(lines[0], "identity_id")
+	uIdx := columnIndex(lines[0], "uuid")
+	serialIdx := []int{}
+	for _, col := range []string{"merge_into_uuid", "bulk_email_domain", "bulk_org_name"} {
+		if i := columnIndex(lines[0], col); i >= 0 {
+			serialIdx = append(serialIdx, i)
+		}
+	}
+	ids := []string{}
+	seen := make(map[string]struct{})
+	for i, line := range lines[1:] {
+		for _, c := range serialIdx {
+			if c < len(line) && strings.TrimSpace(line[c]) != "" {
+				shards[i+1] = cSerialShard
+			}
+		}
+		if shards[i+1] == cSerialShard {
+			continue
+		}
+		if (idx < 0 || line[idx] == "") && uIdx >= 0 && strings.TrimSpace(line[uIdx]) != "" {
+			keys[i+1] = strings.TrimSpace(line[uIdx])
+			continue
+		}
+		if idx < 0 || line[idx] == "" {
+			if len(gIDFallback) > 0 {
+				shards[i+1] = cSerialShard
+			}
+			continue
+		}
+		id := rekeyedID(line[idx])
+		keys[i+1] = id
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		ids = append(ids, id)
+	}
+	var uuids map[string]string
+	uuids, err = identityUUIDs(db, ids)
+	if err != nil {
+		return
+	}
+	for i := 1; i < len(lines); i++ {
+		if shards[i] == cSerialShard {
+			continue
+		}
+		key := keys[i]
+		if uuid, ok := uuids[key]; ok {
+			key = uuid
+			keys[i] = uuid
+		} else if len(gIDFallback) > 0 && idx >= 0 && lines[i][idx] != "" {
+			shards[i] = cSerialShard
+			keys[i] = ""
+			continue
+		}
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(key))
+		shards[i] = int(h.Sum32() % uint32(thrN))
+	}
+	return
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// cDefaultShowAudit - number of the most recent audit entries shown per person
+	cDefaultShowAudit = 20
+)
+
+// showIdentity - identity of the shown person
+type showIdentity struct {
+	ID       string `json:"id"`
+	Source   string `json:"source"`
+	Name     string `json:"name,omitempty"`
+	Username string `json:"username,omitempty"`
+	Email    string `json:"email,omitempty"`
+}
+
+// showProfile - profile of the shown person
+type showProfile struct {
+	Name        string `json:"name,omitempty"`
+	Email       string `json:"email,omitempty"`
+	Gender      string `json:"gender,omitempty"`
+	IsBot       bool   `json:"is_bot"`
+	CountryCode string `json:"country_code,omitempty"`
+}
+
+// showEnrollment - enrollment of the shown person
+type showEnrollment struct {
+	ID             int    `json:"id"`
+	Organization   string `json:"organization"`
+	OrganizationID int    `json:"organization_id"`
+	ProjectSlug    string `json:"project_slug,omitempty"`
+	Start          string `json:"start"`
+	End            string `json:"end"`
+}
+
+// showAudit - import_audit entry about the shown person
+type showAudit struct {
+	CreatedAt string `json:"created_at"`
+	RunID     string `json:"run_id"`
+	Action    string `json:"action"`
+	Table     string `json:"table"`
+	RowID     int64  `json:"row_id"`
+	Before    string `json:"before,omitempty"`
+	After     string `json:"after,omitempty"`
+	Who       string `json:"who,omitempty"`
+}
+
+// personView - everything about a unique identity a support engineer needs
+type personView struct {
+	UUID        string           `json:"uuid"`
+	Profile     *showProfile     `json:"profile,omitempty"`
+	Identities  []showIdentity   `json:"identities"`
+	Enrollments []showEnrollment `json:"enrollments"`
+	Audit       []showAudit      `json:"audit,omitempty"`
+	AuditNote   string           `json:"audit_note,omitempty"`
+}
+
+// showPeople - "show" subcommand, read only: prints identities, profile, enrollments and recent audit entries of
+// people given by email, uuid or identity_id (an email can belong to more than one uuid)
+// SHOW_JSON - dump JSON instead of text, SHOW_AUDIT - number of the most recent audit entries (default 20, 0 - none)
+func showPeople(db *sql.DB, dbg bool, args []string) (err error) {
+	if len(args) == 0 {
+		err = fmt.Errorf("show requires at least one email, uuid or identity_id")
+		return
+	}
+	auditLimit := cDefaultShowAudit
+	if s := os.Getenv("SHOW_AUDIT"); s != "" {
+		auditLimit, err = strconv.Atoi(s)
+		if err != nil || auditLimit < 0 {
+			err = fmt.Errorf("invalid SHOW_AUDIT=%s, expected a non-negative integer", s)
+			return
+		}
+	}
+	views := []*personView{}
+	seen := make(map[string]struct{})
+	for _, arg := range args {
+		arg = strings.TrimSpace(arg)
+		var uuids []string
+		uuids, err = resolvePerson(db, arg)
+		if err != nil {
+			return
+		}
+		if len(uuids) == 0 {
+			fmt.Printf("WARNING: no person found for %s\n", arg)
+			continue
+		}
+		for _, uuid := range uuids {
+			if _, ok := seen[uuid]; ok {
+				continue
+			}
+			seen[uuid] = struct{}{}
+			var view *personView
+			view, err = loadPersonView(db, dbg, uuid, auditLimit)
+			if err != nil {
+				return
+			}
+			views = append(views, view)
+		}
+	}
+	if os.Getenv("SHOW_JSON") != "" {
+		var data []byte
+		data, err = json.MarshalIndent(views, "", "  ")
+		if err == nil {
+			fmt.Printf("%s\n", data)
+		}
+		return
+	}
+	for _, view := range views {
+		fmt.Print(view.text())
+	}
+	return
+}
+
+// resolvePerson - uuids of the email (any case), identity_id or uuid
+func resolvePerson(db *sql.DB, arg string) (uuids []string, err error) {
+	var rows *stmtRows
+	if strings.Contains(arg, "@") {
+		rows, err = query(db, "select distinct uuid from identities where lower(email) = lower(?) order by uuid", arg)
+	} else {
+		rows, err = query(db, "select uuid from identities where id = ? union select uuid from uidentities where uuid = ?", arg, arg)
+	}
+	if err != nil {
+		err = fmt.Errorf("person %s lookup: %v", arg, err)
+		return
+	}
+	for rows.Next() {
+		var uuid string
+		err = rows.Scan(&uuid)
+		if err != nil {
+			break
+		}
+		uuids = append(uuids, uuid)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	e := rows.Close()
+	if err == nil {
+		err = e
+	}
+	if err != nil {
+		err = fmt.Errorf("person %s lookup: %v", arg, err)
+	}
+	return
+}
+
+// loadPersonView - reads identities, profile, enrollments and the most recent audit entries of the uuid
+func loadPersonView(db *sql.DB, dbg bool, uuid string, auditLimit int) (view *personView, err error) {
+	view = &personView{UUID: uuid, Identities: []showIdentity{}, Enrollments: []showEnrollment{}}
+	var identities []personIdentity
+	identities, err = personIdentities(db, uuid)
+	if err != nil {
+		err = fmt.Errorf("uuid %s identities: %v", uuid, err)
+		return
+	}
+	for _, identity := range identities {
+		view.Identities = append(view.Identities, showIdentity{ID: identity.id, Source: identity.source, Name: identity.name, Username: identity.username, Email: identity.email})
+	}
+	profile := &showProfile{}
+	var found bool
+	found, err = queryFirst(
+		db,
+		[]interface{}{&profile.Name, &profile.Email, &profile.Gender, &profile.IsBot, &profile.CountryCode},
+		"select coalesce(name, ''), coalesce(email, ''), coalesce(gender, ''), coalesce(is_bot, 0), coalesce(country_code, '') from profiles where uuid = ?",
+		uuid,
+	)
+	if err != nil {
+		err = fmt.Errorf("uuid %s profile: %v", uuid, err)
+		return
+	}
+	if found {
+		view.Profile = profile
+	}
+	var rows *stmtRows
+	rows, err = query(
+		db,
+		"select e.id, coalesce(o.name, ''), e.organization_id, coalesce(e.project_slug, ''), date_format(e.start, '%Y-%m-%d'), date_format(e.end, '%Y-%m-%d') "+
+			"from enrollments e left join organizations o on e.organization_id = o.id where e.uuid = ? order by e.project_slug, e.start, e.id",
+		uuid,
+	)
+	if err != nil {
+		err = fmt.Errorf("uuid %s enrollments: %v", uuid, err)
+		return
+	}
+	eids := []interface{}{}
+	for rows.Next() {
+		e := showEnrollment{}
+		err = rows.Scan(&e.ID, &e.Organization, &e.OrganizationID, &e.ProjectSlug, &e.Start, &e.End)
+		if err != nil {
+			break
+		}
+		view.Enrollments = append(view.Enrollments, e)
+		eids = append(eids, e.ID)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	e := rows.Close()
+	if err == nil {
+		err = e
+	}
+	if err != nil {
+		err = fmt.Errorf("uuid %s enrollments: %v", uuid, err)
+		return
+	}
+	if auditLimit == 0 {
+		return
+	}
+	// deleted enrollments and identity changes are found by uuid, enrollment updates by enrollment id
+	q := "select date_format(created_at, '%Y-%m-%d %H:%i:%s'), run_id, action, table_name, row_id, coalesce(before_json, ''), coalesce(after_json, ''), coalesce(who, '') " +
+		"from import_audit where uuid = ?"
+	args := []interface{}{uuid}
+	if len(eids) > 0 {
+		q += " or (table_name = 'enrollments' and row_id in (" + strings.TrimSuffix(strings.Repeat("?, ", len(eids)), ", ") + "))"
+		args = append(args, eids...)
+	}
+	q += " order by id desc limit " + strconv.Itoa(auditLimit)
+	rows, err = query(db, q, args...)
+	if err != nil {
+		if strings.Contains(err.Error(), "Error 1146") {
+			if dbg {
+				fmt.Printf("uuid %s audit: %v\n", uuid, err)
+			}
+			view.AuditNote = "no audit trail (import_audit table doesn't exist, imports run without AUDIT)"
+			err = nil
+			return
+		}
+		err = fmt.Errorf("uuid %s audit: %v", uuid, err)
+		return
+	}
+	for rows.Next() {
+		a := showAudit{}
+		err = rows.Scan(&a.CreatedAt, &a.RunID, &a.Action, &a.Table, &a.RowID, &a.Before, &a.After, &a.Who)
+		if err != nil {
+			break
+		}
+		view.Audit = append(view.Audit, a)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	e = rows.Close()
+	if err == nil {
+		err = e
+	}
+	if err != nil {
+		err = fmt.Errorf("uuid %s audit: %v", uuid, err)
+	}
+	return
+}
+
+// text - human readable person view
+func (v *personView) text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "uuid %s\n", v.UUID)
+	if v.Profile != nil {
+		p := v.Profile
+		fmt.Fprintf(&b, "  profile: name %q email %q gender %q country %q bot %v\n", p.Name, p.Email, p.Gender, p.CountryCode, p.IsBot)
+	} else {
+		fmt.Fprintf(&b, "  profile: none\n")
+	}
+	fmt.Fprintf(&b, "  identities (%d):\n", len(v.Identities))
+	sources := make(map[string]int)
+	for _, i := range v.Identities {
+		sources[i.Source]++
+		fmt.Fprintf(&b, "    %s %-12s name %q username %q email %q\n", i.ID, i.Source, i.Name, i.Username, i.Email)
+	}
+	if len(sources) > 1 {
+		names := []string{}
+		for source, n := range sources {
+			names = append(names, fmt.Sprintf("%s: %d", source, n))
+		}
+		sort.Strings(names)
+		fmt.Fprintf(&b, "    sources: %s\n", strings.Join(names, ", "))
+	}
+	fmt.Fprintf(&b, "  enrollments (%d):\n", len(v.Enrollments))
+	for _, e := range v.Enrollments {
+		project := e.ProjectSlug
+		if project == "" {
+			project = "(global)"
+		}
+		fmt.Fprintf(&b, "    %d %s - %s %s/%d %s\n", e.ID, e.Start, e.End, e.Organization, e.OrganizationID, project)
+	}
+	if v.AuditNote != "" {
+		fmt.Fprintf(&b, "  audit: %s\n", v.AuditNote)
+	} else if len(v.Audit) > 0 {
+		fmt.Fprintf(&b, "  recent audit entries (%d):\n", len(v.Audit))
+		for _, a := range v.Audit {
+			fmt.Fprintf(&b, "    %s run %s %s %s %d by %s\n", a.CreatedAt, a.RunID, a.Action, a.Table, a.RowID, a.Who)
+			if a.Before != "" {
+				fmt.Fprintf(&b, "      before: %s\n", a.Before)
+			}
+			if a.After != "" {
+				fmt.Fprintf(&b, "      after: %s\n", a.After)
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"strings"
+)
+
+// signatureFile - detached signature of file: file.sig or file.asc, empty when there is none
+func signatureFile(file string) string {
+	for _, ext := range []string{".sig", ".asc"} {
+		if _, err := os.Stat(file + ext); err == nil {
+			return file + ext
+		}
+	}
+	return ""
+}
+
+// verifySignatures - PGP_KEYRING=path, verifies detached signatures of input files with gpgv before processing
+// unsigned files are refused unless ALLOW_UNSIGNED is set, invalid signatures are always refused
+func verifySignatures(dbg bool, files []string) (err error) {
+	keyring := os.Getenv("PGP_KEYRING")
+	if keyring == "" {
+		return
+	}
+	allowUnsigned := os.Getenv("ALLOW_UNSIGNED") != ""
+	for _, file := range files {
+		sig := signatureFile(file)
+		if sig == "" {
+			if !allowUnsigned {
+				err = fmt.Errorf("%s is not signed (no %s.sig or %s.asc), set ALLOW_UNSIGNED to import unsigned files", file, file, file)
+				return
+			}
+			warnf(cWarnOther, "%s is not signed\n", file)
+			continue
+		}
+		var stderr bytes.Buffer
+		cmd := osexec.Command("gpgv", "--keyring", keyring, sig, file)
+		cmd.Stderr = &stderr
+		if dbg {
+			fmt.Printf("gpgv --keyring %s %s %s\n", keyring, sig, file)
+		}
+		err = cmd.Run()
+		if err != nil {
+			err = fmt.Errorf("invalid signature %s of %s: %v: %s", sig, file, err, strings.TrimSpace(stderr.String()))
+			return
+		}
+		fmt.Printf("Signature of %s verified\n", file)
+	}
+	return
+}
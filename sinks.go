@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// outputSink - destination of reports and run artifacts (results, failed rows, summary, plan, affected uuids)
+type outputSink interface {
+	write(path string, data []byte) error
+}
+
+// fileSink - local file (file:// prefix is optional)
+type fileSink struct{}
+
+// s3Sink - s3://bucket/key uploaded via AWS CLI
+type s3Sink struct{}
+
+// httpSink - http(s)://... receives the content in a POST request, OUTPUT_HTTP_TOKEN is sent as a bearer token
+type httpSink struct{}
+
+// isHTTPPath - output is sent to HTTP endpoint
+func isHTTPPath(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// sinkFor - sink handling the path, chosen by its scheme
+func sinkFor(path string) outputSink {
+	switch {
+	case isS3Path(path):
+		return s3Sink{}
+	case isHTTPPath(path):
+		return httpSink{}
+	}
+	return fileSink{}
+}
+
+// writeOutput - writes report data to a local path, s3://bucket/key or http(s):// URL
+func writeOutput(path string, data []byte) error {
+	return sinkFor(path).write(path, data)
+}
+
+// write - writes local file
+func (fileSink) write(path string, data []byte) error {
+	return ioutil.WriteFile(strings.TrimPrefix(path, "file://"), data, 0644)
+}
+
+// write - uploads data to S3 via a temporary file
+func (s3Sink) write(path string, data []byte) (err error) {
+	var f *os.File
+	f, err = ioutil.TempFile("", "report-*"+filepath.Ext(path))
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+	_, err = f.Write(data)
+	e := f.Close()
+	if err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+	_, err = awsS3(false, "cp", "--only-show-errors", f.Name(), path)
+	return
+}
+
+// write - POSTs data to the URL, content type is derived from the extension, any 2xx status is a success
+func (httpSink) write(path string, data []byte) (err error) {
+	var req *http.Request
+	req, err = http.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	contentType := "application/octet-stream"
+	switch strings.ToLower(filepath.Ext(strings.SplitN(path, "?", 2)[0])) {
+	case ".csv":
+		contentType = "text/csv"
+	case ".json":
+		contentType = "application/json"
+	case ".txt":
+		contentType = "text/plain"
+	}
+	req.Header.Set("Content-Type", contentType)
+	if token := os.Getenv("OUTPUT_HTTP_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: 60 * time.Second}
+	var resp *http.Response
+	resp, err = client.Do(req)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("POST %s returned %d: %s", path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return
+}
+
+// writeSummary - SUMMARY_OUT=path (local, s3:// or http(s)://, {run_id} is replaced) receives the run summary JSON
+func writeSummary(summary *importSummary) (err error) {
+	path := os.Getenv("SUMMARY_OUT")
+	if path == "" {
+		return
+	}
+	path = strings.Replace(path, "{run_id}", summary.RunID, -1)
+	var data []byte
+	data, err = json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return
+	}
+	err = writeOutput(path, append(data, '\n'))
+	if err == nil {
+		fmt.Printf("Summary written to %s\n", path)
+	}
+	return
+}
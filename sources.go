@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+var (
+	// gOnlySources - when not empty only identities from these sources are imported
+	gOnlySources map[string]struct{}
+	// gExcludeSources - identities from these sources are not imported
+	gExcludeSources map[string]struct{}
+	// gOnlyProjects - when not empty only enrollments of these projects are imported
+	gOnlyProjects []string
+)
+
+// sourceSet - comma separated sources, lower case
+func sourceSet(s string) map[string]struct{} {
+	set := make(map[string]struct{})
+	for _, source := range strings.Split(s, ",") {
+		source = strings.ToLower(strings.TrimSpace(source))
+		if source != "" {
+			set[source] = struct{}{}
+		}
+	}
+	return set
+}
+
+// setSourceFilter - ONLY_SOURCES, EXCLUDE_SOURCES, for example ONLY_SOURCES=git,github or EXCLUDE_SOURCES=slack,gerrit
+func setSourceFilter() {
+	gOnlySources = sourceSet(os.Getenv("ONLY_SOURCES"))
+	gExcludeSources = sourceSet(os.Getenv("EXCLUDE_SOURCES"))
+}
+
+// sourceAllowed - if rows of identities from source are imported
+func sourceAllowed(source string) bool {
+	source = strings.ToLower(strings.TrimSpace(source))
+	if _, ok := gExcludeSources[source]; ok {
+		return false
+	}
+	if len(gOnlySources) == 0 {
+		return true
+	}
+	_, ok := gOnlySources[source]
+	return ok
+}
+
+// setProjectFilter - ONLY_PROJECTS, comma separated SFDC or DA project slugs, for example ONLY_PROJECTS=cncf,lfn/onap
+func setProjectFilter() {
+	gOnlyProjects = nil
+	for _, project := range strings.Split(os.Getenv("ONLY_PROJECTS"), ",") {
+		project = strings.TrimSpace(project)
+		if project != "" {
+			gOnlyProjects = append(gOnlyProjects, project)
+		}
+	}
+}
+
+// projectAllowed - if enrollment rows of the project are imported, DA slugs also match their parent (foundation) slug
+func projectAllowed(sfdcSlug, daSlug string) bool {
+	if len(gOnlyProjects) == 0 {
+		return true
+	}
+	for _, project := range gOnlyProjects {
+		if (sfdcSlug != "" && sfdcSlug == project) || daSlug == project || strings.HasPrefix(daSlug, project+"/") {
+			return true
+		}
+	}
+	return false
+}
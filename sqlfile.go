@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// splitSQL - splits SQL script into statements on semicolons outside of quotes and comments, comments are removed
+func splitSQL(script string) (statements []string) {
+	var (
+		current strings.Builder
+		quote   byte
+	)
+	flush := func() {
+		if s := strings.TrimSpace(current.String()); s != "" {
+			statements = append(statements, s)
+		}
+		current.Reset()
+	}
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		if quote != 0 {
+			current.WriteByte(c)
+			if c == '\\' && quote != '`' && i+1 < len(script) {
+				i++
+				current.WriteByte(script[i])
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+			current.WriteByte(c)
+		case c == '#' || (c == '-' && strings.HasPrefix(script[i:], "-- ")):
+			for i < len(script) && script[i] != '\n' {
+				i++
+			}
+			current.WriteByte('\n')
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				i = len(script)
+			} else {
+				i += end + 3
+			}
+			current.WriteByte(' ')
+		case c == ';':
+			flush()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	flush()
+	return
+}
+
+// runSQLFile - executes operator's SQL file from env (PRE_IMPORT_SQL, POST_IMPORT_SQL) statement by statement,
+// {run_id} and {database} are replaced with quoted run ID and database name; dry mode only prints statements
+// statements are executed as written, they are not adapted to SCHEMA=django
+func runSQLFile(db *sql.DB, dbg, dry bool, env string, summary *importSummary) (err error) {
+	path := os.Getenv(env)
+	if path == "" {
+		return
+	}
+	var data []byte
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("%s: %v", env, err)
+		return
+	}
+	replacer := strings.NewReplacer("{run_id}", sqlQuote(summary.RunID), "{database}", sqlQuote(summary.Database))
+	statements := splitSQL(replacer.Replace(string(data)))
+	fmt.Printf("%s: %d statements from %s\n", env, len(statements), path)
+	for i, statement := range statements {
+		if dry {
+			fmt.Printf("would execute: %s\n", statement)
+			continue
+		}
+		if dbg {
+			fmt.Printf("%s\n", statement)
+		}
+		dtStart := time.Now()
+		var res sql.Result
+		ctx, cancel := stmtContext()
+		res, err = db.ExecContext(ctx, statement)
+		cancel()
+		recordLatency(statement, time.Since(dtStart))
+		if err != nil {
+			err = fmt.Errorf("%s %s statement %d failed: %v: %s", env, path, i+1, err, statement)
+			return
+		}
+		if dbg {
+			n, _ := res.RowsAffected()
+			fmt.Printf("%d rows affected\n", n)
+		}
+	}
+	return
+}
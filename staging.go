@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// importFiles - imports files into all databases, first into the staging one when STAGING_DSN is set
+// STAGING_DSN - staging copy of the SortingHat DB (separate schema or server), all changes are applied
+// and verified there first, production is only touched when the staging import succeeded
+// with no verification mismatches, the staging run has no side effects (see runOptions.quiet)
+// then the same import runs against production where every change must be one of the staging change log,
+// any other change is rolled back before it commits and fails its row
+// STAGING_ONLY - stop after the staging phase
+// In dry mode the staging phase is skipped, summaries of the production databases are returned
+func importFiles(dbs []*shDatabase, dbg, dry bool, inputs inputFiles, opts runOptions) (summaries []*importSummary, err error) {
+	dsn := os.Getenv("STAGING_DSN")
+	if dsn == "" {
+		return importIntoDatabases(dbs, dbg, dry, inputs, opts)
+	}
+	if dry {
+		fmt.Printf("Dry mode, skipping staging phase\n")
+		return importIntoDatabases(dbs, dbg, dry, inputs, opts)
+	}
+	if os.Getenv("APPLY_PLAN") != "" {
+		err = fmt.Errorf("STAGING_DSN cannot be used with APPLY_PLAN")
+		return
+	}
+	staging := &shDatabase{name: dsnName(dsn), dsn: dsn, charset: dsnCharset(dsn)}
+	staging.db, err = openMySQL(dsn)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = staging.db.Close()
+	}()
+	fmt.Printf("Staging phase: importing into %s\n", staging.name)
+	staging.use(true)
+	var summary *importSummary
+	summary, err = importCSVfiles(staging.db, dbg, false, inputs, runOptions{quiet: true, verify: true})
+	dbs[0].use(len(dbs) > 1)
+	if err != nil {
+		err = fmt.Errorf("staging import into %s failed, production not touched: %v", staging.name, err)
+		return
+	}
+	if summary.VerifyMismatches > 0 {
+		err = fmt.Errorf("staging import into %s has %d verification mismatches, production not touched", staging.name, summary.VerifyMismatches)
+		return
+	}
+	plan := &importPlan{RunID: summary.RunID, Files: summary.Files}
+	gSummaryMtx.Lock()
+	plan.Changes, err = summary.allChanges()
+	gSummaryMtx.Unlock()
+	if err != nil {
+		err = fmt.Errorf("cannot read staging change log: %v", err)
+		return
+	}
+	fmt.Printf("Staging phase succeeded: %d changes verified\n", len(plan.Changes))
+	if os.Getenv("STAGING_ONLY") != "" {
+		return
+	}
+	fmt.Printf("Promoting %d changes to production\n", len(plan.Changes))
+	opts.plan = plan
+	return importIntoDatabases(dbs, dbg, dry, inputs, opts)
+}
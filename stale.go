@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	cStaleSkip   = "skip"
+	cStaleWarn   = "warn"
+	cStaleRefuse = "refuse"
+)
+
+var (
+	// gExportTime - export timestamp (UTC) of the file being imported, zero when stale check is disabled
+	gExportTime time.Time
+	// gStaleMode - what to do with rows modified after the export
+	gStaleMode string
+)
+
+// setStaleMode - STALE_CHECK enables stale-export protection
+// skip (or 1) - warn and skip rows modified in the DB after the export
+// warn - warn about such rows but apply them anyway
+// refuse - refuse to import the whole file when any of its rows was modified after the export
+func setStaleMode() (err error) {
+	gStaleMode = os.Getenv("STALE_CHECK")
+	switch gStaleMode {
+	case "", cStaleSkip, cStaleWarn, cStaleRefuse:
+	case "1":
+		gStaleMode = cStaleSkip
+	default:
+		err = fmt.Errorf("invalid STALE_CHECK=%s, allowed: %s, %s, %s", gStaleMode, cStaleSkip, cStaleWarn, cStaleRefuse)
+	}
+	return
+}
+
+// setExportTime - export time is taken from user_{identities,affiliations}_YYYYMMDDHHMI.csv file name (in INPUT_TZ)
+func setExportTime(fileName string) {
+	gExportTime = time.Time{}
+	if gStaleMode == "" {
+		return
+	}
+	ts := fileTimestamp(fileName)
+	if ts == "" {
+		warnf(cWarnOther, "%s has no YYYYMMDDHHMI timestamp in its name, stale-export check disabled for it\n", fileName)
+		return
+	}
+	dt, err := time.ParseInLocation("200601021504", ts, gInputTZ)
+	if err != nil {
+		warnf(cWarnValidation, "%s: cannot parse timestamp %s: %v, stale-export check disabled for it\n", fileName, ts, err)
+		return
+	}
+	gExportTime = dt.UTC()
+	fmt.Printf("%s exported at %s UTC, rows modified later will be skipped\n", fileName, gExportTime.Format("2006-01-02 15:04"))
+}
+
+// modifiedAfterExport - true when table row with key column = key was modified after the export
+func modifiedAfterExport(db *sql.DB, table, keyCol string, key interface{}) (modified bool, err error) {
+	if gExportTime.IsZero() {
+		return
+	}
+	var rows *stmtRows
+	rows, err = query(db, "select 1 from "+table+" where "+keyCol+" = ? and last_modified > str_to_date(?, ?)", key, gExportTime.Format("2006-01-02 15:04:05"), "%Y-%m-%d %H:%i:%s")
+	if err != nil {
+		return
+	}
+	modified = rows.Next()
+	err = rows.Err()
+	e := rows.Close()
+	if err == nil {
+		err = e
+	}
+	return
+}
+
+// checkStaleFile - in refuse mode returns an error when any identity (or enrollment of an identity)
+// from the file was modified after the export, nothing from the file is imported then
+func checkStaleFile(db *sql.DB, fileName string, lines [][]string, enrollments bool) (err error) {
+	if gStaleMode != cStaleRefuse || gExportTime.IsZero() || len(lines) < 2 {
+		return
+	}
+	idx := columnIndex(lines[0], "identity_id")
+	if idx < 0 {
+		return
+	}
+	ids := []string{}
+	seen := make(map[string]struct{})
+	for _, line := range lines[1:] {
+		if idx >= len(line) {
+			continue
+		}
+		id := strings.TrimSpace(line[idx])
+		if _, ok := seen[id]; ok || id == "" {
+			continue
+		}
+		seen[id] = struct{}{}
+		ids = append(ids, id)
+	}
+	q := "select count(*) from identities where last_modified > str_to_date(?, ?) and id in ("
+	if enrollments {
+		q = "select count(*) from enrollments e, identities i where e.uuid = i.uuid and e.last_modified > str_to_date(?, ?) and i.id in ("
+	}
+	stale := 0
+	for from := 0; from < len(ids); from += cReconcileBatch {
+		to := from + cReconcileBatch
+		if to > len(ids) {
+			to = len(ids)
+		}
+		args := []interface{}{gExportTime.Format("2006-01-02 15:04:05"), "%Y-%m-%d %H:%i:%s"}
+		for _, id := range ids[from:to] {
+			args = append(args, id)
+		}
+		var rows *stmtRows
+		rows, err = query(db, q+strings.TrimSuffix(strings.Repeat("?,", to-from), ",")+")", args...)
+		if err != nil {
+			return
+		}
+		n := 0
+		for rows.Next() {
+			err = rows.Scan(&n)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		e := rows.Close()
+		if err == nil {
+			err = e
+		}
+		if err != nil {
+			return
+		}
+		stale += n
+	}
+	if stale > 0 {
+		what := "identities"
+		if enrollments {
+			what = "enrollments"
+		}
+		err = fmt.Errorf("%s: %d %s were modified after the export at %s UTC, refusing to import it", fileName, stale, what, gExportTime.Format("2006-01-02 15:04"))
+	}
+	return
+}
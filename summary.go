@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// importSummary - statistics of a single import run
+type importSummary struct {
+	RunID                  string         `json:"run_id"`
+	Database               string         `json:"database,omitempty"`
+	Profile                string         `json:"profile,omitempty"`
+	IdentitiesFile         string         `json:"identities_file"`
+	AffiliationsFile       string         `json:"affiliations_file"`
+	OrganizationsFile      string         `json:"organizations_file,omitempty"`
+	ProfilesFile           string         `json:"profiles_file,omitempty"`
+	Files                  []runFile      `json:"files,omitempty"`
+	Dry                    bool           `json:"dry"`
+	Shadow                 bool           `json:"shadow,omitempty"`
+	Start                  time.Time      `json:"start"`
+	End                    time.Time      `json:"end"`
+	Duration               string         `json:"duration"`
+	IdentityRows           int            `json:"identity_rows"`
+	EnrollmentRows         int            `json:"enrollment_rows"`
+	OrganizationRows       int            `json:"organization_rows,omitempty"`
+	ProfileRows            int            `json:"profile_rows,omitempty"`
+	UpdatedIdentities      int            `json:"updated_identities"`
+	UpdatedEnrollments     int            `json:"updated_enrollments"`
+	UpdatedUIdentities     int            `json:"updated_uidentities"`
+	UpdatedProfiles        int            `json:"updated_profiles"`
+	UpdatedOrganizations   int            `json:"updated_organizations,omitempty"`
+	Warnings               int            `json:"warnings"`
+	Collisions             int            `json:"collisions"`
+	FailedRows             int            `json:"failed_rows"`
+	OrphanRows             int            `json:"orphan_rows"`
+	LedgerSkipped          int            `json:"ledger_skipped"`
+	ProtectedRows          int            `json:"protected_rows,omitempty"`
+	VerifyChecked          int            `json:"verify_checked"`
+	VerifyMismatches       int            `json:"verify_mismatches"`
+	PublishedEvents        int            `json:"published_events,omitempty"`
+	Latencies              []queryLatency `json:"latencies,omitempty"`
+	Changes                []string       `json:"changes,omitempty"`
+	SpilledChanges         int            `json:"spilled_changes,omitempty"`
+	ChangesFile            string         `json:"changes_file,omitempty"`
+	WarningMessages        []string       `json:"warning_messages,omitempty"`
+	SpilledWarnings        int            `json:"spilled_warnings,omitempty"`
+	WarningsFile           string         `json:"warnings_file,omitempty"`
+	WarningCategories      map[string]int `json:"warning_categories,omitempty"`
+	BlankedIdentities      []string       `json:"blanked_identities,omitempty"`
+	SuspiciousAffiliations []string       `json:"suspicious_affiliations,omitempty"`
+	Error                  string         `json:"error,omitempty"`
+	// historyID - id of the run in import_runs (RUN_HISTORY)
+	historyID int64
+	// outcomes - per-row outcomes of processed input files (runOptions.outcomes)
+	outcomes []fileOutcomes
+}
+
+var (
+	gSummary    *importSummary
+	gSummaryMtx = &sync.Mutex{}
+	gRunIDs     = make(map[string]int)
+)
+
+// newRunID - run start time YYYYMMDDHHMMSS, suffixed with -N when more runs start in the same second
+func newRunID(start time.Time) string {
+	id := start.Format("20060102150405")
+	gSummaryMtx.Lock()
+	n := gRunIDs[id]
+	gRunIDs[id] = n + 1
+	gSummaryMtx.Unlock()
+	if n > 0 {
+		id += fmt.Sprintf("-%d", n+1)
+	}
+	return id
+}
+
+// warnf - prints a warning and counts it in the current run summary
+func warnf(category, f string, a ...interface{}) {
+	fmt.Printf("WARNING: "+f, a...)
+	gSummaryMtx.Lock()
+	if gSummary != nil {
+		gSummary.Warnings++
+		gSummary.WarningMessages = append(gSummary.WarningMessages, anonymize(strings.TrimSpace(fmt.Sprintf(f, a...))))
+		countWarning(category)
+		spillSummary()
+	}
+	gSummaryMtx.Unlock()
+}
+
+// fieldChange - change message part of a single field, values are quoted (Go syntax), so values with spaces,
+// quotes or "->" are unambiguous and can be parsed back with strconv.Unquote
+func fieldChange(field, from, to string) string {
+	return fmt.Sprintf("%s %q -> %q ", field, from, to)
+}
+
+// addChange - records applied (or, in dry mode, planned) change message
+func addChange(msg string) {
+	gSummaryMtx.Lock()
+	if gSummary != nil {
+		gSummary.Changes = append(gSummary.Changes, anonymize(msg))
+		spillSummary()
+	}
+	gSummaryMtx.Unlock()
+}
+
+// addBlanked - records identity row that blanks out name, username and email (refused or allowed)
+func addBlanked(msg string) {
+	gSummaryMtx.Lock()
+	if gSummary != nil {
+		gSummary.BlankedIdentities = append(gSummary.BlankedIdentities, anonymize(msg))
+	}
+	gSummaryMtx.Unlock()
+}
+
+// addCollision - counts unique key collision
+func addCollision() {
+	gSummaryMtx.Lock()
+	if gSummary != nil {
+		gSummary.Collisions++
+		countWarning(cWarnCollision)
+	}
+	gSummaryMtx.Unlock()
+}
+
+// finish - sets end time, duration and final error (if any)
+func (s *importSummary) finish(err error) {
+	s.End = time.Now()
+	s.Duration = s.End.Sub(s.Start).String()
+	if err != nil {
+		s.Error = anonymize(err.Error())
+	}
+}
+
+// add - adds counts, changes and warnings of a run that is a part of the session s (review)
+func (s *importSummary) add(run *importSummary) {
+	s.IdentityRows += run.IdentityRows
+	s.EnrollmentRows += run.EnrollmentRows
+	s.UpdatedIdentities += run.UpdatedIdentities
+	s.UpdatedEnrollments += run.UpdatedEnrollments
+	s.UpdatedUIdentities += run.UpdatedUIdentities
+	s.UpdatedProfiles += run.UpdatedProfiles
+	s.Warnings += run.Warnings
+	s.Collisions += run.Collisions
+	s.FailedRows += run.FailedRows
+	s.OrphanRows += run.OrphanRows
+	s.LedgerSkipped += run.LedgerSkipped
+	s.ProtectedRows += run.ProtectedRows
+	s.VerifyChecked += run.VerifyChecked
+	s.VerifyMismatches += run.VerifyMismatches
+	s.PublishedEvents += run.PublishedEvents
+	changes, err := run.allChanges()
+	if err != nil {
+		fmt.Printf("WARNING: cannot read changes of run %s: %v\n", run.RunID, err)
+	}
+	s.Changes = append(s.Changes, changes...)
+	warnings, err := run.allWarnings()
+	if err != nil {
+		fmt.Printf("WARNING: cannot read warnings of run %s: %v\n", run.RunID, err)
+	}
+	s.WarningMessages = append(s.WarningMessages, warnings...)
+	for category, n := range run.WarningCategories {
+		if s.WarningCategories == nil {
+			s.WarningCategories = make(map[string]int)
+		}
+		s.WarningCategories[category] += n
+	}
+	s.BlankedIdentities = append(s.BlankedIdentities, run.BlankedIdentities...)
+	s.SuspiciousAffiliations = append(s.SuspiciousAffiliations, run.SuspiciousAffiliations...)
+}
+
+// Mode - "import", "dry-run" or "shadow"
+func (s *importSummary) Mode() string {
+	if s.Dry {
+		return "dry-run"
+	}
+	if s.Shadow {
+		return "shadow"
+	}
+	return "import"
+}
+
+// Status - "succeeded" or "failed"
+func (s *importSummary) Status() string {
+	if s.Error != "" {
+		return "failed"
+	}
+	return "succeeded"
+}
+
+// text - human readable summary
+func (s *importSummary) text() string {
+	status := s.Status()
+	if s.Error != "" {
+		status += ": " + s.Error
+	}
+	into := ""
+	if s.Database != "" {
+		into = " into " + s.Database
+	}
+	if s.Profile != "" {
+		into += " (profile " + s.Profile + ")"
+	}
+	warnings, latencies := "", ""
+	if len(s.WarningCategories) > 0 {
+		warnings = "warnings: " + warningCategoriesText(s.WarningCategories) + "\n"
+	}
+	if s.ProtectedRows > 0 {
+		warnings += fmt.Sprintf("protected rows skipped: %d\n", s.ProtectedRows)
+	}
+	if len(s.BlankedIdentities) > 0 {
+		warnings += fmt.Sprintf("blanked identities: %s\n", strings.Join(s.BlankedIdentities, "; "))
+	}
+	if len(s.SuspiciousAffiliations) > 0 {
+		warnings += fmt.Sprintf("suspicious affiliations: %s\n", strings.Join(s.SuspiciousAffiliations, "; "))
+	}
+	if s.ChangesFile != "" || s.WarningsFile != "" {
+		warnings += fmt.Sprintf("spilled over MAX_MEMORY: %d changes to %s, %d warning messages to %s\n", s.SpilledChanges, s.ChangesFile, s.SpilledWarnings, s.WarningsFile)
+	}
+	if s.ProfilesFile != "" {
+		warnings += fmt.Sprintf("profiles: %d rows of %s\n", s.ProfileRows, s.ProfilesFile)
+	}
+	if s.OrganizationsFile != "" {
+		warnings += fmt.Sprintf("organizations: %d rows of %s, %d updated\n", s.OrganizationRows, s.OrganizationsFile, s.UpdatedOrganizations)
+	}
+	for _, l := range s.Latencies {
+		latencies += fmt.Sprintf("%s: %d statements, p50 %s, p95 %s, p99 %s, max %s\n", l.Statement, l.Count, l.P50, l.P95, l.P99, l.Max)
+	}
+	return fmt.Sprintf(
+		"%s%s of %s, %s %s\nrows: %d identities, %d enrollments\nupdated: %d identities, %d enrollments, %d uidentities, %d profiles\n%d changes, %d warnings, %d collisions, %d failed rows, %d orphan affiliations rows, %d already applied rows skipped, %d verified, %d verify mismatches, took %s\n%s",
+		s.Mode(), into, s.IdentitiesFile, s.AffiliationsFile, status,
+		s.IdentityRows, s.EnrollmentRows,
+		s.UpdatedIdentities, s.UpdatedEnrollments, s.UpdatedUIdentities, s.UpdatedProfiles,
+		s.ChangesCount(), s.Warnings, s.Collisions, s.FailedRows, s.OrphanRows, s.LedgerSkipped, s.VerifyChecked, s.VerifyMismatches, s.Duration,
+		warnings+latencies,
+	)
+}
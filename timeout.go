@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	// gRowTimeout - deadline of every statement and row transaction, 0 means none
+	gRowTimeout time.Duration
+	// gRunDeadline - time when the run is aborted, zero means none
+	gRunDeadline time.Time
+	// errRunTimeout - run exceeded RUN_TIMEOUT, aborts the run regardless of the error policy
+	errRunTimeout = fmt.Errorf("run timeout exceeded")
+)
+
+// parseTimeout - Go duration (30s, 5m) or number of seconds
+func parseTimeout(env string) (timeout time.Duration, err error) {
+	s := os.Getenv(env)
+	if s == "" {
+		return
+	}
+	if secs, e := strconv.Atoi(s); e == nil {
+		timeout = time.Duration(secs) * time.Second
+	} else {
+		timeout, err = time.ParseDuration(s)
+	}
+	if err != nil || timeout < 0 {
+		err = fmt.Errorf("invalid %s=%s, expected duration like 30s or number of seconds", env, s)
+	}
+	return
+}
+
+// setTimeouts - ROW_TIMEOUT, RUN_TIMEOUT, the run deadline starts now
+func setTimeouts() (err error) {
+	gRowTimeout, err = parseTimeout("ROW_TIMEOUT")
+	if err != nil {
+		return
+	}
+	var runTimeout time.Duration
+	runTimeout, err = parseTimeout("RUN_TIMEOUT")
+	gRunDeadline = time.Time{}
+	if err == nil && runTimeout > 0 {
+		gRunDeadline = time.Now().Add(runTimeout)
+	}
+	return
+}
+
+// runExpired - errTerminated after a signal, errRunTimeout when the run deadline passed
+func runExpired() error {
+	if terminating() {
+		return errTerminated
+	}
+	if !gRunDeadline.IsZero() && time.Now().After(gRunDeadline) {
+		return errRunTimeout
+	}
+	return nil
+}
+
+// stmtContext - context of a statement or a row transaction: deadline is ROW_TIMEOUT from now or the run deadline,
+// whichever is earlier; the driver cancels statements of a hung connection when it expires
+// cancel must be called when the statement or transaction is done, it releases the deadline timer
+func stmtContext() (context.Context, context.CancelFunc) {
+	deadline := gRunDeadline
+	if gRowTimeout > 0 && (deadline.IsZero() || time.Now().Add(gRowTimeout).Before(deadline)) {
+		deadline = time.Now().Add(gRowTimeout)
+	}
+	if deadline.IsZero() {
+		return context.Background(), func() {}
+	}
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+// stmtRows - rows of a query run with its own statement context, Close also releases the context
+type stmtRows struct {
+	*sql.Rows
+	cancel context.CancelFunc
+}
+
+// Close - closes rows and cancels their statement context
+func (r *stmtRows) Close() error {
+	err := r.Rows.Close()
+	r.cancel()
+	return err
+}
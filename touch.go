@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// gTouchBatch - when > 0 uidentities/profiles touch updates are deferred and applied in chunks of that many uuids
+	gTouchBatch int
+	// gTouchPending - table -> last_modified_by -> uuids waiting for the touch update
+	gTouchPending map[string]map[string]map[string]struct{}
+)
+
+// setTouchBatch - TOUCH_BATCH=N, reset pending touches
+func setTouchBatch() (err error) {
+	gTouchBatch = 0
+	gTouchPending = make(map[string]map[string]map[string]struct{})
+	s := os.Getenv("TOUCH_BATCH")
+	if s == "" || gShadow {
+		return
+	}
+	gTouchBatch, err = strconv.Atoi(s)
+	if err != nil || gTouchBatch < 1 {
+		err = fmt.Errorf("invalid TOUCH_BATCH=%s, expected a positive number", s)
+	}
+	return
+}
+
+// recordTouch - defers last_modified update of uuid's row in uidentities or profiles
+func recordTouch(table, uuid, who string) {
+	if gMtx != nil {
+		gMtx.Lock()
+	}
+	byWho, ok := gTouchPending[table]
+	if !ok {
+		byWho = make(map[string]map[string]struct{})
+		gTouchPending[table] = byWho
+	}
+	uuids, ok := byWho[who]
+	if !ok {
+		uuids = make(map[string]struct{})
+		byWho[who] = uuids
+	}
+	uuids[uuid] = struct{}{}
+	if gMtx != nil {
+		gMtx.Unlock()
+	}
+}
+
+// flushTouches - applies deferred touch updates with update ... where uuid in (...) statements
+func flushTouches(db *sql.DB, dbg bool) (err error) {
+	// interleaved enrollments can record touches while identities are flushed
+	if gMtx != nil {
+		gMtx.Lock()
+	}
+	pending := gTouchPending
+	gTouchPending = make(map[string]map[string]map[string]struct{})
+	if gMtx != nil {
+		gMtx.Unlock()
+	}
+	tables := []string{}
+	for table := range pending {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		statements, affected, touched := 0, int64(0), make(map[string]struct{})
+		for who, set := range pending[table] {
+			uuids := []string{}
+			for uuid := range set {
+				uuids = append(uuids, uuid)
+				touched[uuid] = struct{}{}
+			}
+			sort.Strings(uuids)
+			for from := 0; from < len(uuids); from += gTouchBatch {
+				to := from + gTouchBatch
+				if to > len(uuids) {
+					to = len(uuids)
+				}
+				args := auditArgs(table, who)
+				for _, uuid := range uuids[from:to] {
+					args = append(args, uuid)
+				}
+				var res sql.Result
+				res, err = execDB(
+					db,
+					"update "+table+" set "+auditSet(table)+" where uuid in ("+strings.TrimSuffix(strings.Repeat("?,", to-from), ",")+")",
+					args...,
+				)
+				if err != nil {
+					err = fmt.Errorf("error touching %d %s rows: %v", to-from, table, err)
+					return
+				}
+				n, _ := res.RowsAffected()
+				affected += n
+				statements++
+			}
+		}
+		if gMtx != nil {
+			gMtx.Lock()
+		}
+		for uuid := range touched {
+			if table == "uidentities" {
+				gUpdatedUIdentities[uuid] = struct{}{}
+			} else {
+				gUpdatedProfiles[uuid] = struct{}{}
+			}
+		}
+		if gMtx != nil {
+			gMtx.Unlock()
+		}
+		if dbg || affected < int64(len(touched)) {
+			fmt.Printf("Touched %d/%d %s rows with %d statements\n", affected, len(touched), table, statements)
+		}
+		delete(pending, table)
+	}
+	return
+}
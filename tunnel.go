@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	osexec "os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	// cDefaultSSHTimeout - time allowed for the tunnel to authenticate and start forwarding
+	cDefaultSSHTimeout = 15 * time.Second
+	// cSSHNet - DSN network of a database reached through an SSH tunnel, the address is the one seen from the bastion
+	cSSHNet = "sshtunnel"
+)
+
+var (
+	// gSSHHost - SH_SSH_HOST, bastion the databases are reached through
+	gSSHHost string
+	// gSSHTunnels - remote address -> running tunnel, gSSHMtx guards it
+	gSSHTunnels = make(map[string]*sshTunnel)
+	gSSHMtx     sync.Mutex
+	// gSSHClosed - tunnels were stopped on exit, no new ones are started
+	gSSHClosed bool
+)
+
+// sshTunnel - ssh process forwarding a local port to a database address as seen from the bastion
+type sshTunnel struct {
+	local  string
+	cmd    *osexec.Cmd
+	stderr bytes.Buffer
+	done   chan struct{}
+}
+
+// setSSHTunnel - SH_SSH_HOST=bastion makes all databases reached through an SSH tunnel (system ssh client), so
+// DSN hosts are resolved on the bastion: SH_SSH_USER, SH_SSH_KEY (private key file), SH_SSH_PORT (default 22),
+// SH_SSH_OPTS - extra ssh options (space separated), SH_SSH_TIMEOUT - time to establish a tunnel (default 15s)
+// registers the "sshtunnel" DSN network, every new connection checks its tunnel and re-establishes it when it exited
+func setSSHTunnel() (err error) {
+	gSSHHost = strings.TrimSpace(os.Getenv("SH_SSH_HOST"))
+	if gSSHHost == "" {
+		return
+	}
+	_, err = osexec.LookPath("ssh")
+	if err != nil {
+		err = fmt.Errorf("SH_SSH_HOST requires the ssh client: %v", err)
+		return
+	}
+	mysql.RegisterDialContext(cSSHNet, func(ctx context.Context, addr string) (net.Conn, error) {
+		return dialTunnel(ctx, 0, addr)
+	})
+	return
+}
+
+// dialTunnel - connects to addr on the bastion's side through its SSH tunnel, starting the tunnel when it is not
+// running (anymore), timeout 0 means no timeout other than the context's
+func dialTunnel(ctx context.Context, timeout time.Duration, addr string) (net.Conn, error) {
+	local, err := sshForward(addr)
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{Timeout: timeout}
+	return d.DialContext(ctx, "tcp", local)
+}
+
+// sshForward - local address forwarding to addr (host:port or a unix socket path) on the bastion's side, tunnels are
+// started once per address and shared by all connections to it, a tunnel that exited is started again
+func sshForward(addr string) (local string, err error) {
+	gSSHMtx.Lock()
+	defer gSSHMtx.Unlock()
+	if gSSHClosed {
+		err = fmt.Errorf("SSH tunnels are closed")
+		return
+	}
+	if t, ok := gSSHTunnels[addr]; ok {
+		select {
+		case <-t.done:
+			delete(gSSHTunnels, addr)
+			fmt.Printf("Re-establishing SSH tunnel to %s via %s\n", addr, gSSHHost)
+		default:
+			local = t.local
+			return
+		}
+	}
+	timeout := cDefaultSSHTimeout
+	if s := os.Getenv("SH_SSH_TIMEOUT"); s != "" {
+		timeout, err = time.ParseDuration(s)
+		if err != nil || timeout <= 0 {
+			err = fmt.Errorf("invalid SH_SSH_TIMEOUT=%s, expected a positive duration like 15s", s)
+			return
+		}
+	}
+	// a free local port, ssh fails with ExitOnForwardFailure should it be taken meanwhile
+	var l net.Listener
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+	local = "127.0.0.1:" + strconv.Itoa(port)
+	args := []string{"-N", "-o", "ExitOnForwardFailure=yes", "-o", "BatchMode=yes", "-o", "ServerAliveInterval=30", "-L", local + ":" + addr}
+	if user := os.Getenv("SH_SSH_USER"); user != "" {
+		args = append(args, "-l", user)
+	}
+	if key := os.Getenv("SH_SSH_KEY"); key != "" {
+		args = append(args, "-i", key, "-o", "IdentitiesOnly=yes")
+	}
+	if sshPort := os.Getenv("SH_SSH_PORT"); sshPort != "" {
+		args = append(args, "-p", sshPort)
+	}
+	args = append(args, strings.Fields(os.Getenv("SH_SSH_OPTS"))...)
+	args = append(args, gSSHHost)
+	t := &sshTunnel{local: local, done: make(chan struct{})}
+	t.cmd = osexec.Command("ssh", args...)
+	t.cmd.Stderr = &t.stderr
+	err = t.cmd.Start()
+	if err != nil {
+		err = fmt.Errorf("ssh %s: %v", strings.Join(args, " "), err)
+		return
+	}
+	go func() {
+		e := t.cmd.Wait()
+		close(t.done)
+		gSSHMtx.Lock()
+		running := gSSHTunnels[addr] == t && !gSSHClosed
+		gSSHMtx.Unlock()
+		if running {
+			fmt.Printf("WARNING: SSH tunnel %s -> %s via %s exited, it is re-established on the next connection: %v: %s\n", local, addr, gSSHHost, e, strings.TrimSpace(t.stderr.String()))
+		}
+	}()
+	deadline := time.Now().Add(timeout)
+	for {
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", local, time.Second)
+		if err == nil {
+			_ = conn.Close()
+			break
+		}
+		select {
+		case <-t.done:
+			err = fmt.Errorf("SSH tunnel to %s via %s failed to start: %s", addr, gSSHHost, strings.TrimSpace(t.stderr.String()))
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			_ = t.cmd.Process.Kill()
+			err = fmt.Errorf("SSH tunnel to %s via %s not ready after %v: %s", addr, gSSHHost, timeout, strings.TrimSpace(t.stderr.String()))
+			return
+		}
+	}
+	fmt.Printf("SSH tunnel %s -> %s via %s\n", local, addr, gSSHHost)
+	gSSHTunnels[addr] = t
+	return
+}
+
+// tunnelConfig - points the DSN config to SSH tunnels: tcp and unix socket addresses use the "sshtunnel" network,
+// failover lists dial every host through its tunnel, addresses are kept so TLS still verifies the database host name,
+// tunnels are started here so an unreachable bastion fails the open
+func tunnelConfig(cfg *mysql.Config) (err error) {
+	switch cfg.Net {
+	case "tcp", "unix":
+		_, err = sshForward(cfg.Addr)
+		cfg.Net = cSSHNet
+	case cFailoverNet:
+		for _, addr := range strings.Split(cfg.Addr, ",") {
+			_, err = sshForward(addr)
+			if err != nil {
+				return
+			}
+		}
+	default:
+		err = fmt.Errorf("SH_SSH_HOST doesn't support %s(%s) addresses", cfg.Net, cfg.Addr)
+	}
+	return
+}
+
+// closeTunnels - stops all SSH tunnels, called before the process exits
+func closeTunnels() {
+	gSSHMtx.Lock()
+	gSSHClosed = true
+	tunnels := []*sshTunnel{}
+	for addr, t := range gSSHTunnels {
+		tunnels = append(tunnels, t)
+		delete(gSSHTunnels, addr)
+	}
+	gSSHMtx.Unlock()
+	for _, t := range tunnels {
+		_ = t.cmd.Process.Kill()
+		<-t.done
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	cUUIDReport = "report"
+	cUUIDRekey  = "rekey"
+)
+
+var (
+	// gUUIDCheck - what to do when identity values no longer hash to its id
+	gUUIDCheck string
+	gRekeyMtx  = &sync.Mutex{}
+	// gRekeyed - old identity id -> new id, so affiliations rows using old ids still work
+	gRekeyed map[string]string
+)
+
+// setUUIDCheck - UUID_CHECK=report|rekey
+// SortingHat identity id is SHA1 of "source:email:name:username" (lower case, name unaccented, NULL values as None)
+// report - warn when changed values no longer hash to the identity id
+// rekey - rewrite identity id to the new hash (identities used as uidentity uuid are only reported)
+func setUUIDCheck() (err error) {
+	gUUIDCheck = os.Getenv("UUID_CHECK")
+	gRekeyMtx.Lock()
+	gRekeyed = make(map[string]string)
+	gRekeyMtx.Unlock()
+	switch gUUIDCheck {
+	case "", cUUIDReport, cUUIDRekey:
+	default:
+		err = fmt.Errorf("invalid UUID_CHECK=%s, allowed: %s, %s", gUUIDCheck, cUUIDReport, cUUIDRekey)
+	}
+	return
+}
+
+// identityHash - SortingHat uuid(source, email, name, username), nil values are NULL columns (hashed as None)
+func identityHash(source string, email, name, username *string) string {
+	toStr := func(s *string) string {
+		if s == nil {
+			return "None"
+		}
+		return *s
+	}
+	s := strings.ToLower(strings.Join([]string{source, toStr(email), unaccent(toStr(name)), toStr(username)}, ":"))
+	h := sha1.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// storedValue - identity column value after the update, nil for NULL: emptied columns are set to NULL,
+// unchanged ones keep their value (null - the column is NULL now)
+func storedValue(value, newValue string, null bool) *string {
+	if newValue != value {
+		if newValue == "" {
+			return nil
+		}
+		return &newValue
+	}
+	if null {
+		return nil
+	}
+	return &value
+}
+
+// nullIfEmpty - NULL for empty identity column values, as SortingHat stores missing values
+func nullIfEmpty(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+// recordRekey - remembers new id of rekeyed identity
+func recordRekey(oldID, newID string) {
+	gRekeyMtx.Lock()
+	gRekeyed[oldID] = newID
+	gRekeyMtx.Unlock()
+}
+
+// rekeyedID - returns new id when the identity was rekeyed by this import
+func rekeyedID(id string) string {
+	gRekeyMtx.Lock()
+	defer gRekeyMtx.Unlock()
+	if newID, ok := gRekeyed[id]; ok {
+		return newID
+	}
+	return id
+}
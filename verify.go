@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+// expectedIdentity - identity values written by the import
+type expectedIdentity struct {
+	name     string
+	username string
+	email    string
+}
+
+// expectedEnrollment - enrollment values written by the import
+type expectedEnrollment struct {
+	uuid        string
+	orgID       int
+	projectSlug string
+	start       string
+	end         string
+}
+
+var (
+	gVerify            bool
+	gVerifyMtx         = &sync.Mutex{}
+	gVerifyIdentities  map[string]expectedIdentity
+	gVerifyEnrollments map[int64]expectedEnrollment
+	gVerifyDeleted     map[int64]struct{}
+)
+
+// resetVerify - enables/disables recording of written values for the post-import verification
+func resetVerify(enabled bool) {
+	gVerifyMtx.Lock()
+	gVerify = enabled
+	gVerifyIdentities = make(map[string]expectedIdentity)
+	gVerifyEnrollments = make(map[int64]expectedEnrollment)
+	gVerifyDeleted = make(map[int64]struct{})
+	gVerifyMtx.Unlock()
+}
+
+// recordIdentityForVerify - records committed identity values, later rows for the same id win
+func recordIdentityForVerify(id, name, username, email string) {
+	gVerifyMtx.Lock()
+	if gVerify {
+		gVerifyIdentities[id] = expectedIdentity{name: name, username: username, email: email}
+	}
+	gVerifyMtx.Unlock()
+}
+
+// recordEnrollmentForVerify - records committed enrollment values
+func recordEnrollmentForVerify(eid int64, uuid string, orgID int, projectSlug, start, end string) {
+	gVerifyMtx.Lock()
+	if gVerify {
+		gVerifyEnrollments[eid] = expectedEnrollment{uuid: uuid, orgID: orgID, projectSlug: projectSlug, start: start, end: end}
+		delete(gVerifyDeleted, eid)
+	}
+	gVerifyMtx.Unlock()
+}
+
+// recordEnrollmentDeletionForVerify - records committed enrollment deletion, enrollment must no longer exist
+func recordEnrollmentDeletionForVerify(eid int64) {
+	gVerifyMtx.Lock()
+	if gVerify {
+		gVerifyDeleted[eid] = struct{}{}
+		delete(gVerifyEnrollments, eid)
+	}
+	gVerifyMtx.Unlock()
+}
+
+// verifyMismatch - reports a single mismatch
+func verifyMismatch(category, f string, a ...interface{}) {
+	warnf(category, "verify: "+f, a...)
+	gSummaryMtx.Lock()
+	if gSummary != nil {
+		gSummary.VerifyMismatches++
+	}
+	gSummaryMtx.Unlock()
+}
+
+// verifyImport - re-queries every updated identity and enrollment and compares stored values with the CSV ones
+// VERIFY - enables the verification, it is skipped in dry mode
+// Mismatches (for example caused by triggers or charset truncation) are reported as warnings and counted in the summary
+func verifyImport(db *sql.DB, dbg bool) (err error) {
+	gVerifyMtx.Lock()
+	defer gVerifyMtx.Unlock()
+	if !gVerify {
+		return
+	}
+	checked := 0
+	for id, exp := range gVerifyIdentities {
+		var rows *stmtRows
+		rows, err = query(db, "select coalesce(name, ''), coalesce(username, ''), coalesce(email, '') from identities where id = ?", id)
+		if err != nil {
+			return
+		}
+		name, username, email, found := "", "", "", false
+		for rows.Next() {
+			err = rows.Scan(&name, &username, &email)
+			found = true
+			break
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		e := rows.Close()
+		if err == nil {
+			err = e
+		}
+		if err != nil {
+			return
+		}
+		checked++
+		if !found {
+			verifyMismatch(cWarnNotFound, "identity_id %s no longer exists\n", id)
+			continue
+		}
+		if name != exp.name {
+			verifyMismatch(cWarnOther, "identity_id %s name expected '%s', stored '%s'\n", id, exp.name, name)
+		}
+		if username != exp.username {
+			verifyMismatch(cWarnOther, "identity_id %s username expected '%s', stored '%s'\n", id, exp.username, username)
+		}
+		if email != exp.email {
+			verifyMismatch(cWarnOther, "identity_id %s email expected '%s', stored '%s'\n", id, exp.email, email)
+		}
+	}
+	for eid, exp := range gVerifyEnrollments {
+		var rows *stmtRows
+		rows, err = query(
+			db,
+			"select uuid, organization_id, coalesce(project_slug, ''), date_format(start, '%Y-%m-%d'), date_format(end, '%Y-%m-%d') from enrollments where id = ?",
+			eid,
+		)
+		if err != nil {
+			return
+		}
+		var act expectedEnrollment
+		found := false
+		for rows.Next() {
+			err = rows.Scan(&act.uuid, &act.orgID, &act.projectSlug, &act.start, &act.end)
+			found = true
+			break
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		e := rows.Close()
+		if err == nil {
+			err = e
+		}
+		if err != nil {
+			return
+		}
+		checked++
+		if !found {
+			verifyMismatch(cWarnNotFound, "enrollment %d no longer exists\n", eid)
+			continue
+		}
+		if act != exp {
+			verifyMismatch(cWarnOther, "enrollment %d expected %+v, stored %+v\n", eid, exp, act)
+		}
+	}
+	for eid := range gVerifyDeleted {
+		var rows *stmtRows
+		rows, err = query(db, "select 1 from enrollments where id = ?", eid)
+		if err != nil {
+			return
+		}
+		found := rows.Next()
+		err = rows.Err()
+		e := rows.Close()
+		if err == nil {
+			err = e
+		}
+		if err != nil {
+			return
+		}
+		checked++
+		if found {
+			verifyMismatch(cWarnOther, "deleted enrollment %d still exists\n", eid)
+		}
+	}
+	gSummaryMtx.Lock()
+	mismatches := 0
+	if gSummary != nil {
+		gSummary.VerifyChecked = checked
+		mismatches = gSummary.VerifyMismatches
+	}
+	gSummaryMtx.Unlock()
+	fmt.Printf("Verified %d identities, %d enrollments and %d deleted enrollments, %d mismatches\n", len(gVerifyIdentities), len(gVerifyEnrollments), len(gVerifyDeleted), mismatches)
+	if dbg {
+		fmt.Printf("Verification checked %d rows\n", checked)
+	}
+	return
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	cWarnRowError   = "row-error"
+	cWarnValidation = "validation-error"
+	cWarnNotFound   = "not-found"
+	cWarnCollision  = "collision"
+	cWarnPartial    = "partial-affect"
+	cWarnSuspicious = "suspicious-affiliation"
+	cWarnOther      = "other"
+)
+
+var (
+	// gWarningExitCodes - exit code of each category with EXIT_CODES set, lower codes take precedence, they start at 10
+	// so they never clash with the exit codes of failures (1, 2)
+	gWarningExitCodes = map[string]int{
+		cWarnRowError:   10,
+		cWarnValidation: 11,
+		cWarnNotFound:   12,
+		cWarnCollision:  13,
+		cWarnPartial:    14,
+		cWarnOther:      15,
+		cWarnSuspicious: 16,
+	}
+	// gProcessWarnings - warning categories counted over all runs of the process
+	gProcessWarnings = make(map[string]int)
+)
+
+// errorCategory - warning category of a row error: skipped rows keep the category they were reported with, lookups
+// that found nothing are not-found, anything else is a row error
+func errorCategory(err error) string {
+	var skipped errRowSkipped
+	if errors.As(err, &skipped) && skipped.category != "" {
+		return skipped.category
+	}
+	if isNotFound(err) {
+		return cWarnNotFound
+	}
+	return cWarnRowError
+}
+
+// countWarning - counts warning category in the run summary and process totals, gSummaryMtx must be held
+func countWarning(category string) {
+	if gSummary == nil {
+		return
+	}
+	if gSummary.WarningCategories == nil {
+		gSummary.WarningCategories = make(map[string]int)
+	}
+	gSummary.WarningCategories[category]++
+	gProcessWarnings[category]++
+}
+
+// warningCategoriesText - "not-found: 2, collision: 1"
+func warningCategoriesText(categories map[string]int) string {
+	keys := []string{}
+	for category := range categories {
+		keys = append(keys, category)
+	}
+	sort.Slice(keys, func(i, j int) bool { return gWarningExitCodes[keys[i]] < gWarningExitCodes[keys[j]] })
+	items := []string{}
+	for _, category := range keys {
+		items = append(items, fmt.Sprintf("%s: %d", category, categories[category]))
+	}
+	return strings.Join(items, ", ")
+}
+
+// warningExitCode - EXIT_CODES: exit code of the most severe warning category seen by the process, 0 otherwise
+func warningExitCode() (code int) {
+	if os.Getenv("EXIT_CODES") == "" {
+		return
+	}
+	gSummaryMtx.Lock()
+	defer gSummaryMtx.Unlock()
+	for category, n := range gProcessWarnings {
+		if c := gWarningExitCodes[category]; n > 0 && (code == 0 || c < code) {
+			code = c
+		}
+	}
+	return
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	gIdentitiesFileRE   = regexp.MustCompile(`^user_identities_(\d{12})\.csv$`)
+	gAffiliationsFileRE = regexp.MustCompile(`^user_affiliations_(\d{12})\.csv$`)
+)
+
+// filePair - identities and affiliations files exported at the same timestamp
+type filePair struct {
+	ts           string
+	identities   string
+	affiliations string
+}
+
+func isS3Path(path string) bool {
+	return strings.HasPrefix(path, "s3://")
+}
+
+// joinPath - joins local paths, S3 prefixes or HTTP URLs
+func joinPath(dir, name string) string {
+	if isS3Path(dir) || isHTTPPath(dir) {
+		return strings.TrimSuffix(dir, "/") + "/" + name
+	}
+	return filepath.Join(dir, name)
+}
+
+// awsS3 - runs AWS CLI s3 command, returns its output
+func awsS3(dbg bool, args ...string) (string, error) {
+	args = append([]string{"s3"}, args...)
+	if dbg {
+		fmt.Printf("aws %s\n", strings.Join(args, " "))
+	}
+	out, err := osexec.Command("aws", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("aws %s: %v: %s", strings.Join(args, " "), err, string(out))
+	}
+	return string(out), nil
+}
+
+// listWatchedFiles - returns file name -> size for all regular files directly in dir
+func listWatchedFiles(dbg bool, dir string) (files map[string]int64, err error) {
+	files = make(map[string]int64)
+	if isS3Path(dir) {
+		var out string
+		out, err = awsS3(dbg, "ls", strings.TrimSuffix(dir, "/")+"/")
+		if err != nil {
+			return
+		}
+		// 2022-01-06 14:33:00      12345 user_identities_202201061433.csv
+		for _, line := range strings.Split(out, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 4 {
+				continue
+			}
+			size, e := strconv.ParseInt(fields[2], 10, 64)
+			if e != nil {
+				continue
+			}
+			files[fields[3]] = size
+		}
+		return
+	}
+	var infos []os.FileInfo
+	infos, err = ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			files[info.Name()] = info.Size()
+		}
+	}
+	return
+}
+
+// findFilePairs - pairs user_identities_YYYYMMDDHHMI.csv with user_affiliations_YYYYMMDDHHMI.csv
+// returns pairs sorted oldest first and names of files that have no pair (yet)
+func findFilePairs(names []string) (pairs []filePair, unpaired []string) {
+	identities := make(map[string]string)
+	affiliations := make(map[string]string)
+	for _, name := range names {
+		if m := gIdentitiesFileRE.FindStringSubmatch(name); m != nil {
+			identities[m[1]] = name
+		} else if m := gAffiliationsFileRE.FindStringSubmatch(name); m != nil {
+			affiliations[m[1]] = name
+		}
+	}
+	for ts, identitiesFile := range identities {
+		affiliationsFile, ok := affiliations[ts]
+		if !ok {
+			unpaired = append(unpaired, identitiesFile)
+			continue
+		}
+		pairs = append(pairs, filePair{ts: ts, identities: identitiesFile, affiliations: affiliationsFile})
+	}
+	for ts, affiliationsFile := range affiliations {
+		if _, ok := identities[ts]; !ok {
+			unpaired = append(unpaired, affiliationsFile)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].ts < pairs[j].ts })
+	sort.Strings(unpaired)
+	return
+}
+
+// moveWatchedFile - moves processed file into target directory/prefix
+func moveWatchedFile(dbg bool, dir, name, toDir string) (err error) {
+	from, to := joinPath(dir, name), joinPath(toDir, name)
+	fmt.Printf("Moving %s -> %s\n", from, to)
+	if isS3Path(dir) {
+		_, err = awsS3(dbg, "mv", from, to)
+		return
+	}
+	err = os.MkdirAll(toDir, 0755)
+	if err != nil {
+		return
+	}
+	err = os.Rename(from, to)
+	return
+}
+
+// importFilePair - imports a single pair into all databases (through staging when configured), downloading it first
+// when watching S3, recovers from panics so a single bad pair cannot stop the watcher
+func importFilePair(dbs []*shDatabase, dbg bool, dir string, pair filePair) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("import of %s, %s panicked: %v", pair.identities, pair.affiliations, r)
+		}
+	}()
+	localDir := dir
+	if isS3Path(dir) {
+		localDir, err = ioutil.TempDir("", "import-"+pair.ts+"-")
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = os.RemoveAll(localDir)
+		}()
+		for _, name := range []string{pair.identities, pair.affiliations} {
+			_, err = awsS3(dbg, "cp", joinPath(dir, name), filepath.Join(localDir, name))
+			if err != nil {
+				return
+			}
+		}
+	}
+	_, err = importFiles(dbs, dbg, os.Getenv("DRY") != "", inputFiles{identities: []string{filepath.Join(localDir, pair.identities)}, affiliations: []string{filepath.Join(localDir, pair.affiliations)}}, runOptions{})
+	return
+}
+
+// watchDirectory - watches directory (or S3 prefix) for new identities/affiliations pairs and imports them
+// WATCH_DIR - directory or s3://bucket/prefix to watch
+// WATCH_INTERVAL - seconds between scans, default 60
+// WATCH_PROCESSED_DIR - where successfully imported files are moved, default WATCH_DIR/processed
+// WATCH_FAILED_DIR - where failed files are moved, default WATCH_DIR/failed
+// WATCH_ONCE - if set, scan only once and exit (useful for testing)
+// A file is only imported once its size didn't change between two consecutive scans
+func watchDirectory(dbs []*shDatabase, dir string) (err error) {
+	dbg := os.Getenv("DEBUG") != ""
+	interval := 60
+	if os.Getenv("WATCH_INTERVAL") != "" {
+		interval, err = strconv.Atoi(os.Getenv("WATCH_INTERVAL"))
+		if err != nil {
+			return
+		}
+		if interval < 1 {
+			err = fmt.Errorf("WATCH_INTERVAL must be positive, got %d", interval)
+			return
+		}
+	}
+	processedDir := os.Getenv("WATCH_PROCESSED_DIR")
+	if processedDir == "" {
+		processedDir = joinPath(dir, "processed")
+	}
+	failedDir := os.Getenv("WATCH_FAILED_DIR")
+	if failedDir == "" {
+		failedDir = joinPath(dir, "failed")
+	}
+	once := os.Getenv("WATCH_ONCE") != ""
+	fmt.Printf("Watching %s every %ds, processed -> %s, failed -> %s\n", dir, interval, processedDir, failedDir)
+	prevSizes := make(map[string]int64)
+	reported := make(map[string]struct{})
+	for {
+		var sizes map[string]int64
+		sizes, err = listWatchedFiles(dbg, dir)
+		if err != nil {
+			if once {
+				return
+			}
+			fmt.Printf("WARNING: cannot list %s: %v\n", dir, err)
+			time.Sleep(time.Duration(interval) * time.Second)
+			continue
+		}
+		stable := []string{}
+		for name, size := range sizes {
+			prevSize, ok := prevSizes[name]
+			if once || (ok && prevSize == size) {
+				stable = append(stable, name)
+			} else if dbg {
+				fmt.Printf("%s is new or still growing (%d bytes)\n", name, size)
+			}
+		}
+		prevSizes = sizes
+		pairs, unpaired := findFilePairs(stable)
+		for _, name := range unpaired {
+			if _, ok := reported[name]; !ok {
+				fmt.Printf("Waiting for the other file of %s\n", name)
+				reported[name] = struct{}{}
+			}
+		}
+		for _, pair := range pairs {
+			dtStart := time.Now()
+			toDir := processedDir
+			e := importFilePair(dbs, dbg, dir, pair)
+			if e != nil {
+				fmt.Printf("WARNING: importing %s, %s failed: %v\n", pair.identities, pair.affiliations, e)
+				toDir = failedDir
+			}
+			for _, name := range []string{pair.identities, pair.affiliations} {
+				e = moveWatchedFile(dbg, dir, name, toDir)
+				if e != nil {
+					fmt.Printf("WARNING: cannot move %s to %s: %v\n", name, toDir, e)
+				}
+				delete(prevSizes, name)
+				delete(reported, name)
+			}
+			fmt.Printf("Processed %s pair in %v\n", pair.ts, time.Now().Sub(dtStart))
+		}
+		if once {
+			return
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}